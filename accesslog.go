@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxAccessParamsLength = 256 // maximum length of the encoded parameters recorded in an access log entry
+
+// Formats of the access log.
+const (
+	AccessLogJSON   = "json"
+	AccessLogLogfmt = "logfmt"
+)
+
+// Outcomes of a call for the caches, recorded in access log entries.
+const (
+	CacheOutcomeNone = "none" // the call did not read any blocks
+	CacheOutcomeHit  = "hit"  // every block read by the call was found in a cache
+	CacheOutcomeMiss = "miss" // the call was passed to the lotus node
+	CacheOutcomeFill = "fill" // blocks read from a slower tier or the lotus node were written to a cache
+)
+
+// ValidAccessLogFormat reports whether format is a supported access log format.
+func ValidAccessLogFormat(format string) bool {
+	return format == AccessLogJSON || format == AccessLogLogfmt
+}
+
+// callOutcome counts how the caches were used while handling a call.
+type callOutcome struct {
+	reads    int32 // blocks read through the cache tiers, accessed atomically
+	upstream int32 // calls made to the lotus node, accessed atomically
+	fills    int32 // blocks written to a cache, accessed atomically
+}
+
+type callOutcomeKey struct{}
+
+// withCallOutcome returns a context that counts how the caches are used by the call it carries. A context
+// that is already counting is returned unchanged.
+func withCallOutcome(ctx context.Context) (context.Context, *callOutcome) {
+	if o, ok := ctx.Value(callOutcomeKey{}).(*callOutcome); ok {
+		return ctx, o
+	}
+	o := &callOutcome{}
+	return context.WithValue(ctx, callOutcomeKey{}, o), o
+}
+
+// noteCacheRead records that a block was read through the cache tiers by the call carried by the context.
+func noteCacheRead(ctx context.Context) {
+	if o, ok := ctx.Value(callOutcomeKey{}).(*callOutcome); ok {
+		atomic.AddInt32(&o.reads, 1)
+	}
+}
+
+// noteUpstreamCall records that the lotus node was called by the call carried by the context.
+func noteUpstreamCall(ctx context.Context) {
+	if o, ok := ctx.Value(callOutcomeKey{}).(*callOutcome); ok {
+		atomic.AddInt32(&o.upstream, 1)
+	}
+}
+
+// noteFill records that a block was written to a cache by the call carried by the context.
+func noteFill(ctx context.Context) {
+	if o, ok := ctx.Value(callOutcomeKey{}).(*callOutcome); ok {
+		atomic.AddInt32(&o.fills, 1)
+	}
+}
+
+// String returns the outcome of the call for the caches.
+func (o *callOutcome) String() string {
+	switch {
+	case atomic.LoadInt32(&o.fills) > 0:
+		return CacheOutcomeFill
+	case atomic.LoadInt32(&o.upstream) > 0:
+		return CacheOutcomeMiss
+	case atomic.LoadInt32(&o.reads) > 0:
+		return CacheOutcomeHit
+	default:
+		return CacheOutcomeNone
+	}
+}
+
+// AccessEntry is a single record written to the access log.
+type AccessEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Method     string    `json:"method"`
+	Params     string    `json:"params,omitempty"`
+	Duration   float64   `json:"duration_ms"`
+	Cache      string    `json:"cache"`
+	Size       int       `json:"size"` // size of the response, as measured by responseSize
+	Error      string    `json:"error,omitempty"`
+}
+
+// AccessLog writes a record of rpc calls as JSON or logfmt lines to a dedicated stream, separate from the
+// operational logs, for log pipelines such as Loki or Elasticsearch. Successful calls are sampled and
+// failed calls are always recorded.
+type AccessLog struct {
+	format string
+	sample float64
+
+	mu     sync.Mutex // guards w
+	w      io.Writer
+	closer io.Closer
+}
+
+// OpenAccessLog opens an access log appending to the file at path in the given format, recording the
+// given fraction of successful calls. A path of "-" writes to stderr.
+func OpenAccessLog(path string, format string, sample float64) (*AccessLog, error) {
+	if !ValidAccessLogFormat(format) {
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	if sample <= 0 || sample > 1 {
+		return nil, fmt.Errorf("sample must be greater than 0 and at most 1")
+	}
+	if path == "-" {
+		return &AccessLog{format: format, sample: sample, w: os.Stderr}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
+	return &AccessLog{format: format, sample: sample, w: f, closer: f}, nil
+}
+
+// Close closes the file the access log is written to.
+func (a *AccessLog) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// Record writes an entry to the access log, filling in the client identity from the context.
+func (a *AccessLog) Record(ctx context.Context, e AccessEntry) {
+	e.Client = clientName(ctx)
+	e.RemoteAddr = clientAddr(ctx)
+
+	var data []byte
+	if a.format == AccessLogLogfmt {
+		data = e.logfmt()
+	} else {
+		var err error
+		if data, err = json.Marshal(e); err != nil {
+			return
+		}
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = a.w.Write(data)
+}
+
+// Middleware returns method middleware that records the sampled calls and all failed calls.
+func (a *AccessLog) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		start := time.Now()
+		ctx, outcome := withCallOutcome(ctx)
+		res, err := next(ctx, call)
+		if err == nil && a.sample < 1 && rand.Float64() >= a.sample {
+			return res, err
+		}
+
+		e := AccessEntry{
+			Time:     start.UTC(),
+			Method:   call.Method,
+			Params:   encodeParams(call.Params, maxAccessParamsLength),
+			Duration: float64(time.Since(start)) / 1e6,
+			Cache:    outcome.String(),
+		}
+		if err != nil {
+			e.Error = err.Error()
+		} else if res != nil {
+			e.Size, _ = responseSize(res)
+		}
+		a.Record(ctx, e)
+
+		return res, err
+	}
+}
+
+// logfmt encodes the entry as a logfmt line.
+func (e AccessEntry) logfmt() []byte {
+	var buf bytes.Buffer
+	field := func(k, v string) {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		if v == "" || strings.ContainsAny(v, " =\"\\\t\r\n") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(v)
+	}
+	field("time", e.Time.Format(time.RFC3339Nano))
+	field("client", e.Client)
+	if e.RemoteAddr != "" {
+		field("remote_addr", e.RemoteAddr)
+	}
+	field("method", e.Method)
+	if e.Params != "" {
+		field("params", e.Params)
+	}
+	field("duration_ms", strconv.FormatFloat(e.Duration, 'f', 3, 64))
+	field("cache", e.Cache)
+	field("size", strconv.Itoa(e.Size))
+	if e.Error != "" {
+		field("error", e.Error)
+	}
+	return buf.Bytes()
+}
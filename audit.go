@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lotus/api/apistruct"
+)
+
+const maxAuditParamsLength = 1024 // maximum length of the encoded parameters recorded in an audit entry
+
+// Audit event types
+const (
+	AuditAuthFailure = "auth_failure" // a request was made without a valid token
+	AuditDenied      = "denied"       // a method call was rejected by policy
+	AuditPrivileged  = "privileged"   // a method requiring more than read permission was called
+	AuditTokenIssued = "token_issued" // a node token was minted through the proxy
+)
+
+// AuditEntry is a single record written to the audit log.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Client     string    `json:"client"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Perm       string    `json:"perm,omitempty"`
+	Params     string    `json:"params,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Token      string    `json:"token,omitempty"` // fingerprint of an issued token
+}
+
+// AuditLog writes security relevant events as JSON lines to a dedicated stream, separate from the
+// operational logs.
+type AuditLog struct {
+	mu     sync.Mutex // guards w
+	w      io.Writer
+	closer io.Closer
+}
+
+// OpenAuditLog opens an audit log appending to the file at path. A path of "-" writes to stderr.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if path == "-" {
+		return &AuditLog{w: os.Stderr}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return &AuditLog{w: f, closer: f}, nil
+}
+
+func (a *AuditLog) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// Record writes an entry to the audit log, filling in the time and client identity from the context.
+func (a *AuditLog) Record(ctx context.Context, e AuditEntry) {
+	e.Time = time.Now().UTC()
+	e.Client = clientName(ctx)
+	e.RemoteAddr = clientAddr(ctx)
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = a.w.Write(data)
+}
+
+// Middleware returns method middleware that records calls rejected by policy and all calls to
+// methods that require more than read permission.
+func (a *AuditLog) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		res, err := next(ctx, call)
+
+		denied := err != nil && isPolicyError(err)
+		if !denied && call.Perm == apistruct.PermRead {
+			return res, err
+		}
+
+		e := AuditEntry{
+			Event:  AuditPrivileged,
+			Method: call.Method,
+			Perm:   string(call.Perm),
+			Params: auditParams(call.Params),
+		}
+		if denied {
+			e.Event = AuditDenied
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		a.Record(ctx, e)
+
+		return res, err
+	}
+}
+
+// isPolicyError reports whether the error was caused by a call being rejected by policy.
+func isPolicyError(err error) bool {
+	return errors.Is(err, ErrTokenRequired) || errors.Is(err, ErrMethodScope) || errors.Is(err, ErrMethodDisabled) ||
+		errors.Is(err, ErrCodecNotAllowed) || errors.Is(err, ErrPermNotAllowed) || errors.Is(err, ErrPassthroughNotAllowed) ||
+		errors.Is(err, ErrReadOnly) || errors.Is(err, ErrPermDenied) || errors.Is(err, ErrAuthzDenied)
+}
+
+func auditParams(params []interface{}) string {
+	return encodeParams(params, maxAuditParamsLength)
+}
+
+// encodeParams encodes the parameters of a call as JSON, truncated to max bytes.
+func encodeParams(params []interface{}, max int) string {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Sprintf("unencodable params: %v", err)
+	}
+	if len(data) > max {
+		return string(data[:max]) + "..."
+	}
+	return string(data)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/lotus/api/apistruct"
+)
+
+var ErrPermNotAllowed = errors.New("permission not allowed by proxy token policy")
+
+// authNewNone is used in place of a permission to refuse every AuthNew call.
+const authNewNone = "none"
+
+// AuthNewPolicy limits the permissions of the node tokens that clients may mint through the proxy using
+// AuthNew, so a read only deployment can't be used to obtain tokens that write to the node. Issued tokens
+// are recorded in the audit log.
+type AuthNewPolicy struct {
+	allowed map[auth.Permission]bool
+	audit   *AuditLog // records issued tokens, may be nil
+}
+
+// NewAuthNewPolicy returns a policy allowing tokens with the given permissions to be minted. The
+// permission "none" allows no tokens to be minted.
+func NewAuthNewPolicy(perms []string, audit *AuditLog) (*AuthNewPolicy, error) {
+	p := &AuthNewPolicy{
+		allowed: map[auth.Permission]bool{},
+		audit:   audit,
+	}
+	for _, perm := range perms {
+		if perm == authNewNone {
+			continue
+		}
+		if !validPermission(auth.Permission(perm)) {
+			return nil, fmt.Errorf("unknown permission %q", perm)
+		}
+		p.allowed[auth.Permission(perm)] = true
+	}
+	return p, nil
+}
+
+func validPermission(perm auth.Permission) bool {
+	for _, p := range apistruct.AllPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns ErrPermNotAllowed if a token with the permissions may not be minted.
+func (p *AuthNewPolicy) Check(perms []auth.Permission) error {
+	for _, perm := range perms {
+		if !p.allowed[perm] {
+			return fmt.Errorf("%w: %s", ErrPermNotAllowed, perm)
+		}
+	}
+	return nil
+}
+
+// Issued records that a token with the permissions was minted for the client making the request.
+func (p *AuthNewPolicy) Issued(ctx context.Context, perms []auth.Permission, token []byte) {
+	if p.audit == nil {
+		return
+	}
+	names := make([]string, len(perms))
+	for i, perm := range perms {
+		names[i] = string(perm)
+	}
+	p.audit.Record(ctx, AuditEntry{
+		Event:  AuditTokenIssued,
+		Method: "AuthNew",
+		Perm:   strings.Join(names, ","),
+		Token:  tokenFingerprint(token),
+	})
+}
+
+// tokenFingerprint identifies a token without revealing it.
+func tokenFingerprint(token []byte) string {
+	sum := sha256.Sum256(token)
+	return hex.EncodeToString(sum[:8])
+}
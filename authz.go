@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/filecoin-project/lotus/api/apistruct"
+	"github.com/go-logr/logr"
+	"go.opencensus.io/tag"
+)
+
+var ErrAuthzDenied = errors.New("call denied by authorization service")
+
+// maxAuthzResponseSize is the maximum size of a response read from the authorization service.
+const maxAuthzResponseSize = 64 << 10
+
+// AuthzRequest is the JSON body posted to the authorization service for each call it is consulted on.
+type AuthzRequest struct {
+	Method     string `json:"method"`
+	Perm       string `json:"perm"`
+	Params     string `json:"params,omitempty"`
+	Client     string `json:"client"` // name carried by the verified token of the client, empty if none
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	TokenID    string `json:"token_id,omitempty"` // identifier of the bearer token presented by the client
+}
+
+// AuthzResponse is the JSON body expected from the authorization service.
+type AuthzResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuthzWebhook is method middleware that asks an external authorization service whether sensitive calls
+// may be made, so that an existing policy engine can decide on calls without changes to the proxy. By
+// default it is consulted on calls to methods requiring more than read permission. Calls are denied if
+// the service cannot be reached or does not give a decision.
+type AuthzWebhook struct {
+	url     string
+	all     bool            // consult the service on every call
+	methods map[string]bool // methods requiring read permission that the service is also consulted on
+	hc      *http.Client
+	logger  logr.Logger
+}
+
+// NewAuthzWebhook creates middleware that posts an AuthzRequest to url for calls to methods requiring more
+// than read permission and to the listed methods, or to every method if the list contains *.
+func NewAuthzWebhook(url string, methods []string, timeout time.Duration, logger logr.Logger) *AuthzWebhook {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	w := &AuthzWebhook{
+		url:     url,
+		methods: map[string]bool{},
+		hc:      &http.Client{Timeout: timeout},
+		logger:  logger.V(LogLevelInfo),
+	}
+	for _, m := range methods {
+		if m == "*" {
+			w.all = true
+			continue
+		}
+		w.methods[m] = true
+	}
+	return w
+}
+
+// consulted reports whether the service decides on calls to the method.
+func (w *AuthzWebhook) consulted(call *MethodCall) bool {
+	return w.all || call.Perm != apistruct.PermRead || w.methods[call.Method]
+}
+
+func (w *AuthzWebhook) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		if !w.consulted(call) {
+			return next(ctx, call)
+		}
+
+		mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+		reportEvent(mctx, authzRequest)
+		resp, err := w.authorize(ctx, call)
+		if err != nil {
+			w.logger.Info("Authorization service failed", "method", call.Method, "client", clientIdentity(ctx), "error", err.Error())
+			reportEvent(mctx, authzFailed)
+			return nil, fmt.Errorf("%w: %s: authorization service unavailable", ErrAuthzDenied, call.Method)
+		}
+		if !resp.Allow {
+			reportEvent(mctx, authzDenied)
+			if resp.Reason != "" {
+				return nil, fmt.Errorf("%w: %s: %s", ErrAuthzDenied, call.Method, resp.Reason)
+			}
+			return nil, fmt.Errorf("%w: %s", ErrAuthzDenied, call.Method)
+		}
+		return next(ctx, call)
+	}
+}
+
+// authorize asks the service for a decision on the call.
+func (w *AuthzWebhook) authorize(ctx context.Context, call *MethodCall) (*AuthzResponse, error) {
+	body, err := json.Marshal(AuthzRequest{
+		Method:     call.Method,
+		Perm:       string(call.Perm),
+		Params:     auditParams(call.Params),
+		Client:     clientIdentity(ctx),
+		RemoteAddr: clientAddr(ctx),
+		TokenID:    clientTokenID(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var ar AuthzResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxAuthzResponseSize)).Decode(&ar); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &ar, nil
+}
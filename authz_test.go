@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lotus/api/apistruct"
+	"github.com/go-logr/logr"
+)
+
+func TestAuthzWebhookClient(t *testing.T) {
+	var req AuthzRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		_ = json.NewEncoder(w).Encode(AuthzResponse{Allow: true})
+	}))
+	defer srv.Close()
+
+	mw := NewAuthzWebhook(srv.URL, nil, time.Second, logr.Discard()).Middleware(func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		return nil, nil
+	})
+	call := &MethodCall{Method: "ChainSetHead", Perm: apistruct.PermAdmin}
+
+	testCases := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "named by header", ctx: withClientName(context.Background(), "explorer"), want: ""},
+		{name: "named by token", ctx: withClientIdentity(context.Background(), "indexer"), want: "indexer"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req = AuthzRequest{}
+			if _, err := mw(tc.ctx, call); err != nil {
+				t.Fatalf("call was denied: %v", err)
+			}
+			if req.Client != tc.want {
+				t.Errorf("authorization service was sent client %q, wanted %q", req.Client, tc.want)
+			}
+		})
+	}
+}
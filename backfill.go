@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/go-logr/logr"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/time/rate"
+)
+
+// backfillClientName is the client name attributed to requests made by the backfiller.
+const backfillClientName = "backfill"
+
+// backfillSeenSize is the number of blocks remembered as already walked, so that the state trees of
+// neighbouring tipsets, which share most of their blocks, are not walked again.
+const backfillSeenSize = 1 << 20
+
+// backfillRetryInterval is how long the backfiller waits before retrying a tipset that failed.
+const backfillRetryInterval = time.Minute
+
+// BackfillAPI is the part of the lotus api used to find where a backfill starts.
+type BackfillAPI interface {
+	ChainHead(ctx context.Context) (*types.TipSet, error)
+}
+
+// backfillProgress is the content of the progress file.
+type backfillProgress struct {
+	Next    types.TipSetKey `json:"next"`    // the next tipset to backfill
+	Reached abi.ChainEpoch  `json:"reached"` // height of the last tipset backfilled
+}
+
+// Backfiller walks the chain from the node's head back to a target height, reading every block header,
+// message and receipt, and optionally the state trees, through the cache so that the caches are populated
+// with historical data. Blocks are read at a limited rate so that the backfill does not starve clients.
+// Progress is recorded in a file after each tipset so an interrupted backfill resumes where it stopped.
+// A backfill that has completed is extended when restarted with a lower target height.
+type Backfiller struct {
+	node   BackfillAPI
+	cache  BlockCache
+	path   string
+	to     abi.ChainEpoch
+	state  bool
+	limit  *rate.Limiter // nil for no limit
+	seen   *lru.Cache    // blocks already walked, keyed by cid
+	logger logr.Logger
+
+	coverage *StoreCoverage // records the heights backfilled, may be nil
+}
+
+func NewBackfiller(node BackfillAPI, cache BlockCache, path string, to abi.ChainEpoch, logger logr.Logger) *Backfiller {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	seen, _ := lru.New(backfillSeenSize)
+	return &Backfiller{
+		node:   node,
+		cache:  cache,
+		path:   path,
+		to:     to,
+		seen:   seen,
+		logger: logger.V(LogLevelInfo),
+	}
+}
+
+// SetState sets whether the state tree of each tipset is backfilled along with its messages and receipts.
+func (b *Backfiller) SetState(state bool) {
+	b.state = state
+}
+
+// SetRate limits the number of blocks read per second. A limit of zero is not enforced.
+func (b *Backfiller) SetRate(blocksPerSec float64) {
+	b.limit = nil
+	if blocksPerSec > 0 {
+		burst := int(blocksPerSec)
+		if burst < 1 {
+			burst = 1
+		}
+		b.limit = rate.NewLimiter(rate.Limit(blocksPerSec), burst)
+	}
+}
+
+// SetCoverage sets the record of heights held by the store, which is updated as tipsets are backfilled.
+// Tipsets with blocks that could not be found are recorded as absent.
+func (b *Backfiller) SetCoverage(c *StoreCoverage) {
+	b.coverage = c
+}
+
+// Run backfills the chain until the target height is reached or the context is cancelled.
+func (b *Backfiller) Run(ctx context.Context) {
+	ctx = withClientName(ctx, backfillClientName)
+	ctx = withFillOrigin(ctx, fillOriginBackfill)
+
+	progress, err := b.load()
+	if err != nil {
+		b.logger.Error(err, "failed to read backfill progress, not backfilling", "path", b.path)
+		return
+	}
+	for progress == nil {
+		head, err := b.node.ChainHead(ctx)
+		if err == nil {
+			progress = &backfillProgress{Next: head.Key(), Reached: head.Height() + 1}
+			break
+		}
+		b.logger.Error(err, "failed to get chain head to start backfill")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backfillRetryInterval):
+		}
+	}
+	b.logger.Info("Starting backfill", "from", progress.Reached-1, "to", b.to, "state", b.state)
+
+	for progress.Reached > b.to && progress.Reached > 0 {
+		ts, missing, err := b.backfill(ctx, progress.Next)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			reportEvent(ctx, backfillFailure)
+			b.logger.Error(err, "failed to backfill tipset, retrying", "tsk", progress.Next)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backfillRetryInterval):
+			}
+			continue
+		}
+
+		// Null rounds between the tipset and its child are included in its range
+		if missing > 0 {
+			b.coverage.AddAbsent(ts.Height(), progress.Reached-1)
+		} else {
+			b.coverage.AddCovered(ts.Height(), progress.Reached-1)
+		}
+		progress = &backfillProgress{Next: ts.Parents(), Reached: ts.Height()}
+		if err := b.save(progress); err != nil {
+			b.logger.Error(err, "failed to save backfill progress", "path", b.path)
+		}
+		reportEvent(ctx, backfillTipset)
+		reportMeasurement(ctx, backfillHeight.M(int64(ts.Height())))
+	}
+	b.logger.Info("Backfill complete", "reached", progress.Reached)
+}
+
+// backfill reads the blocks of a tipset through the cache, returning the number of message and receipt
+// blocks that could not be found.
+func (b *Backfiller) backfill(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, int, error) {
+	for range tsk.Cids() {
+		if err := b.wait(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+	ts, err := cachedTipSet(ctx, b.cache, tsk)
+	if err != nil {
+		return nil, 0, fmt.Errorf("fetch tipset: %w", err)
+	}
+
+	missing := 0
+	for _, bh := range ts.Blocks() {
+		n, err := b.walk(ctx, []cid.Cid{bh.Messages, bh.ParentMessageReceipts})
+		if err == nil && b.state {
+			// Missing state does not count against the messages and receipts of the tipset
+			_, err = b.walk(ctx, []cid.Cid{bh.ParentStateRoot})
+		}
+		if err != nil {
+			// Blocks whose links were not all walked may have been marked as walked
+			b.seen.Purge()
+			return nil, 0, fmt.Errorf("block %s: %w", bh.Cid(), err)
+		}
+		missing += n
+	}
+	return ts, missing, nil
+}
+
+// walk reads the blocks reachable from the roots through the links of dag-cbor blocks, skipping blocks
+// that have already been walked. Blocks that cannot be found, such as those pruned by the node, are
+// counted and skipped, and the number returned.
+func (b *Backfiller) walk(ctx context.Context, roots []cid.Cid) (int, error) {
+	missing := 0
+	stack := append([]cid.Cid{}, roots...)
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if c.Prefix().MhType == mh.IDENTITY || b.seen.Contains(c) {
+			continue
+		}
+		if err := b.wait(ctx); err != nil {
+			return 0, err
+		}
+		blk, err := b.cache.Get(ctx, c)
+		if err != nil {
+			if isBlockNotFound(err) {
+				reportEvent(ctx, backfillMissing)
+				missing++
+				continue
+			}
+			return 0, fmt.Errorf("fetch %s: %w", c, err)
+		}
+		reportEvent(ctx, backfillBlock)
+
+		if c.Type() == cid.DagCBOR {
+			if err := cbg.ScanForLinks(bytes.NewReader(blk.RawData()), func(l cid.Cid) {
+				stack = append(stack, l)
+			}); err != nil {
+				b.logger.Info("Failed to scan block for links", "cid", c.String(), "error", err.Error())
+			}
+		}
+		b.seen.Add(c, nil)
+	}
+	return missing, nil
+}
+
+// wait blocks until another block may be read according to the rate limit.
+func (b *Backfiller) wait(ctx context.Context) error {
+	if b.limit == nil {
+		return ctx.Err()
+	}
+	return b.limit.Wait(ctx)
+}
+
+// load reads the progress file, returning nil if there is none.
+func (b *Backfiller) load() (*backfillProgress, error) {
+	data, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read backfill progress: %w", err)
+	}
+	var p backfillProgress
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("decode backfill progress: %w", err)
+	}
+	return &p, nil
+}
+
+// save writes the progress file, replacing it atomically.
+func (b *Backfiller) save(p *backfillProgress) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("encode backfill progress: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), filepath.Base(b.path)+".*")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write backfill progress: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close backfill progress: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		return fmt.Errorf("rename backfill progress: %w", err)
+	}
+	return nil
+}
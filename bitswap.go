@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	bitswap "github.com/ipfs/go-bitswap"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	"github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-ipfs-blockstore"
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+var _ (BlockCache) = (*BitswapBlockCache)(nil)
+
+// bitswapReconnectInterval is the time between attempts to reconnect to bitswap peers that are not connected.
+const bitswapReconnectInterval = time.Minute
+
+// BitswapBlockCache fetches blocks from a list of peers using the bitswap protocol, such as other Filecoin
+// nodes or IPFS nodes holding chain data, so that old blocks that are widely held need not be read from
+// the lotus node. Peers are not discovered, only those given are asked for blocks. Blocks received are not
+// kept since the tiers in front of the cache hold them.
+type BitswapBlockCache struct {
+	host     host.Host
+	peers    []peer.AddrInfo
+	bstore   blockstore.Blockstore // holds blocks received by bitswap until they are returned
+	exchange exchange.Interface
+	timeout  time.Duration
+	upstream BlockCache
+	name     string
+	logger   logr.Logger
+}
+
+// NewBitswapBlockCache creates a libp2p host that connects to the peers, given as multiaddrs ending in their
+// /p2p/ peer id, and fetches blocks from them using bitswap with the given protocol prefix, such as /chain
+// for Filecoin nodes. Each block is waited for for up to timeout.
+func NewBitswapBlockCache(ctx context.Context, peers []string, prefix string, timeout time.Duration, name string, logger logr.Logger) (*BitswapBlockCache, error) {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("timeout must be positive")
+	}
+
+	infos := make([]peer.AddrInfo, 0, len(peers))
+	for _, p := range peers {
+		ma, err := multiaddr.NewMultiaddr(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer address %q: %w", p, err)
+		}
+		info, err := peer.AddrInfoFromP2pAddr(ma)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer address %q: %w", p, err)
+		}
+		infos = append(infos, *info)
+	}
+
+	// Blocks are only fetched, so the host need not accept connections
+	h, err := libp2p.New(ctx, libp2p.NoListenAddrs)
+	if err != nil {
+		return nil, fmt.Errorf("new libp2p host: %w", err)
+	}
+
+	var opts []bsnet.NetOpt
+	if prefix != "" {
+		opts = append(opts, bsnet.Prefix(protocol.ID(prefix)))
+	}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	bc := &BitswapBlockCache{
+		host:     h,
+		peers:    infos,
+		bstore:   bstore,
+		exchange: bitswap.New(ctx, bsnet.NewFromIpfsHost(h, nullRouting{}, opts...), bstore, bitswap.ProvideEnabled(false)),
+		timeout:  timeout,
+		name:     name,
+		logger:   logger.V(LogLevelInfo),
+	}
+	bc.connect(ctx)
+	return bc, nil
+}
+
+// Run reconnects to peers that have disconnected until the context is cancelled.
+func (bc *BitswapBlockCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(bitswapReconnectInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			bc.connect(ctx)
+		}
+	}
+}
+
+// connect connects to each peer that is not connected and reports the number connected.
+func (bc *BitswapBlockCache) connect(ctx context.Context) {
+	connected := 0
+	for _, p := range bc.peers {
+		if bc.host.Network().Connectedness(p.ID) == network.Connected {
+			connected++
+			continue
+		}
+		cctx, cancel := context.WithTimeout(ctx, bc.timeout)
+		err := bc.host.Connect(cctx, p)
+		cancel()
+		if err != nil {
+			bc.logger.Info("Failed to connect to bitswap peer", "peer", p.ID.String(), "error", err.Error())
+			continue
+		}
+		bc.logger.Info("Connected to bitswap peer", "peer", p.ID.String())
+		connected++
+	}
+	reportMeasurement(cacheContext(ctx, bc.name), bitswapPeersConnected.M(int64(connected)))
+}
+
+// Close stops bitswap and the libp2p host.
+func (bc *BitswapBlockCache) Close() error {
+	if err := bc.exchange.Close(); err != nil {
+		bc.host.Close()
+		return err
+	}
+	return bc.host.Close()
+}
+
+// Has asks the upstream cache since bitswap cannot tell whether a peer holds a block without fetching it.
+func (bc *BitswapBlockCache) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if bc.upstream == nil {
+		return false, nil
+	}
+	return bc.upstream.Has(ctx, c)
+}
+
+func (bc *BitswapBlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	ctx = cacheContext(ctx, bc.name)
+	reportEvent(ctx, getRequest)
+	stop := startTimer(ctx, getDuration)
+	defer stop()
+
+	bctx, cancel := context.WithTimeout(ctx, bc.timeout)
+	blk, err := bc.exchange.GetBlock(bctx, c)
+	cancel()
+	if err == nil {
+		_ = bc.bstore.DeleteBlock(c)
+		reportEvent(ctx, getHit)
+		reportSize(ctx, getSize, len(blk.RawData()))
+		return blk, nil
+	}
+	reportEvent(ctx, getMiss)
+
+	if bc.upstream == nil {
+		return nil, blockstore.ErrNotFound
+	}
+	return bc.upstream.Get(ctx, c)
+}
+
+func (bc *BitswapBlockCache) SetUpstream(u BlockCache) {
+	bc.upstream = u
+}
+
+// nullRouting is content routing that finds no providers, limiting bitswap to the peers it is connected to.
+type nullRouting struct{}
+
+func (nullRouting) Provide(context.Context, cid.Cid, bool) error {
+	return nil
+}
+
+func (nullRouting) FindProvidersAsync(ctx context.Context, c cid.Cid, n int) <-chan peer.AddrInfo {
+	ch := make(chan peer.AddrInfo)
+	close(ch)
+	return ch
+}
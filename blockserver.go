@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+)
+
+// blockHandler serves the data of blocks read through the proxy's cache chain at /block/{cid}/data.raw,
+// following the url pattern read by HttpBlockCache so that one proxy can use another as an http
+// blockstore tier. Range requests are supported for partial reads of large blocks. A HEAD request reads the
+// whole block, filling the cache chain as a GET would.
+func blockHandler(p *Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c, err := cid.Decode(mux.Vars(r)["cid"])
+		if err != nil {
+			http.Error(w, "invalid cid", http.StatusBadRequest)
+			return
+		}
+
+		// Blocks requested by a peer are not requested from this proxy's peers in turn
+		data, err := p.ChainReadObj(withPeerHops(r.Context(), requestPeerHops(r)), c)
+		if err != nil {
+			switch {
+			case isBlockNotFound(err), errors.Is(err, ErrHistoryUnavailable):
+				http.Error(w, "not found", http.StatusNotFound)
+			case errors.Is(err, ErrCodecNotAllowed):
+				http.Error(w, err.Error(), http.StatusForbidden)
+			case isUpstreamUnavailable(err):
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Blocks are immutable so their cid is a strong validator
+		w.Header().Set("ETag", `"`+c.String()+`"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/go-logr/logr"
+	"github.com/ipfs/go-cid"
+)
+
+// bootstrapFile is the name of the file, held in the first store directory, that records the snapshot the
+// store was bootstrapped from.
+const bootstrapFile = "bootstrap.json"
+
+// bootstrapFlushEvery is the number of blocks imported from a snapshot between flushes of the store.
+const bootstrapFlushEvery = 10000
+
+// SnapshotRange records the snapshot a store was bootstrapped from and the heights of the tipsets whose
+// headers it holds.
+type SnapshotRange struct {
+	URL      string           `json:"url"`
+	Roots    []cid.Cid        `json:"roots"`
+	Low      abi.ChainEpoch   `json:"low"`
+	High     abi.ChainEpoch   `json:"high"`
+	Imported time.Time        `json:"imported"`
+	Result   *CarImportResult `json:"-"`
+}
+
+// Key returns the key of the snapshot's head tipset.
+func (r *SnapshotRange) Key() types.TipSetKey {
+	return types.NewTipSetKey(r.Roots...)
+}
+
+// BootstrapSnapshot imports the snapshot CAR file published at url into the store the first time it is
+// called for the store, such as a chain export published by a snapshot service, then records the heights
+// covered by the headers in the snapshot. Later calls return the recorded range without downloading the
+// snapshot again. The returned range has a nil Result unless the snapshot was imported by this call.
+func BootstrapSnapshot(ctx context.Context, s *ShardedStore, dir string, url string, logger logr.Logger) (*SnapshotRange, error) {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	logger = logger.V(LogLevelInfo)
+
+	path := filepath.Join(dir, bootstrapFile)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		var r SnapshotRange
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", bootstrapFile, err)
+		}
+		return &r, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read %s: %w", bootstrapFile, err)
+	}
+
+	logger.Info("Downloading snapshot to bootstrap store", "url", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download snapshot: unexpected status %s", resp.Status)
+	}
+
+	res, err := ImportCar(ctx, s, bufio.NewReaderSize(resp.Body, 1<<20), bootstrapFlushEvery)
+	if err != nil {
+		return nil, fmt.Errorf("import snapshot: %w", err)
+	}
+	if len(res.Roots) == 0 {
+		return nil, fmt.Errorf("snapshot has no roots")
+	}
+
+	r := &SnapshotRange{
+		URL:      url,
+		Roots:    res.Roots,
+		Imported: time.Now().UTC(),
+		Result:   res,
+	}
+	if err := r.measure(s); err != nil {
+		return nil, err
+	}
+
+	data, err = json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("encode %s: %w", bootstrapFile, err)
+	}
+	if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+		return nil, fmt.Errorf("write %s: %w", bootstrapFile, err)
+	}
+	logger.Info("Bootstrapped store from snapshot", "imported", res.Imported, "size", res.Size, "existing", res.Existing, "skipped", res.Skipped, "low", r.Low, "high", r.High)
+	return r, nil
+}
+
+// measure finds the range of heights covered by the snapshot by walking the headers held in the store back
+// from the snapshot's roots.
+func (r *SnapshotRange) measure(s *ShardedStore) error {
+	ts, err := storedTipSet(s, r.Key())
+	if err != nil {
+		return fmt.Errorf("read snapshot head: %w", err)
+	}
+	r.High, r.Low = ts.Height(), ts.Height()
+	for ts.Height() > 0 {
+		parent, err := storedTipSet(s, ts.Parents())
+		if err != nil {
+			// Snapshots may only hold recent headers
+			break
+		}
+		ts = parent
+		r.Low = ts.Height()
+	}
+	return nil
+}
+
+// storedTipSet reads the headers of a tipset from the store.
+func storedTipSet(s *ShardedStore, tsk types.TipSetKey) (*types.TipSet, error) {
+	cids := tsk.Cids()
+	blks := make([]*types.BlockHeader, len(cids))
+	for i, c := range cids {
+		rd, err := s.FetchReader(string(c.Hash()))
+		if err != nil {
+			return nil, fmt.Errorf("fetch %s: %w", c, err)
+		}
+		data, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", c, err)
+		}
+		if blks[i], err = types.DecodeBlock(data); err != nil {
+			return nil, fmt.Errorf("decode block %s: %w", c, err)
+		}
+	}
+	return types.NewTipSet(blks)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opencensus.io/tag"
+)
+
+// Cache directives a client may give in the Cache-Control header of a request to change how the proxy's
+// caches are used for the calls it makes.
+const (
+	CacheDirectiveNoCache      = "no-cache"       // read from the lotus node, bypassing the cache tiers
+	CacheDirectiveOnlyIfCached = "only-if-cached" // answer only from the caches, never calling the lotus node
+)
+
+type cacheDirectiveKey struct{}
+
+// withCacheDirective returns a context carrying the cache directive given by the client.
+func withCacheDirective(ctx context.Context, directive string) context.Context {
+	return context.WithValue(ctx, cacheDirectiveKey{}, directive)
+}
+
+// cacheBypassed reports whether the client asked for the call carried by the context to bypass the caches.
+func cacheBypassed(ctx context.Context) bool {
+	directive, _ := ctx.Value(cacheDirectiveKey{}).(string)
+	return directive == CacheDirectiveNoCache
+}
+
+// cacheOnly reports whether the client asked for the call carried by the context to be answered only from
+// the caches.
+func cacheOnly(ctx context.Context) bool {
+	directive, _ := ctx.Value(cacheDirectiveKey{}).(string)
+	return directive == CacheDirectiveOnlyIfCached
+}
+
+// requestCacheDirective returns the first cache directive understood by the proxy in the request's
+// Cache-Control header, empty if there is none.
+func requestCacheDirective(r *http.Request) string {
+	for _, v := range r.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			switch d = strings.ToLower(strings.TrimSpace(d)); d {
+			case CacheDirectiveNoCache, CacheDirectiveOnlyIfCached:
+				return d
+			}
+		}
+	}
+	return ""
+}
+
+// honorCacheControl applies the cache directive given in the Cache-Control header of a request to the calls
+// it carries, so that a trusted client investigating stale data can compare the node's answer with the
+// cached one. Directives sent when opening a websocket apply to every call made over it.
+func honorCacheControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		directive := requestCacheDirective(r)
+		if directive == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, _ := tag.New(r.Context(), tag.Upsert(reasonTag, directive))
+		reportEvent(ctx, cacheDirectiveRequest)
+		next.ServeHTTP(w, r.WithContext(withCacheDirective(r.Context(), directive)))
+	})
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-logr/logr"
+	"github.com/iand/logfmtr"
+	"github.com/urfave/cli/v2"
+)
+
+// Types of cache layer that may be declared in a config file.
+const (
+	CacheLayerHttp    = "http"    // an http blockstore with one or more mirrors
+	CacheLayerS3      = "s3"      // a blockstore held in an S3 bucket, read using the AWS SDK
+	CacheLayerGonudb  = "gonudb"  // a local gonudb store
+	CacheLayerMemory  = "memory"  // recently used blocks held in memory
+	CacheLayerPeer    = "peer"    // sibling lotus-cpr instances serving blocks over http
+	CacheLayerBitswap = "bitswap" // peers serving blocks using the bitswap protocol
+)
+
+// CacheLayerConfig configures a single layer of the cache chain. Options that are not given in the config
+// file take the value of the corresponding command line flag.
+type CacheLayerConfig struct {
+	Type string
+
+	// Options for http and s3 layers
+	BaseURL            []string
+	Race               bool
+	RaceStagger        configDuration
+	RankMirrors        bool
+	Discover           string
+	DiscoverInterval   configDuration
+	Timeout            configDuration
+	Retries            int
+	MaxIdleConns       int
+	MaxConnsPerHost    int
+	ETagCacheSize      int
+	WriteThrough       bool
+	Headers            []string
+	BearerToken        string
+	AWSRegion          string
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSSessionToken    string
+	RequesterPays      bool
+
+	// Options for s3 layers
+	Bucket          string
+	Region          string
+	Endpoint        string
+	Prefix          string
+	PartSize        int64
+	PartConcurrency int
+
+	// Options for gonudb layers
+	Path            []string
+	ReadOnly        bool
+	Sync            string
+	FlushInterval   configDuration
+	FlushPending    int64
+	InsertQueue     int
+	ReadConcurrency int
+	Rotate          string
+	Generations     int
+	CheckSamples    int
+	CheckThreshold  int
+	CheckRefuse     bool
+	MaxRecords      int64
+	MaxBytes        int64
+	FullNoFill      bool
+	Evict           bool
+	Bootstrap       string
+
+	// Options for memory layers
+	Size int64
+
+	// Options for peer layers
+	Peers       []string
+	PeerToken   string
+	PeerTimeout configDuration
+
+	// Options for bitswap layers
+	BitswapPeers   []string
+	BitswapPrefix  string
+	BitswapTimeout configDuration
+}
+
+// configDuration is a duration written in a config file as a string such as 30s.
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = configDuration(v)
+	return nil
+}
+
+// cacheLayerDefaults returns the configuration of a layer of the given type as set by the command line flags.
+func cacheLayerDefaults(cc *cli.Context, typ string) CacheLayerConfig {
+	return CacheLayerConfig{
+		Type:               typ,
+		BaseURL:            cc.StringSlice("blockstore-baseurl"),
+		Race:               cc.Bool("blockstore-race"),
+		RaceStagger:        configDuration(cc.Duration("blockstore-race-stagger")),
+		RankMirrors:        cc.Bool("blockstore-rank-mirrors"),
+		Discover:           cc.String("blockstore-discover"),
+		DiscoverInterval:   configDuration(cc.Duration("blockstore-discover-interval")),
+		Timeout:            configDuration(cc.Duration("blockstore-timeout")),
+		Retries:            cc.Int("blockstore-retries"),
+		MaxIdleConns:       cc.Int("blockstore-max-idle-conns"),
+		MaxConnsPerHost:    cc.Int("blockstore-max-conns-per-host"),
+		ETagCacheSize:      cc.Int("blockstore-etag-cache-size"),
+		WriteThrough:       cc.Bool("blockstore-write-through"),
+		Headers:            cc.StringSlice("blockstore-header"),
+		BearerToken:        cc.String("blockstore-bearer-token"),
+		AWSRegion:          cc.String("blockstore-aws-region"),
+		AWSAccessKeyID:     cc.String("blockstore-aws-access-key-id"),
+		AWSSecretAccessKey: cc.String("blockstore-aws-secret-access-key"),
+		AWSSessionToken:    cc.String("blockstore-aws-session-token"),
+		RequesterPays:      cc.Bool("blockstore-requester-pays"),
+		Bucket:             cc.String("s3-bucket"),
+		Region:             cc.String("s3-region"),
+		Endpoint:           cc.String("s3-endpoint"),
+		Prefix:             cc.String("s3-prefix"),
+		PartSize:           cc.Int64("s3-part-size"),
+		PartConcurrency:    cc.Int("s3-part-concurrency"),
+		Path:               cc.StringSlice("store"),
+		ReadOnly:           cc.Bool("store-readonly"),
+		Sync:               cc.String("store-sync"),
+		FlushInterval:      configDuration(cc.Duration("store-flush-interval")),
+		FlushPending:       cc.Int64("store-flush-pending-bytes"),
+		InsertQueue:        cc.Int("store-insert-queue"),
+		ReadConcurrency:    cc.Int("store-read-concurrency"),
+		Rotate:             cc.String("store-rotate"),
+		Generations:        cc.Int("store-generations"),
+		CheckSamples:       cc.Int("store-check-samples"),
+		CheckThreshold:     cc.Int("store-check-threshold"),
+		CheckRefuse:        cc.Bool("store-check-refuse"),
+		MaxRecords:         cc.Int64("store-max-records"),
+		MaxBytes:           cc.Int64("store-max-bytes"),
+		FullNoFill:         cc.Bool("store-full-nofill"),
+		Evict:              cc.Bool("store-evict"),
+		Bootstrap:          cc.String("bootstrap-snapshot-url"),
+		Size:               cc.Int64("memory-cache-size"),
+		Peers:              cc.StringSlice("peer"),
+		PeerToken:          cc.String("peer-token"),
+		PeerTimeout:        configDuration(cc.Duration("peer-timeout")),
+		BitswapPeers:       cc.StringSlice("bitswap-peer"),
+		BitswapPrefix:      cc.String("bitswap-protocol-prefix"),
+		BitswapTimeout:     configDuration(cc.Duration("bitswap-timeout")),
+	}
+}
+
+// ReadCacheChainConfig reads the cache layers declared in a TOML config file as a list of [[Cache]]
+// tables. Layers are listed in the order they are consulted: the first layer receives requests from the
+// proxy and each layer fills from the one after it. The last layer fills from the lotus node.
+func ReadCacheChainConfig(cc *cli.Context, path string) ([]CacheLayerConfig, error) {
+	var raw struct {
+		Cache []toml.Primitive
+	}
+	md, err := toml.DecodeFile(path, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	layers := make([]CacheLayerConfig, 0, len(raw.Cache))
+	for i, prim := range raw.Cache {
+		var typ struct{ Type string }
+		if err := md.PrimitiveDecode(prim, &typ); err != nil {
+			return nil, fmt.Errorf("cache %d: %w", i, err)
+		}
+		switch typ.Type {
+		case CacheLayerHttp, CacheLayerS3, CacheLayerGonudb, CacheLayerMemory, CacheLayerPeer, CacheLayerBitswap:
+		default:
+			return nil, fmt.Errorf("cache %d: unknown type %q", i, typ.Type)
+		}
+
+		// Only tuning options are taken from the flags, each layer must say where its blocks are held
+		layer := cacheLayerDefaults(cc, typ.Type)
+		layer.BaseURL, layer.Discover, layer.Bucket, layer.Path, layer.Peers, layer.BitswapPeers = nil, "", "", nil, nil, nil
+		if err := md.PrimitiveDecode(prim, &layer); err != nil {
+			return nil, fmt.Errorf("cache %d: %w", i, err)
+		}
+		layers = append(layers, layer)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown config option %q", undecoded[0].String())
+	}
+	return layers, nil
+}
+
+// CacheLayersFromFlags returns the cache layers configured by the command line flags, in the order they
+// are consulted: the memory cache, the gonudb store, the http blockstore, the S3 bucket, the peer proxies
+// and then the bitswap peers.
+func CacheLayersFromFlags(cc *cli.Context) []CacheLayerConfig {
+	var layers []CacheLayerConfig
+	if cc.Int64("memory-cache-size") > 0 {
+		layers = append(layers, cacheLayerDefaults(cc, CacheLayerMemory))
+	}
+	if len(cc.StringSlice("store")) > 0 {
+		layers = append(layers, cacheLayerDefaults(cc, CacheLayerGonudb))
+	}
+	if len(cc.StringSlice("blockstore-baseurl")) > 0 || cc.String("blockstore-discover") != "" {
+		layers = append(layers, cacheLayerDefaults(cc, CacheLayerHttp))
+	}
+	if cc.String("s3-bucket") != "" {
+		layers = append(layers, cacheLayerDefaults(cc, CacheLayerS3))
+	}
+	if len(cc.StringSlice("peer")) > 0 {
+		layers = append(layers, cacheLayerDefaults(cc, CacheLayerPeer))
+	}
+	if len(cc.StringSlice("bitswap-peer")) > 0 {
+		layers = append(layers, cacheLayerDefaults(cc, CacheLayerBitswap))
+	}
+	return layers
+}
+
+// cacheChain builds the chain of caches in front of the lotus node and manages their lifetime, along with
+// the background workers that read through them.
+type cacheChain struct {
+	ctx           context.Context // cancelled when the chain is closed
+	cancel        context.CancelFunc
+	workers       sync.WaitGroup
+	caches        []BlockCache // the caches in the chain, starting with the lotus node
+	tiers         []*CacheTier // the tiers wrapping each cache after the lotus node, in the order they were added
+	status        *StatusReporter
+	reportMetrics bool
+	closers       []func()
+	snapshot      *SnapshotRange // the snapshot a store was bootstrapped from, nil if none
+	coverage      *StoreCoverage // heights held by the store, nil if there is no writable store
+	logger        logr.Logger
+
+	store *ShardedStore // the gonudb store, nil if there is none
+}
+
+func newCacheChain(ctx context.Context, node BlockCache, status *StatusReporter, reportMetrics bool, logger logr.Logger) *cacheChain {
+	ctx, cancel := context.WithCancel(ctx)
+	return &cacheChain{
+		ctx:           ctx,
+		cancel:        cancel,
+		caches:        []BlockCache{node},
+		status:        status,
+		reportMetrics: reportMetrics,
+		logger:        logger,
+	}
+}
+
+// Head returns the cache the proxy should read from.
+func (c *cacheChain) Head() BlockCache {
+	return c.caches[len(c.caches)-1]
+}
+
+// Store returns the chain's gonudb store, or nil if it has none.
+func (c *cacheChain) Store() *ShardedStore {
+	return c.store
+}
+
+// Coverage returns the record of the heights held by the chain's store, or nil if it has no writable store.
+func (c *cacheChain) Coverage() *StoreCoverage {
+	return c.coverage
+}
+
+// Snapshot returns the snapshot the chain's store was bootstrapped from, or nil if it was not.
+func (c *cacheChain) Snapshot() *SnapshotRange {
+	return c.snapshot
+}
+
+// Go runs a background worker until the chain is closed. The worker must return once its context is
+// cancelled.
+func (c *cacheChain) Go(run func(ctx context.Context)) {
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		run(c.ctx)
+	}()
+}
+
+// OnClose adds a function to be called when the chain is closed, once its workers have stopped.
+func (c *cacheChain) OnClose(f func()) {
+	c.closers = append(c.closers, f)
+}
+
+// Close stops the chain's workers and waits for them to return, then releases the resources held by the
+// caches in the chain, most recently added first.
+func (c *cacheChain) Close() {
+	c.cancel()
+	c.workers.Wait()
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i]()
+	}
+}
+
+// Build adds the layers to the chain, which are given in the order they are consulted.
+func (c *cacheChain) Build(layers []CacheLayerConfig) error {
+	for i := len(layers) - 1; i >= 0; i-- {
+		var err error
+		switch layers[i].Type {
+		case CacheLayerHttp:
+			err = c.addHttp(layers[i])
+		case CacheLayerS3:
+			err = c.addS3(layers[i])
+		case CacheLayerGonudb:
+			err = c.addGonudb(layers[i])
+		case CacheLayerMemory:
+			err = c.addMemory(layers[i])
+		case CacheLayerPeer:
+			err = c.addPeer(layers[i])
+		case CacheLayerBitswap:
+			err = c.addBitswap(layers[i])
+		default:
+			err = fmt.Errorf("unknown cache type %q", layers[i].Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tiers returns the tiers of the chain that may be disabled at runtime, in the order they are consulted.
+func (c *cacheChain) Tiers() []*CacheTier {
+	tiers := make([]*CacheTier, len(c.tiers))
+	for i, t := range c.tiers {
+		tiers[len(tiers)-1-i] = t
+	}
+	return tiers
+}
+
+// add places a cache in front of the chain, wrapped in a tier named after the type of the cache. A number
+// is appended to the names of tiers of the same type.
+func (c *cacheChain) add(typ string, bc BlockCache) {
+	name := typ
+	for n := 2; c.hasTier(name); n++ {
+		name = fmt.Sprintf("%s-%d", typ, n)
+	}
+	t := NewCacheTier(name, bc, logfmtr.NewNamed("proxy"))
+	t.SetUpstream(c.Head())
+	c.tiers = append(c.tiers, t)
+	c.caches = append(c.caches, t)
+}
+
+func (c *cacheChain) hasTier(name string) bool {
+	for _, t := range c.tiers {
+		if t.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cacheChain) addHttp(l CacheLayerConfig) error {
+	if l.Bucket != "" {
+		return fmt.Errorf("s3 buckets are read by a separate s3 cache layer")
+	}
+
+	hOpts := DefaultHttpClientOptions
+	hOpts.Timeout = time.Duration(l.Timeout)
+	hOpts.Retries = l.Retries
+	hOpts.MaxIdleConns = l.MaxIdleConns
+	hOpts.MaxIdleConnsPerHost = l.MaxIdleConns
+	hOpts.MaxConnsPerHost = l.MaxConnsPerHost
+	hOpts.ETagCacheSize = l.ETagCacheSize
+	hOpts.RaceMirrors = l.Race
+	hOpts.RaceStagger = time.Duration(l.RaceStagger)
+	hOpts.RankMirrors = l.RankMirrors
+	hOpts.WriteThrough = l.WriteThrough
+	hOpts.BearerToken = l.BearerToken
+	hOpts.RequesterPays = l.RequesterPays
+
+	headers, err := parseHeaders(l.Headers)
+	if err != nil {
+		return fmt.Errorf("blockstore-header: %w", err)
+	}
+	hOpts.Headers = headers
+
+	if l.AWSRegion != "" {
+		if l.AWSAccessKeyID == "" || l.AWSSecretAccessKey == "" {
+			return fmt.Errorf("blockstore-aws-access-key-id and blockstore-aws-secret-access-key must be set when blockstore-aws-region is specified")
+		}
+		hOpts.AWSRegion = l.AWSRegion
+		hOpts.AWSCredentials = &AWSCredentials{
+			AccessKeyID:     l.AWSAccessKeyID,
+			SecretAccessKey: l.AWSSecretAccessKey,
+			SessionToken:    l.AWSSessionToken,
+		}
+	}
+
+	hCache := NewHttpBlockCache(l.BaseURL, l.Type, &hOpts)
+	if l.Discover != "" && l.Type == CacheLayerHttp {
+		if l.DiscoverInterval <= 0 {
+			return fmt.Errorf("blockstore-discover-interval must be positive")
+		}
+		discovery := NewMirrorDiscovery(l.Discover, l.BaseURL, hCache, time.Duration(l.DiscoverInterval), logfmtr.NewNamed("proxy"))
+		discovery.Refresh(c.ctx)
+		c.Go(discovery.Run)
+	}
+
+	c.add(l.Type, hCache)
+	c.logger.Info("Added http blockstore", "base_url", hCache.Mirrors(), "discover", l.Discover)
+	return nil
+}
+
+func (c *cacheChain) addS3(l CacheLayerConfig) error {
+	loc := S3Location{
+		Bucket:   l.Bucket,
+		Region:   l.Region,
+		Endpoint: l.Endpoint,
+		Prefix:   l.Prefix,
+	}
+	opts := S3Options{
+		Timeout:       time.Duration(l.Timeout),
+		Retries:       l.Retries,
+		PartSize:      l.PartSize,
+		Concurrency:   l.PartConcurrency,
+		WriteThrough:  l.WriteThrough,
+		RequesterPays: l.RequesterPays,
+	}
+	if l.AWSAccessKeyID != "" || l.AWSSecretAccessKey != "" {
+		if l.AWSAccessKeyID == "" || l.AWSSecretAccessKey == "" {
+			return fmt.Errorf("blockstore-aws-access-key-id and blockstore-aws-secret-access-key must be set together")
+		}
+		opts.Credentials = &AWSCredentials{
+			AccessKeyID:     l.AWSAccessKeyID,
+			SecretAccessKey: l.AWSSecretAccessKey,
+			SessionToken:    l.AWSSessionToken,
+		}
+	}
+
+	sCache, err := NewS3BlockCache(loc, l.Type, opts)
+	if err != nil {
+		return fmt.Errorf("s3-bucket: %w", err)
+	}
+	c.add(l.Type, sCache)
+	c.logger.Info("Added s3 blockstore", "bucket", l.Bucket, "region", loc.region(), "endpoint", l.Endpoint, "prefix", l.Prefix, "static_credentials", opts.Credentials != nil)
+	return nil
+}
+
+func (c *cacheChain) addPeer(l CacheLayerConfig) error {
+	if len(l.Peers) == 0 {
+		return fmt.Errorf("peer: at least one peer must be specified")
+	}
+	pCache := NewPeerBlockCache(l.Peers, l.Type, l.PeerToken, time.Duration(l.PeerTimeout))
+	c.add(l.Type, pCache)
+	c.logger.Info("Added peer tier", "peers", pCache.Peers())
+	return nil
+}
+
+func (c *cacheChain) addBitswap(l CacheLayerConfig) error {
+	if len(l.BitswapPeers) == 0 {
+		return fmt.Errorf("bitswap-peer: at least one peer must be specified")
+	}
+	bCache, err := NewBitswapBlockCache(c.ctx, l.BitswapPeers, l.BitswapPrefix, time.Duration(l.BitswapTimeout), l.Type, logfmtr.NewNamed("proxy"))
+	if err != nil {
+		return fmt.Errorf("bitswap-peer: %w", err)
+	}
+	c.Go(bCache.Run)
+	c.closers = append(c.closers, func() {
+		if err := bCache.Close(); err != nil {
+			c.logger.Error(err, "failed to close bitswap cleanly")
+		}
+	})
+	c.add(l.Type, bCache)
+	c.logger.Info("Added bitswap tier", "peers", l.BitswapPeers, "protocol_prefix", l.BitswapPrefix)
+	return nil
+}
+
+func (c *cacheChain) addMemory(l CacheLayerConfig) error {
+	if l.Size <= 0 {
+		return fmt.Errorf("memory-cache-size must be positive")
+	}
+	mCache := NewMemoryBlockCache(l.Size)
+	if c.reportMetrics {
+		c.Go(func(ctx context.Context) {
+			timer := time.NewTicker(metricReportingInterval)
+			for {
+				select {
+				case <-timer.C:
+					mCache.ReportMetrics(ctx)
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+		})
+	}
+
+	c.add(l.Type, mCache)
+	c.logger.Info("Added memory cache", "size", l.Size)
+	return nil
+}
+
+func (c *cacheChain) addGonudb(l CacheLayerConfig) error {
+	ctx := c.ctx
+	if len(l.Path) == 0 {
+		return fmt.Errorf("store: path must be specified")
+	}
+	c.logger.Info("Opening store", "path", l.Path, "readonly", l.ReadOnly)
+	if !ValidStoreSync(l.Sync) {
+		return fmt.Errorf("store-sync: unknown policy %q", l.Sync)
+	}
+	if !l.ReadOnly {
+		cov, err := OpenStoreCoverage(filepath.Join(l.Path[0], coverageFile), logfmtr.NewNamed("gonudb"))
+		if err != nil {
+			return fmt.Errorf("failed to open store coverage: %w", err)
+		}
+		c.coverage = cov
+	}
+
+	var s *ShardedStore
+	if l.Rotate != "" {
+		if !ValidStoreRotate(l.Rotate) {
+			return fmt.Errorf("store-rotate: unknown schedule %q", l.Rotate)
+		}
+		if l.Generations < 1 {
+			return fmt.Errorf("store-generations must be at least 1")
+		}
+		rotator := NewStoreRotator(l.Path, l.Rotate, l.Generations, l.ReadOnly, logfmtr.NewNamed("gonudb"))
+		rotator.SetReadConcurrency(l.ReadConcurrency)
+		if c.coverage != nil {
+			rotator.SetDiscardHook(c.coverage.ResetCovered)
+		}
+		if l.Evict {
+			if l.MaxRecords <= 0 && l.MaxBytes <= 0 {
+				return fmt.Errorf("store-evict requires store-max-records or store-max-bytes")
+			}
+			rotator.SetEviction(StoreCeiling{MaxRecords: l.MaxRecords, MaxBytes: l.MaxBytes})
+		}
+		var err error
+		s, err = rotator.Open(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to open gonudb store: %w", err)
+		}
+		c.Go(rotator.Run)
+	} else {
+		if l.Evict {
+			return fmt.Errorf("store-evict requires store-rotate")
+		}
+		var err error
+		s, err = openShardedStore(ctx, l.Path, l.ReadOnly)
+		if err != nil {
+			return fmt.Errorf("failed to open gonudb store: %w", err)
+		}
+		if err := s.OpenReaders(ctx, l.ReadConcurrency); err != nil {
+			s.Close()
+			return fmt.Errorf("failed to open gonudb store: %w", err)
+		}
+	}
+	c.closers = append(c.closers, func() {
+		err := s.Close()
+		if err != nil {
+			c.logger.Error(err, "failed to close store cleanly")
+		}
+	})
+	c.store = s
+
+	if l.Bootstrap != "" {
+		if l.ReadOnly {
+			return fmt.Errorf("bootstrap-snapshot-url cannot be used with a read only store")
+		}
+		snap, err := BootstrapSnapshot(ctx, s, l.Path[0], l.Bootstrap, logfmtr.NewNamed("gonudb"))
+		if err != nil {
+			return fmt.Errorf("bootstrap-snapshot-url: %w", err)
+		}
+		c.logger.Info("Store holds snapshot", "url", snap.URL, "low", snap.Low, "high", snap.High, "imported", snap.Imported)
+		c.snapshot = snap
+	}
+
+	if l.CheckSamples > 0 {
+		c.logger.Info("Checking store consistency", "samples", l.CheckSamples)
+		res, err := CheckStore(s, l.CheckSamples)
+		if err != nil {
+			return fmt.Errorf("failed to check store consistency: %w", err)
+		}
+		kv := []interface{}{"sampled", res.Sampled, "bad_hash", res.BadHash, "unindexed", res.Unindexed, "record_count", res.RecordCount, "complete", res.Complete}
+		if res.Inconsistencies() > l.CheckThreshold {
+			if l.CheckRefuse {
+				return fmt.Errorf("store is inconsistent: found %d inconsistencies", res.Inconsistencies())
+			}
+			c.logger.Error(fmt.Errorf("found %d inconsistencies", res.Inconsistencies()), "Store is inconsistent", kv...)
+		} else {
+			c.logger.Info("Store consistency check passed", kv...)
+		}
+	}
+
+	dbCache := NewDBBlockCache(s, logfmtr.NewNamed("gonudb"))
+	dbCache.SetSyncPolicy(l.Sync)
+	dbCache.SetFlushThreshold(l.FlushPending)
+	dbCache.SetReadOnly(l.ReadOnly)
+	if !l.ReadOnly {
+		dbCache.SetInsertQueue(l.InsertQueue)
+		// Closers run in reverse so waiting blocks are inserted and flushed before the store is closed
+		c.closers = append(c.closers, dbCache.Close)
+	}
+
+	if l.MaxRecords > 0 || l.MaxBytes > 0 {
+		dbCache.SetCeiling(StoreCeiling{
+			MaxRecords:  l.MaxRecords,
+			MaxBytes:    l.MaxBytes,
+			StopFilling: l.FullNoFill,
+		})
+		dbCache.CheckCeiling(ctx)
+		c.Go(func(ctx context.Context) {
+			timer := time.NewTicker(storeCeilingCheckInterval)
+			for {
+				select {
+				case <-timer.C:
+					dbCache.CheckCeiling(ctx)
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+		})
+	}
+
+	if l.Sync == StoreSyncPeriodic && !l.ReadOnly {
+		if l.FlushInterval <= 0 {
+			return fmt.Errorf("store-flush-interval must be positive")
+		}
+		c.Go(func(ctx context.Context) {
+			timer := time.NewTicker(time.Duration(l.FlushInterval))
+			for {
+				select {
+				case <-timer.C:
+					if err := dbCache.Flush(ctx); err != nil {
+						c.logger.Error(err, "failed to flush store")
+					}
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+		})
+	}
+	c.status.SetStore(s)
+	if c.coverage != nil {
+		c.status.SetCoverage(c.coverage)
+	}
+
+	if c.reportMetrics {
+		c.Go(func(ctx context.Context) {
+			timer := time.NewTicker(2 * time.Second)
+			for {
+				select {
+				case <-timer.C:
+					dbCache.ReportMetrics(ctx)
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+		})
+	}
+
+	// A read-only store may be shared so lifetime statistics are not written to it
+	if c.reportMetrics && !l.ReadOnly {
+		ls := NewLifetimeStats(filepath.Join(l.Path[0], "stats.json"), logfmtr.NewNamed("stats"))
+		if err := ls.Load(); err != nil {
+			c.logger.Error(err, "failed to load lifetime statistics, starting from zero")
+		}
+
+		c.Go(func(ctx context.Context) {
+			timer := time.NewTicker(metricReportingInterval)
+			lastSave := time.Now()
+			for {
+				select {
+				case <-timer.C:
+					ls.Update()
+					if time.Since(lastSave) >= lifetimeStatsInterval {
+						if err := ls.Save(); err != nil {
+							c.logger.Error(err, "failed to save lifetime statistics")
+						}
+						lastSave = time.Now()
+					}
+				case <-ctx.Done():
+					timer.Stop()
+					ls.Update()
+					if err := ls.Save(); err != nil {
+						c.logger.Error(err, "failed to save lifetime statistics")
+					}
+					return
+				}
+			}
+		})
+	}
+
+	c.add(l.Type, dbCache)
+	c.logger.Info("Added gonudb cache", "path", l.Path)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestCacheChainCloseStopsWorkers(t *testing.T) {
+	c := newCacheChain(context.Background(), &testUpstream{memBlockstore{}}, nil, false, logr.Discard())
+	var running int32
+	for i := 0; i < 3; i++ {
+		c.Go(func(ctx context.Context) {
+			atomic.AddInt32(&running, 1)
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+
+	var closedWith int32 = -1
+	c.OnClose(func() { closedWith = atomic.LoadInt32(&running) })
+	c.Close()
+	if closedWith != 0 {
+		t.Errorf("chain was closed with %d workers running, wanted none", closedWith)
+	}
+}
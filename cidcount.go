@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+)
+
+// CIDCount is the number of times a cid has been requested.
+type CIDCount struct {
+	CID   string `json:"cid"`
+	Count int64  `json:"count"`
+}
+
+// CIDCounter counts requests for recently requested cids. Only a bounded number of cids are tracked,
+// the least recently requested being forgotten first, so counts are approximate.
+type CIDCounter struct {
+	mu     sync.Mutex // guards counts
+	counts *lru.Cache // request counts keyed by cid
+}
+
+func NewCIDCounter(size int) *CIDCounter {
+	counts, _ := lru.New(size)
+	return &CIDCounter{counts: counts}
+}
+
+// Add counts a request for the cid. It is safe to call on a nil counter.
+func (c *CIDCounter) Add(k cid.Cid) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int64
+	if v, ok := c.counts.Get(k); ok {
+		n = v.(int64)
+	}
+	c.counts.Add(k, n+1)
+}
+
+// Top returns up to n of the most requested cids, most requested first.
+func (c *CIDCounter) Top(n int) []CIDCount {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	top := make([]CIDCount, 0, c.counts.Len())
+	for _, k := range c.counts.Keys() {
+		if v, ok := c.counts.Peek(k); ok {
+			top = append(top, CIDCount{CID: k.(cid.Cid).String(), Count: v.(int64)})
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].CID < top[j].CID
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/filecoin-project/go-address"
@@ -12,17 +13,25 @@ import (
 	"github.com/filecoin-project/go-jsonrpc"
 	"github.com/filecoin-project/go-jsonrpc/auth"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
 	lotusapi "github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/build"
 	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/go-logr/logr"
 	"github.com/iand/circuit"
 	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+	"go.opencensus.io/tag"
 )
 
+// upstreamVersionTimeout is the maximum time allowed for a lotus node to report its version when the proxy
+// connects to it.
+const upstreamVersionTimeout = 10 * time.Second
+
 func apiURI(addr string) string {
 	return "ws://" + addr + "/rpc/v0"
 }
@@ -45,9 +54,21 @@ type apiClient struct {
 	cb      *circuit.Breaker
 	logger  logr.Logger
 
-	mu     sync.Mutex // guards api and closer
+	mu     sync.Mutex // guards api, closer and compat
 	api    lotusapi.FullNode
 	closer jsonrpc.ClientCloser
+	compat nodeCompat
+
+	hmu               sync.Mutex // guards fields below
+	consecutiveErrors int
+	lastSuccess       time.Time
+	lastError         error
+	lastErrorTime     time.Time
+
+	priority  int          // position in the failover order, 0 for the preferred node
+	fallbacks []*apiClient // upstreams called in order when the circuit of the preferred node is open
+	active    int32        // priority of the upstream that last answered a call, accessed atomically
+	slowStart *SlowStart   // limits calls after the circuit closes, nil for no limit
 }
 
 func newAPIClient(maddr string, token string, errorThreshold int, maxConcurrency int, resetTimeout time.Duration, logger logr.Logger) (*apiClient, error) {
@@ -61,6 +82,8 @@ func newAPIClient(maddr string, token string, errorThreshold int, maxConcurrency
 		return nil, fmt.Errorf("convert api multiaddress: %w", err)
 	}
 
+	upstreamAddrs.Store(addr, maddr)
+
 	a := &apiClient{
 		maddr:   maddr,
 		uri:     apiURI(addr),
@@ -82,6 +105,9 @@ func newAPIClient(maddr string, token string, errorThreshold int, maxConcurrency
 }
 
 func (a *apiClient) Close() {
+	for _, f := range a.fallbacks {
+		f.Close()
+	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	// Close the connection to the upstream api if it was open
@@ -92,9 +118,34 @@ func (a *apiClient) Close() {
 	a.api = nil
 }
 
+// AddFallback adds an upstream, such as a remote or paid node, that is only called while the circuits of
+// the preferred node and of any fallbacks added before it are open. Fallbacks are closed with the client.
+func (a *apiClient) AddFallback(f *apiClient) {
+	f.priority = len(a.fallbacks) + 1
+	a.fallbacks = append(a.fallbacks, f)
+}
+
+// SetSlowStart ramps up the number of concurrent calls allowed to this upstream and its fallbacks over the
+// given period after their circuits close. A period of zero disables the slow start.
+func (a *apiClient) SetSlowStart(period time.Duration, maxConcurrency int) {
+	for _, f := range a.fallbacks {
+		f.SetSlowStart(period, maxConcurrency)
+	}
+	if period <= 0 {
+		a.slowStart = nil
+		return
+	}
+	a.slowStart = NewSlowStart(period, maxConcurrency)
+}
+
 func (a *apiClient) onCircuitOpen(r circuit.OpenReason) {
-	a.logger.Info("Disconnecting from lotus", "maddr", a.maddr, "reason", reason(r))
-	reportMeasurement(context.Background(), circuitStatus.M(1))
+	a.logger.Info("Disconnecting from lotus", "maddr", a.maddr, "reason", reason(r), "priority", a.priority)
+	if a.slowStart != nil {
+		a.slowStart.Cancel()
+	}
+	if a.priority == 0 {
+		reportMeasurement(context.Background(), circuitStatus.M(1))
+	}
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -112,7 +163,71 @@ func (a *apiClient) onCircuitReset() {
 }
 
 func (a *apiClient) onCircuitClose() {
-	reportMeasurement(context.Background(), circuitStatus.M(0))
+	if a.priority == 0 {
+		reportMeasurement(context.Background(), circuitStatus.M(0))
+	}
+	if a.slowStart != nil {
+		a.logger.Info("Slowly raising concurrency of calls to lotus", "maddr", a.maddr, "period", a.slowStart.period)
+		a.slowStart.Begin()
+	}
+}
+
+// CircuitState reports the state of the circuit breaker guarding the connection to the lotus node.
+func (a *apiClient) CircuitState() string {
+	a.mu.Lock()
+	connected := a.api != nil
+	a.mu.Unlock()
+
+	switch {
+	case a.cb.IsOpen():
+		return CircuitOpen
+	case a.cb.IsHalfOpen():
+		return CircuitHalfOpen
+	case !connected:
+		return CircuitDisconnected
+	default:
+		return CircuitClosed
+	}
+}
+
+// recordResult tracks the outcome of calls to the lotus node for health reporting.
+func (a *apiClient) recordResult(err error) {
+	a.hmu.Lock()
+	defer a.hmu.Unlock()
+	if err != nil {
+		a.consecutiveErrors++
+		a.lastError = err
+		a.lastErrorTime = time.Now()
+		return
+	}
+	a.consecutiveErrors = 0
+	a.lastSuccess = time.Now()
+}
+
+// UpstreamHealth reports the health of the connection to the lotus node.
+func (a *apiClient) UpstreamHealth() *UpstreamHealth {
+	h := &UpstreamHealth{
+		Address: a.maddr,
+		State:   a.CircuitState(),
+	}
+	if compat := a.nodeCompat(); compat.version.Version != "" {
+		h.Version = compat.version.Version
+		h.APIVersion = compat.version.APIVersion.String()
+	}
+
+	a.hmu.Lock()
+	defer a.hmu.Unlock()
+	h.ConsecutiveErrors = a.consecutiveErrors
+	if !a.lastSuccess.IsZero() {
+		t := a.lastSuccess
+		h.LastSuccess = &t
+	}
+	if a.lastError != nil {
+		t := a.lastErrorTime
+		h.LastError = a.lastError.Error()
+		h.LastErrorTime = &t
+	}
+	return h
 }
 
 func (a *apiClient) connect() {
@@ -125,31 +240,147 @@ func (a *apiClient) connect() {
 		a.mu.Unlock()
 		return
 	}
-	a.logger.Info("Connected to lotus", "maddr", a.maddr)
+
+	// Detect the version of the node so calls can be adapted to it. Nodes that don't report their version
+	// are assumed to match the proxy.
+	vctx, cancel := context.WithTimeout(context.Background(), upstreamVersionTimeout)
+	v, err := upstream.Version(vctx)
+	cancel()
+	if err != nil {
+		a.logger.Error(err, "Detecting lotus version", "maddr", a.maddr)
+		v = lotusapi.Version{APIVersion: build.FullAPIVersion}
+	}
+	compat := detectCompat(v)
+	a.logger.Info("Connected to lotus", "maddr", a.maddr, "version", v.Version, "api_version", v.APIVersion)
+	if !v.APIVersion.EqMajorMinor(build.FullAPIVersion) {
+		a.logger.Info("Lotus api version differs from the version supported by the proxy, some calls will be adapted", "api_version", v.APIVersion, "supported_version", build.FullAPIVersion)
+	}
 
 	a.mu.Lock()
 	a.api = upstream
 	a.closer = closer
+	a.compat = compat
 	a.mu.Unlock()
 }
 
+// nodeCompat returns the adaptations needed for the connected node.
+func (a *apiClient) nodeCompat() nodeCompat {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.compat
+}
+
+// setNoReceipt records that the connected node does not serve StateGetReceipt.
+func (a *apiClient) setNoReceipt() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.compat.noReceipt {
+		a.logger.Info("Lotus does not serve StateGetReceipt, using StateSearchMsg instead", "maddr", a.maddr)
+		a.compat.noReceipt = true
+	}
+}
+
 func (a *apiClient) withApi(ctx context.Context, fn func(api lotusapi.FullNode) error) error {
+	return a.withUpstream(ctx, func(_ *apiClient, api lotusapi.FullNode) error {
+		return fn(api)
+	})
+}
+
+// withUpstream calls fn with the preferred node, failing over to each fallback in turn while the upstream
+// tried cannot be called. fn is passed the upstream being called so that it can adapt to the node.
+func (a *apiClient) withUpstream(ctx context.Context, fn func(u *apiClient, api lotusapi.FullNode) error) error {
+	if cacheOnly(ctx) {
+		return fmt.Errorf("%w: the client asked for the call to be answered only from the caches", ErrLotusUnavailable)
+	}
+	var err error
+	for _, u := range a.upstreams() {
+		err = u.call(ctx, fn)
+		if err != nil && isUpstreamUnavailable(err) {
+			continue
+		}
+		a.setActive(u)
+		return err
+	}
+	return err
+}
+
+// upstreams returns the preferred node followed by the fallbacks in priority order.
+func (a *apiClient) upstreams() []*apiClient {
+	return append([]*apiClient{a}, a.fallbacks...)
+}
+
+// setActive records the upstream that answered a call, logging and reporting any change.
+func (a *apiClient) setActive(u *apiClient) {
+	prev := atomic.SwapInt32(&a.active, int32(u.priority))
+	if prev == int32(u.priority) {
+		return
+	}
+	if u.priority == 0 {
+		a.logger.Info("Returned to preferred lotus node", "maddr", u.maddr)
+	} else {
+		a.logger.Info("Failed over to fallback lotus node", "maddr", u.maddr, "priority", u.priority)
+	}
+	reportMeasurement(context.Background(), upstreamActive.M(int64(u.priority)))
+}
+
+// ActiveUpstream returns the address of the upstream that last answered a call.
+func (a *apiClient) ActiveUpstream() string {
+	return a.upstreams()[atomic.LoadInt32(&a.active)].maddr
+}
+
+// FallbackHealth reports the health of the connections to the fallback nodes in priority order.
+func (a *apiClient) FallbackHealth() []*UpstreamHealth {
+	hs := make([]*UpstreamHealth, 0, len(a.fallbacks))
+	for _, f := range a.fallbacks {
+		hs = append(hs, f.UpstreamHealth())
+	}
+	return hs
+}
+
+// call passes fn to this upstream through its circuit breaker.
+func (a *apiClient) call(ctx context.Context, fn func(u *apiClient, api lotusapi.FullNode) error) error {
 	a.mu.Lock()
 	api := a.api
 	a.mu.Unlock()
 	if api == nil {
 		return ErrLotusUnavailable
 	}
+	if a.slowStart != nil {
+		release, err := a.slowStart.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	ctx, span := startUpstreamSpan(ctx, a)
+	defer span.End()
+
 	// pass the function through the circuit breaker
-	return a.cb.Do(ctx, func() error {
+	var cancelled error
+	err := a.cb.Do(ctx, func() error {
 		reportEvent(ctx, circuitRequest)
-		err := fn(api)
+		noteUpstreamCall(ctx)
+		err := fn(a, api)
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up, which says nothing about the health of the node
+			rctx, _ := tag.New(ctx, tag.Upsert(reasonTag, cancelReason(ctx)))
+			reportEvent(rctx, upstreamCancelled)
+			cancelled = err
+			return nil
+		}
 		if err != nil {
 			reportEvent(ctx, circuitFailure)
 		}
+		a.recordResult(err)
 
 		return err
 	})
+	if cancelled != nil {
+		recordSpanError(span, cancelled)
+		return cancelled
+	}
+	recordSpanError(span, err)
+	return err
 }
 
 func (a *apiClient) AuthVerify(ctx context.Context, token string) ([]auth.Permission, error) {
@@ -478,8 +709,15 @@ func (a *apiClient) StateGetReceipt(ctx context.Context, msg cid.Cid, tsk types.
 		e error
 	)
 
-	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
-		r, e = api.StateGetReceipt(ctx, msg, tsk)
+	if err := a.withUpstream(ctx, func(u *apiClient, api lotusapi.FullNode) error {
+		if !u.nodeCompat().noReceipt {
+			r, e = api.StateGetReceipt(ctx, msg, tsk)
+			if !isMethodNotFound(e, "StateGetReceipt") {
+				return e
+			}
+			u.setNoReceipt()
+		}
+		r, e = searchReceipt(ctx, api, msg, tsk)
 		return e
 	}); err != nil {
 		return nil, err
@@ -600,6 +838,182 @@ func (a *apiClient) StateVMCirculatingSupplyInternal(ctx context.Context, tsk ty
 	return r, e
 }
 
+func (a *apiClient) NetPeers(ctx context.Context) ([]peer.AddrInfo, error) {
+	var (
+		r []peer.AddrInfo
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.NetPeers(ctx)
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) NetAddrsListen(ctx context.Context) (peer.AddrInfo, error) {
+	var (
+		r peer.AddrInfo
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.NetAddrsListen(ctx)
+		return e
+	}); err != nil {
+		return peer.AddrInfo{}, err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) SyncState(ctx context.Context) (*lotusapi.SyncState, error) {
+	var (
+		r *lotusapi.SyncState
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.SyncState(ctx)
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) SyncIncomingBlocks(ctx context.Context) (<-chan *types.BlockHeader, error) {
+	var (
+		r <-chan *types.BlockHeader
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.SyncIncomingBlocks(ctx)
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) ID(ctx context.Context) (peer.ID, error) {
+	var (
+		r peer.ID
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.ID(ctx)
+		return e
+	}); err != nil {
+		return "", err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) ChainGetRandomnessFromTickets(ctx context.Context, tsk types.TipSetKey, personalization crypto.DomainSeparationTag, randEpoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error) {
+	var (
+		r abi.Randomness
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.ChainGetRandomnessFromTickets(ctx, tsk, personalization, randEpoch, entropy)
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) ChainGetRandomnessFromBeacon(ctx context.Context, tsk types.TipSetKey, personalization crypto.DomainSeparationTag, randEpoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error) {
+	var (
+		r abi.Randomness
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.ChainGetRandomnessFromBeacon(ctx, tsk, personalization, randEpoch, entropy)
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) StateDecodeParams(ctx context.Context, toAddr address.Address, method abi.MethodNum, params []byte, tsk types.TipSetKey) (interface{}, error) {
+	var (
+		r interface{}
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.StateDecodeParams(ctx, toAddr, method, params, tsk)
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) BeaconGetEntry(ctx context.Context, epoch abi.ChainEpoch) (*types.BeaconEntry, error) {
+	var (
+		r *types.BeaconEntry
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.BeaconGetEntry(ctx, epoch)
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) StateCall(ctx context.Context, msg *types.Message, tsk types.TipSetKey) (*lotusapi.InvocResult, error) {
+	var (
+		r *lotusapi.InvocResult
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.StateCall(ctx, msg, tsk)
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
+func (a *apiClient) StateCompute(ctx context.Context, height abi.ChainEpoch, msgs []*types.Message, tsk types.TipSetKey) (*lotusapi.ComputeStateOutput, error) {
+	var (
+		r *lotusapi.ComputeStateOutput
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = api.StateCompute(ctx, height, msgs, tsk)
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
 func reason(r circuit.OpenReason) string {
 	switch r {
 	case circuit.OpenReasonThreshold:
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/lotus/api/apistruct"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+var ErrPermDenied = errors.New("method not permitted by token permissions")
+
+// clientAuthCacheSize is the number of tokens verified by the node whose permissions are remembered.
+const clientAuthCacheSize = 1024
+
+// clientAuthCacheTTL is how long the permissions of a token verified by the node are remembered.
+const clientAuthCacheTTL = time.Minute
+
+// clientAuthFailureTTL is how long a token rejected by the node is remembered, so that clients repeating a
+// bad token do not each cost a call to the node.
+const clientAuthFailureTTL = 10 * time.Second
+
+// TokenVerifier returns the permissions granted by a Lotus api token.
+type TokenVerifier interface {
+	AuthVerify(ctx context.Context, token string) ([]auth.Permission, error)
+}
+
+// clientToken is a token that clients may present to the proxy.
+type clientToken struct {
+	name  string
+	perms []auth.Permission
+}
+
+// verifiedToken is the cached result of verifying a token with the node.
+type verifiedToken struct {
+	perms   []auth.Permission
+	err     error // the reason the node rejected the token, nil if it was accepted
+	expires time.Time
+}
+
+// ClientAuth authenticates clients by the bearer tokens sent with their requests, granting each token
+// permissions following Lotus's read, write, sign and admin scheme. Tokens are either listed in a tokens
+// file or, if a verifier is set, verified by the lotus node's AuthVerify so that the node's own tokens
+// may be used with the proxy.
+type ClientAuth struct {
+	tokens   map[[sha256.Size]byte]clientToken // keyed by hash of the token
+	verifier TokenVerifier
+	verified *lru.Cache // verifiedToken keyed by hash of the token
+}
+
+func NewClientAuth() *ClientAuth {
+	verified, _ := lru.New(clientAuthCacheSize)
+	return &ClientAuth{
+		tokens:   map[[sha256.Size]byte]clientToken{},
+		verified: verified,
+	}
+}
+
+// LoadTokens reads tokens from a file with one token per line in the form: perm token [name]. The
+// permission is one of read, write, sign or admin and, as with Lotus, includes the permissions before it.
+// The optional name is used to attribute the token's requests. Blank lines and lines starting with #
+// are ignored.
+func (a *ClientAuth) LoadTokens(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open tokens file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("line %d: expected perm token [name]", line)
+		}
+		perms, err := expandPerm(auth.Permission(fields[0]))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		t := clientToken{perms: perms}
+		if len(fields) == 3 {
+			t.name = sanitizeClientName(fields[2])
+		}
+		a.tokens[sha256.Sum256([]byte(fields[1]))] = t
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read tokens file: %w", err)
+	}
+	return nil
+}
+
+// SetVerifier verifies tokens not listed in a tokens file using v, normally the lotus node.
+func (a *ClientAuth) SetVerifier(v TokenVerifier) {
+	a.verifier = v
+}
+
+// expandPerm returns the permissions granted by a token with permission perm.
+func expandPerm(perm auth.Permission) ([]auth.Permission, error) {
+	for i, p := range apistruct.AllPermissions {
+		if p == perm {
+			return apistruct.AllPermissions[: i+1 : i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown permission %q", perm)
+}
+
+// Verify returns the name and permissions granted by a token. The name is empty if the token does not
+// carry one.
+func (a *ClientAuth) Verify(ctx context.Context, token string) (string, []auth.Permission, error) {
+	if token == "" {
+		return "", nil, ErrTokenRequired
+	}
+	key := sha256.Sum256([]byte(token))
+	if t, ok := a.tokens[key]; ok {
+		return t.name, t.perms, nil
+	}
+	if a.verifier == nil {
+		return "", nil, fmt.Errorf("unknown token")
+	}
+
+	if v, ok := a.verified.Get(key); ok && time.Now().Before(v.(verifiedToken).expires) {
+		return "", v.(verifiedToken).perms, v.(verifiedToken).err
+	}
+	perms, err := a.verifier.AuthVerify(ctx, token)
+	if err != nil {
+		err = fmt.Errorf("verify token with node: %w", err)
+		// Failures to reach the node say nothing about the token
+		if !isUpstreamUnavailable(err) && ctx.Err() == nil {
+			a.verified.Add(key, verifiedToken{err: err, expires: time.Now().Add(clientAuthFailureTTL)})
+		}
+		return "", nil, err
+	}
+	a.verified.Add(key, verifiedToken{perms: perms, expires: time.Now().Add(clientAuthCacheTTL)})
+	return "", perms, nil
+}
+
+type clientPermsKey struct{}
+
+// clientPerms returns the permissions granted to the client making the request carried by the context.
+func clientPerms(ctx context.Context) ([]auth.Permission, bool) {
+	perms, ok := ctx.Value(clientPermsKey{}).([]auth.Permission)
+	return perms, ok
+}
+
+// requireClientToken is middleware that rejects requests without a token accepted by the ClientAuth and
+// adds the token's permissions and name, if it has one, to the request's context. Rejected requests are recorded in the audit log,
+// if any.
+func requireClientToken(a *ClientAuth, al *AuditLog, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		name, perms, err := a.Verify(ctx, bearerToken(r))
+		if err != nil {
+			if al != nil {
+				al.Record(ctx, AuditEntry{Event: AuditAuthFailure, Error: err.Error()})
+			}
+			http.Error(w, ErrTokenRequired.Error(), http.StatusUnauthorized)
+			return
+		}
+		if name != "" {
+			ctx = withClientIdentity(ctx, name)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, clientPermsKey{}, perms)))
+	})
+}
+
+// PermPolicy is method middleware that only permits calls to methods whose permission is granted to the
+// caller's token. Calls without token permissions are rejected.
+func PermPolicy(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		perms, ok := clientPerms(ctx)
+		if !ok {
+			return nil, ErrTokenRequired
+		}
+		if !hasPerm(perms, call.Perm) {
+			return nil, fmt.Errorf("%w: %s requires %s permission", ErrPermDenied, call.Method, call.Perm)
+		}
+		return next(ctx, call)
+	}
+}
+
+func hasPerm(perms []auth.Permission, perm auth.Permission) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
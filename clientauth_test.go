@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/lotus/api/apistruct"
+)
+
+// countingVerifier accepts a single token, counting the tokens it is asked to verify.
+type countingVerifier struct {
+	token string
+	calls int
+}
+
+func (v *countingVerifier) AuthVerify(ctx context.Context, token string) ([]auth.Permission, error) {
+	v.calls++
+	if token != v.token {
+		return nil, errors.New("invalid token")
+	}
+	return []auth.Permission{apistruct.PermRead}, nil
+}
+
+func TestClientAuthCachesVerifications(t *testing.T) {
+	ctx := context.Background()
+	v := &countingVerifier{token: "good"}
+	a := NewClientAuth()
+	a.SetVerifier(v)
+
+	for i := 0; i < 3; i++ {
+		if _, perms, err := a.Verify(ctx, "good"); err != nil || !hasPerm(perms, apistruct.PermRead) {
+			t.Fatalf("Verify of an accepted token returned %v, %v, wanted read permission", perms, err)
+		}
+		if _, _, err := a.Verify(ctx, "bad"); err == nil {
+			t.Fatalf("Verify of a rejected token succeeded")
+		}
+	}
+	if v.calls != 2 {
+		t.Errorf("node was asked to verify tokens %d times, wanted once for each token", v.calls)
+	}
+}
+
+func TestRequireClientTokenName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte("read secret indexer\n"), 0o600); err != nil {
+		t.Fatalf("write tokens: %v", err)
+	}
+	a := NewClientAuth()
+	if err := a.LoadTokens(path); err != nil {
+		t.Fatalf("load tokens: %v", err)
+	}
+
+	var got string
+	h := identifyClient(map[string]bool{"explorer": true}, requireClientToken(a, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientName(r.Context())
+	})))
+	r := httptest.NewRequest(http.MethodPost, "/rpc/v0", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set(clientNameHeader, "explorer")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "indexer" {
+		t.Errorf("client name was %q, wanted the token's name %q", got, "indexer")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/iand/gonudb"
+	"github.com/iand/logfmtr"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/urfave/cli/v2"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+var exportCarCommand = &cli.Command{
+	Name:      "export-car",
+	Usage:     "Export the blocks held in the gonudb store to a CAR file. The store is opened read-only so the proxy may keep running.",
+	ArgsUsage: "<file.car>",
+	Flags: append(carStoreFlags,
+		&cli.StringFlag{
+			Name:  "tipset",
+			Usage: "Comma separated cids of the blocks of a tipset to root the export at. Only blocks in the store linked from the tipset, including its ancestors, are exported. Every block in the store is exported when not set.",
+		},
+		&cli.StringFlag{
+			Name:  "codec",
+			Usage: "Codec given to the cids of blocks when exporting every block in the store, which only records their hashes.",
+			Value: "dag-cbor",
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		if cc.NArg() != 1 {
+			return fmt.Errorf("expected the path of a CAR file, or - to write to stdout")
+		}
+
+		var roots []cid.Cid
+		if cc.String("tipset") != "" {
+			for _, s := range strings.Split(cc.String("tipset"), ",") {
+				c, err := cid.Decode(strings.TrimSpace(s))
+				if err != nil {
+					return fmt.Errorf("tipset: %w", err)
+				}
+				roots = append(roots, c)
+			}
+		}
+		codec, err := parseCodec(cc.String("codec"))
+		if err != nil {
+			return fmt.Errorf("codec: %w", err)
+		}
+
+		ctx := context.Background()
+		s, err := openCarStore(ctx, cc, true)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		var out io.Writer = os.Stdout
+		if path := cc.Args().First(); path != "-" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		w := bufio.NewWriterSize(out, 1<<20)
+
+		res, err := ExportCar(ctx, s, w, roots, codec)
+		if err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "exported %d blocks (%d bytes), %d linked blocks not in store\n", res.Exported, res.Size, res.Missing)
+		return nil
+	},
+}
+
+// CarExportResult counts the blocks written to a CAR file by ExportCar.
+type CarExportResult struct {
+	Exported int   // blocks written
+	Size     int64 // total size of the blocks written
+	Missing  int   // blocks linked from the roots that are not in the store
+}
+
+// ExportCar writes blocks held in the store to w in CAR format. When roots are given, the blocks reachable
+// from them through the links of dag-cbor blocks are written. Otherwise every block in the store is written
+// with a cid of the given codec, since the store only records the hashes of blocks, and the first block is
+// declared as the root.
+func ExportCar(ctx context.Context, s *ShardedStore, w io.Writer, roots []cid.Cid, codec uint64) (*CarExportResult, error) {
+	if len(roots) == 0 {
+		return exportStore(ctx, s, w, codec)
+	}
+
+	logger := logfmtr.NewNamed("export").V(LogLevelInfo)
+	res := &CarExportResult{}
+	if err := car.WriteHeader(&car.CarHeader{Roots: roots, Version: 1}, w); err != nil {
+		return res, fmt.Errorf("write car header: %w", err)
+	}
+
+	seen := map[string]bool{}
+	stack := append([]cid.Cid{}, roots...)
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		key := string(c.Hash())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if c.Prefix().MhType == mh.IDENTITY {
+			// The block's data is held in its cid
+			continue
+		}
+
+		r, err := s.FetchReader(key)
+		if err != nil {
+			if errors.Is(err, gonudb.ErrKeyNotFound) {
+				res.Missing++
+				continue
+			}
+			return res, fmt.Errorf("fetch %s: %w", c, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return res, fmt.Errorf("read %s: %w", c, err)
+		}
+		if err := util.LdWrite(w, c.Bytes(), data); err != nil {
+			return res, fmt.Errorf("write car block: %w", err)
+		}
+		res.Exported++
+		res.Size += int64(len(data))
+		if res.Exported%100000 == 0 {
+			logger.Info("Export progress", "exported", res.Exported, "size", res.Size, "missing", res.Missing)
+		}
+
+		if c.Type() == cid.DagCBOR {
+			if err := cbg.ScanForLinks(bytes.NewReader(data), func(l cid.Cid) {
+				stack = append(stack, l)
+			}); err != nil {
+				logger.Info("Failed to scan block for links", "cid", c.String(), "error", err.Error())
+			}
+		}
+	}
+	return res, nil
+}
+
+// exportStore writes every block in the store, skipping records duplicated across generations.
+func exportStore(ctx context.Context, s *ShardedStore, w io.Writer, codec uint64) (*CarExportResult, error) {
+	res := &CarExportResult{}
+	shards := s.Shards()
+
+	// A CAR file must declare at least one root
+	var root cid.Cid
+	for _, st := range shards {
+		rs := st.RecordScanner()
+		for rs.Next() {
+			if rs.IsData() {
+				root = cid.NewCidV1(codec, mh.Multihash(rs.Key()))
+				break
+			}
+		}
+		rs.Close()
+		if root.Defined() {
+			break
+		}
+	}
+	if !root.Defined() {
+		return res, fmt.Errorf("store is empty")
+	}
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, w); err != nil {
+		return res, fmt.Errorf("write car header: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for _, st := range shards {
+		rs := st.RecordScanner()
+		for rs.Next() {
+			if err := ctx.Err(); err != nil {
+				rs.Close()
+				return res, err
+			}
+			if !rs.IsData() || seen[rs.Key()] {
+				continue
+			}
+			seen[rs.Key()] = true
+
+			data, err := ioutil.ReadAll(rs.Reader())
+			if err != nil {
+				rs.Close()
+				return res, fmt.Errorf("read record: %w", err)
+			}
+			c := cid.NewCidV1(codec, mh.Multihash(rs.Key()))
+			if err := util.LdWrite(w, c.Bytes(), data); err != nil {
+				rs.Close()
+				return res, fmt.Errorf("write car block: %w", err)
+			}
+			res.Exported++
+			res.Size += int64(len(data))
+		}
+		err := rs.Err()
+		rs.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return res, fmt.Errorf("scan records: %w", err)
+		}
+	}
+	return res, nil
+}
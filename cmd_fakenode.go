@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/apistruct"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/iand/logfmtr"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car"
+	"github.com/urfave/cli/v2"
+)
+
+var fakeNodeCommand = &cli.Command{
+	Name:      "fake-node",
+	Usage:     "Serve a chain read from a CAR file, such as a chain export, over the lotus jsonrpc api so the proxy can be developed and tried without a live lotus node.",
+	ArgsUsage: "<car file>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "listen",
+			Usage: "Address to serve the jsonrpc api on, at /rpc/v0 as served by lotus.",
+			Value: "127.0.0.1:1234",
+		},
+		&cli.Int64Flag{
+			Name:  "start-height",
+			Usage: "Height of the first head reported, -1 for the head of the chain in the CAR file. When lower than the head of the chain the head advances by one tipset every block-interval until it is reached.",
+			Value: -1,
+		},
+		&cli.DurationFlag{
+			Name:  "block-interval",
+			Usage: "Time between advances of the head when start-height is below the head of the chain.",
+			Value: 30 * time.Second,
+		},
+	},
+	Action: func(cc *cli.Context) error {
+		if cc.NArg() != 1 {
+			return fmt.Errorf("expected the path of a CAR file")
+		}
+		f, err := os.Open(cc.Args().First())
+		if err != nil {
+			return err
+		}
+		node, err := LoadFakeNode(bufio.NewReaderSize(f, 1<<20))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("load chain: %w", err)
+		}
+
+		logger := logfmtr.NewNamed("fake-node")
+		ctx, cancel := context.WithCancel(cc.Context)
+		defer cancel()
+
+		if h := cc.Int64("start-height"); h >= 0 {
+			if err := node.SetHead(abi.ChainEpoch(h)); err != nil {
+				return fmt.Errorf("start-height: %w", err)
+			}
+			go node.Advance(ctx, cc.Duration("block-interval"))
+		}
+
+		head, _ := node.ChainHead(ctx)
+		logger.Info("Serving chain", "addr", cc.String("listen"), "blocks", len(node.blocks), "tipsets", len(node.tipsets), "genesis", node.genesis.Height(), "head", head.Height())
+
+		go func() {
+			interrupt := make(chan os.Signal, 1)
+			signal.Notify(interrupt, syscall.SIGTERM, syscall.SIGINT)
+			select {
+			case <-interrupt:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		srv := &http.Server{Addr: cc.String("listen"), Handler: node.Handler()}
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+}
+
+// FakeNode serves a fixed chain held in memory through the subset of the lotus FullNode api used to read the
+// chain, so that the proxy and its caches can be exercised deterministically without a live node. Calls to
+// other methods fail. The head may be moved back to replay the chain, notifying subscribers as it advances.
+type FakeNode struct {
+	blocks   map[cid.Cid][]byte
+	tipsets  map[types.TipSetKey]*types.TipSet
+	byHeight map[abi.ChainEpoch]*types.TipSet
+	genesis  *types.TipSet // lowest tipset held, the genesis tipset for a full export
+	last     *types.TipSet // head of the chain read
+
+	mu   sync.Mutex // guards fields below
+	head *types.TipSet
+	subs map[chan []*api.HeadChange]struct{}
+}
+
+// LoadFakeNode reads a CAR file whose roots are the block headers of a tipset, such as one written by lotus
+// chain export, and follows the parents of the tipset until they are missing from the file.
+func LoadFakeNode(r io.Reader) (*FakeNode, error) {
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return nil, err
+	}
+	n := &FakeNode{
+		blocks:   map[cid.Cid][]byte{},
+		tipsets:  map[types.TipSetKey]*types.TipSet{},
+		byHeight: map[abi.ChainEpoch]*types.TipSet{},
+		subs:     map[chan []*api.HeadChange]struct{}{},
+	}
+	for {
+		blk, err := cr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		n.blocks[blk.Cid()] = blk.RawData()
+	}
+
+	ts, err := n.loadTipSet(cr.Header.Roots)
+	if err != nil {
+		return nil, fmt.Errorf("roots of the CAR file are not the headers of a tipset: %w", err)
+	}
+	n.last = ts
+	n.head = ts
+	for {
+		n.tipsets[ts.Key()] = ts
+		n.byHeight[ts.Height()] = ts
+		n.genesis = ts
+		if ts.Height() == 0 {
+			break
+		}
+		parent, err := n.loadTipSet(ts.Parents().Cids())
+		if err != nil {
+			break
+		}
+		ts = parent
+	}
+	return n, nil
+}
+
+// loadTipSet assembles the tipset made of the given block headers.
+func (n *FakeNode) loadTipSet(cids []cid.Cid) (*types.TipSet, error) {
+	headers := make([]*types.BlockHeader, 0, len(cids))
+	for _, c := range cids {
+		data, ok := n.blocks[c]
+		if !ok {
+			return nil, fmt.Errorf("block %s not found", c)
+		}
+		bh, err := types.DecodeBlock(data)
+		if err != nil {
+			return nil, fmt.Errorf("decode block %s: %w", c, err)
+		}
+		headers = append(headers, bh)
+	}
+	return types.NewTipSet(headers)
+}
+
+// Handler returns an http handler serving the api at /rpc/v0.
+func (n *FakeNode) Handler() http.Handler {
+	var full apistruct.FullNodeStruct
+	bindMethods(&full.CommonStruct.Internal, n, fakeNodeUnsupported, nil)
+	bindMethods(&full.Internal, n, fakeNodeUnsupported, nil)
+
+	rpcServer := jsonrpc.NewServer()
+	rpcServer.Register("Filecoin", &full)
+
+	mux := http.NewServeMux()
+	mux.Handle("/rpc/v0", rpcServer)
+	return mux
+}
+
+func fakeNodeUnsupported(ctx context.Context, call *MethodCall) (interface{}, error) {
+	return nil, fmt.Errorf("method %s is not supported by the fake node", call.Method)
+}
+
+// SetHead moves the head back to the tipset at height h, or the first tipset below it.
+func (n *FakeNode) SetHead(h abi.ChainEpoch) error {
+	ts, err := n.tipSetByHeight(h, n.last)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.head = ts
+	return nil
+}
+
+// Advance moves the head forward by one tipset every interval until it reaches the head of the chain read or
+// the context is cancelled, sending each new head to subscribers as an apply change.
+func (n *FakeNode) Advance(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		var next *types.TipSet
+		for h := n.head.Height() + 1; h <= n.last.Height(); h++ {
+			if ts, ok := n.byHeight[h]; ok {
+				next = ts
+				break
+			}
+		}
+		if next == nil {
+			n.mu.Unlock()
+			return
+		}
+		n.head = next
+		for ch := range n.subs {
+			select {
+			case ch <- []*api.HeadChange{{Type: "apply", Val: next}}:
+			default:
+				// Drop slow subscribers as lotus does
+				delete(n.subs, ch)
+				close(ch)
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// tipSetByHeight returns the tipset at height h, or the first tipset below it if h is a null round, that is
+// an ancestor of ts.
+func (n *FakeNode) tipSetByHeight(h abi.ChainEpoch, ts *types.TipSet) (*types.TipSet, error) {
+	if h > ts.Height() {
+		return nil, fmt.Errorf("looking for tipset with height greater than start point")
+	}
+	for hh := h; hh >= n.genesis.Height(); hh-- {
+		if found, ok := n.byHeight[hh]; ok {
+			return found, nil
+		}
+	}
+	return nil, fmt.Errorf("tipset at height %d is not held by the fake node", h)
+}
+
+func (n *FakeNode) AuthVerify(ctx context.Context, token string) ([]auth.Permission, error) {
+	return []auth.Permission{apistruct.PermRead}, nil
+}
+
+func (n *FakeNode) Version(ctx context.Context) (api.Version, error) {
+	return api.Version{
+		Version:    "fake-node",
+		APIVersion: build.FullAPIVersion,
+		BlockDelay: build.BlockDelaySecs,
+	}, nil
+}
+
+func (n *FakeNode) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.head, nil
+}
+
+func (n *FakeNode) ChainNotify(ctx context.Context) (<-chan []*api.HeadChange, error) {
+	ch := make(chan []*api.HeadChange, 16)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch <- []*api.HeadChange{{Type: "current", Val: n.head}}
+	n.subs[ch] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if _, ok := n.subs[ch]; ok {
+			delete(n.subs, ch)
+			close(ch)
+		}
+	}()
+	return ch, nil
+}
+
+func (n *FakeNode) ChainGetGenesis(ctx context.Context) (*types.TipSet, error) {
+	if n.genesis.Height() != 0 {
+		return nil, fmt.Errorf("genesis is not held by the fake node")
+	}
+	return n.genesis, nil
+}
+
+func (n *FakeNode) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	if tsk == types.EmptyTSK {
+		return n.ChainHead(ctx)
+	}
+	ts, ok := n.tipsets[tsk]
+	if !ok {
+		return nil, fmt.Errorf("tipset %s not found", tsk)
+	}
+	return ts, nil
+}
+
+func (n *FakeNode) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	ts, err := n.ChainGetTipSet(ctx, tsk)
+	if err != nil {
+		return nil, err
+	}
+	return n.tipSetByHeight(h, ts)
+}
+
+func (n *FakeNode) ChainGetBlock(ctx context.Context, c cid.Cid) (*types.BlockHeader, error) {
+	data, ok := n.blocks[c]
+	if !ok {
+		return nil, fmt.Errorf("block %s not found", c)
+	}
+	return types.DecodeBlock(data)
+}
+
+func (n *FakeNode) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	data, ok := n.blocks[c]
+	if !ok {
+		return nil, blockstore.ErrNotFound
+	}
+	return data, nil
+}
+
+func (n *FakeNode) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	_, ok := n.blocks[c]
+	return ok, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/iand/gonudb"
+	"github.com/iand/logfmtr"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/urfave/cli/v2"
+)
+
+var importCarCommand = &cli.Command{
+	Name:      "import-car",
+	Usage:     "Import the blocks of a CAR file, such as a chain export, into the gonudb store. The proxy must not be running against the store.",
+	ArgsUsage: "<file.car>",
+	Flags: append(carStoreFlags,
+		&cli.IntFlag{
+			Name:  "flush-every",
+			Usage: "Number of blocks imported between flushes of the store.",
+			Value: 10000,
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		if cc.NArg() != 1 {
+			return fmt.Errorf("expected the path of a CAR file, or - to read from stdin")
+		}
+		if cc.Int("flush-every") < 1 {
+			return fmt.Errorf("flush-every must be at least 1")
+		}
+
+		var in io.Reader = os.Stdin
+		if path := cc.Args().First(); path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+
+		ctx := context.Background()
+		s, err := openCarStore(ctx, cc, false)
+		if err != nil {
+			return err
+		}
+
+		res, importErr := ImportCar(ctx, s, bufio.NewReaderSize(in, 1<<20), cc.Int("flush-every"))
+		if err := s.Close(); err != nil && importErr == nil {
+			importErr = fmt.Errorf("close store: %w", err)
+		}
+		fmt.Printf("imported %d blocks (%d bytes), %d already present, %d skipped\n", res.Imported, res.Size, res.Existing, res.Skipped)
+		return importErr
+	},
+}
+
+// carStoreFlags are the flags used by the CAR commands to locate the gonudb store.
+var carStoreFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:     "store",
+		Usage:    "Path to directory containing gonudb store. May be repeated, giving the directories in the same order as the proxy.",
+		EnvVars:  []string{"LOTUS_CPR_STORE_PATH"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:    "store-rotate",
+		Usage:   "Schedule the store is rotated on, daily or weekly. Blocks are imported into the current generation and exported from every kept generation.",
+		EnvVars: []string{"LOTUS_CPR_STORE_ROTATE"},
+	},
+	&cli.IntFlag{
+		Name:    "store-generations",
+		Usage:   "Number of store generations kept when rotating the store, including the current generation.",
+		Value:   2,
+		EnvVars: []string{"LOTUS_CPR_STORE_GENERATIONS"},
+	},
+}
+
+// openCarStore opens the gonudb store given by carStoreFlags.
+func openCarStore(ctx context.Context, cc *cli.Context, readOnly bool) (*ShardedStore, error) {
+	var (
+		s   *ShardedStore
+		err error
+	)
+	if cc.String("store-rotate") != "" {
+		if !ValidStoreRotate(cc.String("store-rotate")) {
+			return nil, fmt.Errorf("store-rotate: unknown schedule %q", cc.String("store-rotate"))
+		}
+		if cc.Int("store-generations") < 1 {
+			return nil, fmt.Errorf("store-generations must be at least 1")
+		}
+		s, err = NewStoreRotator(cc.StringSlice("store"), cc.String("store-rotate"), cc.Int("store-generations"), readOnly, logfmtr.NewNamed("gonudb")).Open(ctx)
+	} else {
+		s, err = openShardedStore(ctx, cc.StringSlice("store"), readOnly)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gonudb store: %w", err)
+	}
+	return s, nil
+}
+
+// CarImportResult counts the blocks read from a CAR file by ImportCar.
+type CarImportResult struct {
+	Imported int       // blocks inserted into the store
+	Size     int64     // total size of the blocks inserted
+	Existing int       // blocks already held by the store
+	Skipped  int       // zero sized blocks and blocks whose data does not match their cid
+	Roots    []cid.Cid // roots declared by the CAR file
+}
+
+// ImportCar inserts the blocks read from a CAR file into the store, flushing it after every flushEvery
+// blocks and once all blocks have been read. Blocks are verified against their cids since records cannot
+// be deleted from the store.
+func ImportCar(ctx context.Context, s *ShardedStore, r io.Reader, flushEvery int) (*CarImportResult, error) {
+	logger := logfmtr.NewNamed("import").V(LogLevelInfo)
+	res := &CarImportResult{}
+
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return res, fmt.Errorf("read car header: %w", err)
+	}
+	logger.Info("Importing CAR file", "roots", cr.Header.Roots)
+	res.Roots = cr.Header.Roots
+
+	pending := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		blk, err := cr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return res, fmt.Errorf("read car block: %w", err)
+		}
+
+		data := blk.RawData()
+		// gonudb doesn't support zero sized blocks
+		if len(data) == 0 {
+			res.Skipped++
+			continue
+		}
+		chkc, err := blk.Cid().Prefix().Sum(data)
+		if err != nil || !chkc.Equals(blk.Cid()) {
+			logger.Info("Skipping block that does not match its cid", "cid", blk.Cid().String())
+			res.Skipped++
+			continue
+		}
+
+		if err := s.Insert(string(blk.Cid().Hash()), data); err != nil {
+			if errors.Is(err, gonudb.ErrKeyExists) {
+				res.Existing++
+				continue
+			}
+			return res, fmt.Errorf("insert %s: %w", blk.Cid(), err)
+		}
+		res.Imported++
+		res.Size += int64(len(data))
+
+		pending++
+		if pending >= flushEvery {
+			if err := s.Flush(); err != nil {
+				return res, fmt.Errorf("flush: %w", err)
+			}
+			pending = 0
+			logger.Info("Import progress", "imported", res.Imported, "size", res.Size, "existing", res.Existing, "skipped", res.Skipped)
+		}
+	}
+
+	if err := s.Flush(); err != nil {
+		return res, fmt.Errorf("flush: %w", err)
+	}
+	return res, nil
+}
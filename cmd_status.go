@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var statusCommand = &cli.Command{
+	Name:  "status",
+	Usage: "Display the live status of a running proxy.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "endpoint",
+			Usage:   "Address of the diagnostics server of the proxy.",
+			Value:   "localhost:33112",
+			EnvVars: []string{"LOTUS_CPR_STATUS_ENDPOINT"},
+		},
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "Time between status updates.",
+			Value: 2 * time.Second,
+		},
+		&cli.BoolFlag{
+			Name:  "once",
+			Usage: "Print the status once and exit instead of displaying a live view.",
+		},
+	},
+	Action: func(cc *cli.Context) error {
+		url := cc.String("endpoint")
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		url = strings.TrimSuffix(url, "/") + "/status"
+
+		hc := &http.Client{Timeout: 10 * time.Second}
+
+		var prev *Status
+		for {
+			st, err := fetchStatus(hc, url)
+			if cc.Bool("once") {
+				if err != nil {
+					return err
+				}
+				renderStatus(os.Stdout, url, st, nil, nil)
+				return nil
+			}
+
+			// Clear the screen and move the cursor to the top left before redrawing
+			fmt.Fprint(os.Stdout, "\x1b[H\x1b[2J")
+			renderStatus(os.Stdout, url, st, prev, err)
+			if err == nil {
+				prev = st
+			}
+
+			select {
+			case <-time.After(cc.Duration("interval")):
+			case <-cc.Context.Done():
+				return nil
+			}
+		}
+	},
+}
+
+func fetchStatus(hc *http.Client, url string) (*Status, error) {
+	resp, err := hc.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, url)
+	}
+
+	var st Status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("decode status: %w", err)
+	}
+	return &st, nil
+}
+
+// renderStatus writes a status report. When prev is not nil the growth of the store since the previous
+// report is included. If err is not nil it is shown in place of the status.
+func renderStatus(w io.Writer, url string, st *Status, prev *Status, err error) {
+	fmt.Fprintf(w, "lotus-cpr status  %s  %s\n\n", url, time.Now().Format(time.RFC3339))
+	if err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+
+	fmt.Fprintln(w, "Upstream")
+	if st.HeadError != "" {
+		fmt.Fprintf(w, "  head       unknown (%s)\n", st.HeadError)
+	} else {
+		fmt.Fprintf(w, "  head       %d (lag %s)\n", st.HeadHeight, time.Duration(st.HeadLag*float64(time.Second)).Round(time.Second))
+	}
+	fmt.Fprintf(w, "  circuit    %s\n", st.Circuit)
+	fmt.Fprintf(w, "  in flight  %d\n\n", st.InFlight)
+
+	fmt.Fprintln(w, "Caches")
+	fmt.Fprintf(w, "  %-10s %12s %12s %10s %10s %12s\n", "tier", "requests", "hits", "hit rate", "failures", "fills/sec")
+	names := make([]string, 0, len(st.Caches))
+	for name := range st.Caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cs := st.Caches[name]
+		fmt.Fprintf(w, "  %-10s %12d %12d %9.1f%% %10d %12.2f\n", name, cs.Requests, cs.Hits, cs.HitRate*100, cs.Failures, cs.FillsPerSec)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "Store")
+	fmt.Fprintf(w, "  records    %d\n", st.StoreRecords)
+	fmt.Fprintf(w, "  size       %s\n", formatBytes(st.StoreBytes))
+	if prev != nil {
+		if elapsed := st.Time.Sub(prev.Time).Seconds(); elapsed > 0 {
+			fmt.Fprintf(w, "  growth     %.1f records/sec, %s/sec\n", float64(st.StoreRecords-prev.StoreRecords)/elapsed, formatBytes(int64(float64(st.StoreBytes-prev.StoreBytes)/elapsed)))
+		}
+	}
+	if len(st.Covered) > 0 {
+		fmt.Fprintf(w, "  covered    %s\n", formatRanges(st.Covered))
+	}
+	if len(st.Absent) > 0 {
+		fmt.Fprintf(w, "  absent     %s\n", formatRanges(st.Absent))
+	}
+}
+
+func formatRanges(rs []EpochRange) string {
+	parts := make([]string, len(rs))
+	for i, r := range rs {
+		parts[i] = fmt.Sprintf("%d-%d", r.Low, r.High)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit || m <= -unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/iand/gonudb"
+	"github.com/urfave/cli/v2"
+)
+
+// Sizes of the structures in gonudb files.
+const (
+	gonudbDatHeaderSize    = 92  // header at the start of a data file
+	gonudbKeyHeaderSize    = 104 // header at the start of a key file
+	gonudbBucketHeaderSize = 8   // key count and spill offset at the start of a bucket
+	gonudbBucketEntrySize  = 18  // offset, size and hash of a key in a bucket
+)
+
+// storeRepairDir is the directory within a store that a repaired store is built in before it replaces the
+// store's files.
+const storeRepairDir = "repair"
+
+var storeCommand = &cli.Command{
+	Name:  "store",
+	Usage: "Inspect and maintain gonudb stores while the proxy is not using them.",
+	Subcommands: []*cli.Command{
+		storeVerifyCommand,
+		storeStatsCommand,
+	},
+}
+
+var storeVerifyCommand = &cli.Command{
+	Name:  "verify",
+	Usage: "Read every record of the gonudb store, checking that its data hashes to its key and that it can be found through the key file.",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:     "store",
+			Usage:    "Path to directory containing gonudb store. May be repeated to verify each shard of a store or each generation of a rotated store.",
+			EnvVars:  []string{"LOTUS_CPR_STORE_PATH"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "quarantine",
+			Usage: "Path to a file that records whose data does not match their key are appended to as JSON lines.",
+		},
+		&cli.BoolFlag{
+			Name:  "repair",
+			Usage: "Rebuild the store from the records in its data file whose data matches their key, removing mismatched records and replacing a damaged key file.",
+		},
+		&cli.IntFlag{
+			Name:  "flush-every",
+			Usage: "Number of records written to a repaired store between flushes.",
+			Value: 10000,
+		},
+	},
+	Action: func(cc *cli.Context) error {
+		if cc.Int("flush-every") < 1 {
+			return fmt.Errorf("flush-every must be at least 1")
+		}
+
+		var quarantine io.Writer
+		if path := cc.String("quarantine"); path != "" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+			if err != nil {
+				return fmt.Errorf("open quarantine file: %w", err)
+			}
+			defer f.Close()
+			quarantine = f
+		}
+
+		ctx := context.Background()
+		failed := false
+		for _, path := range cc.StringSlice("store") {
+			res, err := VerifyStore(ctx, path, quarantine, cc.Bool("repair"), cc.Int("flush-every"))
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			fmt.Printf("%s: %d records (%d bytes), %d with mismatched data, %d missing from the key file", path, res.Records, res.Size, res.BadHash, res.Unindexed)
+			if res.Truncated {
+				fmt.Printf(", data file ends with a partially written record")
+			}
+			if res.KeyFileErr != nil {
+				fmt.Printf(", key file unusable: %v", res.KeyFileErr)
+			}
+			if cc.Bool("repair") {
+				fmt.Printf(", rebuilt with %d records", res.Kept)
+			}
+			fmt.Println()
+			if !cc.Bool("repair") && res.Problems() > 0 {
+				failed = true
+			}
+		}
+		if failed {
+			return fmt.Errorf("store verification found problems, run with --repair to rebuild the store")
+		}
+		return nil
+	},
+}
+
+var storeStatsCommand = &cli.Command{
+	Name:  "stats",
+	Usage: "Print the number and sizes of the records in the gonudb store, when they were inserted and how full the buckets of its key file are, for capacity planning.",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:     "store",
+			Usage:    "Path to directory containing gonudb store. May be repeated to report on each shard of a store or each generation of a rotated store.",
+			EnvVars:  []string{"LOTUS_CPR_STORE_PATH"},
+			Required: true,
+		},
+	},
+	Action: func(cc *cli.Context) error {
+		for i, path := range cc.StringSlice("store") {
+			st, err := ReadStoreStats(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if i > 0 {
+				fmt.Println()
+			}
+			printStoreStats(os.Stdout, path, st)
+		}
+		return nil
+	},
+}
+
+// StoreVerifyResult reports the outcome of verifying a single gonudb store.
+type StoreVerifyResult struct {
+	Records    int   // data records read from the data file
+	Size       int64 // total size of the data of the records
+	BadHash    int   // records whose data does not hash to their key
+	Unindexed  int   // records that could not be fetched using the key file
+	Truncated  bool  // the data file ends with a partially written record
+	KeyFileErr error // the error opening the store, if its key file could not be used
+	Kept       int   // records written to the repaired store
+}
+
+// Problems returns the number of problems found with the store.
+func (r *StoreVerifyResult) Problems() int {
+	n := r.BadHash + r.Unindexed
+	if r.Truncated {
+		n++
+	}
+	if r.KeyFileErr != nil {
+		n++
+	}
+	return n
+}
+
+// quarantinedRecord is written to the quarantine file for each record whose data does not match its key.
+type quarantinedRecord struct {
+	Store string `json:"store"`
+	Key   string `json:"key"` // hex encoded
+	Data  []byte `json:"data"`
+}
+
+// VerifyStore reads every record in the data file of the gonudb store in path, which must not be in use,
+// checking that its data hashes to its key and that the record can be fetched using the key file. Records
+// whose data does not match are written to quarantine if it is not nil. When repair is true the store is
+// rebuilt from the records that match, which also replaces a key file damaged by a crash.
+func VerifyStore(ctx context.Context, path string, quarantine io.Writer, repair bool, flushEvery int) (*StoreVerifyResult, error) {
+	res := &StoreVerifyResult{}
+
+	// The store is opened only to check the key file, the records are read from the data file directly so
+	// they can be recovered when the key file is unusable
+	st, err := openStore(ctx, path, true)
+	if err != nil {
+		res.KeyFileErr = err
+	}
+	defer func() {
+		if st != nil {
+			st.Close()
+		}
+	}()
+
+	var rebuilt *gonudb.Store
+	if repair {
+		rebuilt, err = createRepairStore(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if rebuilt != nil {
+				rebuilt.Close()
+			}
+		}()
+	}
+
+	var enc *json.Encoder
+	if quarantine != nil {
+		enc = json.NewEncoder(quarantine)
+	}
+	res.Truncated, err = scanDataFile(filepath.Join(path, "blocks.dat"), func(key string, data []byte) error {
+		res.Records++
+		res.Size += int64(len(data))
+
+		if !verifyRecordHash(key, data) {
+			res.BadHash++
+			if enc != nil {
+				if err := enc.Encode(quarantinedRecord{Store: path, Key: hex.EncodeToString([]byte(key)), Data: data}); err != nil {
+					return fmt.Errorf("write quarantine file: %w", err)
+				}
+			}
+			return nil
+		}
+
+		if st != nil {
+			if _, err := st.FetchReader(key); err != nil {
+				res.Unindexed++
+			}
+		}
+
+		if rebuilt != nil {
+			if err := rebuilt.Insert(key, data); err != nil {
+				if errors.Is(err, gonudb.ErrKeyExists) {
+					return nil
+				}
+				return fmt.Errorf("insert into repaired store: %w", err)
+			}
+			res.Kept++
+			if res.Kept%flushEvery == 0 {
+				if err := rebuilt.Flush(); err != nil {
+					return fmt.Errorf("flush repaired store: %w", err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rebuilt != nil {
+		if err := rebuilt.Flush(); err != nil {
+			return nil, fmt.Errorf("flush repaired store: %w", err)
+		}
+		err := rebuilt.Close()
+		rebuilt = nil
+		if err != nil {
+			return nil, fmt.Errorf("close repaired store: %w", err)
+		}
+		if st != nil {
+			st.Close()
+			st = nil
+		}
+		if err := replaceStoreFiles(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// createRepairStore creates an empty store in the repair directory of the store in path, removing any left
+// by an interrupted repair.
+func createRepairStore(ctx context.Context, path string) (*gonudb.Store, error) {
+	dir := filepath.Join(path, storeRepairDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("remove previous repair: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create repair directory: %w", err)
+	}
+	st, err := openStore(ctx, dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("create repaired store: %w", err)
+	}
+	return st, nil
+}
+
+// replaceStoreFiles replaces the data and key files of the store in path with those of the repaired store
+// and removes the log file, which describes the replaced files.
+func replaceStoreFiles(path string) error {
+	dir := filepath.Join(path, storeRepairDir)
+	for _, name := range []string{"blocks.dat", "blocks.key"} {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(path, name)); err != nil {
+			return fmt.Errorf("replace %s: %w", name, err)
+		}
+	}
+	if err := os.Remove(filepath.Join(path, "blocks.log")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove log file: %w", err)
+	}
+	return os.RemoveAll(dir)
+}
+
+// StoreStats describes the contents of a single gonudb store.
+type StoreStats struct {
+	Records   int       // data records in the data file
+	Size      int64     // total size of the data of the records
+	MaxSize   int64     // size of the largest record
+	Sizes     [64]int   // number of records by size class, class n holds sizes up to 2^n bytes
+	Truncated bool      // the data file ends with a partially written record
+	DataBytes int64     // size of the data file
+	KeyBytes  int64     // size of the key file
+	Timed     int       // records with a recorded insert time
+	Oldest    time.Time // earliest recorded insert time
+	Newest    time.Time // latest recorded insert time
+
+	KeyFileErr     error // the error reading the key file, if it could not be read
+	Buckets        int   // buckets in the key file
+	BucketCapacity int   // maximum number of keys held by a bucket before it spills
+	Keys           int   // keys held in buckets, excluding spills
+	EmptyBuckets   int   // buckets holding no keys
+	FullBuckets    int   // buckets holding as many keys as they can
+	Spills         int   // bucket spills reachable from the key file
+	SpillKeys      int   // keys held in spills
+	MaxChain       int   // most keys held by a bucket and its spills
+}
+
+// Load returns the fraction of the capacity of the buckets in the key file that is used, excluding spills.
+func (s *StoreStats) Load() float64 {
+	if s.Buckets == 0 || s.BucketCapacity == 0 {
+		return 0
+	}
+	return float64(s.Keys) / float64(s.Buckets*s.BucketCapacity)
+}
+
+// ReadStoreStats reads every record in the data file of the gonudb store in path and the buckets of its key
+// file. Insert times are taken from the record times sidecar file when the store has one.
+func ReadStoreStats(path string) (*StoreStats, error) {
+	st := &StoreStats{}
+
+	for name, n := range map[string]*int64{"blocks.dat": &st.DataBytes, "blocks.key": &st.KeyBytes} {
+		if fi, err := os.Stat(filepath.Join(path, name)); err == nil {
+			*n = fi.Size()
+		}
+	}
+
+	times, err := readRecordTimes(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	st.Truncated, err = scanDataFile(filepath.Join(path, "blocks.dat"), func(key string, data []byte) error {
+		size := int64(len(data))
+		st.Records++
+		st.Size += size
+		if size > st.MaxSize {
+			st.MaxSize = size
+		}
+		st.Sizes[bits.Len64(uint64(size-1))]++
+
+		if rt, ok := times[key]; ok && !rt.Inserted.IsZero() {
+			st.Timed++
+			if st.Oldest.IsZero() || rt.Inserted.Before(st.Oldest) {
+				st.Oldest = rt.Inserted
+			}
+			if rt.Inserted.After(st.Newest) {
+				st.Newest = rt.Inserted
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := readBucketLoad(path, st); err != nil {
+		st.KeyFileErr = err
+	}
+	return st, nil
+}
+
+// readBucketLoad reads the buckets of the key file of the store in path and follows their spills into the
+// data file, recording how full they are in st. The files are read directly since gonudb's bucket scanner
+// does not report the keys held by buckets.
+func readBucketLoad(path string, st *StoreStats) error {
+	kf, err := os.Open(filepath.Join(path, "blocks.key"))
+	if err != nil {
+		return fmt.Errorf("open key file: %w", err)
+	}
+	defer kf.Close()
+	df, err := os.Open(filepath.Join(path, "blocks.dat"))
+	if err != nil {
+		return fmt.Errorf("open data file: %w", err)
+	}
+	defer df.Close()
+	r := bufio.NewReaderSize(kf, 1<<20)
+
+	hdr := make([]byte, gonudbKeyHeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return fmt.Errorf("read key file header: %w", err)
+	}
+	if !bytes.Equal(hdr[:8], []byte("gonudbky")) {
+		return fmt.Errorf("not a gonudb key file")
+	}
+	blockSize := int(binary.BigEndian.Uint16(hdr[44:46]))
+	if blockSize < gonudbBucketHeaderSize+gonudbBucketEntrySize {
+		return fmt.Errorf("invalid block size %d in key file", blockSize)
+	}
+	st.BucketCapacity = (blockSize - gonudbBucketHeaderSize) / gonudbBucketEntrySize
+
+	// Each bucket begins with a 2 byte big endian count of its keys followed by the 6 byte little endian
+	// offset in the data file of the spill holding the keys that did not fit, which begins the same way
+	// after the 8 byte header of the spill record
+	block := make([]byte, blockSize)
+	var bh [8 + gonudbBucketHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("read key file: %w", err)
+		}
+		count := int(binary.BigEndian.Uint16(block[:2]))
+		st.Buckets++
+		st.Keys += count
+		if count == 0 {
+			st.EmptyBuckets++
+		}
+		if count >= st.BucketCapacity {
+			st.FullBuckets++
+		}
+
+		chain := count
+		spill := decodeUint48(block[2:8])
+		for spill != 0 {
+			if _, err := df.ReadAt(bh[:], int64(spill)); err != nil {
+				return fmt.Errorf("read spill at %d: %w", spill, err)
+			}
+			if decodeUint48(bh[:6]) != 0 {
+				return fmt.Errorf("invalid spill at %d", spill)
+			}
+			n := int(binary.BigEndian.Uint16(bh[8:10]))
+			st.Spills++
+			st.SpillKeys += n
+			chain += n
+			spill = decodeUint48(bh[10:16])
+		}
+		if chain > st.MaxChain {
+			st.MaxChain = chain
+		}
+	}
+}
+
+// decodeUint48 decodes a 6 byte little endian integer as written by gonudb.
+func decodeUint48(b []byte) uint64 {
+	var buf [8]byte
+	copy(buf[:], b[:6])
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+func printStoreStats(w io.Writer, path string, st *StoreStats) {
+	fmt.Fprintln(w, path)
+	fmt.Fprintf(w, "  records    %d\n", st.Records)
+	fmt.Fprintf(w, "  size       %s of data, %s data file, %s key file\n", formatBytes(st.Size), formatBytes(st.DataBytes), formatBytes(st.KeyBytes))
+	if st.Records > 0 {
+		fmt.Fprintf(w, "  record     %s average, %s largest\n", formatBytes(st.Size/int64(st.Records)), formatBytes(st.MaxSize))
+	}
+	if st.Truncated {
+		fmt.Fprintln(w, "  warning    data file ends with a partially written record, run store verify")
+	}
+	if st.Timed > 0 {
+		fmt.Fprintf(w, "  inserted   %s to %s (%d records with times)\n", st.Oldest.UTC().Format(time.RFC3339), st.Newest.UTC().Format(time.RFC3339), st.Timed)
+	} else {
+		fmt.Fprintln(w, "  inserted   unknown, no insert times recorded")
+	}
+
+	if st.Records > 0 {
+		fmt.Fprintln(w, "  sizes")
+		for n, count := range st.Sizes {
+			if count == 0 {
+				continue
+			}
+			lo := int64(1)
+			if n > 0 {
+				lo = 1<<uint(n-1) + 1
+			}
+			fmt.Fprintf(w, "    %10s - %-10s %12d %6.1f%%\n", formatBytes(lo), formatBytes(1<<uint(n)), count, float64(count)*100/float64(st.Records))
+		}
+	}
+
+	if st.KeyFileErr != nil {
+		fmt.Fprintf(w, "  buckets    unknown, key file unusable: %v\n", st.KeyFileErr)
+		return
+	}
+	fmt.Fprintf(w, "  buckets    %d holding up to %d keys, %d keys, %.1f%% load\n", st.Buckets, st.BucketCapacity, st.Keys, st.Load()*100)
+	fmt.Fprintf(w, "  spills     %d holding %d keys, %d full buckets, %d empty buckets, at most %d keys in a bucket\n", st.Spills, st.SpillKeys, st.FullBuckets, st.EmptyBuckets, st.MaxChain)
+}
+
+// scanDataFile calls fn with the key and data of each data record in the gonudb data file at path, in the
+// order they were written, skipping bucket spills. It reports whether the file ends with a record that was
+// only partially written, such as by a crash, which is not passed to fn.
+func scanDataFile(path string, fn func(key string, data []byte) error) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("open data file: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1<<20)
+
+	hdr := make([]byte, gonudbDatHeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return false, fmt.Errorf("read data file header: %w", err)
+	}
+	if !bytes.Equal(hdr[:8], []byte("gonudbdt")) {
+		return false, fmt.Errorf("not a gonudb data file")
+	}
+
+	var rh [8]byte // 6 byte little endian data size followed by a 2 byte big endian key or spill size
+	for {
+		if _, err := io.ReadFull(r, rh[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return true, nil
+			}
+			return false, fmt.Errorf("read data file: %w", err)
+		}
+		var sizeBuf [8]byte
+		copy(sizeBuf[:], rh[:6])
+		size := binary.LittleEndian.Uint64(sizeBuf[:])
+		n := binary.BigEndian.Uint16(rh[6:])
+
+		if size == 0 {
+			// A bucket spill of n bytes
+			if _, err := r.Discard(int(n)); err != nil {
+				return true, nil
+			}
+			continue
+		}
+
+		rec := make([]byte, int(n)+int(size))
+		if _, err := io.ReadFull(r, rec); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return true, nil
+			}
+			return false, fmt.Errorf("read data file: %w", err)
+		}
+		if err := fn(string(rec[:n]), rec[n:]); err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iand/gonudb"
+	"github.com/iand/logfmtr"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/urfave/cli/v2"
+)
+
+// storeSyncTimeout is the timeout of each request made to a remote proxy when syncing stores.
+const storeSyncTimeout = 5 * time.Minute
+
+var syncStoreCommand = &cli.Command{
+	Name:  "sync-store",
+	Usage: "Copy the records held by another gonudb store, or by the store of a remote proxy, that are missing from the gonudb store, bringing a replica up to parity.",
+	Flags: append(carStoreFlags,
+		&cli.StringSliceFlag{
+			Name:  "from-store",
+			Usage: "Path to directory containing the gonudb store to copy from, which is opened read-only. May be repeated, giving the directories in the same order as the proxy using them.",
+		},
+		&cli.StringFlag{
+			Name:  "from-store-rotate",
+			Usage: "Schedule the store to copy from is rotated on, daily or weekly. Records are copied from every kept generation.",
+		},
+		&cli.IntFlag{
+			Name:  "from-store-generations",
+			Usage: "Number of generations kept by the store to copy from, including the current generation.",
+			Value: 2,
+		},
+		&cli.StringFlag{
+			Name:  "from-diag",
+			Usage: "Address of the diagnostics server of a remote proxy whose store is copied from, instead of from-store.",
+		},
+		&cli.IntFlag{
+			Name:  "flush-every",
+			Usage: "Number of records copied between flushes of the store.",
+			Value: 10000,
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		if (len(cc.StringSlice("from-store")) == 0) == (cc.String("from-diag") == "") {
+			return fmt.Errorf("exactly one of from-store or from-diag must be specified")
+		}
+		if cc.Int("flush-every") < 1 {
+			return fmt.Errorf("flush-every must be at least 1")
+		}
+
+		ctx := context.Background()
+		var src StoreSyncSource
+		if url := cc.String("from-diag"); url != "" {
+			if !strings.Contains(url, "://") {
+				url = "http://" + url
+			}
+			src = &remoteSyncSource{
+				base: strings.TrimSuffix(url, "/"),
+				hc:   &http.Client{Timeout: storeSyncTimeout},
+			}
+		} else {
+			var (
+				from *ShardedStore
+				err  error
+			)
+			if cc.String("from-store-rotate") != "" {
+				if !ValidStoreRotate(cc.String("from-store-rotate")) {
+					return fmt.Errorf("from-store-rotate: unknown schedule %q", cc.String("from-store-rotate"))
+				}
+				if cc.Int("from-store-generations") < 1 {
+					return fmt.Errorf("from-store-generations must be at least 1")
+				}
+				from, err = NewStoreRotator(cc.StringSlice("from-store"), cc.String("from-store-rotate"), cc.Int("from-store-generations"), true, logfmtr.NewNamed("gonudb")).Open(ctx)
+			} else {
+				from, err = openShardedStore(ctx, cc.StringSlice("from-store"), true)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to open gonudb store to copy from: %w", err)
+			}
+			defer from.Close()
+			src = &localSyncSource{s: from}
+		}
+
+		s, err := openCarStore(ctx, cc, false)
+		if err != nil {
+			return err
+		}
+
+		res, syncErr := SyncStore(ctx, s, src, cc.Int("flush-every"))
+		if err := s.Close(); err != nil && syncErr == nil {
+			syncErr = fmt.Errorf("close store: %w", err)
+		}
+		fmt.Printf("compared %d records, copied %d records (%d bytes), %d already present, %d skipped\n", res.Compared, res.Copied, res.Size, res.Existing, res.Skipped)
+		return syncErr
+	},
+}
+
+// StoreSyncSource is a store whose records can be copied by SyncStore.
+type StoreSyncSource interface {
+	// Each calls fn with the key of each record held by the source and a function that reads its data.
+	Each(ctx context.Context, fn func(key string, data func() ([]byte, error)) error) error
+}
+
+// StoreSyncResult counts the records compared and copied by SyncStore.
+type StoreSyncResult struct {
+	Compared int   // records held by the source
+	Copied   int   // records copied to the store
+	Size     int64 // total size of the records copied
+	Existing int   // records already held by the store
+	Skipped  int   // records that were empty or whose data did not match their key
+}
+
+// SyncStore copies the records held by the source that are missing from the store. Records are only read
+// from the source when the store does not hold them, and are checked against the hash held in their key
+// before being written.
+func SyncStore(ctx context.Context, s *ShardedStore, src StoreSyncSource, flushEvery int) (*StoreSyncResult, error) {
+	logger := logfmtr.NewNamed("sync").V(LogLevelInfo)
+	res := &StoreSyncResult{}
+
+	pending := 0
+	err := src.Each(ctx, func(key string, data func() ([]byte, error)) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res.Compared++
+		if _, err := s.FetchReader(key); err == nil {
+			res.Existing++
+			return nil
+		} else if !errors.Is(err, gonudb.ErrKeyNotFound) {
+			return fmt.Errorf("fetch %x: %w", key, err)
+		}
+
+		d, err := data()
+		if err != nil {
+			return fmt.Errorf("read %x: %w", key, err)
+		}
+		if !recordMatchesKey(key, d) {
+			logger.Info("Skipping record that does not match its key", "key", hex.EncodeToString([]byte(key)))
+			res.Skipped++
+			return nil
+		}
+		if err := s.Insert(key, d); err != nil {
+			if errors.Is(err, gonudb.ErrKeyExists) {
+				res.Existing++
+				return nil
+			}
+			return fmt.Errorf("insert %x: %w", key, err)
+		}
+		res.Copied++
+		res.Size += int64(len(d))
+
+		pending++
+		if pending >= flushEvery {
+			if err := s.Flush(); err != nil {
+				return fmt.Errorf("flush: %w", err)
+			}
+			pending = 0
+			logger.Info("Sync progress", "compared", res.Compared, "copied", res.Copied, "size", res.Size, "existing", res.Existing, "skipped", res.Skipped)
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	if err := s.Flush(); err != nil {
+		return res, fmt.Errorf("flush: %w", err)
+	}
+	return res, nil
+}
+
+// recordMatchesKey reports whether the data of a record hashes to the multihash held in its key. gonudb
+// doesn't support zero sized records.
+func recordMatchesKey(key string, data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	dec, err := mh.Decode([]byte(key))
+	if err != nil {
+		return false
+	}
+	sum, err := mh.Sum(data, dec.Code, dec.Length)
+	return err == nil && string(sum) == key
+}
+
+// localSyncSource reads the records of a store opened by this process.
+type localSyncSource struct {
+	s *ShardedStore
+}
+
+func (l *localSyncSource) Each(ctx context.Context, fn func(key string, data func() ([]byte, error)) error) error {
+	for _, st := range l.s.Shards() {
+		rs := st.RecordScanner()
+		for rs.Next() {
+			if !rs.IsData() {
+				continue
+			}
+			if err := fn(rs.Key(), func() ([]byte, error) { return ioutil.ReadAll(rs.Reader()) }); err != nil {
+				rs.Close()
+				return err
+			}
+		}
+		err := rs.Err()
+		rs.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("scan records: %w", err)
+		}
+	}
+	return nil
+}
+
+// remoteSyncSource reads the records of the store of a remote proxy from its diagnostics server.
+type remoteSyncSource struct {
+	base string
+	hc   *http.Client
+}
+
+func (r *remoteSyncSource) Each(ctx context.Context, fn func(key string, data func() ([]byte, error)) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.base+"/store/keys", nil)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	// Listing a large store can take longer than the timeout of a single record
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("list keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("list keys: unexpected status %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		k, err := hex.DecodeString(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("decode key %q: %w", scanner.Text(), err)
+		}
+		key := string(k)
+		if err := fn(key, func() ([]byte, error) { return r.fetch(ctx, key) }); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("list keys: %w", err)
+	}
+	return nil
+}
+
+// fetch reads the data of a record from the remote proxy.
+func (r *remoteSyncSource) fetch(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.base+"/store/record/"+hex.EncodeToString([]byte(key)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	resp, err := r.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// storeKeysHandler lists the keys of the records held by the store, hex encoded one per line, so that
+// another proxy can find the records it is missing. Keys held by more than one generation are listed once
+// for each.
+func storeKeysHandler(s *ShardedStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		bw := bufio.NewWriterSize(w, 1<<16)
+		defer bw.Flush()
+		for _, st := range s.Shards() {
+			rs := st.RecordScanner()
+			for rs.Next() {
+				if r.Context().Err() != nil {
+					rs.Close()
+					return
+				}
+				if !rs.IsData() {
+					continue
+				}
+				if _, err := fmt.Fprintln(bw, hex.EncodeToString([]byte(rs.Key()))); err != nil {
+					rs.Close()
+					return
+				}
+			}
+			rs.Close()
+		}
+	})
+}
+
+// storeRecordHandler serves the data of the record whose hex encoded key is given in the path.
+func storeRecordHandler(s *ShardedStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := hex.DecodeString(mux.Vars(r)["key"])
+		if err != nil {
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+		rd, err := s.FetchReader(string(key))
+		if err != nil {
+			if errors.Is(err, gonudb.ErrKeyNotFound) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = io.Copy(w, rd)
+	})
+}
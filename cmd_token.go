@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+var tokenCommand = &cli.Command{
+	Name:  "token",
+	Usage: "Manage tokens minted by the proxy.",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "init-secret",
+			Usage: "Generate a new secret for signing proxy tokens.",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "token-secret-file",
+					Usage:    "Path of file to write the secret to. The file must not already exist.",
+					EnvVars:  []string{"LOTUS_CPR_TOKEN_SECRET_FILE"},
+					Required: true,
+				},
+			},
+			Action: func(cc *cli.Context) error {
+				return WriteTokenSecret(cc.String("token-secret-file"))
+			},
+		},
+		{
+			Name:  "create",
+			Usage: "Mint a new proxy token.",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "token-secret-file",
+					Usage:    "Path to file containing the secret used to sign tokens.",
+					EnvVars:  []string{"LOTUS_CPR_TOKEN_SECRET_FILE"},
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "scope",
+					Usage: fmt.Sprintf("Scope of the token, one of %q, %q or %q.", ScopeChain, ScopeChainState, ScopeAdmin),
+					Value: ScopeChain,
+				},
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "Name of the client the token is issued to, used to attribute requests.",
+				},
+			},
+			Action: func(cc *cli.Context) error {
+				secret, err := ReadTokenSecret(cc.String("token-secret-file"))
+				if err != nil {
+					return err
+				}
+
+				token, err := NewTokenIssuer(secret).Mint(TokenClaims{
+					Name:  cc.String("name"),
+					Scope: cc.String("scope"),
+				})
+				if err != nil {
+					return err
+				}
+
+				fmt.Println(string(token))
+				return nil
+			},
+		},
+	},
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"go.opencensus.io/tag"
+)
+
+var ErrCodecNotAllowed = errors.New("codec is not allowed")
+
+// codecAliases are alternative names for codecs accepted in an allowlist, in addition to the names used by go-cid.
+var codecAliases = map[string]uint64{
+	"dag-cbor": cid.DagCBOR,
+	"dag-pb":   cid.DagProtobuf,
+}
+
+// CodecAllowlist is the set of codecs of the objects the proxy will cache and serve. A nil allowlist
+// allows every codec.
+type CodecAllowlist map[uint64]bool
+
+// ParseCodecAllowlist parses a list of codec names, such as dag-cbor or raw, or numeric multicodec codes.
+func ParseCodecAllowlist(names []string) (CodecAllowlist, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	a := CodecAllowlist{}
+	for _, name := range names {
+		code, err := parseCodec(name)
+		if err != nil {
+			return nil, err
+		}
+		a[code] = true
+	}
+	return a, nil
+}
+
+// parseCodec parses a codec name, such as dag-cbor or raw, or a numeric multicodec code.
+func parseCodec(name string) (uint64, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if code, ok := codecAliases[name]; ok {
+		return code, nil
+	}
+	if code, ok := cid.Codecs[name]; ok {
+		return code, nil
+	}
+	code, err := strconv.ParseUint(name, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unknown codec %q", name)
+	}
+	return code, nil
+}
+
+// Allowed reports whether objects with the cid's codec may be cached and served.
+func (a CodecAllowlist) Allowed(c cid.Cid) bool {
+	return a == nil || a[c.Type()]
+}
+
+// checkCodec returns ErrCodecNotAllowed if the cid's codec is not in the proxy's allowlist, logging and
+// counting the rejection.
+func (p *Proxy) checkCodec(ctx context.Context, method string, c cid.Cid) error {
+	if p.codecs.Allowed(c) {
+		return nil
+	}
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, method))
+	reportEvent(mctx, codecRejected)
+	p.logger.Info("Rejected object with unexpected codec", "method", method, "cid", c, "codec", c.Type(), "client", clientName(ctx))
+	return fmt.Errorf("%w: %s", ErrCodecNotAllowed, c)
+}
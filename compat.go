@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+)
+
+// nodeAPIVersionV1 is the api version reported by nodes serving version 1 of the full node api, which
+// no longer has StateGetReceipt.
+const nodeAPIVersionV1 = build.Version(2 << 16)
+
+// nodeCompat records the differences between the api of the connected node and the api the proxy was built
+// against, so calls can be adapted to the node.
+type nodeCompat struct {
+	version   lotusapi.Version
+	noReceipt bool // the node does not serve StateGetReceipt, receipts are found using StateSearchMsg
+}
+
+// detectCompat returns the adaptations needed for a node reporting version v.
+func detectCompat(v lotusapi.Version) nodeCompat {
+	return nodeCompat{
+		version:   v,
+		noReceipt: v.APIVersion >= nodeAPIVersionV1,
+	}
+}
+
+// isMethodNotFound reports whether err was returned because the node does not serve the method.
+func isMethodNotFound(err error, method string) bool {
+	return err != nil && strings.Contains(err.Error(), fmt.Sprintf("method 'Filecoin.%s' not found", method))
+}
+
+// searchReceipt finds the receipt of a message using StateSearchMsg for nodes that do not serve
+// StateGetReceipt. As with StateGetReceipt no receipt is returned for a message executed after the
+// tipset tsk.
+func searchReceipt(ctx context.Context, api lotusapi.FullNode, msg cid.Cid, tsk types.TipSetKey) (*types.MessageReceipt, error) {
+	lookup, err := api.StateSearchMsg(ctx, msg)
+	if err != nil || lookup == nil {
+		return nil, err
+	}
+	if tsk != types.EmptyTSK {
+		ts, err := api.ChainGetTipSet(ctx, tsk)
+		if err != nil {
+			return nil, err
+		}
+		if lookup.Height > ts.Height() {
+			return nil, nil
+		}
+	}
+	return &lookup.Receipt, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/go-logr/logr"
+)
+
+// coverageFile is the name of the file, held in the first store directory, that records the heights whose
+// data is held by the store.
+const coverageFile = "coverage.json"
+
+// EpochRange is an inclusive range of chain heights.
+type EpochRange struct {
+	Low  abi.ChainEpoch `json:"low"`
+	High abi.ChainEpoch `json:"high"`
+}
+
+// coverageState is the content of the coverage file.
+type coverageState struct {
+	Covered []EpochRange `json:"covered"`
+	Absent  []EpochRange `json:"absent"`
+}
+
+// StoreCoverage records the ranges of heights whose block headers, messages and receipts have all been
+// written to the store, and the ranges known to be absent from both the store and the lotus node. Ranges
+// are recorded by the prefetcher and the backfiller as they read tipsets through the cache, and include
+// any null rounds between each tipset and its child. The covered ranges are forgotten when a store generation is discarded
+// since the heights it held are no longer known. The ranges are saved to a file after every change.
+type StoreCoverage struct {
+	path   string
+	logger logr.Logger
+
+	mu    sync.Mutex // guards state
+	state coverageState
+}
+
+// OpenStoreCoverage opens the coverage recorded at path, starting with no coverage if the file does not
+// exist.
+func OpenStoreCoverage(path string, logger logr.Logger) (*StoreCoverage, error) {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	c := &StoreCoverage{
+		path:   path,
+		logger: logger.V(LogLevelInfo),
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", coverageFile, err)
+	}
+	if err := json.Unmarshal(data, &c.state); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", coverageFile, err)
+	}
+	c.logger.Info("Opened store coverage", "path", path, "covered", c.state.Covered, "absent", c.state.Absent)
+	return c, nil
+}
+
+// AddCovered records that the data of the heights from low to high is held by the store. It is safe to
+// call on nil coverage.
+func (c *StoreCoverage) AddCovered(low, high abi.ChainEpoch) {
+	if c == nil || high < low {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if containsRange(c.state.Covered, EpochRange{Low: low, High: high}) {
+		return
+	}
+	c.state.Covered = addRange(c.state.Covered, EpochRange{Low: low, High: high})
+	c.state.Absent = removeRange(c.state.Absent, EpochRange{Low: low, High: high})
+	c.changed()
+}
+
+// AddAbsent records that some of the data of the heights from low to high could be found neither by the
+// store nor by the lotus node. It is safe to call on nil coverage.
+func (c *StoreCoverage) AddAbsent(low, high abi.ChainEpoch) {
+	if c == nil || high < low {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if containsRange(c.state.Absent, EpochRange{Low: low, High: high}) {
+		return
+	}
+	c.state.Absent = addRange(c.state.Absent, EpochRange{Low: low, High: high})
+	c.state.Covered = removeRange(c.state.Covered, EpochRange{Low: low, High: high})
+	c.changed()
+}
+
+// ResetCovered forgets the covered ranges, used when data has been removed from the store.
+func (c *StoreCoverage) ResetCovered() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.state.Covered) == 0 {
+		return
+	}
+	c.logger.Info("Forgetting store coverage after data was discarded from the store")
+	c.state.Covered = nil
+	c.changed()
+}
+
+// Covered reports whether the data of the height is held by the store. It is safe to call on nil coverage.
+func (c *StoreCoverage) Covered(h abi.ChainEpoch) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return inRanges(c.state.Covered, h)
+}
+
+// Absent reports whether the data of the height is known to be missing from the store and the lotus node,
+// so that looking for it in the cache tiers is futile. It is safe to call on nil coverage.
+func (c *StoreCoverage) Absent(h abi.ChainEpoch) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return inRanges(c.state.Absent, h)
+}
+
+// Ranges returns copies of the covered and absent ranges, lowest first.
+func (c *StoreCoverage) Ranges() (covered []EpochRange, absent []EpochRange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]EpochRange(nil), c.state.Covered...), append([]EpochRange(nil), c.state.Absent...)
+}
+
+// changed reports the number of covered heights and saves the ranges. Callers must hold the lock.
+func (c *StoreCoverage) changed() {
+	var n int64
+	for _, r := range c.state.Covered {
+		n += int64(r.High-r.Low) + 1
+	}
+	reportMeasurement(context.Background(), storeCoveredEpochs.M(n))
+	if err := c.save(); err != nil {
+		c.logger.Error(err, "failed to save store coverage", "path", c.path)
+	}
+}
+
+// save writes the coverage file, replacing it atomically. Callers must hold the lock.
+func (c *StoreCoverage) save() error {
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		return fmt.Errorf("encode store coverage: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write store coverage: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close store coverage: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("rename store coverage: %w", err)
+	}
+	return nil
+}
+
+// addRange adds r to the sorted ranges, merging it with any ranges it overlaps or adjoins.
+func addRange(rs []EpochRange, r EpochRange) []EpochRange {
+	out := make([]EpochRange, 0, len(rs)+1)
+	for _, e := range rs {
+		switch {
+		case e.High+1 < r.Low || r.High+1 < e.Low:
+			out = append(out, e)
+		default:
+			if e.Low < r.Low {
+				r.Low = e.Low
+			}
+			if e.High > r.High {
+				r.High = e.High
+			}
+		}
+	}
+	out = append(out, r)
+	sort.Slice(out, func(i, j int) bool { return out[i].Low < out[j].Low })
+	return out
+}
+
+// removeRange removes the heights in r from the sorted ranges, splitting any range that contains it.
+func removeRange(rs []EpochRange, r EpochRange) []EpochRange {
+	out := make([]EpochRange, 0, len(rs)+1)
+	for _, e := range rs {
+		if e.High < r.Low || r.High < e.Low {
+			out = append(out, e)
+			continue
+		}
+		if e.Low < r.Low {
+			out = append(out, EpochRange{Low: e.Low, High: r.Low - 1})
+		}
+		if e.High > r.High {
+			out = append(out, EpochRange{Low: r.High + 1, High: e.High})
+		}
+	}
+	return out
+}
+
+// inRanges reports whether h falls within one of the sorted ranges.
+func inRanges(rs []EpochRange, h abi.ChainEpoch) bool {
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].High >= h })
+	return i < len(rs) && rs[i].Low <= h
+}
+
+// containsRange reports whether r falls entirely within one of the sorted ranges.
+func containsRange(rs []EpochRange, r EpochRange) bool {
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].High >= r.Low })
+	return i < len(rs) && rs[i].Low <= r.Low && rs[i].High >= r.High
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dashboardRefresh is how often the dashboard page reloads itself, in seconds.
+const dashboardRefresh = 5
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+	"bytes":   formatBytes,
+	"lag": func(secs float64) string {
+		return time.Duration(secs * float64(time.Second)).Round(time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>lotus-cpr status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.3em 1em; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.open, .disconnected, .error { color: #b00; }
+.half-open { color: #b60; }
+.closed { color: #070; }
+</style>
+</head>
+<body>
+<h1>lotus-cpr</h1>
+<p>Updated {{.Status.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+
+<h2>Upstream</h2>
+<table>
+<tr><td>Circuit</td><td class="{{.Status.Circuit}}">{{.Status.Circuit}}</td></tr>
+{{if .Status.HeadError}}<tr><td>Head</td><td class="error">{{.Status.HeadError}}</td></tr>
+{{else}}<tr><td>Head</td><td>{{.Status.HeadHeight}}</td></tr>
+<tr><td>Head lag</td><td>{{lag .Status.HeadLag}}</td></tr>
+{{end}}<tr><td>In flight</td><td>{{.Status.InFlight}}</td></tr>
+</table>
+
+<h2>Cache tiers</h2>
+<table>
+<tr><th>Tier</th><th>Requests</th><th>Hits</th><th>Hit rate</th><th>Failures</th><th>Fills</th><th>Fills/sec</th></tr>
+{{range .Tiers}}<tr><td>{{.Name}}</td><td>{{.Requests}}</td><td>{{.Hits}}</td><td>{{percent .HitRate}}</td><td>{{.Failures}}</td><td>{{.Fills}}</td><td>{{printf "%.2f" .FillsPerSec}}</td></tr>
+{{end}}</table>
+
+<h2>Store</h2>
+<table>
+<tr><td>Records</td><td>{{.Status.StoreRecords}}</td></tr>
+<tr><td>Size</td><td>{{bytes .Status.StoreBytes}}</td></tr>
+</table>
+
+<h2>Top CIDs</h2>
+<table>
+<tr><th>CID</th><th>Requests</th></tr>
+{{range .Status.TopCIDs}}<tr><td>{{.CID}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+
+<h2>Client egress</h2>
+<table>
+<tr><th>Client</th><th>Address</th><th>Calls</th><th>Served</th></tr>
+{{range .Status.Egress}}<tr><td>{{.Client}}</td><td>{{.Addr}}</td><td>{{.Calls}}</td><td>{{bytes .Bytes}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type dashboardTier struct {
+	Name string
+	*CacheStatus
+}
+
+// dashboardHandler serves an html page summarising the status of the proxy.
+func dashboardHandler(sr *StatusReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := sr.Status(r.Context())
+
+		tiers := make([]dashboardTier, 0, len(st.Caches))
+		for name, cs := range st.Caches {
+			tiers = append(tiers, dashboardTier{Name: name, CacheStatus: cs})
+		}
+		sort.Slice(tiers, func(i, j int) bool { return tiers[i].Name < tiers[j].Name })
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, struct {
+			Refresh int
+			Status  *Status
+			Tiers   []dashboardTier
+		}{
+			Refresh: dashboardRefresh,
+			Status:  st,
+			Tiers:   tiers,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opencensus.io/tag"
+)
+
+// requestTimeoutHeader is the header clients use to tell the proxy how long they will wait for a response,
+// as a Go duration such as 30s.
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// Reasons for cancelled requests, used as the value of the reason tag.
+const (
+	cancelReasonDeadline   = "deadline"   // the request's deadline passed
+	cancelReasonDisconnect = "disconnect" // the client disconnected or cancelled the request
+)
+
+// cancelReason returns the reason the context was cancelled.
+func cancelReason(ctx context.Context) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return cancelReasonDeadline
+	}
+	return cancelReasonDisconnect
+}
+
+// requestDeadline is middleware that applies a deadline to each http request from the X-Request-Timeout
+// header, limited to max. When max is positive it is also used as the deadline of requests without the
+// header. The deadline is carried by the request's context to the upstream calls made while handling it,
+// which are cancelled when it passes. Websocket connections are long lived so are not given a deadline.
+func requestDeadline(next http.Handler, max time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := max
+		if v := r.Header.Get(requestTimeoutHeader); v != "" {
+			if d, err := time.ParseDuration(v); err == nil && d > 0 && (max <= 0 || d < max) {
+				timeout = d
+			}
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CancellationMetrics is method middleware that counts calls abandoned because the client disconnected
+// or the call's deadline passed before it completed.
+func CancellationMetrics(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		res, err := next(ctx, call)
+		if err != nil && ctx.Err() != nil {
+			mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method), tag.Upsert(reasonTag, cancelReason(ctx)))
+			reportEvent(mctx, requestCancelled)
+		}
+		return res, err
+	}
+}
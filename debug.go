@@ -0,0 +1,31 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	rpprof "runtime/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// registerDebugHandlers adds the runtime profiling and debugging endpoints to the diagnostics server so that
+// operators can profile the proxy without rebuilding it: the net/http/pprof profiles under /debug/pprof/,
+// expvar variables at /debug/vars and a dump of the stacks of all goroutines at /debug/goroutines.
+func registerDebugHandlers(m *mux.Router) {
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	m.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	m.Handle("/debug/vars", expvar.Handler())
+	m.HandleFunc("/debug/goroutines", goroutineDumpHandler)
+}
+
+// goroutineDumpHandler writes the stacks of all goroutines in the same format as an unrecovered panic.
+func goroutineDumpHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := rpprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
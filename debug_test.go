@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRPCRouterDebugNotFound(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := rpcRouter(ok, ok, func(h http.Handler) http.Handler { return h })
+
+	for _, path := range []string{"/debug/vars", "/debug/pprof/cmdline"} {
+		// The handlers are registered on the default mux when expvar and net/http/pprof are imported
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("default mux responded to %s with status %d, wanted %d", path, rec.Code, http.StatusOK)
+		}
+
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("rpc router responded to %s with status %d, wanted %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// MirrorDiscovery keeps the mirrors of an http blockstore up to date with those published in DNS, so
+// mirrors can be added and removed without reconfiguring the proxy. Mirrors are published as TXT records
+// holding the base url of a mirror and as SRV records naming a mirror's host and port. Mirrors found
+// through SRV records are addressed by https unless their port is 80.
+type MirrorDiscovery struct {
+	name     string   // DNS name holding the records
+	static   []string // mirrors that are always used, tried before any that are discovered
+	cache    *HttpBlockCache
+	interval time.Duration
+	resolver *net.Resolver
+	logger   logr.Logger
+}
+
+func NewMirrorDiscovery(name string, static []string, cache *HttpBlockCache, interval time.Duration, logger logr.Logger) *MirrorDiscovery {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	bases := make([]string, 0, len(static))
+	for _, base := range static {
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		bases = append(bases, base)
+	}
+	return &MirrorDiscovery{
+		name:     name,
+		static:   bases,
+		cache:    cache,
+		interval: interval,
+		resolver: net.DefaultResolver,
+		logger:   logger.V(LogLevelInfo),
+	}
+}
+
+// Run refreshes the mirrors at each interval until the context is cancelled. If a lookup fails or finds
+// no mirrors the previously discovered mirrors are kept.
+func (d *MirrorDiscovery) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.Refresh(ctx)
+		}
+	}
+}
+
+// Refresh looks up the mirrors once, updating the blockstore's mirrors if they have changed.
+func (d *MirrorDiscovery) Refresh(ctx context.Context) {
+	found, err := d.lookup(ctx)
+	if err != nil {
+		d.logger.Error(err, "failed to discover blockstore mirrors", "name", d.name)
+		return
+	}
+	if len(found) == 0 {
+		d.logger.Info("No blockstore mirrors discovered, keeping existing mirrors", "name", d.name)
+		return
+	}
+
+	mirrors := append(append([]string{}, d.static...), found...)
+	if equalStrings(mirrors, d.cache.Mirrors()) {
+		return
+	}
+	d.cache.SetMirrors(mirrors)
+	d.logger.Info("Discovered blockstore mirrors", "name", d.name, "base_url", d.cache.Mirrors())
+}
+
+// lookup returns the sorted base urls of the mirrors published at the DNS name. It only fails if neither
+// TXT nor SRV records could be looked up.
+func (d *MirrorDiscovery) lookup(ctx context.Context) ([]string, error) {
+	seen := map[string]bool{}
+	var mirrors []string
+	add := func(base string) {
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		if !seen[base] {
+			seen[base] = true
+			mirrors = append(mirrors, base)
+		}
+	}
+
+	txts, txtErr := d.resolver.LookupTXT(ctx, d.name)
+	for _, txt := range txts {
+		u, err := url.Parse(strings.TrimSpace(txt))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			// Other TXT records may share the name
+			continue
+		}
+		add(u.String())
+	}
+
+	_, srvs, srvErr := d.resolver.LookupSRV(ctx, "", "", d.name)
+	for _, srv := range srvs {
+		scheme := "https"
+		if srv.Port == 80 {
+			scheme = "http"
+		}
+		host := strings.TrimSuffix(srv.Target, ".")
+		if host == "" {
+			continue
+		}
+		add(fmt.Sprintf("%s://%s/", scheme, net.JoinHostPort(host, fmt.Sprint(srv.Port))))
+	}
+
+	if txtErr != nil && srvErr != nil {
+		return nil, fmt.Errorf("lookup txt: %v, lookup srv: %w", txtErr, srvErr)
+	}
+	sort.Strings(mirrors)
+	return mirrors, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
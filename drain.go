@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var ErrDraining = errors.New("proxy is shutting down")
+
+// drainPollInterval is the time between checks of whether the rpc calls in flight have completed while
+// draining.
+const drainPollInterval = 50 * time.Millisecond
+
+// Drainer lets the rpc calls being handled when the proxy shuts down complete before it exits. Calls made
+// after draining has started are refused.
+type Drainer struct {
+	inflight int64 // number of rpc calls being handled, accessed atomically and first for alignment
+	draining int32 // set to 1 once draining has started, accessed atomically
+}
+
+func NewDrainer() *Drainer {
+	return &Drainer{}
+}
+
+// Middleware is method middleware that counts the rpc calls being handled and refuses calls with
+// ErrDraining once draining has started.
+func (d *Drainer) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		if atomic.LoadInt32(&d.draining) != 0 {
+			return nil, ErrDraining
+		}
+		atomic.AddInt64(&d.inflight, 1)
+		defer atomic.AddInt64(&d.inflight, -1)
+		return next(ctx, call)
+	}
+}
+
+// InFlight returns the number of rpc calls being handled.
+func (d *Drainer) InFlight() int64 {
+	return atomic.LoadInt64(&d.inflight)
+}
+
+// Drain stops srv accepting new requests and waits until the requests it is handling have completed,
+// including rpc calls made over websocket connections which the server does not track. It returns the
+// context's error if requests are still being handled when the context is done.
+func (d *Drainer) Drain(ctx context.Context, srv *http.Server) error {
+	atomic.StoreInt32(&d.draining, 1)
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for d.InFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
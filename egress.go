@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// ClientEgress is the number of bytes served to a client from an address.
+type ClientEgress struct {
+	Client string `json:"client"`
+	Addr   string `json:"addr"`
+	Calls  int64  `json:"calls"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type egressKey struct {
+	client string
+	addr   string
+}
+
+// EgressCounter counts the bytes served to each client, identified by its name and the IP address it
+// connects from, so that shared deployments can attribute their traffic. Only a bounded number of clients
+// are tracked, the least recently served being forgotten first. Sizes are those of the JSON encoded results,
+// and results delivered through channels are not counted.
+type EgressCounter struct {
+	mu      sync.Mutex // guards clients
+	clients *lru.Cache // *ClientEgress keyed by egressKey
+}
+
+func NewEgressCounter(size int) *EgressCounter {
+	clients, _ := lru.New(size)
+	return &EgressCounter{clients: clients}
+}
+
+// Middleware is method middleware that counts the size of each result served to the caller.
+func (e *EgressCounter) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		res, err := next(ctx, call)
+		if err != nil || res == nil || reflect.TypeOf(res).Kind() == reflect.Chan {
+			return res, err
+		}
+		size := encodedSize(res)
+		reportMeasurement(ctx, clientEgress.M(size))
+		e.add(clientName(ctx), clientAddr(ctx), size)
+		return res, err
+	}
+}
+
+func (e *EgressCounter) add(client string, addr string, size int64) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	key := egressKey{client: client, addr: addr}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ce, ok := e.clients.Get(key)
+	if !ok {
+		ce = &ClientEgress{Client: client, Addr: addr}
+		e.clients.Add(key, ce)
+	}
+	ce.(*ClientEgress).Calls++
+	ce.(*ClientEgress).Bytes += size
+}
+
+// Top returns up to n of the clients that have been served the most bytes, largest first. It is safe to
+// call on a nil counter.
+func (e *EgressCounter) Top(n int) []ClientEgress {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	top := make([]ClientEgress, 0, e.clients.Len())
+	for _, k := range e.clients.Keys() {
+		if v, ok := e.clients.Peek(k); ok {
+			top = append(top, *v.(*ClientEgress))
+		}
+	}
+	e.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Bytes != top[j].Bytes {
+			return top[i].Bytes > top[j].Bytes
+		}
+		if top[i].Client != top[j].Client {
+			return top[i].Client < top[j].Client
+		}
+		return top[i].Addr < top[j].Addr
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// encodedSize returns the size of the JSON encoding of v. Byte slices, such as the blocks returned by
+// ChainReadObj, are sized without encoding them.
+func encodedSize(v interface{}) int64 {
+	if b, ok := v.([]byte); ok {
+		// base64 encoded and quoted
+		return int64((len(b)+2)/3*4 + 2)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return int64(len(data))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"go.opencensus.io/tag"
+)
+
+var epochTag, _ = tag.NewKey("epoch")
+
+// Coarse ranges of epochs relative to the head, used as the value of the epoch tag.
+const (
+	epochBucketHead     = "head"     // within epochHeadDistance of the head, or above it
+	epochBucketRecent   = "recent"   // within the chain's finality period of the head
+	epochBucketArchival = "archival" // older than the chain's finality period
+)
+
+// epochHeadDistance is the number of epochs below the head that are counted as reads of the head.
+const epochHeadDistance = 10
+
+// EpochTracker follows the height of the node's head so that metrics recorded by calls for a known epoch can
+// be tagged with how far the epoch is from the head, showing how archival reads behave compared with reads
+// of the head.
+type EpochTracker struct {
+	head int64 // height of the head, -1 until known, accessed atomically
+}
+
+func NewEpochTracker() *EpochTracker {
+	return &EpochTracker{
+		head: -1,
+	}
+}
+
+// HeadChanges records the height of the most recent head in the changes.
+func (t *EpochTracker) HeadChanges(ctx context.Context, changes []*api.HeadChange) {
+	for _, hc := range changes {
+		if hc.Type == "current" || hc.Type == "apply" {
+			atomic.StoreInt64(&t.head, int64(hc.Val.Height()))
+		}
+	}
+}
+
+// Bucket returns the range of epochs relative to the head that h falls in, false if the head is not known.
+func (t *EpochTracker) Bucket(h abi.ChainEpoch) (string, bool) {
+	head := atomic.LoadInt64(&t.head)
+	if head < 0 {
+		return "", false
+	}
+	switch depth := head - int64(h); {
+	case depth <= epochHeadDistance:
+		return epochBucketHead, true
+	case depth <= int64(build.Finality):
+		return epochBucketRecent, true
+	default:
+		return epochBucketArchival, true
+	}
+}
+
+// epochContext returns a context that tags the metrics recorded with it with the range of epochs that h falls
+// in. The context is returned unchanged when epochs are not being tracked or the head is not known.
+func (p *Proxy) epochContext(ctx context.Context, h abi.ChainEpoch) context.Context {
+	if p.epochs == nil {
+		return ctx
+	}
+	bucket, ok := p.epochs.Bucket(h)
+	if !ok {
+		return ctx
+	}
+	ctx, _ = tag.New(ctx, tag.Upsert(epochTag, bucket))
+	return ctx
+}
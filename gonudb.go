@@ -3,24 +3,87 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/iand/gonudb"
 	"github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-ipfs-blockstore"
+	"go.opencensus.io/tag"
 )
 
-var _ (BlockCache) = (*DBBlockCache)(nil)
+var (
+	_ (BlockCache)       = (*DBBlockCache)(nil)
+	_ (BlockRangeReader) = (*DBBlockCache)(nil)
+)
+
+// Store sync policies, controlling when blocks inserted into the store are flushed and synced to disk.
+const (
+	StoreSyncInsert   = "insert"   // flush after every insert
+	StoreSyncPeriodic = "periodic" // flush periodically in the background
+	StoreSyncClose    = "close"    // flush only when the store is closed
+)
+
+// storeSyncNever is used as gonudb's background flush interval so that flushes are only made by the proxy.
+const storeSyncNever = 100 * 365 * 24 * time.Hour
+
+// ValidStoreSync reports whether policy is a known store sync policy.
+func ValidStoreSync(policy string) bool {
+	switch policy {
+	case StoreSyncInsert, StoreSyncPeriodic, StoreSyncClose:
+		return true
+	}
+	return false
+}
 
 type DBBlockCache struct {
-	store    *gonudb.Store
-	upstream BlockCache
-	logger   logr.Logger
+	pendingRecords int64 // number of records inserted since the last flush, accessed atomically and first for alignment
+	pendingBytes   int64 // size of records inserted since the last flush, accessed atomically
+	full           int32 // non-zero when the store has exceeded its ceiling and filling has stopped, accessed atomically
+
+	store        *ShardedStore
+	upstream     BlockCache
+	syncInsert   bool  // flush the store after every insert
+	flushPending int64 // size of records waiting to be flushed above which the store is flushed, 0 for no limit
+	readOnly     bool  // never insert blocks filled from upstream
+	ceiling      StoreCeiling
+	warned       bool // whether the store has been reported as approaching its ceiling, only used by CheckCeiling
+	exceeded     bool // whether the store has been reported as exceeding its ceiling, only used by CheckCeiling
+	logger       logr.Logger
+
+	mu       sync.RWMutex     // held for reading while inserting or queueing a block, for writing by Close
+	closed   bool             // whether Close has been called, after which filled blocks are not inserted
+	inserts  chan storeInsert // blocks waiting to be inserted by the background inserter, nil when inserting before responding
+	inserted chan struct{}    // closed when the background inserter has stopped
+}
+
+// storeInsert is a block filled from upstream waiting to be inserted into the store.
+type storeInsert struct {
+	ctx  context.Context
+	c    cid.Cid
+	data []byte
+}
+
+// StoreCeiling limits the growth of the store. A zero limit is not enforced.
+type StoreCeiling struct {
+	MaxRecords  int64 // number of records above which the store is considered full
+	MaxBytes    int64 // size of the data files above which the store is considered full
+	StopFilling bool  // stop inserting blocks filled from upstream while the store is full
 }
 
-func NewDBBlockCache(s *gonudb.Store, logger logr.Logger) *DBBlockCache {
+// storeCeilingWarnRatio is the fraction of the store's ceiling above which a warning is logged.
+const storeCeilingWarnRatio = 0.9
+
+// storeCeilingCheckInterval is how often the size of the store is compared with its ceiling.
+const storeCeilingCheckInterval = 10 * time.Second
+
+func NewDBBlockCache(s *ShardedStore, logger logr.Logger) *DBBlockCache {
 	if logger == nil {
 		logger = logr.Discard()
 	}
@@ -72,23 +135,93 @@ func (d *DBBlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, error)
 	return blocks.NewBlockWithCid(buf, c)
 }
 
+// GetRange reads part of a block from the store without reading the whole record. Blocks that
+// are not in the store are filled from upstream in full.
+func (d *DBBlockCache) GetRange(ctx context.Context, c cid.Cid, offset int64, length int64) ([]byte, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	ctx = cacheContext(ctx, "gonudb")
+	reportEvent(ctx, getRequest)
+	stop := startTimer(ctx, getDuration)
+	defer stop()
+
+	r, err := d.store.FetchReader(string(c.Hash()))
+	if err != nil {
+		data, err := d.fillFromUpstream(ctx, c)
+		if err != nil {
+			reportEvent(ctx, getFailure)
+			return nil, err
+		}
+		reportEvent(ctx, getMiss)
+		data = sliceRange(data, offset, length)
+		reportSize(ctx, getSize, len(data))
+		return data, nil
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			reportEvent(ctx, getHit)
+			return []byte{}, nil
+		}
+		reportEvent(ctx, getFailure)
+		return nil, err
+	}
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		reportEvent(ctx, getFailure)
+		return nil, err
+	}
+	reportEvent(ctx, getHit)
+	reportSize(ctx, getSize, len(buf))
+	return buf, nil
+}
+
 func (d *DBBlockCache) SetUpstream(u BlockCache) {
 	d.upstream = u
 }
 
+// SetSyncPolicy sets when blocks filled from upstream are flushed to disk. Periodic flushing is
+// performed by calling Flush.
+func (d *DBBlockCache) SetSyncPolicy(policy string) {
+	d.syncInsert = policy == StoreSyncInsert
+}
+
+// SetFlushThreshold flushes the store whenever more than size bytes of records have been inserted since the
+// last flush, whatever the sync policy. gonudb holds unflushed records in memory so this bounds the memory
+// used between flushes. A size of zero or less removes the limit.
+func (d *DBBlockCache) SetFlushThreshold(size int64) {
+	d.flushPending = size
+}
+
+// SetReadOnly prevents blocks filled from upstream from being inserted into the store. They are still
+// returned to the caller.
+func (d *DBBlockCache) SetReadOnly(readOnly bool) {
+	d.readOnly = readOnly
+}
+
 func (d *DBBlockCache) fillFromUpstream(ctx context.Context, c cid.Cid) ([]byte, error) {
+	ctx = fillContext(ctx)
 	reportEvent(ctx, fillRequest)
 	stop := startTimer(ctx, fillDuration)
 	defer stop()
 
 	if d.upstream == nil {
-		reportEvent(ctx, fillFailure)
+		reportFillFailure(ctx, fillReasonUpstreamMiss)
 		return nil, blockstore.ErrNotFound
 	}
 
 	blk, err := d.upstream.Get(ctx, c)
 	if err != nil {
-		reportEvent(ctx, fillFailure)
+		if errors.Is(err, blockstore.ErrNotFound) {
+			reportFillFailure(ctx, fillReasonUpstreamMiss)
+		} else {
+			reportFillFailure(ctx, fillReasonUpstreamError)
+		}
 		d.logger.Error(err, "upstream get", "cid", c.String())
 		return nil, err
 	}
@@ -104,31 +237,175 @@ func (d *DBBlockCache) fillFromUpstream(ctx context.Context, c cid.Cid) ([]byte,
 	// Only insert if the block data and cid match, since we can't delete from the store
 	chkc, err := c.Prefix().Sum(data)
 	if err != nil {
-		reportEvent(ctx, fillFailure)
+		reportFillFailure(ctx, fillReasonHashUnsupported)
 		d.logger.Error(err, "compute block hash", "cid", c.String())
 		return nil, err
 	}
 
 	if !chkc.Equals(c) {
-		reportEvent(ctx, fillFailure)
+		reportFillFailure(ctx, fillReasonHashMismatch)
 		d.logger.Error(err, "wrong block hash", "cid", c.String(), "hash", chkc.String())
 		return nil, blocks.ErrWrongHash
 	}
 
+	if d.readOnly || atomic.LoadInt32(&d.full) != 0 {
+		return data, nil
+	}
+
+	// Requests still running when the cache is closed, such as those cut off after draining, are served
+	// without storing their blocks
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		reportFillFailure(ctx, fillReasonBusy)
+		return data, nil
+	}
+
+	if d.inserts == nil {
+		d.insert(ctx, c, data)
+		return data, nil
+	}
+
+	// The insert outlives the request so only the request's tags are kept
+	select {
+	case d.inserts <- storeInsert{ctx: tag.NewContext(context.Background(), tag.FromContext(ctx)), c: c, data: data}:
+	default:
+		// Serve the block without storing it rather than wait for the store
+		reportFillFailure(ctx, fillReasonBusy)
+	}
+	return data, nil
+}
+
+// insert adds a block filled from upstream to the store.
+func (d *DBBlockCache) insert(ctx context.Context, c cid.Cid, data []byte) {
 	if err := d.store.Insert(string(c.Hash()), data); err != nil {
 		// Data may have been inserted while we were fetching
 		if !errors.Is(err, gonudb.ErrKeyExists) {
-			reportEvent(ctx, fillFailure)
+			reportFillFailure(ctx, fillReasonInsertError)
 			d.logger.Error(err, "insert", "cid", c.String())
 		}
-		return data, nil
+		return
+	}
+	atomic.AddInt64(&d.pendingRecords, 1)
+	pending := atomic.AddInt64(&d.pendingBytes, int64(len(data)))
+	if d.syncInsert || (d.flushPending > 0 && pending > d.flushPending) {
+		if err := d.Flush(ctx); err != nil {
+			d.logger.Error(err, "flush", "cid", c.String())
+		}
 	}
 	reportEvent(ctx, fillSuccess)
 	reportSize(ctx, fillSize, len(data))
-	return data, nil
+}
+
+// SetInsertQueue inserts blocks filled from upstream in the background so that the time taken by the store
+// to accept them, such as while it is flushing or throttling inserts, is not added to requests. Up to size
+// blocks may wait to be inserted; blocks filled while the queue is full are returned without being stored
+// and reported as busy fill failures. Close must be called to insert the waiting blocks before the store
+// is closed.
+func (d *DBBlockCache) SetInsertQueue(size int) {
+	if size <= 0 {
+		return
+	}
+	d.inserts = make(chan storeInsert, size)
+	d.inserted = make(chan struct{})
+	go func() {
+		defer close(d.inserted)
+		for ins := range d.inserts {
+			d.insert(ins.ctx, ins.c, ins.data)
+		}
+	}()
+}
+
+// Close stops the background inserter once the blocks waiting to be inserted have been added to the store,
+// then flushes the store. It does not close the store. Blocks filled after Close are not inserted.
+func (d *DBBlockCache) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	if d.inserts != nil {
+		close(d.inserts)
+		<-d.inserted
+	}
+	if err := d.Flush(context.Background()); err != nil {
+		d.logger.Error(err, "failed to flush store")
+	}
+}
+
+// Flush commits records inserted into the store to disk, reporting the duration of the flush and the
+// number and size of the records that were waiting to be flushed.
+func (d *DBBlockCache) Flush(ctx context.Context) error {
+	ctx = cacheContext(ctx, "gonudb")
+	records := atomic.SwapInt64(&d.pendingRecords, 0)
+	size := atomic.SwapInt64(&d.pendingBytes, 0)
+	reportMeasurement(ctx, gonudbFlushRecords.M(records))
+	reportMeasurement(ctx, gonudbFlushSize.M(size))
+
+	stop := startTimer(ctx, gonudbFlushDuration)
+	defer stop()
+	if err := d.store.Flush(); err != nil {
+		reportEvent(ctx, gonudbFlushFailure)
+		return err
+	}
+	return nil
+}
+
+// SetCeiling sets the limits on the growth of the store that are checked by CheckCeiling.
+func (d *DBBlockCache) SetCeiling(c StoreCeiling) {
+	d.ceiling = c
+}
+
+// CheckCeiling compares the size of the store with its ceiling, logging a warning when the store
+// approaches or exceeds the ceiling and stopping filling while it is exceeded if the ceiling requires.
+// It must not be called concurrently.
+func (d *DBBlockCache) CheckCeiling(ctx context.Context) {
+	records := int64(d.store.RecordCount())
+	size, err := d.store.DataSize()
+	if err != nil {
+		d.logger.Error(err, "failed to read store size")
+		return
+	}
+	reportMeasurement(ctx, gonudbSize.M(size))
+
+	var usage float64
+	if d.ceiling.MaxRecords > 0 {
+		usage = float64(records) / float64(d.ceiling.MaxRecords)
+	}
+	if d.ceiling.MaxBytes > 0 {
+		if u := float64(size) / float64(d.ceiling.MaxBytes); u > usage {
+			usage = u
+		}
+	}
+	reportMeasurement(ctx, gonudbCeilingUsage.M(usage))
+
+	exceeded := usage > 1
+	if exceeded {
+		reportMeasurement(ctx, gonudbCeilingExceeded.M(1))
+	} else {
+		reportMeasurement(ctx, gonudbCeilingExceeded.M(0))
+	}
+
+	kv := []interface{}{"records", records, "size", size, "max_records", d.ceiling.MaxRecords, "max_bytes", d.ceiling.MaxBytes}
+	switch {
+	case exceeded && !d.exceeded:
+		d.logger.Error(fmt.Errorf("store exceeded ceiling"), "Store is full", append(kv, "stop_filling", d.ceiling.StopFilling)...)
+	case !exceeded && d.exceeded:
+		d.logger.Info("Store is no longer full", kv...)
+	case usage > storeCeilingWarnRatio && !d.warned:
+		d.logger.Info("Store is approaching its ceiling", append(kv, "usage", usage)...)
+	}
+	d.warned = usage > storeCeilingWarnRatio
+	d.exceeded = exceeded
+
+	if exceeded && d.ceiling.StopFilling {
+		atomic.StoreInt32(&d.full, 1)
+	} else {
+		atomic.StoreInt32(&d.full, 0)
+	}
 }
 
 func (d *DBBlockCache) ReportMetrics(ctx context.Context) {
+	reportMeasurement(ctx, gonudbFlushBacklog.M(atomic.LoadInt64(&d.pendingRecords)))
+	reportMeasurement(ctx, gonudbInsertBacklog.M(int64(len(d.inserts))))
 	reportMeasurement(ctx, gonudbRecordCount.M(int64(d.store.RecordCount())))
 	reportMeasurement(ctx, gonudbRate.M(d.store.Rate()))
 }
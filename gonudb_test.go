@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-logr/logr"
+	blocks "github.com/ipfs/go-block-format"
+)
+
+func TestDBBlockCacheFlushThreshold(t *testing.T) {
+	s, _ := newTestShardedStore(t, 0)
+	d := NewDBBlockCache(s, logr.Discard())
+	d.SetSyncPolicy(StoreSyncClose)
+	d.SetFlushThreshold(100)
+
+	ctx := context.Background()
+	d.insert(ctx, blocks.NewBlock(make([]byte, 60)).Cid(), make([]byte, 60))
+	if pending := atomic.LoadInt64(&d.pendingBytes); pending != 60 {
+		t.Fatalf("got %d pending bytes, wanted 60", pending)
+	}
+
+	blk := blocks.NewBlock(append(make([]byte, 59), 1))
+	d.insert(ctx, blk.Cid(), blk.RawData())
+	if pending := atomic.LoadInt64(&d.pendingBytes); pending != 0 {
+		t.Errorf("got %d pending bytes after exceeding the threshold, wanted a flush", pending)
+	}
+}
+
+func TestDBBlockCacheFillAfterClose(t *testing.T) {
+	s, _ := newTestShardedStore(t, 0)
+	d := NewDBBlockCache(s, logr.Discard())
+	d.SetInsertQueue(4)
+	upstream := &testUpstream{memBlockstore{}}
+	d.SetUpstream(upstream)
+
+	blk := blocks.NewBlock([]byte("filled after the cache was closed"))
+	upstream.Put(blk)
+
+	d.Close()
+	// A request cut off by shutdown may still fill a block, which is served without being stored
+	got, err := d.Get(context.Background(), blk.Cid())
+	if err != nil {
+		t.Fatalf("Get after Close: %v", err)
+	}
+	if !bytes.Equal(got.RawData(), blk.RawData()) {
+		t.Errorf("Get after Close returned %q, wanted %q", got.RawData(), blk.RawData())
+	}
+	if _, err := s.FetchReader(string(blk.Cid().Hash())); err == nil {
+		t.Errorf("block filled after Close was stored")
+	}
+}
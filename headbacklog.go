@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/go-logr/logr"
+)
+
+var (
+	ErrBacklogDisabled = errors.New("chain notify backlog is not enabled")
+	ErrBacklogTooOld   = errors.New("epoch is older than the chain notify backlog")
+)
+
+// headBacklogSubscriberBuffer is the number of live head changes buffered for a subscriber in addition to
+// those replayed from the backlog. Subscribers that fall further behind are closed.
+const headBacklogSubscriberBuffer = 16
+
+// HeadBacklog keeps the most recent head changes reported by the node so that a subscriber that has
+// briefly disconnected can have the changes it missed replayed before receiving new ones.
+//
+// Tipsets missed by the proxy's subscription to the node, such as while it resubscribes, are detected when a
+// new head does not follow the previous one. The missing tipsets are fetched through the cache, which
+// fills it, and added to the backlog as applied changes.
+type HeadBacklog struct {
+	size   int        // maximum number of head changes kept
+	cache  BlockCache // used to fetch tipsets missed by the subscription, may be nil
+	logger logr.Logger
+
+	// The head most recently applied, only used by HeadChanges
+	headKey    types.TipSetKey
+	headHeight abi.ChainEpoch
+
+	mu      sync.Mutex // guards changes, oldest and subs
+	changes []*api.HeadChange
+	oldest  abi.ChainEpoch // height of the oldest change that has been dropped from the backlog, -1 if none
+	subs    map[chan []*api.HeadChange]struct{}
+}
+
+func NewHeadBacklog(size int, logger logr.Logger) *HeadBacklog {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	return &HeadBacklog{
+		size:   size,
+		oldest: -1,
+		subs:   map[chan []*api.HeadChange]struct{}{},
+		logger: logger.V(LogLevelInfo),
+	}
+}
+
+// SetBackfillCache sets the cache used to fetch tipsets missed by the subscription. When no cache is set
+// gaps are detected and reported but not filled.
+func (b *HeadBacklog) SetBackfillCache(c BlockCache) {
+	b.cache = c
+}
+
+// HeadChanges adds the changes to the backlog, filling in any tipsets missed since the previous head.
+func (b *HeadBacklog) HeadChanges(ctx context.Context, changes []*api.HeadChange) {
+	b.add(b.follow(withFillOrigin(ctx, fillOriginGap), changes))
+}
+
+// HeadsLost closes the subscribers when the head changes stop being followed. Tipsets missed while
+// resubscribing are filled in by HeadChanges.
+func (b *HeadBacklog) HeadsLost(ctx context.Context) {
+	if ctx.Err() != nil {
+		b.closeSubscribers()
+	}
+}
+
+// follow tracks the head through a set of changes reported by the node, returning the changes to be
+// added to the backlog. The current head sent when subscribing is treated as applied if it differs from
+// the previous head. Tipsets missed between the previous head and a newly applied one are filled in.
+func (b *HeadBacklog) follow(ctx context.Context, changes []*api.HeadChange) []*api.HeadChange {
+	var applied []*api.HeadChange
+	for _, hc := range changes {
+		switch hc.Type {
+		case "current", "apply":
+			if b.headKey == types.EmptyTSK {
+				b.headKey, b.headHeight = hc.Val.Key(), hc.Val.Height()
+				if hc.Type == "current" {
+					continue
+				}
+			} else if hc.Val.Key() == b.headKey {
+				continue
+			} else if hc.Val.Parents() != b.headKey {
+				applied = append(applied, b.backfill(ctx, hc.Val)...)
+			}
+			applied = append(applied, &api.HeadChange{Type: "apply", Val: hc.Val})
+			b.headKey, b.headHeight = hc.Val.Key(), hc.Val.Height()
+		case "revert":
+			applied = append(applied, hc)
+			b.headKey, b.headHeight = hc.Val.Parents(), hc.Val.Height()-1
+		}
+	}
+	return applied
+}
+
+// backfill returns changes applying the tipsets between the current head and ts, oldest first. At most
+// the size of the backlog tipsets are fetched. If ts is not descended from the head the tipsets above the
+// head's height are returned.
+func (b *HeadBacklog) backfill(ctx context.Context, ts *types.TipSet) []*api.HeadChange {
+	reportEvent(ctx, headGapDetected)
+	b.logger.Info("Detected gap in head changes", "head", b.headHeight, "new_head", ts.Height())
+	if b.cache == nil {
+		return nil
+	}
+
+	var missed []*types.TipSet
+	key := ts.Parents()
+	for len(missed) < b.size && key != b.headKey {
+		pts, err := cachedTipSet(ctx, b.cache, key)
+		if err != nil {
+			b.logger.Error(err, "failed to fetch tipset to fill gap in head changes", "tsk", key)
+			break
+		}
+		if pts.Height() <= b.headHeight {
+			break
+		}
+		missed = append(missed, pts)
+		key = pts.Parents()
+	}
+
+	changes := make([]*api.HeadChange, 0, len(missed))
+	for i := len(missed) - 1; i >= 0; i-- {
+		changes = append(changes, &api.HeadChange{Type: "apply", Val: missed[i]})
+	}
+	reportSize(ctx, headGapBackfilled, len(changes))
+	return changes
+}
+
+// cachedTipSet reads the blocks of a tipset through the cache.
+func cachedTipSet(ctx context.Context, cache BlockCache, tsk types.TipSetKey) (*types.TipSet, error) {
+	cids := tsk.Cids()
+	blks := make([]*types.BlockHeader, len(cids))
+	for i, c := range cids {
+		blk, err := cache.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		bh, err := types.DecodeBlock(blk.RawData())
+		if err != nil {
+			return nil, fmt.Errorf("decode block: %w", err)
+		}
+		blks[i] = bh
+	}
+	return types.NewTipSet(blks)
+}
+
+func (b *HeadBacklog) add(applied []*api.HeadChange) {
+	if len(applied) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.changes = append(b.changes, applied...)
+	if excess := len(b.changes) - b.size; excess > 0 {
+		b.oldest = b.changes[excess-1].Val.Height()
+		b.changes = append(b.changes[:0:0], b.changes[excess:]...)
+	}
+
+	for sub := range b.subs {
+		select {
+		case sub <- applied:
+		default:
+			delete(b.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// Subscribe returns a channel that first receives the head changes in the backlog at or above the epoch
+// from, followed by new head changes as they are reported by the node. It returns ErrBacklogTooOld if
+// changes at the epoch may have been dropped from the backlog.
+func (b *HeadBacklog) Subscribe(ctx context.Context, from abi.ChainEpoch) (<-chan []*api.HeadChange, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.oldest >= 0 && from <= b.oldest {
+		return nil, fmt.Errorf("%w: %d", ErrBacklogTooOld, from)
+	}
+
+	var replay []*api.HeadChange
+	for _, hc := range b.changes {
+		if hc.Val.Height() >= from {
+			replay = append(replay, hc)
+		}
+	}
+
+	sub := make(chan []*api.HeadChange, len(replay)+headBacklogSubscriberBuffer)
+	for _, hc := range replay {
+		sub <- []*api.HeadChange{hc}
+	}
+	b.subs[sub] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[sub]; ok {
+			delete(b.subs, sub)
+			close(sub)
+		}
+	}()
+
+	return sub, nil
+}
+
+func (b *HeadBacklog) closeSubscribers() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub)
+	}
+}
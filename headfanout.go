@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/go-logr/logr"
+)
+
+// headFanoutRetryInterval is the time to wait before resubscribing to the node's head changes after the
+// subscription ends.
+const headFanoutRetryInterval = 5 * time.Second
+
+// headFanoutBuffer is the number of sets of head changes buffered for each consumer. A consumer that falls
+// further behind delays the others.
+const headFanoutBuffer = 16
+
+// HeadNotifier is the subset of the node api needed to follow head changes.
+type HeadNotifier interface {
+	ChainNotify(ctx context.Context) (<-chan []*api.HeadChange, error)
+}
+
+// HeadConsumer follows the node's head changes passed to it by a HeadFanout.
+type HeadConsumer interface {
+	// HeadChanges is called with each set of head changes reported by the node, starting with the current
+	// head each time the fan-out subscribes.
+	HeadChanges(ctx context.Context, changes []*api.HeadChange)
+}
+
+// HeadLossHandler is implemented by head consumers that need to know when head changes may have been missed.
+type HeadLossHandler interface {
+	// HeadsLost is called when the fan-out's subscription ends, after which head changes are missed until
+	// it resubscribes. It is also called when the fan-out stops, with a cancelled context.
+	HeadsLost(ctx context.Context)
+}
+
+// HeadFanout subscribes once to the node's head changes and passes them to each of its consumers,
+// resubscribing when the subscription ends. Each consumer is called from its own goroutine, in the order
+// the changes were reported, so that a slow consumer does not hold up the others.
+type HeadFanout struct {
+	node      HeadNotifier
+	logger    logr.Logger
+	consumers []HeadConsumer
+}
+
+func NewHeadFanout(node HeadNotifier, logger logr.Logger) *HeadFanout {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	return &HeadFanout{
+		node:   node,
+		logger: logger.V(LogLevelInfo),
+	}
+}
+
+// Add adds a consumer of the head changes. Consumers must be added before Run is called.
+func (f *HeadFanout) Add(c HeadConsumer) {
+	f.consumers = append(f.consumers, c)
+}
+
+// Run follows the node's head changes until the context is cancelled, returning once every consumer has
+// handled the changes passed to it.
+func (f *HeadFanout) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	queues := make([]chan []*api.HeadChange, len(f.consumers))
+	for i, c := range f.consumers {
+		queues[i] = make(chan []*api.HeadChange, headFanoutBuffer)
+		wg.Add(1)
+		go func(c HeadConsumer, q <-chan []*api.HeadChange) {
+			defer wg.Done()
+			consumeHeads(ctx, c, q)
+		}(c, queues[i])
+	}
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+		wg.Wait()
+	}()
+
+	// A nil set of changes tells the consumers the subscription ended
+	send := func(changes []*api.HeadChange) {
+		for _, q := range queues {
+			select {
+			case q <- changes:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	for {
+		ch, err := f.node.ChainNotify(ctx)
+		if err != nil {
+			f.logger.Error(err, "failed to subscribe to head changes")
+		} else {
+			for changes := range ch {
+				if changes != nil {
+					send(changes)
+				}
+			}
+			f.logger.Info("Head change subscription ended")
+		}
+		send(nil)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(headFanoutRetryInterval):
+		}
+	}
+}
+
+// consumeHeads passes the head changes received from q to c until q is closed.
+func consumeHeads(ctx context.Context, c HeadConsumer, q <-chan []*api.HeadChange) {
+	lh, _ := c.(HeadLossHandler)
+	for changes := range q {
+		if changes != nil {
+			c.HeadChanges(ctx, changes)
+		} else if lh != nil {
+			lh.HeadsLost(ctx)
+		}
+	}
+	if lh != nil {
+		lh.HeadsLost(ctx)
+	}
+}
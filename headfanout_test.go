@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// stubNotifier is a node whose head change subscriptions are fed by the test.
+type stubNotifier struct {
+	mu   sync.Mutex
+	subs []chan []*api.HeadChange
+}
+
+func (s *stubNotifier) ChainNotify(ctx context.Context) (<-chan []*api.HeadChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan []*api.HeadChange, 1)
+	s.subs = append(s.subs, ch)
+	return ch, nil
+}
+
+// subscription waits for the node's nth subscription.
+func (s *stubNotifier) subscription(t *testing.T, n int) chan []*api.HeadChange {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		if len(s.subs) > n {
+			ch := s.subs[n]
+			s.mu.Unlock()
+			return ch
+		}
+		s.mu.Unlock()
+	}
+	t.Fatalf("node was not subscribed to")
+	return nil
+}
+
+func (s *stubNotifier) subscriptions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs)
+}
+
+type recordingConsumer struct {
+	changes chan []*api.HeadChange
+}
+
+func (r *recordingConsumer) HeadChanges(ctx context.Context, changes []*api.HeadChange) {
+	r.changes <- changes
+}
+
+type lossRecordingConsumer struct {
+	recordingConsumer
+	lost chan error
+}
+
+func (r *lossRecordingConsumer) HeadsLost(ctx context.Context) {
+	r.lost <- ctx.Err()
+}
+
+func TestHeadFanout(t *testing.T) {
+	tc := newTestChain(t, 0, 1, 2)
+	node := &stubNotifier{}
+	fanout := NewHeadFanout(node, nil)
+	plain := &recordingConsumer{changes: make(chan []*api.HeadChange, 10)}
+	lossy := &lossRecordingConsumer{recordingConsumer{changes: make(chan []*api.HeadChange, 10)}, make(chan error, 10)}
+	fanout.Add(plain)
+	fanout.Add(lossy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		fanout.Run(ctx)
+		close(done)
+	}()
+
+	sub := node.subscription(t, 0)
+	sub <- []*api.HeadChange{{Type: "current", Val: tc.tipsets[1]}}
+	sub <- []*api.HeadChange{{Type: "apply", Val: tc.tipsets[2]}}
+	for _, c := range []*recordingConsumer{plain, &lossy.recordingConsumer} {
+		for _, want := range []*types.TipSet{tc.tipsets[1], tc.tipsets[2]} {
+			select {
+			case changes := <-c.changes:
+				if changes[0].Val.Key() != want.Key() {
+					t.Fatalf("consumer received tipset at height %d, wanted %d", changes[0].Val.Height(), want.Height())
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("consumer did not receive head changes")
+			}
+		}
+	}
+	if n := node.subscriptions(); n != 1 {
+		t.Errorf("node was subscribed to %d times, wanted 1", n)
+	}
+
+	// Consumers that handle lost heads are told when the subscription ends and when the fan-out stops
+	close(sub)
+	select {
+	case err := <-lossy.lost:
+		if err != nil {
+			t.Errorf("heads lost at end of subscription with context error %v, wanted none", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer was not told the subscription ended")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("fan-out did not stop")
+	}
+	select {
+	case err := <-lossy.lost:
+		if err == nil {
+			t.Errorf("heads lost when the fan-out stopped without a context error")
+		}
+	default:
+		t.Errorf("consumer was not told the fan-out stopped")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Health is a detailed report of the health of the proxy's dependencies.
+type Health struct {
+	Healthy       bool              `json:"healthy"`
+	Upstream      *UpstreamHealth   `json:"upstream"`
+	Fallbacks     []*UpstreamHealth `json:"fallbacks,omitempty"`       // fallback nodes in priority order
+	Active        string            `json:"active_upstream,omitempty"` // address of the lotus node answering calls
+	Store         *StoreHealth      `json:"store,omitempty"`
+	Subscriptions map[string]int    `json:"subscriptions"` // active subscriptions keyed by method
+}
+
+// UpstreamHealth reports the state of the connection to the lotus node.
+type UpstreamHealth struct {
+	Address           string     `json:"address"`
+	State             string     `json:"state"`                 // state of the circuit breaker
+	Version           string     `json:"version,omitempty"`     // version of lotus reported by the node
+	APIVersion        string     `json:"api_version,omitempty"` // version of the api served by the node
+	ConsecutiveErrors int        `json:"consecutive_errors"`    // number of failed calls since the last successful one
+	LastSuccess       *time.Time `json:"last_success,omitempty"`
+	LastError         string     `json:"last_error,omitempty"`
+	LastErrorTime     *time.Time `json:"last_error_time,omitempty"`
+}
+
+// StoreHealth reports the state of the gonudb store.
+type StoreHealth struct {
+	Open    bool   `json:"open"`
+	Records int64  `json:"records"`
+	Error   string `json:"error,omitempty"` // error reported by the store's background flushing, if any
+}
+
+// UpstreamHealthReporter is implemented by upstream clients that can report the health of their connection.
+type UpstreamHealthReporter interface {
+	UpstreamHealth() *UpstreamHealth
+}
+
+// SubscriptionCounter is implemented by proxies that can report their active subscriptions.
+type SubscriptionCounter interface {
+	SubscriptionCounts() map[string]int
+}
+
+// Health returns a detailed health report. The proxy is healthy when the circuit of the upstream node, or
+// of any fallback node, is closed and the store, if any, has not reported an error.
+func (s *StatusReporter) Health() *Health {
+	h := &Health{
+		Upstream:      &UpstreamHealth{State: CircuitDisconnected},
+		Subscriptions: map[string]int{},
+	}
+
+	if uh, ok := s.circuit.(UpstreamHealthReporter); ok {
+		h.Upstream = uh.UpstreamHealth()
+	}
+	if au, ok := s.circuit.(ActiveUpstreamReporter); ok {
+		h.Fallbacks = au.FallbackHealth()
+		h.Active = au.ActiveUpstream()
+	}
+
+	if s.store != nil {
+		h.Store = &StoreHealth{
+			Open:    true,
+			Records: int64(s.store.RecordCount()),
+		}
+		if err := s.store.Err(); err != nil {
+			h.Store.Error = err.Error()
+		}
+	}
+
+	if s.subs != nil {
+		h.Subscriptions = s.subs.SubscriptionCounts()
+	}
+
+	upstreamOK := h.Upstream.State == CircuitClosed
+	for _, f := range h.Fallbacks {
+		upstreamOK = upstreamOK || f.State == CircuitClosed
+	}
+	h.Healthy = upstreamOK && (h.Store == nil || h.Store.Error == "")
+	return h
+}
+
+// healthHandler serves the detailed health report as JSON, responding with 503 Service Unavailable when
+// the proxy is not healthy.
+func healthHandler(sr *StatusReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := sr.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if !h.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(h)
+	})
+}
+
+// livenessHandler responds with 200 OK while the proxy is able to serve http requests, for use as a
+// liveness probe. It does not depend on the lotus node so that an unavailable node does not cause the
+// proxy to be restarted.
+func livenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+}
+
+// readinessHandler responds with 200 OK when the proxy can serve calls, for use as a readiness probe so that
+// traffic is not routed to a proxy that cannot reach a lotus node. The proxy is ready when the circuit of the
+// upstream node, or of any fallback node, is closed and the store, if any, is open and has not reported an
+// error. Otherwise it responds with 503 Service Unavailable and the reason.
+func readinessHandler(sr *StatusReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := sr.Health()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if h.Healthy {
+			_, _ = w.Write([]byte("ready\n"))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if h.Store != nil && h.Store.Error != "" {
+			_, _ = w.Write([]byte("not ready: store error: " + h.Store.Error + "\n"))
+			return
+		}
+		_, _ = w.Write([]byte("not ready: no lotus node circuit is closed, upstream circuit is " + h.Upstream.State + "\n"))
+	})
+}
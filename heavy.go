@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// heavyMethods are methods that can place significant load on the upstream node and must be
+// explicitly enabled.
+var heavyMethods = map[string]bool{
+	"StateCall":    true,
+	"StateCompute": true,
+}
+
+var (
+	ErrMethodDisabled = errors.New("method is disabled")
+	ErrMethodBusy     = errors.New("too many concurrent calls to heavy methods")
+)
+
+// HeavyMethodOptions configure the guardrails applied to heavy methods.
+type HeavyMethodOptions struct {
+	Enabled     []string      // names of heavy methods that may be called
+	Timeout     time.Duration // maximum duration of a call, including time spent waiting to start, zero for no limit
+	Concurrency int           // maximum number of heavy method calls in progress at once, zero for no limit
+}
+
+// HeavyMethodGuard is method middleware that rejects calls to heavy methods that have not been
+// enabled and limits the duration and concurrency of those that have.
+type HeavyMethodGuard struct {
+	enabled map[string]bool
+	timeout time.Duration
+	sem     chan struct{}
+}
+
+func NewHeavyMethodGuard(opts HeavyMethodOptions) (*HeavyMethodGuard, error) {
+	g := &HeavyMethodGuard{
+		enabled: map[string]bool{},
+		timeout: opts.Timeout,
+	}
+	for _, m := range opts.Enabled {
+		if !heavyMethods[m] {
+			return nil, fmt.Errorf("unknown heavy method %q", m)
+		}
+		g.enabled[m] = true
+	}
+	if opts.Concurrency > 0 {
+		g.sem = make(chan struct{}, opts.Concurrency)
+	}
+	return g, nil
+}
+
+func (g *HeavyMethodGuard) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		if !heavyMethods[call.Method] {
+			return next(ctx, call)
+		}
+		if !g.enabled[call.Method] {
+			return nil, fmt.Errorf("%w: %s must be enabled by the proxy operator", ErrMethodDisabled, call.Method)
+		}
+
+		if g.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, g.timeout)
+			defer cancel()
+		}
+
+		if g.sem != nil {
+			select {
+			case g.sem <- struct{}{}:
+				defer func() { <-g.sem }()
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w: %s", ErrMethodBusy, call.Method)
+			}
+		}
+
+		return next(ctx, call)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/go-logr/logr"
+)
+
+// heightIndexMaxNullRounds is the longest run of null rounds searched when answering a lookup for a height
+// with no tipset.
+const heightIndexMaxNullRounds = 900
+
+// heightIndexRepairDepth is the maximum number of tipsets walked back through the cache to repair the index
+// after a reorg or a gap in the head changes. The index below is discarded if the walk does not rejoin it.
+const heightIndexRepairDepth = 900
+
+// heightIndexSeedBatch is the number of records appended to the index file at a time while seeding it.
+const heightIndexSeedBatch = 1000
+
+// heightIndexEntry is a tipset recorded in the index.
+type heightIndexEntry struct {
+	Key     types.TipSetKey
+	Parents types.TipSetKey
+}
+
+// heightIndexRecord is a line of the index file, either adding a tipset at a height or deleting the tipset
+// at a height.
+type heightIndexRecord struct {
+	Height  abi.ChainEpoch   `json:"height"`
+	Key     *types.TipSetKey `json:"key,omitempty"`
+	Parents *types.TipSetKey `json:"parents,omitempty"`
+}
+
+// HeightIndex maps heights of the chain followed by the node to the keys of its tipsets so that
+// ChainGetTipSetByHeight can be answered from the block cache. It is populated from the node's head
+// changes and persisted to an append-only file that is compacted when the index is opened.
+//
+// Reverted tipsets are removed from the index. When an applied tipset does not follow the tipset below it
+// in the index, such as after a reorg that was missed while resubscribing, its ancestors are fetched
+// through the cache and replace the index entries until the two chains rejoin.
+type HeightIndex struct {
+	path   string
+	cache  BlockCache // used to repair the index after a reorg
+	logger logr.Logger
+
+	mu      sync.Mutex // guards fields below
+	file    *os.File
+	entries map[abi.ChainEpoch]heightIndexEntry
+	heights map[types.TipSetKey]abi.ChainEpoch
+	head    abi.ChainEpoch // height of the most recently applied tipset, -1 if none
+}
+
+// OpenHeightIndex opens the index persisted at path, creating it if it does not exist.
+func OpenHeightIndex(path string, cache BlockCache, logger logr.Logger) (*HeightIndex, error) {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	x := &HeightIndex{
+		path:    path,
+		cache:   cache,
+		logger:  logger.V(LogLevelInfo),
+		entries: map[abi.ChainEpoch]heightIndexEntry{},
+		heights: map[types.TipSetKey]abi.ChainEpoch{},
+		head:    -1,
+	}
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	if err := x.compact(); err != nil {
+		return nil, err
+	}
+	x.logger.Info("Opened height index", "path", path, "tipsets", len(x.entries), "head", x.head)
+	return x, nil
+}
+
+// load replays the records in the index file.
+func (x *HeightIndex) load() error {
+	f, err := os.Open(x.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("open height index: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec heightIndexRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A partial record may be left by a crash while appending
+			x.logger.Info("Ignoring invalid height index record", "error", err.Error())
+			continue
+		}
+		if rec.Key == nil {
+			x.delete(rec.Height)
+			continue
+		}
+		var parents types.TipSetKey
+		if rec.Parents != nil {
+			parents = *rec.Parents
+		}
+		x.set(rec.Height, heightIndexEntry{Key: *rec.Key, Parents: parents})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read height index: %w", err)
+	}
+	return nil
+}
+
+// compact rewrites the index file to hold only the current entries and opens it for appending.
+func (x *HeightIndex) compact() error {
+	tmp, err := os.Create(x.path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("create height index: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for h, e := range x.entries {
+		e := e
+		if err := enc.Encode(heightIndexRecord{Height: h, Key: &e.Key, Parents: &e.Parents}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write height index: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write height index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write height index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), x.path); err != nil {
+		return fmt.Errorf("replace height index: %w", err)
+	}
+
+	x.file, err = os.OpenFile(x.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open height index: %w", err)
+	}
+	return nil
+}
+
+// Close closes the index file.
+func (x *HeightIndex) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.file.Close()
+}
+
+// HeadChanges updates the index with a set of head changes.
+func (x *HeightIndex) HeadChanges(ctx context.Context, changes []*api.HeadChange) {
+	ctx = withFillOrigin(ctx, fillOriginIndex)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var recs []heightIndexRecord
+	for _, hc := range changes {
+		switch hc.Type {
+		case "current", "apply":
+			recs = append(recs, x.apply(ctx, hc.Val)...)
+		case "revert":
+			if e, ok := x.entries[hc.Val.Height()]; ok && e.Key == hc.Val.Key() {
+				x.delete(hc.Val.Height())
+				recs = append(recs, heightIndexRecord{Height: hc.Val.Height()})
+			}
+		}
+	}
+	x.write(recs)
+}
+
+// apply adds a tipset to the index, removing any entries above it and repairing the entries below it if they
+// are not its ancestors. It returns the records to be appended to the index file.
+func (x *HeightIndex) apply(ctx context.Context, ts *types.TipSet) []heightIndexRecord {
+	var recs []heightIndexRecord
+	for h, top := ts.Height(), x.head; h <= top; h++ {
+		if _, ok := x.entries[h]; ok {
+			x.delete(h)
+			recs = append(recs, heightIndexRecord{Height: h})
+		}
+	}
+
+	key, parents := ts.Key(), ts.Parents()
+	x.set(ts.Height(), heightIndexEntry{Key: key, Parents: parents})
+	recs = append(recs, heightIndexRecord{Height: ts.Height(), Key: &key, Parents: &parents})
+
+	// Walk back until the index joins the chain of the applied tipset
+	height := ts.Height()
+	for i := 0; i < heightIndexRepairDepth; i++ {
+		below, ok := x.below(height)
+		if !ok || x.entries[below].Key == parents {
+			return recs
+		}
+		pts, err := cachedTipSet(ctx, x.cache, parents)
+		if err != nil {
+			x.logger.Error(err, "failed to fetch tipset to repair height index", "tsk", parents)
+			break
+		}
+		for h := pts.Height(); h < height; h++ {
+			if _, ok := x.entries[h]; ok {
+				x.delete(h)
+				recs = append(recs, heightIndexRecord{Height: h})
+			}
+		}
+		pkey, pparents := pts.Key(), pts.Parents()
+		x.set(pts.Height(), heightIndexEntry{Key: pkey, Parents: pparents})
+		recs = append(recs, heightIndexRecord{Height: pts.Height(), Key: &pkey, Parents: &pparents})
+		height, parents = pts.Height(), pparents
+	}
+
+	// The index below could not be joined to the chain so it can no longer be trusted
+	x.logger.Info("Discarding height index below unrepaired height", "height", height)
+	for h := range x.entries {
+		if h < height {
+			x.delete(h)
+			recs = append(recs, heightIndexRecord{Height: h})
+		}
+	}
+	return recs
+}
+
+// below returns the highest height below h that has an entry, searching no further than the longest run
+// of null rounds.
+func (x *HeightIndex) below(h abi.ChainEpoch) (abi.ChainEpoch, bool) {
+	for b := h - 1; b >= 0 && b >= h-heightIndexMaxNullRounds; b-- {
+		if _, ok := x.entries[b]; ok {
+			return b, true
+		}
+	}
+	return 0, false
+}
+
+// above returns the lowest height above h and no higher than max that has an entry, searching no further
+// than the longest run of null rounds.
+func (x *HeightIndex) above(h abi.ChainEpoch, max abi.ChainEpoch) (abi.ChainEpoch, bool) {
+	for a := h + 1; a <= max && a <= h+heightIndexMaxNullRounds; a++ {
+		if _, ok := x.entries[a]; ok {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+func (x *HeightIndex) set(h abi.ChainEpoch, e heightIndexEntry) {
+	x.delete(h)
+	x.entries[h] = e
+	x.heights[e.Key] = h
+	if h > x.head {
+		x.head = h
+	}
+}
+
+func (x *HeightIndex) delete(h abi.ChainEpoch) {
+	e, ok := x.entries[h]
+	if !ok {
+		return
+	}
+	delete(x.entries, h)
+	delete(x.heights, e.Key)
+	if h == x.head {
+		if b, ok := x.below(h); ok {
+			x.head = b
+			return
+		}
+		x.head = -1
+		for eh := range x.entries {
+			if eh > x.head {
+				x.head = eh
+			}
+		}
+	}
+}
+
+// Seed adds the tipsets of the chain ending at tsk, down to height low, to the index, reading them through
+// the cache. Heights that already have an entry are left unchanged. It returns the number of tipsets added
+// and stops at the first tipset that cannot be read.
+func (x *HeightIndex) Seed(ctx context.Context, tsk types.TipSetKey, low abi.ChainEpoch) (int, error) {
+	ctx = withFillOrigin(ctx, fillOriginIndex)
+	added := 0
+	var recs []heightIndexRecord
+	flush := func() {
+		x.mu.Lock()
+		x.write(recs)
+		x.mu.Unlock()
+		recs = recs[:0]
+	}
+	defer flush()
+
+	for {
+		ts, err := cachedTipSet(ctx, x.cache, tsk)
+		if err != nil {
+			return added, fmt.Errorf("fetch tipset %s: %w", tsk, err)
+		}
+		x.mu.Lock()
+		if _, ok := x.entries[ts.Height()]; !ok {
+			key, parents := ts.Key(), ts.Parents()
+			x.set(ts.Height(), heightIndexEntry{Key: key, Parents: parents})
+			recs = append(recs, heightIndexRecord{Height: ts.Height(), Key: &key, Parents: &parents})
+			added++
+		}
+		x.mu.Unlock()
+		if len(recs) >= heightIndexSeedBatch {
+			flush()
+		}
+		if ts.Height() <= low || ts.Height() == 0 {
+			return added, nil
+		}
+		tsk = ts.Parents()
+	}
+}
+
+// write appends records to the index file.
+func (x *HeightIndex) write(recs []heightIndexRecord) {
+	if len(recs) == 0 {
+		return
+	}
+	var buf []byte
+	for _, rec := range recs {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			x.logger.Error(err, "failed to encode height index record")
+			return
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	if _, err := x.file.Write(buf); err != nil {
+		x.logger.Error(err, "failed to write height index")
+	}
+}
+
+// Lookup returns the key of the tipset at height h in the chain ending at the tipset tsk, or in the chain
+// of the most recently applied tipset if tsk is empty. Like the node it returns the tipset before a run of
+// null rounds when h is a null round. It reports false if the index cannot answer, in which case the node
+// should be asked.
+func (x *HeightIndex) Lookup(h abi.ChainEpoch, tsk types.TipSetKey) (types.TipSetKey, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	top := x.head
+	if tsk != types.EmptyTSK {
+		th, ok := x.heights[tsk]
+		if !ok {
+			return types.EmptyTSK, false
+		}
+		top = th
+	}
+	if top < 0 || h < 0 || h > top {
+		return types.EmptyTSK, false
+	}
+
+	if e, ok := x.entries[h]; ok {
+		return e.Key, true
+	}
+
+	// A height with no entry is a null round only if the tipsets either side of it are linked
+	b, ok := x.below(h)
+	if !ok {
+		return types.EmptyTSK, false
+	}
+	a, ok := x.above(h, top)
+	if !ok || x.entries[a].Parents != x.entries[b].Key {
+		return types.EmptyTSK, false
+	}
+	return x.entries[b].Key, true
+}
@@ -1,50 +1,443 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-ipfs-blockstore"
+	"go.opencensus.io/tag"
 )
 
-var _ (BlockCache) = (*HttpBlockCache)(nil)
+var (
+	_ (BlockCache)       = (*HttpBlockCache)(nil)
+	_ (BlockRangeReader) = (*HttpBlockCache)(nil)
+)
+
+// HttpClientOptions controls the behaviour of the http client used to fetch blocks from a remote blockstore.
+type HttpClientOptions struct {
+	Timeout             time.Duration // maximum time allowed for a single request, including reading the body
+	Retries             int           // number of times a failed request is retried before giving up
+	RetryWait           time.Duration // time to wait between retries
+	MaxIdleConns        int           // maximum number of idle connections across all hosts
+	MaxIdleConnsPerHost int           // maximum number of idle connections to keep per host
+	MaxConnsPerHost     int           // maximum number of connections per host, zero means no limit
+	ETagCacheSize       int           // number of block etags to remember for revalidation, zero disables conditional requests
+	RaceMirrors         bool          // whether to race requests to the first two mirrors
+	RaceStagger         time.Duration // time to wait for the first mirror to respond before racing the second
+	RankMirrors         bool          // whether to favour mirrors with the lowest recent latency and error rate
+	WriteThrough        bool          // whether to write blocks filled from upstream to the first mirror
+
+	Headers        http.Header     // additional headers to send with every request
+	BearerToken    string          // optional token sent in an Authorization header
+	AWSCredentials *AWSCredentials // optional credentials used to sign requests with AWS signature version 4
+	AWSRegion      string          // region used when signing requests
+	RequesterPays  bool            // whether to acknowledge that the requester pays for access to the bucket
+}
+
+var DefaultHttpClientOptions = HttpClientOptions{
+	Timeout:             30 * time.Second,
+	Retries:             2,
+	RetryWait:           100 * time.Millisecond,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 100,
+	ETagCacheSize:       100000,
+	RaceStagger:         50 * time.Millisecond,
+}
+
+func newHttpClient(opts HttpClientOptions) *http.Client {
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if len(opts.Headers) > 0 || opts.BearerToken != "" || opts.AWSCredentials != nil || opts.RequesterPays {
+		at := &authTransport{
+			base:          transport,
+			headers:       opts.Headers,
+			bearerToken:   opts.BearerToken,
+			requesterPays: opts.RequesterPays,
+		}
+		if opts.AWSCredentials != nil {
+			at.signer = newSigV4Signer(*opts.AWSCredentials, opts.AWSRegion, "s3")
+		}
+		transport = at
+	}
+
+	return &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: transport,
+	}
+}
+
+// authTransport adds authentication and any configured headers to outgoing requests.
+type authTransport struct {
+	base          http.RoundTripper
+	headers       http.Header
+	bearerToken   string
+	requesterPays bool
+	signer        *sigv4Signer
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the original request
+	req = req.Clone(req.Context())
+	for k, vs := range t.headers {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if t.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+t.bearerToken)
+	}
+	if t.requesterPays {
+		req.Header.Set("X-Amz-Request-Payer", "requester")
+	}
+	if t.signer != nil {
+		t.signer.Sign(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// parseHeaders parses a list of headers in the form "Name: value".
+func parseHeaders(hs []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, h := range hs {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected form \"Name: value\"", h)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return headers, nil
+}
+
+// httpResult is a response from a blockstore mirror with its body fully read.
+type httpResult struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// found reports whether the response indicates the blockstore holds the block.
+func (r *httpResult) found() bool {
+	return r.StatusCode == http.StatusOK || r.StatusCode == http.StatusPartialContent || r.StatusCode == http.StatusNotModified
+}
 
 type HttpBlockCache struct {
-	base     string
-	hc       *http.Client
-	upstream BlockCache
-	name     string
+	mu          sync.RWMutex // guards mirrors and ranking
+	mirrors     []string
+	hc          *http.Client
+	retries     int
+	retryWait   time.Duration
+	race        bool           // whether to race requests to multiple mirrors
+	raceStagger time.Duration  // time to wait for the first mirror before racing the next
+	rank        bool           // whether to rank mirrors by their recent performance
+	ranking     *mirrorRanking // recent performance of the mirrors, nil to try them in the configured order
+	etags       *lru.Cache     // etags of blocks known to be present in the blockstore, keyed by cid
+	writes      chan struct{}  // limits concurrent writes to the blockstore, nil when not writing through
+	upstream    BlockCache
+	name        string
+}
+
+// httpWriteConcurrency is the maximum number of blocks written to the blockstore at once when writing
+// through. Blocks filled while this many writes are in progress are not written.
+const httpWriteConcurrency = 8
+
+// NewHttpBlockCache creates a cache that reads blocks from one or more blockstore mirrors. Mirrors
+// are tried in order until one responds with the block, or in order of their recent performance if
+// ranking is enabled.
+func NewHttpBlockCache(mirrors []string, name string, opts *HttpClientOptions) *HttpBlockCache {
+	if opts == nil {
+		opts = &DefaultHttpClientOptions
+	}
+
+	bc := &HttpBlockCache{
+		name:        name,
+		hc:          newHttpClient(*opts),
+		retries:     opts.Retries,
+		retryWait:   opts.RetryWait,
+		race:        opts.RaceMirrors,
+		raceStagger: opts.RaceStagger,
+		rank:        opts.RankMirrors,
+	}
+	bc.SetMirrors(mirrors)
+
+	if opts.ETagCacheSize > 0 {
+		// Only errors if size is not positive
+		bc.etags, _ = lru.New(opts.ETagCacheSize)
+	}
+
+	if opts.WriteThrough {
+		bc.writes = make(chan struct{}, httpWriteConcurrency)
+	}
+
+	return bc
+}
+
+// SetMirrors replaces the blockstore mirrors. The recent performance of mirrors that are kept is retained.
+func (bc *HttpBlockCache) SetMirrors(mirrors []string) {
+	bases := make([]string, 0, len(mirrors))
+	for _, base := range mirrors {
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		bases = append(bases, base)
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.mirrors = bases
+	if bc.rank && len(bases) > 1 {
+		bc.ranking = newMirrorRanking(bases, bc.ranking)
+	} else {
+		bc.ranking = nil
+	}
+}
+
+// Mirrors returns the base urls of the blockstore mirrors in their configured order.
+func (bc *HttpBlockCache) Mirrors() []string {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.mirrors
+}
+
+// mirrorOrder returns the mirrors in the order they should be tried for a request.
+func (bc *HttpBlockCache) mirrorOrder() []string {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if bc.ranking == nil {
+		return bc.mirrors
+	}
+	return bc.ranking.order()
+}
+
+// fetch requests the block from the configured mirrors, returning the first response that
+// indicates the block was found. If no mirror has the block then the last response received
+// is returned.
+func (bc *HttpBlockCache) fetch(ctx context.Context, method string, c cid.Cid, headers http.Header) (*httpResult, error) {
+	mirrors := bc.mirrorOrder()
+	if len(mirrors) == 0 {
+		return nil, fmt.Errorf("no blockstore mirrors configured")
+	}
+	if bc.race && method == http.MethodGet && len(mirrors) > 1 {
+		return bc.fetchRace(ctx, mirrors, method, c, headers)
+	}
+
+	var (
+		lastRes *httpResult
+		lastErr error
+	)
+	for _, base := range mirrors {
+		res, err := bc.fetchMirror(ctx, base, method, c, headers)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if res.found() {
+			return res, nil
+		}
+		lastRes = res
+	}
+
+	if lastRes != nil {
+		return lastRes, nil
+	}
+	return nil, lastErr
+}
+
+// fetchRace sends the request to the first mirror and, if it has not responded within the
+// stagger period, to the second mirror too, taking whichever finds the block first. Remaining
+// mirrors are only tried when one of the earlier requests fails.
+func (bc *HttpBlockCache) fetchRace(ctx context.Context, mirrors []string, method string, c cid.Cid, headers http.Header) (*httpResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type outcome struct {
+		res *httpResult
+		err error
+	}
+
+	results := make(chan outcome, len(mirrors))
+	next := 0
+	launch := func() {
+		base := mirrors[next]
+		next++
+		go func() {
+			res, err := bc.fetchMirror(ctx, base, method, c, headers)
+			results <- outcome{res: res, err: err}
+		}()
+	}
+
+	launch()
+	pending := 1
+
+	stagger := time.NewTimer(bc.raceStagger)
+	defer stagger.Stop()
+
+	var (
+		lastRes *httpResult
+		lastErr error
+	)
+	for pending > 0 {
+		select {
+		case <-stagger.C:
+			if next == 1 {
+				reportEvent(ctx, httpRaceLaunched)
+				launch()
+				pending++
+			}
+		case o := <-results:
+			pending--
+			if o.err == nil && o.res.found() {
+				return o.res, nil
+			}
+			if o.err != nil {
+				lastErr = o.err
+			} else {
+				lastRes = o.res
+			}
+			if next < len(mirrors) {
+				launch()
+				pending++
+			}
+		}
+	}
+
+	if lastRes != nil {
+		return lastRes, nil
+	}
+	return nil, lastErr
+}
+
+// fetchMirror issues a request for the block to a single mirror, retrying on transport errors and
+// server errors.
+func (bc *HttpBlockCache) fetchMirror(ctx context.Context, base string, method string, c cid.Cid, headers http.Header) (*httpResult, error) {
+	u := base + c.String() + "/data.raw"
+
+	var lastErr error
+	for attempt := 0; attempt <= bc.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(bc.retryWait):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, vs := range headers {
+			req.Header[k] = vs
+		}
+
+		start := time.Now()
+		resp, err := bc.hc.Do(req)
+		if err != nil {
+			bc.recordMirror(ctx, base, start, true)
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			bc.recordMirror(ctx, base, start, true)
+			lastErr = fmt.Errorf("unexpected status: %s", resp.Status)
+			continue
+		}
+
+		buf, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			bc.recordMirror(ctx, base, start, true)
+			lastErr = err
+			continue
+		}
+		bc.recordMirror(ctx, base, start, false)
+
+		return &httpResult{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       buf,
+		}, nil
+	}
+
+	return nil, lastErr
 }
 
-func NewHttpBlockCache(base string, name string) *HttpBlockCache {
-	if !strings.HasSuffix(base, "/") {
-		base += "/"
+// recordMirror adds the outcome of a request to a mirror that started at start to the mirror's ranking.
+// Requests abandoned because the context was cancelled, such as the loser of a race, are not counted.
+func (bc *HttpBlockCache) recordMirror(ctx context.Context, base string, start time.Time, failed bool) {
+	bc.mu.RLock()
+	ranking := bc.ranking
+	bc.mu.RUnlock()
+	if ranking == nil || ctx.Err() != nil {
+		return
 	}
+	ranking.record(ctx, base, time.Since(start), failed)
+}
 
-	return &HttpBlockCache{
-		base: base,
-		name: name,
-		hc:   &http.Client{},
+// rememberETag records the etag of a block that was found in the blockstore so that later
+// requests can be made conditional.
+func (bc *HttpBlockCache) rememberETag(c cid.Cid, res *httpResult) {
+	if bc.etags == nil {
+		return
+	}
+	if etag := res.Header.Get("ETag"); etag != "" {
+		bc.etags.Add(c, etag)
 	}
 }
 
 func (bc *HttpBlockCache) Has(ctx context.Context, c cid.Cid) (bool, error) {
 	ctx = cacheContext(ctx, bc.name)
-	u := bc.base + c.String() + "/data.raw"
-	resp, err := bc.hc.Head(u)
+
+	// If we have seen the block before then revalidate it using its etag. Blockstores that support
+	// conditional requests will respond with 304 Not Modified and no further work is needed.
+	var headers http.Header
+	if bc.etags != nil {
+		if etag, ok := bc.etags.Get(c); ok {
+			headers = http.Header{"If-None-Match": []string{etag.(string)}}
+		}
+	}
+
+	res, err := bc.fetch(ctx, http.MethodHead, c, headers)
 	if err != nil {
 		if bc.upstream == nil {
 			return false, err
 		}
 		return bc.upstream.Has(ctx, c)
 	}
-	if resp.StatusCode == 200 {
+	if res.StatusCode == http.StatusNotModified {
 		return true, nil
 	}
+	if res.StatusCode == http.StatusOK {
+		bc.rememberETag(c, res)
+		return true, nil
+	}
+	if bc.etags != nil {
+		bc.etags.Remove(c)
+	}
 
 	if bc.upstream == nil {
 		return false, nil
@@ -58,8 +451,9 @@ func (bc *HttpBlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, err
 	stop := startTimer(ctx, getDuration)
 	defer stop()
 
-	u := bc.base + c.String() + "/data.raw"
-	resp, err := bc.hc.Get(u)
+	// Gets are never conditional since the tier keeps no copy of its own to serve on a 304 Not Modified,
+	// and the tier below is usually the lotus node that the blockstore shields
+	res, err := bc.fetch(ctx, http.MethodGet, c, nil)
 	if err != nil {
 		reportEvent(ctx, getFailure)
 		if bc.upstream == nil {
@@ -67,27 +461,164 @@ func (bc *HttpBlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, err
 		}
 		return bc.upstream.Get(ctx, c)
 	}
-	defer resp.Body.Close()
-	buf, err := ioutil.ReadAll(resp.Body)
+	if res.StatusCode == http.StatusOK {
+		bc.rememberETag(c, res)
+		reportEvent(ctx, getHit)
+		reportSize(ctx, getSize, len(res.Body))
+		return blocks.NewBlockWithCid(res.Body, c)
+	}
+	reportEvent(ctx, getMiss)
+
+	if bc.upstream == nil {
+		return nil, blockstore.ErrNotFound
+	}
+
+	blk, err := bc.upstream.Get(ctx, c)
+	if err == nil && bc.writes != nil {
+		bc.fill(ctx, blk)
+	}
+	return blk, err
+}
+
+// fill writes a block that was missing from the blockstore to the first mirror in the background, using
+// a PUT to the same url the block is read from. Blocks are only written if their data matches their cid.
+func (bc *HttpBlockCache) fill(ctx context.Context, blk blocks.Block) {
+	ctx = fillContext(ctx)
+	reportEvent(ctx, fillRequest)
+
+	chkc, err := blk.Cid().Prefix().Sum(blk.RawData())
+	if err != nil {
+		reportFillFailure(ctx, fillReasonHashUnsupported)
+		return
+	}
+	if !chkc.Equals(blk.Cid()) {
+		reportFillFailure(ctx, fillReasonHashMismatch)
+		return
+	}
+
+	mirrors := bc.Mirrors()
+	if len(mirrors) == 0 {
+		reportFillFailure(ctx, fillReasonInsertError)
+		return
+	}
+
+	select {
+	case bc.writes <- struct{}{}:
+	default:
+		reportFillFailure(ctx, fillReasonBusy)
+		return
+	}
+
+	// The write outlives the request so only the request's tags are kept
+	wctx := tag.NewContext(context.Background(), tag.FromContext(ctx))
+	go func() {
+		defer func() { <-bc.writes }()
+		stop := startTimer(wctx, fillDuration)
+		defer stop()
+		etag, err := bc.put(wctx, mirrors[0], blk)
+		if err != nil {
+			reportFillFailure(wctx, fillReasonInsertError)
+			return
+		}
+		// Later checks for the block can revalidate it
+		if bc.etags != nil && etag != "" {
+			bc.etags.Add(blk.Cid(), etag)
+		}
+		reportEvent(wctx, fillSuccess)
+		reportSize(wctx, fillSize, len(blk.RawData()))
+	}()
+}
+
+// put writes a block to a single mirror, retrying on transport errors and server errors. It returns
+// the etag of the written block if the mirror reports one.
+func (bc *HttpBlockCache) put(ctx context.Context, base string, blk blocks.Block) (string, error) {
+	u := base + blk.Cid().String() + "/data.raw"
+
+	var lastErr error
+	for attempt := 0; attempt <= bc.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(bc.retryWait):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(blk.RawData()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+
+		resp, err := bc.hc.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp.Header.Get("ETag"), nil
+		}
+		lastErr = fmt.Errorf("unexpected status: %s", resp.Status)
+		if resp.StatusCode < 500 {
+			return "", lastErr
+		}
+	}
+
+	return "", lastErr
+}
+
+// GetRange reads part of a block using an http range request. Blockstores that don't support
+// range requests will respond with the entire block which is then trimmed to the requested range.
+// Partial data can't be verified against the cid so it is never used to fill a cache.
+func (bc *HttpBlockCache) GetRange(ctx context.Context, c cid.Cid, offset int64, length int64) ([]byte, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	ctx = cacheContext(ctx, bc.name)
+	reportEvent(ctx, getRequest)
+	stop := startTimer(ctx, getDuration)
+	defer stop()
+
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		if length == 0 {
+			return []byte{}, nil
+		}
+		rng = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	res, err := bc.fetch(ctx, http.MethodGet, c, http.Header{"Range": []string{rng}})
 	if err != nil {
 		reportEvent(ctx, getFailure)
 		if bc.upstream == nil {
 			return nil, err
 		}
-		return bc.upstream.Get(ctx, c)
+		return getBlockRange(ctx, bc.upstream, c, offset, length)
 	}
-	if resp.StatusCode == 200 {
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		reportEvent(ctx, getHit)
+		reportSize(ctx, getSize, len(res.Body))
+		return res.Body, nil
+	case http.StatusOK:
+		bc.rememberETag(c, res)
 		reportEvent(ctx, getHit)
-		reportSize(ctx, getSize, len(buf))
-		return blocks.NewBlockWithCid(buf, c)
+		reportSize(ctx, getSize, len(res.Body))
+		return sliceRange(res.Body, offset, length), nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		reportEvent(ctx, getHit)
+		return []byte{}, nil
 	}
-	reportEvent(ctx, getMiss)
 
+	reportEvent(ctx, getMiss)
 	if bc.upstream == nil {
 		return nil, blockstore.ErrNotFound
 	}
-
-	return bc.upstream.Get(ctx, c)
+	return getBlockRange(ctx, bc.upstream, c, offset, length)
 }
 
 func (bc *HttpBlockCache) SetUpstream(u BlockCache) {
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// countingUpstream is a testUpstream that counts the blocks read from it.
+type countingUpstream struct {
+	testUpstream
+	gets int32
+}
+
+func (u *countingUpstream) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	atomic.AddInt32(&u.gets, 1)
+	return u.testUpstream.Get(ctx, c)
+}
+
+func TestHttpBlockCacheWrittenThroughRevalidation(t *testing.T) {
+	ctx := context.Background()
+	mirror := &testMirror{blocks: map[string][]byte{}, reqs: map[string]int{}}
+	srv := httptest.NewServer(mirror)
+	t.Cleanup(srv.Close)
+
+	opts := DefaultHttpClientOptions
+	opts.WriteThrough = true
+	bc := NewHttpBlockCache([]string{srv.URL + "/"}, CacheLayerHttp, &opts)
+	upstream := &countingUpstream{testUpstream: testUpstream{memBlockstore{}}}
+	bc.SetUpstream(upstream)
+
+	blk := blocks.NewBlock([]byte("filled from the lower tier"))
+	upstream.Put(blk)
+
+	if _, err := bc.Get(ctx, blk.Cid()); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	waitFor(t, "write through to the mirror", func() bool { return mirror.has(blk.Cid()) })
+	waitFor(t, "etag of the written block", func() bool { return bc.etags.Contains(blk.Cid()) })
+
+	// Checks for the written block are revalidated with a conditional HEAD
+	has, err := bc.Has(ctx, blk.Cid())
+	if err != nil || !has {
+		t.Fatalf("Has returned %v, %v, wanted true", has, err)
+	}
+	if n := mirror.notModifiedResponses(); n != 1 {
+		t.Errorf("mirror answered %d conditional requests with 304, wanted 1", n)
+	}
+
+	// The block is downloaded from the mirror rather than read from the lower tier again
+	got, err := bc.Get(ctx, blk.Cid())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got.RawData(), blk.RawData()) {
+		t.Fatalf("Get returned %q, wanted %q", got.RawData(), blk.RawData())
+	}
+	if n := mirror.notModifiedResponses(); n != 1 {
+		t.Errorf("mirror answered %d conditional requests with 304, wanted no more for a GET", n)
+	}
+	if n := atomic.LoadInt32(&upstream.gets); n != 1 {
+		t.Errorf("lower tier was read %d times, wanted only the read that filled the mirror", n)
+	}
+}
+
+func TestHttpBlockCachePutRetryCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	opts := DefaultHttpClientOptions
+	opts.Retries = 3
+	opts.RetryWait = time.Hour
+	bc := NewHttpBlockCache([]string{srv.URL + "/"}, CacheLayerHttp, &opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := bc.put(ctx, srv.URL+"/", blocks.NewBlock([]byte("unwritable")))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("put returned %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("put waited %s after its context was done", elapsed)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opencensus.io/tag"
+)
+
+const (
+	clientNameHeader    = "X-Client-Name"
+	anonymousClientName = "anonymous"
+	maxClientNameLength = 64
+)
+
+var clientTag, _ = tag.NewKey("client")
+
+type (
+	clientNameKey     struct{}
+	clientIdentityKey struct{}
+	clientAddrKey     struct{}
+	clientTokenIDKey  struct{}
+)
+
+// withClientName returns a context carrying the client's name, also tagging any metrics recorded with it.
+func withClientName(ctx context.Context, name string) context.Context {
+	ctx = context.WithValue(ctx, clientNameKey{}, name)
+	ctx, _ = tag.New(ctx, tag.Upsert(clientTag, name))
+	return ctx
+}
+
+// withClientIdentity returns a context carrying the name of a client established by verifying its token.
+func withClientIdentity(ctx context.Context, name string) context.Context {
+	return context.WithValue(withClientName(ctx, name), clientIdentityKey{}, name)
+}
+
+// clientIdentity returns the name carried by the verified token of the client making the request carried
+// by the context, empty if the client has not been identified by a token.
+func clientIdentity(ctx context.Context) string {
+	if name, ok := ctx.Value(clientIdentityKey{}).(string); ok {
+		return name
+	}
+	return ""
+}
+
+// clientName returns the name of the client making the request carried by the context.
+func clientName(ctx context.Context) string {
+	if name, ok := ctx.Value(clientNameKey{}).(string); ok {
+		return name
+	}
+	return anonymousClientName
+}
+
+// clientAddr returns the network address of the client making the request carried by the context.
+func clientAddr(ctx context.Context) string {
+	if addr, ok := ctx.Value(clientAddrKey{}).(string); ok {
+		return addr
+	}
+	return ""
+}
+
+// clientTokenID returns an identifier of the bearer token presented by the client making the request carried
+// by the context, empty if it presented none.
+func clientTokenID(ctx context.Context) string {
+	if token, ok := ctx.Value(clientTokenIDKey{}).(string); ok {
+		return token
+	}
+	return ""
+}
+
+// identifyClient is middleware that determines the name, address and token of the client making a
+// request and adds them to the request's context. allowed holds the names clients may give themselves
+// with the X-Client-Name header. Middleware that verifies the request's token replaces the name with the
+// one the token carries.
+func identifyClient(allowed map[string]bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withClientName(r.Context(), requestClientName(r, allowed))
+		ctx = context.WithValue(ctx, clientAddrKey{}, r.RemoteAddr)
+		ctx = context.WithValue(ctx, clientTokenIDKey{}, tokenID(bearerToken(r)))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestClientName returns the client name sent in the X-Client-Name header if it is one of the allowed
+// names. Other names are reported as anonymous since the header is not authenticated and each name becomes
+// a metric series.
+func requestClientName(r *http.Request, allowed map[string]bool) string {
+	if name := sanitizeClientName(r.Header.Get(clientNameHeader)); allowed[name] {
+		return name
+	}
+	return anonymousClientName
+}
+
+// sanitizeClientName restricts client names to a safe set of characters and a bounded length so
+// they can be used as metric tags and in logs.
+func sanitizeClientName(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > maxClientNameLength {
+		s = s[:maxClientNameLength]
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdentifyClient(t *testing.T) {
+	ti := NewTokenIssuer([]byte("0123456789abcdef0123456789abcdef"))
+	named, err := ti.Mint(TokenClaims{Name: "indexer", Scope: ScopeChain})
+	if err != nil {
+		t.Fatalf("mint: %v", err)
+	}
+	// A token carrying a name whose signature is not checked
+	unsigned := "eyJhbGciOiJub25lIn0.eyJuYW1lIjoiaW1wb3N0b3IifQ."
+
+	var got string
+	h := identifyClient(map[string]bool{"explorer": true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientName(r.Context())
+	}))
+	verified := identifyClient(map[string]bool{"explorer": true}, requireToken(ti, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientName(r.Context())
+	})))
+
+	testCases := []struct {
+		name    string
+		handler http.Handler
+		header  string
+		token   string
+		want    string
+	}{
+		{name: "allowed header", handler: h, header: "explorer", want: "explorer"},
+		{name: "unlisted header", handler: h, header: "made-up", want: anonymousClientName},
+		{name: "no header", handler: h, want: anonymousClientName},
+		{name: "unverified token claims", handler: h, token: unsigned, want: anonymousClientName},
+		{name: "verified token", handler: verified, token: string(named), want: "indexer"},
+		{name: "verified token overrides header", handler: verified, header: "explorer", token: string(named), want: "indexer"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got = ""
+			r := httptest.NewRequest(http.MethodPost, "/rpc/v0", nil)
+			if tc.header != "" {
+				r.Header.Set(clientNameHeader, tc.header)
+			}
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			tc.handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tc.want {
+				t.Errorf("client name was %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/chain/types"
+	blockadt "github.com/filecoin-project/specs-actors/actors/util/adt"
+	"github.com/go-logr/logr"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// memBlockstore is an ipld blockstore held in memory.
+type memBlockstore map[cid.Cid]blocks.Block
+
+func (m memBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	blk, ok := m[c]
+	if !ok {
+		return nil, blockstore.ErrNotFound
+	}
+	return blk, nil
+}
+
+func (m memBlockstore) Put(blk blocks.Block) error {
+	m[blk.Cid()] = blk
+	return nil
+}
+
+// testChain is a canned chain of single block tipsets. Each block includes one bls message.
+type testChain struct {
+	bs      memBlockstore
+	tipsets map[abi.ChainEpoch]*types.TipSet
+	msgs    map[cid.Cid]cid.Cid // cid of the message included in each block, keyed by block cid
+	head    *types.TipSet
+}
+
+// newTestChain builds a chain with a tipset at each of the given heights, which must be increasing and
+// start at zero. Missing heights are null rounds.
+func newTestChain(t *testing.T, heights ...abi.ChainEpoch) *testChain {
+	t.Helper()
+	ctx := context.Background()
+	tc := &testChain{
+		bs:      memBlockstore{},
+		tipsets: map[abi.ChainEpoch]*types.TipSet{},
+		msgs:    map[cid.Cid]cid.Cid{},
+	}
+	cst := cbor.NewCborStore(tc.bs)
+	store := blockadt.WrapStore(ctx, cst)
+
+	emptyRoot, err := blockadt.MakeEmptyArray(store).Root()
+	if err != nil {
+		t.Fatalf("empty amt: %v", err)
+	}
+	miner, _ := address.NewIDAddress(1000)
+
+	var parent *types.TipSet
+	for _, h := range heights {
+		msg := &types.Message{
+			To:         miner,
+			From:       miner,
+			Nonce:      uint64(h),
+			Value:      types.NewInt(1),
+			GasLimit:   1000,
+			GasFeeCap:  types.NewInt(100),
+			GasPremium: types.NewInt(1),
+		}
+		mblk, err := msg.ToStorageBlock()
+		if err != nil {
+			t.Fatalf("message block: %v", err)
+		}
+		tc.bs.Put(mblk)
+
+		bls := blockadt.MakeEmptyArray(store)
+		mc := cbg.CborCid(msg.Cid())
+		if err := bls.Set(0, &mc); err != nil {
+			t.Fatalf("bls amt: %v", err)
+		}
+		blsRoot, err := bls.Root()
+		if err != nil {
+			t.Fatalf("bls amt: %v", err)
+		}
+		meta, err := cst.Put(ctx, &types.MsgMeta{BlsMessages: blsRoot, SecpkMessages: emptyRoot})
+		if err != nil {
+			t.Fatalf("msgmeta: %v", err)
+		}
+
+		bh := &types.BlockHeader{
+			Miner:                 miner,
+			Ticket:                &types.Ticket{VRFProof: []byte(fmt.Sprintf("ticket %d", h))},
+			ElectionProof:         &types.ElectionProof{WinCount: 1, VRFProof: []byte(fmt.Sprintf("proof %d", h))},
+			ParentWeight:          types.NewInt(uint64(h)),
+			Height:                h,
+			ParentStateRoot:       emptyRoot,
+			ParentMessageReceipts: emptyRoot,
+			Messages:              meta,
+			BLSAggregate:          &crypto.Signature{Type: crypto.SigTypeBLS, Data: []byte("aggregate")},
+			Timestamp:             uint64(h) * 30,
+			BlockSig:              &crypto.Signature{Type: crypto.SigTypeBLS, Data: []byte("signature")},
+			ParentBaseFee:         types.NewInt(100),
+		}
+		if parent != nil {
+			bh.Parents = parent.Cids()
+		}
+		hblk, err := bh.ToStorageBlock()
+		if err != nil {
+			t.Fatalf("header block: %v", err)
+		}
+		tc.bs.Put(hblk)
+		tc.msgs[bh.Cid()] = msg.Cid()
+
+		ts, err := types.NewTipSet([]*types.BlockHeader{bh})
+		if err != nil {
+			t.Fatalf("tipset: %v", err)
+		}
+		tc.tipsets[h] = ts
+		parent = ts
+	}
+	tc.head = parent
+	return tc
+}
+
+// block returns the only block of the tipset at height h.
+func (tc *testChain) block(t *testing.T, h abi.ChainEpoch) *types.BlockHeader {
+	t.Helper()
+	ts, ok := tc.tipsets[h]
+	if !ok {
+		t.Fatalf("no tipset at height %d", h)
+	}
+	return ts.Blocks()[0]
+}
+
+// car writes the chain as a CAR file rooted at the head, as written by lotus chain export.
+func (tc *testChain) car(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: tc.head.Cids(), Version: 1}, &buf); err != nil {
+		t.Fatalf("write car header: %v", err)
+	}
+	for c, blk := range tc.bs {
+		if err := util.LdWrite(&buf, c.Bytes(), blk.RawData()); err != nil {
+			t.Fatalf("write car block: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// testMirror is an http blockstore that accepts writes, counting the requests made to it. Blocks are
+// given etags and requests may be made conditional.
+type testMirror struct {
+	mu          sync.Mutex
+	blocks      map[string][]byte
+	reqs        map[string]int // number of requests by method
+	notModified int            // number of conditional requests answered with 304 Not Modified
+}
+
+func (m *testMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/data.raw")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reqs[r.Method]++
+	switch r.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.blocks[key] = data
+		w.Header().Set("ETag", `"`+key+`"`)
+	case http.MethodGet, http.MethodHead:
+		data, ok := m.blocks[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"`+key+`"`)
+		if r.Header.Get("If-None-Match") == `"`+key+`"` {
+			m.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *testMirror) put(c cid.Cid, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blocks[c.String()] = data
+}
+
+func (m *testMirror) has(c cid.Cid) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.blocks[c.String()]
+	return ok
+}
+
+func (m *testMirror) requests(method string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reqs[method]
+}
+
+func (m *testMirror) notModifiedResponses() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.notModified
+}
+
+// integrationEnv is a proxy reading through an http blockstore and a gonudb store from a fake lotus node
+// serving a canned chain.
+type integrationEnv struct {
+	chain  *testChain
+	node   *httptest.Server
+	mirror *testMirror
+	caches *cacheChain
+	proxy  *Proxy
+}
+
+func newIntegrationEnv(t *testing.T, tc *testChain) *integrationEnv {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fake, err := LoadFakeNode(bytes.NewReader(tc.car(t)))
+	if err != nil {
+		t.Fatalf("load fake node: %v", err)
+	}
+	env := &integrationEnv{
+		chain:  tc,
+		node:   httptest.NewServer(fake.Handler()),
+		mirror: &testMirror{blocks: map[string][]byte{}, reqs: map[string]int{}},
+	}
+	mirror := httptest.NewServer(env.mirror)
+
+	u, _ := url.Parse(env.node.URL)
+	host, port := u.Hostname(), u.Port()
+	client, err := newAPIClient(fmt.Sprintf("/ip4/%s/tcp/%s/http", host, port), "token", 5, 16, time.Second, logr.Discard())
+	if err != nil {
+		t.Fatalf("api client: %v", err)
+	}
+
+	env.caches = newCacheChain(ctx, NewNodeBlockCache(client, logr.Discard()), NewStatusReporter(client, client), false, logr.Discard())
+	err = env.caches.Build([]CacheLayerConfig{
+		{
+			Type:          CacheLayerHttp,
+			BaseURL:       []string{mirror.URL + "/"},
+			Timeout:       configDuration(5 * time.Second),
+			MaxIdleConns:  10,
+			ETagCacheSize: 100,
+			WriteThrough:  true,
+		},
+		{
+			Type: CacheLayerGonudb,
+			Path: []string{t.TempDir()},
+			Sync: StoreSyncInsert,
+		},
+	})
+	if err != nil {
+		t.Fatalf("build cache chain: %v", err)
+	}
+
+	env.proxy = NewAPIProxy(client, env.caches.Head(), logr.Discard())
+	env.proxy.SetCoverage(env.caches.Coverage())
+
+	t.Cleanup(func() {
+		cancel()
+		env.caches.Close()
+		client.Close()
+		env.node.Close()
+		mirror.Close()
+	})
+	return env
+}
+
+// stored reports whether the gonudb store holds the block.
+func (env *integrationEnv) stored(c cid.Cid) bool {
+	_, err := env.caches.Store().FetchReader(string(c.Hash()))
+	return err == nil
+}
+
+// waitFor polls until cond is true or fails the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIntegrationFillsFromNode(t *testing.T) {
+	ctx := context.Background()
+	env := newIntegrationEnv(t, newTestChain(t, 0, 1, 2, 4))
+	bh := env.chain.block(t, 4)
+
+	if env.stored(bh.Cid()) {
+		t.Fatalf("block was stored before it was read")
+	}
+	data, err := env.proxy.ChainReadObj(ctx, bh.Cid())
+	if err != nil {
+		t.Fatalf("ChainReadObj: %v", err)
+	}
+	want, _ := bh.Serialize()
+	if !bytes.Equal(data, want) {
+		t.Fatalf("ChainReadObj returned %d bytes, wanted the %d bytes of the header", len(data), len(want))
+	}
+
+	// A miss fills the store and is written through to the http blockstore
+	if !env.stored(bh.Cid()) {
+		t.Errorf("block was not stored after it was read from the node")
+	}
+	waitFor(t, "write through to the http blockstore", func() bool { return env.mirror.has(bh.Cid()) })
+
+	// Once filled the block is served without the node
+	env.node.Close()
+	data, err = env.proxy.ChainReadObj(ctx, bh.Cid())
+	if err != nil {
+		t.Fatalf("ChainReadObj after the node stopped: %v", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("ChainReadObj after the node stopped returned different data")
+	}
+}
+
+func TestIntegrationHitsHttpTier(t *testing.T) {
+	ctx := context.Background()
+	env := newIntegrationEnv(t, newTestChain(t, 0, 1))
+
+	// A block held by the http blockstore and not by the node
+	blk := blocks.NewBlock([]byte("held by the mirror"))
+	env.mirror.put(blk.Cid(), blk.RawData())
+
+	data, err := env.proxy.ChainReadObj(ctx, blk.Cid())
+	if err != nil {
+		t.Fatalf("ChainReadObj: %v", err)
+	}
+	if !bytes.Equal(data, blk.RawData()) {
+		t.Fatalf("ChainReadObj returned %q, wanted %q", data, blk.RawData())
+	}
+	if env.stored(blk.Cid()) {
+		t.Errorf("hit in the http blockstore was stored by the tier below it")
+	}
+	if n := env.mirror.requests(http.MethodPut); n != 0 {
+		t.Errorf("hit in the http blockstore was written back %d times", n)
+	}
+
+	// Blocks held by no tier fail with the node's error
+	missing := blocks.NewBlock([]byte("held by nobody"))
+	if _, err := env.proxy.ChainReadObj(ctx, missing.Cid()); !isBlockNotFound(err) {
+		t.Fatalf("ChainReadObj of a missing block: got error %v, wanted not found", err)
+	}
+}
+
+func TestIntegrationTipSetFromCache(t *testing.T) {
+	ctx := context.Background()
+	env := newIntegrationEnv(t, newTestChain(t, 0, 1, 2))
+	want := env.chain.tipsets[2]
+
+	ts, err := env.proxy.ChainGetTipSet(ctx, want.Key())
+	if err != nil {
+		t.Fatalf("ChainGetTipSet: %v", err)
+	}
+	if !ts.Equals(want) {
+		t.Fatalf("ChainGetTipSet returned tipset at height %d, wanted %d", ts.Height(), want.Height())
+	}
+	if !env.stored(want.Cids()[0]) {
+		t.Errorf("header of the tipset was not stored")
+	}
+}
+
+func TestIntegrationPrunedHistory(t *testing.T) {
+	ctx := context.Background()
+	env := newIntegrationEnv(t, newTestChain(t, 0, 1, 2, 3))
+	bh := env.chain.block(t, 2)
+
+	// The fake node does not serve ChainGetBlockMessages so the call only succeeds when the messages are
+	// read through the cache chain
+	if _, err := env.proxy.ChainGetBlockMessages(ctx, bh.Cid()); err == nil {
+		t.Fatalf("ChainGetBlockMessages was not forwarded to the node while it holds history")
+	}
+
+	env.proxy.SetPruneDetector(&PruneDetector{pruned: 1})
+
+	bm, err := env.proxy.ChainGetBlockMessages(ctx, bh.Cid())
+	if err != nil {
+		t.Fatalf("ChainGetBlockMessages: %v", err)
+	}
+	if len(bm.BlsMessages) != 1 || len(bm.SecpkMessages) != 0 || bm.Cids[0] != env.chain.msgs[bh.Cid()] {
+		t.Fatalf("ChainGetBlockMessages returned %d bls and %d secpk messages %v, wanted bls message %s", len(bm.BlsMessages), len(bm.SecpkMessages), bm.Cids, env.chain.msgs[bh.Cid()])
+	}
+	if !env.stored(bh.Messages) {
+		t.Errorf("message meta was not stored")
+	}
+
+	receipts, err := env.proxy.ChainGetParentReceipts(ctx, bh.Cid())
+	if err != nil {
+		t.Fatalf("ChainGetParentReceipts: %v", err)
+	}
+	if len(receipts) != 0 {
+		t.Errorf("ChainGetParentReceipts returned %d receipts, wanted none", len(receipts))
+	}
+
+	msgs, err := env.proxy.ChainGetParentMessages(ctx, env.chain.block(t, 3).Cid())
+	if err != nil {
+		t.Fatalf("ChainGetParentMessages: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].Cid != env.chain.msgs[bh.Cid()] {
+		t.Fatalf("ChainGetParentMessages returned %v, wanted the message of the parent", msgs)
+	}
+
+	// Objects held by neither the caches nor the pruned node are reported as unavailable history
+	missing := blocks.NewBlock([]byte("pruned"))
+	if _, err := env.proxy.ChainReadObj(ctx, missing.Cid()); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("ChainReadObj of a pruned object: got error %v, wanted %v", err, ErrHistoryUnavailable)
+	}
+
+	// Heights recorded as absent from the store are not searched for
+	absent := env.chain.block(t, 1)
+	env.caches.Coverage().AddAbsent(1, 1)
+	if _, err := env.proxy.ChainGetBlockMessages(ctx, absent.Cid()); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("ChainGetBlockMessages at an absent height: got error %v, wanted %v", err, ErrHistoryUnavailable)
+	}
+	if env.stored(absent.Messages) {
+		t.Errorf("messages at an absent height were read")
+	}
+	if _, err := env.proxy.ChainGetParentReceipts(ctx, absent.Cid()); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("ChainGetParentReceipts at an absent height: got error %v, wanted %v", err, ErrHistoryUnavailable)
+	}
+
+	// The parent messages of a block are held at the height of its parent
+	child := env.chain.block(t, 2)
+	if _, err := env.proxy.ChainGetParentMessages(ctx, child.Cid()); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("ChainGetParentMessages with a parent at an absent height: got error %v, wanted %v", err, ErrHistoryUnavailable)
+	}
+	if env.stored(absent.Messages) {
+		t.Errorf("parent messages at an absent height were read")
+	}
+}
+
+func TestFakeNodeChain(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t, 0, 1, 2, 4)
+	fake, err := LoadFakeNode(bytes.NewReader(tc.car(t)))
+	if err != nil {
+		t.Fatalf("load fake node: %v", err)
+	}
+
+	head, _ := fake.ChainHead(ctx)
+	if !head.Equals(tc.head) {
+		t.Fatalf("head is at height %d, wanted %d", head.Height(), tc.head.Height())
+	}
+	ts, err := fake.ChainGetTipSetByHeight(ctx, 3, types.EmptyTSK)
+	if err != nil {
+		t.Fatalf("ChainGetTipSetByHeight: %v", err)
+	}
+	if ts.Height() != 2 {
+		t.Errorf("tipset for null round at height 3 is at height %d, wanted 2", ts.Height())
+	}
+
+	if err := fake.SetHead(1); err != nil {
+		t.Fatalf("SetHead: %v", err)
+	}
+	nctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := fake.ChainNotify(nctx)
+	if err != nil {
+		t.Fatalf("ChainNotify: %v", err)
+	}
+	if hc := <-ch; hc[0].Type != "current" || hc[0].Val.Height() != 1 {
+		t.Fatalf("first notification was %s at height %d, wanted current at height 1", hc[0].Type, hc[0].Val.Height())
+	}
+	go fake.Advance(nctx, time.Millisecond)
+	for _, want := range []abi.ChainEpoch{2, 4} {
+		if hc := <-ch; hc[0].Type != "apply" || hc[0].Val.Height() != want {
+			t.Fatalf("notification was %s at height %d, wanted apply at height %d", hc[0].Type, hc[0].Val.Height(), want)
+		}
+	}
+}
+
+func TestIntegrationCountsUpstreamBytes(t *testing.T) {
+	received := &view.View{Name: "test_upstream_received_bytes", Measure: upstreamReceived, Aggregation: view.Sum(), TagKeys: []tag.Key{upstreamTag}}
+	sent := &view.View{Name: "test_upstream_sent_bytes", Measure: upstreamSent, Aggregation: view.Sum(), TagKeys: []tag.Key{upstreamTag}}
+	if err := view.Register(received, sent); err != nil {
+		t.Fatalf("register views: %v", err)
+	}
+	defer view.Unregister(received, sent)
+
+	ctx := context.Background()
+	env := newIntegrationEnv(t, newTestChain(t, 0, 1, 2))
+	bh := env.chain.block(t, 2)
+	if _, err := env.proxy.ChainReadObj(ctx, bh.Cid()); err != nil {
+		t.Fatalf("ChainReadObj: %v", err)
+	}
+
+	u, _ := url.Parse(env.node.URL)
+	maddr := fmt.Sprintf("/ip4/%s/tcp/%s/http", u.Hostname(), u.Port())
+	for _, v := range []*view.View{received, sent} {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			t.Fatalf("retrieve %s: %v", v.Name, err)
+		}
+		var total float64
+		for _, row := range rows {
+			if len(row.Tags) == 1 && row.Tags[0].Value == maddr {
+				total += row.Data.(*view.SumData).Value
+			}
+		}
+		if total == 0 {
+			t.Errorf("no bytes were counted in %s for %s", v.Name, maddr)
+		}
+	}
+}
+
+func TestIntegrationReadObjManyByteCap(t *testing.T) {
+	ctx := context.Background()
+	env := newIntegrationEnv(t, newTestChain(t, 0, 1, 2, 3))
+	objs := []cid.Cid{env.chain.block(t, 1).Cid(), env.chain.block(t, 2).Cid(), env.chain.block(t, 3).Cid()}
+
+	data, err := env.proxy.ChainReadObjMany(ctx, objs)
+	if err != nil {
+		t.Fatalf("ChainReadObjMany: %v", err)
+	}
+	var total int64
+	for _, d := range data {
+		total += int64(len(d))
+	}
+
+	env.proxy.readManyBytes = total - 1
+	if _, err := env.proxy.ChainReadObjMany(ctx, objs); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("ChainReadObjMany over the byte cap returned %v, wanted %v", err, ErrResponseTooLarge)
+	}
+}
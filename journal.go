@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// journalSlotSize is the size of each entry in the request journal file, including the trailing newline.
+const journalSlotSize = 256
+
+// States of an entry in the request journal.
+const (
+	JournalInFlight = "inflight" // the call was being handled when the entry was written
+	JournalDone     = "done"     // the call completed
+)
+
+// JournalEntry describes an rpc call recorded in the request journal.
+type JournalEntry struct {
+	Seq        uint64    `json:"seq"`
+	State      string    `json:"state"`
+	Start      time.Time `json:"start"`
+	Method     string    `json:"method"`
+	ParamsHash string    `json:"params_hash,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	Duration   float64   `json:"duration_ms,omitempty"`
+}
+
+// RequestJournal records each rpc call in a fixed size ring of slots in a file as it starts and again when
+// it completes, so that after a crash the calls that were in flight can be found in the file. Each slot
+// holds a JSON line padded with spaces so the file can be read with standard tools. Writes are not synced
+// since the journal only needs to survive a crash of the proxy, not of the host.
+type RequestJournal struct {
+	f     *os.File
+	slots uint64
+	seq   uint64 // sequence number of the last call recorded, accessed atomically
+}
+
+// OpenRequestJournal opens the journal file at path holding the given number of slots, creating it if
+// needed. Calls left in flight by a previous run are logged before the journal is reused.
+func OpenRequestJournal(path string, slots int, logger logr.Logger) (*RequestJournal, error) {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	if slots <= 0 {
+		return nil, fmt.Errorf("journal size must be positive")
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open request journal: %w", err)
+	}
+
+	entries, err := readJournal(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read request journal: %w", err)
+	}
+	j := &RequestJournal{f: f, slots: uint64(slots)}
+	for _, e := range entries {
+		if e.Seq > j.seq {
+			j.seq = e.Seq
+		}
+		if e.State == JournalInFlight {
+			logger.V(LogLevelInfo).Info("Call was in flight when the proxy last stopped", "seq", e.Seq, "method", e.Method, "start", e.Start, "params_hash", e.ParamsHash, "client", e.Client)
+		}
+	}
+
+	// Clear the file so calls from a previous run are not mistaken for calls from this one
+	blank := bytes.Repeat([]byte(" "), journalSlotSize-1)
+	blank = append(blank, '\n')
+	buf := bytes.Repeat(blank, slots)
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reset request journal: %w", err)
+	}
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reset request journal: %w", err)
+	}
+
+	return j, nil
+}
+
+// readJournal reads the entries held in a journal file, skipping empty and unreadable slots.
+func readJournal(r io.Reader) ([]JournalEntry, error) {
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, k int) bool { return entries[i].Seq < entries[k].Seq })
+	return entries, nil
+}
+
+// Close closes the journal file, leaving the entries it holds in place.
+func (j *RequestJournal) Close() error {
+	return j.f.Close()
+}
+
+// write writes the entry to its slot, dropping the client name if the entry would not otherwise fit.
+func (j *RequestJournal) write(e *JournalEntry) {
+	data, err := json.Marshal(e)
+	if err == nil && len(data) >= journalSlotSize {
+		e.Client = ""
+		data, err = json.Marshal(e)
+	}
+	if err != nil || len(data) >= journalSlotSize {
+		return
+	}
+	slot := make([]byte, journalSlotSize)
+	copy(slot, data)
+	for i := len(data); i < journalSlotSize-1; i++ {
+		slot[i] = ' '
+	}
+	slot[journalSlotSize-1] = '\n'
+	_, _ = j.f.WriteAt(slot, int64((e.Seq-1)%j.slots)*journalSlotSize)
+}
+
+// Middleware is method middleware that records each call in the journal.
+func (j *RequestJournal) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		e := &JournalEntry{
+			Seq:        atomic.AddUint64(&j.seq, 1),
+			State:      JournalInFlight,
+			Start:      time.Now().UTC(),
+			Method:     call.Method,
+			ParamsHash: paramsHash(call.Params),
+			Client:     clientName(ctx),
+		}
+		j.write(e)
+
+		res, err := next(ctx, call)
+
+		// Leave the slot alone if it has since been reused by a later call
+		if atomic.LoadUint64(&j.seq)-e.Seq < j.slots {
+			e.State = JournalDone
+			e.Duration = float64(time.Since(e.Start)) / 1e6
+			j.write(e)
+		}
+		return res, err
+	}
+}
+
+// paramsHash returns a short hash of the JSON encoding of the params, identifying calls with the same params
+// without recording them.
+func paramsHash(params []interface{}) string {
+	if len(params) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricexport"
+	"go.opencensus.io/stats"
+)
+
+// lifetimeMeasures maps the names of the cumulative cache views to the measures used to report
+// their lifetime values.
+var lifetimeMeasures = map[string]*stats.Int64Measure{
+	getRequest.Name() + "_total":  lifetimeGetRequest,
+	getHit.Name() + "_total":      lifetimeGetHit,
+	getMiss.Name() + "_total":     lifetimeGetMiss,
+	getSize.Name() + "_total":     lifetimeGetSize,
+	fillSuccess.Name() + "_total": lifetimeFillSuccess,
+	fillSize.Name() + "_total":    lifetimeFillSize,
+}
+
+var _ metricexport.Exporter = (*LifetimeStats)(nil)
+
+// LifetimeStats accumulates cache counters across restarts by persisting them to a file. The
+// counters recorded since the process started are added to those loaded from the file and
+// reported as lifetime measures.
+type LifetimeStats struct {
+	path   string
+	logger logr.Logger
+	reader *metricexport.Reader
+
+	mu      sync.Mutex                  // guards base and current
+	base    map[string]map[string]int64 // counts loaded at startup, keyed by cache then view name
+	current map[string]map[string]int64 // counts since startup, keyed by cache then view name
+}
+
+type lifetimeStatsFile struct {
+	Caches map[string]map[string]int64 `json:"caches"`
+}
+
+func NewLifetimeStats(path string, logger logr.Logger) *LifetimeStats {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	return &LifetimeStats{
+		path:    path,
+		logger:  logger.V(LogLevelInfo),
+		reader:  metricexport.NewReader(),
+		base:    map[string]map[string]int64{},
+		current: map[string]map[string]int64{},
+	}
+}
+
+// Load reads previously persisted counts. A missing file is not an error.
+func (l *LifetimeStats) Load() error {
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read lifetime stats: %w", err)
+	}
+
+	var f lifetimeStatsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("decode lifetime stats: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f.Caches != nil {
+		l.base = f.Caches
+	}
+	return nil
+}
+
+// Save writes the lifetime counts to the stats file, replacing it atomically.
+func (l *LifetimeStats) Save() error {
+	data, err := json.Marshal(lifetimeStatsFile{Caches: l.Lifetime()})
+	if err != nil {
+		return fmt.Errorf("encode lifetime stats: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write lifetime stats: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close lifetime stats: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("rename lifetime stats: %w", err)
+	}
+	return nil
+}
+
+// Update reads the current cumulative metrics and reports the lifetime measures.
+func (l *LifetimeStats) Update() {
+	l.reader.ReadAndExport(l)
+}
+
+// Lifetime returns the lifetime counts, keyed by cache then view name.
+func (l *LifetimeStats) Lifetime() map[string]map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	counts := map[string]map[string]int64{}
+	for _, src := range []map[string]map[string]int64{l.base, l.current} {
+		for cache, cs := range src {
+			c, ok := counts[cache]
+			if !ok {
+				c = map[string]int64{}
+				counts[cache] = c
+			}
+			for name, v := range cs {
+				c[name] += v
+			}
+		}
+	}
+	return counts
+}
+
+// SinceStart returns the counts recorded since the process started, keyed by cache then view name.
+func (l *LifetimeStats) SinceStart() map[string]map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	counts := map[string]map[string]int64{}
+	for cache, cs := range l.current {
+		c := map[string]int64{}
+		for name, v := range cs {
+			c[name] = v
+		}
+		counts[cache] = c
+	}
+	return counts
+}
+
+func (l *LifetimeStats) ExportMetrics(ctx context.Context, metrics []*metricdata.Metric) error {
+	l.mu.Lock()
+	for _, m := range metrics {
+		if _, ok := lifetimeMeasures[m.Descriptor.Name]; !ok {
+			continue
+		}
+		for _, ts := range m.TimeSeries {
+			if len(ts.LabelValues) != 1 || !ts.LabelValues[0].Present {
+				continue
+			}
+			cache := ts.LabelValues[0].Value
+			for _, p := range ts.Points {
+				if v, ok := p.Value.(int64); ok {
+					c, ok := l.current[cache]
+					if !ok {
+						c = map[string]int64{}
+						l.current[cache] = c
+					}
+					c[m.Descriptor.Name] = v
+				}
+			}
+		}
+	}
+	l.mu.Unlock()
+
+	for cache, cs := range l.Lifetime() {
+		cctx := cacheContext(ctx, cache)
+		for name, v := range cs {
+			if m, ok := lifetimeMeasures[name]; ok {
+				reportMeasurement(cctx, m.M(v))
+			}
+		}
+	}
+
+	return nil
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -12,7 +14,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/go-logr/logr"
 	"github.com/gorilla/mux"
 	"github.com/iand/gonudb"
 	"github.com/iand/logfmtr"
@@ -25,12 +31,21 @@ const (
 	LogLevelTrace       = 3 // log level increment for verbose tracing
 )
 
+// logSubsystems are the names of the loggers used by the proxy
+var logSubsystems = []string{"client", "gonudb", "node", "proxy", "stats"}
+
 const (
 	diagLogInterval         = 5 * time.Minute // interval between logging metrics when diagnostics logging is enabled
 	metricReportingInterval = 2 * time.Second // interval between reporting metrics
+	lifetimeStatsInterval   = time.Minute     // interval between persisting lifetime cache statistics
+	cidCounterSize          = 10000           // number of recently requested cids tracked to report the most requested
+	egressCounterSize       = 10000           // number of clients tracked to report the bytes served to each
 )
 
-var ErrLotusUnavailable = errors.New("upstream lotus server not available")
+var (
+	ErrLotusUnavailable = errors.New("upstream lotus server not available")
+	ErrTipSetNotFound   = errors.New("tipset not found")
+)
 
 func main() {
 	app := &cli.App{
@@ -59,21 +74,326 @@ func main() {
 				Value:   "/ip4/127.0.0.1/tcp/1234/http",
 			},
 			&cli.StringFlag{
-				Name:     "api-token",
-				Usage:    "Read only API token for Lotus node.",
-				EnvVars:  []string{"LOTUS_CPR_API_TOKEN"},
-				Required: true,
+				Name:    "api-token",
+				Usage:   "Read only API token for Lotus node (required).",
+				EnvVars: []string{"LOTUS_CPR_API_TOKEN"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "api-fallback",
+				Usage:   "Multiaddress of a Lotus node, such as a remote or paid node, that is only called while the circuit of the node given by api is open. May be repeated to give further fallbacks which are tried in order.",
+				EnvVars: []string{"LOTUS_CPR_API_FALLBACK"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "api-fallback-token",
+				Usage:   "Read only API token for a fallback Lotus node. Given once to use the same token for every fallback or once for each fallback in the same order.",
+				EnvVars: []string{"LOTUS_CPR_API_FALLBACK_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    "token-secret-file",
+				Usage:   "Path to file containing the secret used to verify tokens minted by the proxy. When set clients must present a proxy token and may only call methods permitted by its scope.",
+				EnvVars: []string{"LOTUS_CPR_TOKEN_SECRET_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "client-tokens-file",
+				Usage:   "Path to file listing the tokens clients must present, one per line as: perm token [name]. The permission is read, write, sign or admin and limits the methods the token may call.",
+				EnvVars: []string{"LOTUS_CPR_CLIENT_TOKENS_FILE"},
+			},
+			&cli.BoolFlag{
+				Name:    "client-auth-node",
+				Usage:   "Require clients to present a token and verify tokens not listed in client-tokens-file with the lotus node, granting the permissions the node reports.",
+				EnvVars: []string{"LOTUS_CPR_CLIENT_AUTH_NODE"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "client-name",
+				Usage:   "Client name that clients may give in the X-Client-Name header to attribute their requests. Requests giving other names are attributed to anonymous unless their token carries a name. May be repeated.",
+				EnvVars: []string{"LOTUS_CPR_CLIENT_NAME"},
+			},
+			&cli.StringFlag{
+				Name:    "authz-url",
+				Usage:   "URL of an authorization service that is posted a description of each sensitive rpc call and decides whether it may be made.",
+				EnvVars: []string{"LOTUS_CPR_AUTHZ_URL"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "authz-method",
+				Usage:   "Method requiring read permission that the authorization service is also consulted on, or * for all methods. May be repeated.",
+				EnvVars: []string{"LOTUS_CPR_AUTHZ_METHOD"},
+			},
+			&cli.DurationFlag{
+				Name:    "authz-timeout",
+				Usage:   "Maximum time to wait for a decision from the authorization service before denying the call.",
+				Value:   2 * time.Second,
+				EnvVars: []string{"LOTUS_CPR_AUTHZ_TIMEOUT"},
 			},
 			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Path to a TOML file declaring the layers of caches in front of the lotus node. Replaces the caches configured by the store, blockstore and s3 flags, whose other options are used as defaults.",
+				EnvVars: []string{"LOTUS_CPR_CONFIG"},
+			},
+			&cli.Int64Flag{
+				Name:    "memory-cache-size",
+				Usage:   "Maximum size in bytes of the blocks held in memory in front of the other caches, 0 to disable.",
+				EnvVars: []string{"LOTUS_CPR_MEMORY_CACHE_SIZE"},
+			},
+			&cli.StringSliceFlag{
 				Name:    "store",
-				Usage:   "Path to directory containing gonudb store.",
+				Usage:   "Path to directory containing gonudb store. May be repeated to distribute the store across several directories, which must always be given in the same order.",
 				EnvVars: []string{"LOTUS_CPR_STORE_PATH"},
 			},
+			&cli.Float64Flag{
+				Name:    "node-fill-rate",
+				Usage:   "Maximum number of blocks per second read from the lotus node to fill the caches, 0 for no limit.",
+				EnvVars: []string{"LOTUS_CPR_NODE_FILL_RATE"},
+			},
+			&cli.Int64Flag{
+				Name:    "node-fill-bandwidth",
+				Usage:   "Maximum number of bytes per second read from the lotus node to fill the caches, 0 for no limit.",
+				EnvVars: []string{"LOTUS_CPR_NODE_FILL_BANDWIDTH"},
+			},
+			&cli.BoolFlag{
+				Name:    "node-verify",
+				Usage:   "Verify that data read from the lotus node matches the requested cid before serving it or filling the caches.",
+				EnvVars: []string{"LOTUS_CPR_NODE_VERIFY"},
+			},
 			&cli.StringFlag{
+				Name:    "node-missing-file",
+				Usage:   "Path of a file recording blocks the lotus node has reported as not found for longer than the chain's finality period. Requests for these blocks are not passed to the node until their record expires.",
+				EnvVars: []string{"LOTUS_CPR_NODE_MISSING_FILE"},
+			},
+			&cli.DurationFlag{
+				Name:    "node-missing-ttl",
+				Usage:   "How long a block recorded in the node-missing-file is remembered.",
+				Value:   7 * 24 * time.Hour,
+				EnvVars: []string{"LOTUS_CPR_NODE_MISSING_TTL"},
+			},
+			&cli.IntFlag{
+				Name:    "node-negative-cache-size",
+				Usage:   "Number of blocks reported as not found by the lotus node that are remembered so that repeated requests for them are not passed to the node. Blocks reported missing since the timestamp of a tipset reverted by the node are forgotten. 0 disables the negative cache.",
+				EnvVars: []string{"LOTUS_CPR_NODE_NEGATIVE_CACHE_SIZE"},
+			},
+			&cli.DurationFlag{
+				Name:    "node-negative-cache-ttl",
+				Usage:   "How long a block reported as not found by the lotus node is remembered by the negative cache.",
+				Value:   30 * time.Second,
+				EnvVars: []string{"LOTUS_CPR_NODE_NEGATIVE_CACHE_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "node-prune-check-interval",
+				Usage:   "Interval between checks of whether the lotus node has discarded historical data, such as a node running a splitstore. While it has, requests for historical messages and receipts are served from the cache tiers first. 0 disables the check.",
+				Value:   time.Hour,
+				EnvVars: []string{"LOTUS_CPR_NODE_PRUNE_CHECK_INTERVAL"},
+			},
+			&cli.IntFlag{
+				Name:    "miss-queue-threshold",
+				Usage:   "Number of times a cid must miss every cache tier and the lotus node before it is queued for an archival fetcher, listed by the /missing endpoint of the diagnostics server. 0 disables the queue.",
+				EnvVars: []string{"LOTUS_CPR_MISS_QUEUE_THRESHOLD"},
+			},
+			&cli.IntFlag{
+				Name:    "miss-queue-size",
+				Usage:   "Maximum number of cids held in the miss queue.",
+				Value:   10000,
+				EnvVars: []string{"LOTUS_CPR_MISS_QUEUE_SIZE"},
+			},
+			&cli.StringSliceFlag{
 				Name:    "blockstore-baseurl",
-				Usage:   "Base URL of a web server that serves blocks (urls follow pattern: {blockstore-baseurl}/{block_cid}/data.raw)",
+				Usage:   "Base URL of a web server that serves blocks (urls follow pattern: {blockstore-baseurl}/{block_cid}/data.raw). May be repeated to specify mirrors which are tried in order.",
 				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_BASEURL"},
 			},
+			&cli.BoolFlag{
+				Name:    "blockstore-race",
+				Usage:   "Race requests to the first two blockstore mirrors, taking the first successful response.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_RACE"},
+			},
+			&cli.DurationFlag{
+				Name:    "blockstore-race-stagger",
+				Usage:   "Time to wait for the first blockstore mirror to respond before sending the request to the second.",
+				Value:   DefaultHttpClientOptions.RaceStagger,
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_RACE_STAGGER"},
+			},
+			&cli.BoolFlag{
+				Name:    "blockstore-rank-mirrors",
+				Usage:   "Send requests first to the blockstore mirrors with the lowest recent latency and error rate instead of in the order given.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_RANK_MIRRORS"},
+			},
+			&cli.StringFlag{
+				Name:    "blockstore-discover",
+				Usage:   "DNS name of TXT records holding base urls, or SRV records naming hosts, of blockstore mirrors to add to those given by blockstore-baseurl.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_DISCOVER"},
+			},
+			&cli.DurationFlag{
+				Name:    "blockstore-discover-interval",
+				Usage:   "Time between DNS lookups of the blockstore mirrors.",
+				Value:   time.Minute,
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_DISCOVER_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "blockstore-timeout",
+				Usage:   "Maximum time to wait for a single request to the blockstore to complete.",
+				Value:   DefaultHttpClientOptions.Timeout,
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "blockstore-retries",
+				Usage:   "Number of times to retry a failed request to the blockstore.",
+				Value:   DefaultHttpClientOptions.Retries,
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_RETRIES"},
+			},
+			&cli.IntFlag{
+				Name:    "blockstore-max-idle-conns",
+				Usage:   "Maximum number of idle connections to keep open to the blockstore.",
+				Value:   DefaultHttpClientOptions.MaxIdleConns,
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_MAX_IDLE_CONNS"},
+			},
+			&cli.IntFlag{
+				Name:    "blockstore-max-conns-per-host",
+				Usage:   "Maximum number of connections to open to each blockstore host, 0 for no limit.",
+				Value:   DefaultHttpClientOptions.MaxConnsPerHost,
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_MAX_CONNS_PER_HOST"},
+			},
+			&cli.IntFlag{
+				Name:    "blockstore-etag-cache-size",
+				Usage:   "Number of blockstore etags to remember for revalidating blocks with conditional requests, 0 to disable.",
+				Value:   DefaultHttpClientOptions.ETagCacheSize,
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_ETAG_CACHE_SIZE"},
+			},
+			&cli.BoolFlag{
+				Name:    "blockstore-write-through",
+				Usage:   "Write blocks that are missing from the blockstore to the first blockstore mirror when they are filled from upstream.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_WRITE_THROUGH"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "blockstore-header",
+				Usage:   "Additional header to send with requests to the blockstore, in the form `\"Name: value\"`. May be repeated.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_HEADER"},
+			},
+			&cli.StringFlag{
+				Name:    "blockstore-bearer-token",
+				Usage:   "Bearer token to send with requests to the blockstore.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_BEARER_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    "blockstore-aws-region",
+				Usage:   "AWS region of the blockstore bucket. When set requests to the blockstore are signed using AWS signature version 4.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_AWS_REGION"},
+			},
+			&cli.StringFlag{
+				Name:    "blockstore-aws-access-key-id",
+				Usage:   "AWS access key id used to sign requests to the blockstore.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID"},
+			},
+			&cli.StringFlag{
+				Name:    "blockstore-aws-secret-access-key",
+				Usage:   "AWS secret access key used to sign requests to the blockstore.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_AWS_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "blockstore-aws-session-token",
+				Usage:   "AWS session token used to sign requests to the blockstore when using temporary credentials.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_AWS_SESSION_TOKEN", "AWS_SESSION_TOKEN"},
+			},
+			&cli.BoolFlag{
+				Name:    "blockstore-requester-pays",
+				Usage:   "Acknowledge that the requester will be charged for access to the blockstore bucket.",
+				EnvVars: []string{"LOTUS_CPR_BLOCKSTORE_REQUESTER_PAYS"},
+			},
+			&cli.StringFlag{
+				Name:    "s3-bucket",
+				Usage:   "Name of an S3 bucket holding a blockstore to read blocks from using the AWS SDK, consulted after the http blockstore. Credentials are taken from blockstore-aws-access-key-id and blockstore-aws-secret-access-key when set, otherwise from the SDK's default chain of environment, shared config files and instance or task roles.",
+				EnvVars: []string{"LOTUS_CPR_S3_BUCKET"},
+			},
+			&cli.StringFlag{
+				Name:    "s3-region",
+				Usage:   "AWS region of the S3 bucket.",
+				Value:   defaultS3Region,
+				EnvVars: []string{"LOTUS_CPR_S3_REGION", "AWS_REGION"},
+			},
+			&cli.StringFlag{
+				Name:    "s3-endpoint",
+				Usage:   "URL of an S3 compatible server, such as MinIO, holding the S3 bucket. The bucket is addressed by path.",
+				EnvVars: []string{"LOTUS_CPR_S3_ENDPOINT"},
+			},
+			&cli.StringFlag{
+				Name:    "s3-prefix",
+				Usage:   "Key prefix under which the blockstore's objects are held in the S3 bucket.",
+				EnvVars: []string{"LOTUS_CPR_S3_PREFIX"},
+			},
+			&cli.Int64Flag{
+				Name:    "s3-part-size",
+				Usage:   "Size in bytes of the ranges blocks are downloaded from the S3 bucket in and of the parts they are uploaded in when writing through. Blocks larger than this are transferred with concurrent requests.",
+				Value:   s3manager.DefaultDownloadPartSize,
+				EnvVars: []string{"LOTUS_CPR_S3_PART_SIZE"},
+			},
+			&cli.IntFlag{
+				Name:    "s3-part-concurrency",
+				Usage:   "Number of parts of a block transferred from or to the S3 bucket at once.",
+				Value:   s3manager.DefaultDownloadConcurrency,
+				EnvVars: []string{"LOTUS_CPR_S3_PART_CONCURRENCY"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "peer",
+				Usage:   "URL of a sibling lotus-cpr, such as http://cpr-2:33111, whose block endpoint is asked for blocks missing from the local caches before the lotus node. May be repeated to give further peers which are tried in order.",
+				EnvVars: []string{"LOTUS_CPR_PEER"},
+			},
+			&cli.StringFlag{
+				Name:    "peer-token",
+				Usage:   "Bearer token presented to peers when requesting blocks.",
+				EnvVars: []string{"LOTUS_CPR_PEER_TOKEN"},
+			},
+			&cli.DurationFlag{
+				Name:    "peer-timeout",
+				Usage:   "Maximum time allowed for a request for a block to a peer.",
+				Value:   5 * time.Second,
+				EnvVars: []string{"LOTUS_CPR_PEER_TIMEOUT"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "bitswap-peer",
+				Usage:   "Multiaddr, ending in the peer id, of a node that is asked for blocks missing from the other caches using bitswap before the lotus node. May be repeated.",
+				EnvVars: []string{"LOTUS_CPR_BITSWAP_PEER"},
+			},
+			&cli.StringFlag{
+				Name:    "bitswap-protocol-prefix",
+				Usage:   "Prefix of the bitswap protocol spoken by the bitswap peers. Filecoin nodes use /chain, give an empty prefix for IPFS nodes.",
+				Value:   "/chain",
+				EnvVars: []string{"LOTUS_CPR_BITSWAP_PROTOCOL_PREFIX"},
+			},
+			&cli.DurationFlag{
+				Name:    "bitswap-timeout",
+				Usage:   "Maximum time to wait for a block from the bitswap peers.",
+				Value:   10 * time.Second,
+				EnvVars: []string{"LOTUS_CPR_BITSWAP_TIMEOUT"},
+			},
+			&cli.StringFlag{
+				Name:    "audit-log",
+				Usage:   "Path to file that an audit log of denied and privileged operations will be appended to, or - for stderr.",
+				EnvVars: []string{"LOTUS_CPR_AUDIT_LOG"},
+			},
+			&cli.StringFlag{
+				Name:    "access-log",
+				Usage:   "Path to file that an access log of rpc calls will be appended to, or - for stderr.",
+				EnvVars: []string{"LOTUS_CPR_ACCESS_LOG"},
+			},
+			&cli.StringFlag{
+				Name:    "access-log-format",
+				Usage:   "Format of the access log, json or logfmt.",
+				Value:   AccessLogJSON,
+				EnvVars: []string{"LOTUS_CPR_ACCESS_LOG_FORMAT"},
+			},
+			&cli.Float64Flag{
+				Name:    "access-log-sample",
+				Usage:   "Fraction of successful rpc calls recorded in the access log. Failed calls are always recorded.",
+				Value:   1,
+				EnvVars: []string{"LOTUS_CPR_ACCESS_LOG_SAMPLE"},
+			},
+			&cli.StringFlag{
+				Name:    "journal-file",
+				Usage:   "Path to a file that the rpc calls being handled are journaled to, so the calls in flight can be found after a crash.",
+				EnvVars: []string{"LOTUS_CPR_JOURNAL_FILE"},
+			},
+			&cli.IntFlag{
+				Name:    "journal-size",
+				Usage:   "Number of recent rpc calls held in the journal file.",
+				Value:   1024,
+				EnvVars: []string{"LOTUS_CPR_JOURNAL_SIZE"},
+			},
 			&cli.StringFlag{
 				Name:    "listen",
 				Usage:   "Address to start the jsonrpc server on.",
@@ -86,6 +406,47 @@ func main() {
 				EnvVars: []string{"LOTUS_CPR_DIAG"},
 				Value:   ":33112",
 			},
+			&cli.BoolFlag{
+				Name:    "diag-debug",
+				Usage:   "Serve pprof profiles, expvar variables and a goroutine dump under /debug/ on the diagnostics server.",
+				EnvVars: []string{"LOTUS_CPR_DIAG_DEBUG"},
+			},
+			&cli.StringFlag{
+				Name:    "otel-endpoint",
+				Usage:   "URL of an OpenTelemetry collector, such as http://localhost:4318, to export traces of rpc calls, cache lookups and calls to the Lotus node to using OTLP over http.",
+				EnvVars: []string{"LOTUS_CPR_OTEL_ENDPOINT"},
+			},
+			&cli.StringFlag{
+				Name:    "listen-tls-cert",
+				Usage:   "Path to PEM encoded certificate chain used to serve the jsonrpc and diagnostics servers over TLS.",
+				EnvVars: []string{"LOTUS_CPR_LISTEN_TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "listen-tls-key",
+				Usage:   "Path to PEM encoded private key of the certificate given by listen-tls-cert.",
+				EnvVars: []string{"LOTUS_CPR_LISTEN_TLS_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "listen-tls-client-ca",
+				Usage:   "Path to PEM encoded certificates of the CAs that clients must present a certificate signed by when connecting over TLS.",
+				EnvVars: []string{"LOTUS_CPR_LISTEN_TLS_CLIENT_CA"},
+			},
+			&cli.StringFlag{
+				Name:    "metrics-namespace",
+				Usage:   "Namespace used to prefix the names of metrics served by the diagnostics server.",
+				Value:   "lotuscpr",
+				EnvVars: []string{"LOTUS_CPR_METRICS_NAMESPACE"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "metrics-label",
+				Usage:   "Constant label to add to all metrics served by the diagnostics server, in the form \"name=value\". May be repeated.",
+				EnvVars: []string{"LOTUS_CPR_METRICS_LABEL"},
+			},
+			&cli.DurationFlag{
+				Name:    "status-log-interval",
+				Usage:   "Interval between status summaries written to the log, 0 to disable.",
+				EnvVars: []string{"LOTUS_CPR_STATUS_LOG_INTERVAL"},
+			},
 			&cli.IntFlag{
 				Name:    "api-concurrency",
 				Usage:   "Maximum number of concurrent requests to make to the Lotus node API before triggering disconnection.",
@@ -104,9 +465,280 @@ func main() {
 				Value:   30 * time.Second,
 				EnvVars: []string{"LOTUS_CPR_DISCONNECT_TIMEOUT"},
 			},
+			&cli.DurationFlag{
+				Name:    "api-slow-start",
+				Usage:   "Period over which the number of concurrent requests to a Lotus node is raised from one to api-concurrency after reconnecting, 0 to disable.",
+				Value:   10 * time.Second,
+				EnvVars: []string{"LOTUS_CPR_API_SLOW_START"},
+			},
+			&cli.DurationFlag{
+				Name:    "request-timeout",
+				Usage:   "Maximum time allowed to handle an http rpc request, 0 for no limit. Clients may ask for a shorter deadline using the X-Request-Timeout header.",
+				EnvVars: []string{"LOTUS_CPR_REQUEST_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "drain-period",
+				Usage:   "Maximum time to wait on shutdown for the requests being handled to complete. New requests are refused while draining. Blocks waiting to be inserted into the store are then inserted and the store flushed before exiting. 0 stops without waiting for requests.",
+				Value:   20 * time.Second,
+				EnvVars: []string{"LOTUS_CPR_DRAIN_PERIOD"},
+			},
+			&cli.DurationFlag{
+				Name:    "shutdown-timeout",
+				Usage:   "Maximum time allowed on shutdown after draining for background workers to stop, waiting blocks to be inserted and the store to be flushed. The proxy exits without finishing once it passes.",
+				Value:   30 * time.Second,
+				EnvVars: []string{"LOTUS_CPR_SHUTDOWN_TIMEOUT"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "allowed-codec",
+				Usage:   "Codec of objects the proxy will cache and serve, such as dag-cbor or raw. May be repeated. Objects with other codecs are rejected. All codecs are allowed when not set.",
+				EnvVars: []string{"LOTUS_CPR_ALLOWED_CODEC"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "authnew-allow-perm",
+				Usage:   "Permission that tokens minted through the proxy with AuthNew may be granted: read, write, sign or admin. May be repeated. Use none to refuse all AuthNew calls. All calls are passed to the node when not set.",
+				EnvVars: []string{"LOTUS_CPR_AUTHNEW_ALLOW_PERM"},
+			},
+			&cli.StringFlag{
+				Name:    "passthrough-max-perm",
+				Usage:   "Highest permission, read, write, sign or admin, of Lotus API methods not implemented by the proxy that are passed through to the node. Use none to refuse all such calls.",
+				Value:   "read",
+				EnvVars: []string{"LOTUS_CPR_PASSTHROUGH_MAX_PERM"},
+			},
+			&cli.BoolFlag{
+				Name:    "read-only",
+				Usage:   "Reject calls to methods requiring more than read permission, such as MpoolPush or WalletNew, whether or not the proxy implements them.",
+				EnvVars: []string{"LOTUS_CPR_READ_ONLY"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "enable-heavy-method",
+				Usage:   "Allow calls to a heavy method that can place significant load on the Lotus node. Supported methods are StateCall and StateCompute. May be repeated.",
+				EnvVars: []string{"LOTUS_CPR_ENABLE_HEAVY_METHOD"},
+			},
+			&cli.DurationFlag{
+				Name:    "heavy-method-timeout",
+				Usage:   "Maximum duration of a call to a heavy method, including time spent waiting for other calls to complete.",
+				Value:   time.Minute,
+				EnvVars: []string{"LOTUS_CPR_HEAVY_METHOD_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "heavy-method-concurrency",
+				Usage:   "Maximum number of calls to heavy methods that may be in progress at once.",
+				Value:   2,
+				EnvVars: []string{"LOTUS_CPR_HEAVY_METHOD_CONCURRENCY"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "max-response-size",
+				Usage:   "Maximum size in bytes of responses to a method, given as method=bytes such as ChainReadObj=1048576. Use * as the method to limit every method without its own limit. May be repeated.",
+				EnvVars: []string{"LOTUS_CPR_MAX_RESPONSE_SIZE"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "latency-slo",
+				Usage:   "Latency objective for calls to a method, given as method=duration such as ChainReadObj=50ms. Use a prefix ending in * such as State* to set the objective for a class of methods, or * for every method without a more specific objective. Calls slower than their objective are counted by the slo_breach_total metric. May be repeated.",
+				EnvVars: []string{"LOTUS_CPR_LATENCY_SLO"},
+			},
+			&cli.BoolFlag{
+				Name:    "epoch-metrics",
+				Usage:   "Break down cache request, hit and latency metrics for calls for a known epoch by whether the epoch is at the head, recent or archival.",
+				EnvVars: []string{"LOTUS_CPR_EPOCH_METRICS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "rate-limit",
+				Usage:   "Maximum rate of calls per second each client may make to a method, given as method=rate or method=rate:burst such as StateChangedActors=0.5:2. Use * as the method to limit every method without its own limit, which share a single allowance. May be repeated.",
+				EnvVars: []string{"LOTUS_CPR_RATE_LIMIT"},
+			},
+			&cli.StringFlag{
+				Name:    "rate-limit-by",
+				Usage:   "How clients are identified for rate limiting: ip, token (falling back to ip for clients without a token) or both.",
+				Value:   RateLimitByIP,
+				EnvVars: []string{"LOTUS_CPR_RATE_LIMIT_BY"},
+			},
+			&cli.IntFlag{
+				Name:    "read-many-concurrency",
+				Usage:   "Number of objects read from the cache at once by each call to the ChainReadObjMany extension method.",
+				Value:   defaultReadManyConcurrency,
+				EnvVars: []string{"LOTUS_CPR_READ_MANY_CONCURRENCY"},
+			},
+			&cli.StringFlag{
+				Name:    "tipset-validation",
+				Usage:   "Validation of tipsets assembled from cached headers by ChainGetTipSet: off, headers (each header matches its cid and all share a parent weight) or parent (as headers, and the parent tipset is lower and no heavier). Tipsets failing validation are read from the lotus node.",
+				Value:   TipSetValidationOff,
+				EnvVars: []string{"LOTUS_CPR_TIPSET_VALIDATION"},
+			},
+			&cli.BoolFlag{
+				Name:    "allow-cache-control",
+				Usage:   "Honor a Cache-Control header of no-cache, to read from the lotus node bypassing the caches, or only-if-cached, to answer only from the caches, sent with rpc requests. Only enable when clients are trusted.",
+				EnvVars: []string{"LOTUS_CPR_ALLOW_CACHE_CONTROL"},
+			},
+			&cli.StringFlag{
+				Name:    "shadow-url",
+				Usage:   "URL of the rpc endpoint of a secondary lotus-cpr that is sent a copy of a sample of calls requiring read permission, such as http://standby:33111/rpc/v0. Responses are discarded.",
+				EnvVars: []string{"LOTUS_CPR_SHADOW_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "shadow-token",
+				Usage:   "Bearer token presented to the secondary lotus-cpr when copying calls.",
+				EnvVars: []string{"LOTUS_CPR_SHADOW_TOKEN"},
+			},
+			&cli.Float64Flag{
+				Name:    "shadow-sample",
+				Usage:   "Fraction of calls copied to the secondary lotus-cpr, greater than 0 and no more than 1.",
+				Value:   1,
+				EnvVars: []string{"LOTUS_CPR_SHADOW_SAMPLE"},
+			},
+			&cli.DurationFlag{
+				Name:    "shadow-timeout",
+				Usage:   "Maximum duration of a call copied to the secondary lotus-cpr.",
+				Value:   30 * time.Second,
+				EnvVars: []string{"LOTUS_CPR_SHADOW_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "chain-notify-backlog",
+				Usage:   "Number of recent head changes kept so that ChainNotifyFrom can replay them to subscribers that reconnect, 0 to disable.",
+				EnvVars: []string{"LOTUS_CPR_CHAIN_NOTIFY_BACKLOG"},
+			},
+			&cli.StringFlag{
+				Name:    "height-index",
+				Usage:   "Path of a file used to persist an index of tipsets by height, built from the node's head changes, that answers ChainGetTipSetByHeight from the cache.",
+				EnvVars: []string{"LOTUS_CPR_HEIGHT_INDEX"},
+			},
+			&cli.IntFlag{
+				Name:    "prefetch-depth",
+				Usage:   "Number of most recent tipsets whose block headers, messages and receipts are fetched into the cache as the chain head changes, 0 to disable.",
+				EnvVars: []string{"LOTUS_CPR_PREFETCH_DEPTH"},
+			},
+			&cli.StringFlag{
+				Name:    "backfill",
+				Usage:   "Path of a file recording the progress of a background backfill, which walks the chain from the node's head back to backfill-to reading block headers, messages and receipts through the cache. An interrupted backfill resumes from the file.",
+				EnvVars: []string{"LOTUS_CPR_BACKFILL"},
+			},
+			&cli.Int64Flag{
+				Name:    "backfill-to",
+				Usage:   "Height of the oldest tipset to backfill.",
+				EnvVars: []string{"LOTUS_CPR_BACKFILL_TO"},
+			},
+			&cli.Float64Flag{
+				Name:    "backfill-rate",
+				Usage:   "Maximum number of blocks per second read by the backfill, 0 for no limit.",
+				Value:   50,
+				EnvVars: []string{"LOTUS_CPR_BACKFILL_RATE"},
+			},
+			&cli.BoolFlag{
+				Name:    "backfill-state",
+				Usage:   "Also backfill the state tree of each tipset.",
+				EnvVars: []string{"LOTUS_CPR_BACKFILL_STATE"},
+			},
+			&cli.IntFlag{
+				Name:    "subscription-buffer",
+				Usage:   "Maximum number of messages buffered for each subscriber to a channel method such as ChainNotify.",
+				Value:   DefaultSubscriptionOptions.BufferSize,
+				EnvVars: []string{"LOTUS_CPR_SUBSCRIPTION_BUFFER"},
+			},
+			&cli.StringFlag{
+				Name:    "subscription-drop-policy",
+				Usage:   "Action to take when a subscriber's buffer is full: close the subscription, or drop the oldest or newest message.",
+				Value:   DefaultSubscriptionOptions.DropPolicy,
+				EnvVars: []string{"LOTUS_CPR_SUBSCRIPTION_DROP_POLICY"},
+			},
+			&cli.StringFlag{
+				Name:    "store-sync",
+				Usage:   "When blocks added to the store are flushed to disk: after every insert, periodically in the background, or only when the store is closed.",
+				Value:   StoreSyncPeriodic,
+				EnvVars: []string{"LOTUS_CPR_STORE_SYNC"},
+			},
+			&cli.BoolFlag{
+				Name:    "store-readonly",
+				Usage:   "Open the store without the write path so that several processes can read one store. Blocks filled from upstream are not added to the store.",
+				EnvVars: []string{"LOTUS_CPR_STORE_READONLY"},
+			},
+			&cli.IntFlag{
+				Name:    "store-read-concurrency",
+				Usage:   "Number of handles opened for reading each store directory, allowing lookups to proceed concurrently. Each handle holds its own copy of the store's index in memory, so the memory used by the index grows by this factor.",
+				Value:   1,
+				EnvVars: []string{"LOTUS_CPR_STORE_READ_CONCURRENCY"},
+			},
+			&cli.StringFlag{
+				Name:    "store-rotate",
+				Usage:   "Roll the store over to a new generation on a schedule: daily or weekly. Generations are kept in subdirectories of the store path.",
+				EnvVars: []string{"LOTUS_CPR_STORE_ROTATE"},
+			},
+			&cli.IntFlag{
+				Name:    "store-generations",
+				Usage:   "Number of store generations to keep readable when rotating the store, including the current generation.",
+				Value:   2,
+				EnvVars: []string{"LOTUS_CPR_STORE_GENERATIONS"},
+			},
+			&cli.DurationFlag{
+				Name:    "store-flush-interval",
+				Usage:   "Interval between flushes of the store when using the periodic sync policy.",
+				Value:   time.Second,
+				EnvVars: []string{"LOTUS_CPR_STORE_FLUSH_INTERVAL"},
+			},
+			&cli.Int64Flag{
+				Name:    "store-flush-pending-bytes",
+				Usage:   "Flush the store whenever more than this many bytes of blocks are waiting to be flushed, whatever the sync policy. Unflushed blocks are held in memory so this bounds the memory used by the close and periodic policies. 0 for no limit.",
+				Value:   256 << 20,
+				EnvVars: []string{"LOTUS_CPR_STORE_FLUSH_PENDING_BYTES"},
+			},
+			&cli.IntFlag{
+				Name:    "store-insert-queue",
+				Usage:   "Number of blocks filled from upstream that may wait to be inserted into the store in the background. Blocks filled while the queue is full are served without being stored. 0 to insert blocks before responding.",
+				Value:   1024,
+				EnvVars: []string{"LOTUS_CPR_STORE_INSERT_QUEUE"},
+			},
+			&cli.IntFlag{
+				Name:    "store-check-samples",
+				Usage:   "Number of store records to verify on startup, 0 to skip the startup consistency check.",
+				Value:   1000,
+				EnvVars: []string{"LOTUS_CPR_STORE_CHECK_SAMPLES"},
+			},
+			&cli.IntFlag{
+				Name:    "store-check-threshold",
+				Usage:   "Number of inconsistencies found by the startup consistency check above which the store is reported as inconsistent.",
+				Value:   0,
+				EnvVars: []string{"LOTUS_CPR_STORE_CHECK_THRESHOLD"},
+			},
+			&cli.BoolFlag{
+				Name:    "store-check-refuse",
+				Usage:   "Refuse to start if the startup consistency check reports the store as inconsistent, instead of only logging a warning.",
+				EnvVars: []string{"LOTUS_CPR_STORE_CHECK_REFUSE"},
+			},
+			&cli.Int64Flag{
+				Name:    "store-max-records",
+				Usage:   "Number of records above which the store is reported as full, 0 for no limit.",
+				EnvVars: []string{"LOTUS_CPR_STORE_MAX_RECORDS"},
+			},
+			&cli.Int64Flag{
+				Name:    "store-max-bytes",
+				Usage:   "Size in bytes of the store's data files above which the store is reported as full, 0 for no limit.",
+				EnvVars: []string{"LOTUS_CPR_STORE_MAX_BYTES"},
+			},
+			&cli.BoolFlag{
+				Name:    "store-full-nofill",
+				Usage:   "Stop adding blocks filled from upstream to the store while it is full.",
+				EnvVars: []string{"LOTUS_CPR_STORE_FULL_NOFILL"},
+			},
+			&cli.StringFlag{
+				Name:    "bootstrap-snapshot-url",
+				Usage:   "URL of a chain snapshot in CAR format, such as the latest snapshot published by a snapshot service, that is imported into the store the first time the proxy starts with it, before serving requests. The heights covered by the snapshot are recorded in bootstrap.json in the first store directory.",
+				EnvVars: []string{"LOTUS_CPR_BOOTSTRAP_SNAPSHOT_URL"},
+			},
+			&cli.BoolFlag{
+				Name:    "store-evict",
+				Usage:   "Evict the oldest store generations while the store exceeds store-max-records or store-max-bytes, starting a new generation early if only the current one remains. Requires store-rotate.",
+				EnvVars: []string{"LOTUS_CPR_STORE_EVICT"},
+			},
 		},
 		Action:          run,
 		HideHelpCommand: true,
+		Commands: []*cli.Command{
+			tokenCommand,
+			statusCommand,
+			importCarCommand,
+			exportCarCommand,
+			syncStoreCommand,
+			storeCommand,
+			fakeNodeCommand,
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -128,75 +760,348 @@ func run(cc *cli.Context) error {
 	logfmtr.UseOptions(loggerOpts)
 	logger := logfmtr.New().V(LogLevelInfo)
 
+	if cc.String("api-token") == "" {
+		return fmt.Errorf("api-token must be specified")
+	}
+
 	// Init metric reporting if required
 	reportMetrics := false
 	dlogger := logfmtr.New().V(LogLevelDiagnostics)
-	if dlogger.Enabled() || cc.String("diag") != "" {
+	if dlogger.Enabled() || cc.String("diag") != "" || cc.Duration("status-log-interval") > 0 {
 		reportMetrics = true
 		if err := initMetricReporting(metricReportingInterval); err != nil {
 			return fmt.Errorf("failed to initialize metric reporting: %w", err)
 		}
 	}
 
+	if endpoint := cc.String("otel-endpoint"); endpoint != "" {
+		shutdown, err := InitTracing(ctx, endpoint)
+		if err != nil {
+			return fmt.Errorf("otel-endpoint: %w", err)
+		}
+		defer func() {
+			sctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+			defer cancel()
+			if err := shutdown(sctx); err != nil {
+				logger.Error(err, "failed to export remaining traces")
+			}
+		}()
+		logger.Info("Exporting traces", "endpoint", endpoint)
+	}
+
 	client, err := newAPIClient(cc.String("api"), cc.String("api-token"), cc.Int("api-errors"), cc.Int("api-concurrency"), cc.Duration("disconnect-timeout"), logfmtr.NewNamed("client"))
 	if err != nil {
 		return fmt.Errorf("failed to create api client: %w", err)
 	}
 	defer client.Close()
 
-	caches := []BlockCache{
-		NewNodeBlockCache(client, logfmtr.NewNamed("node")),
+	if fallbacks := cc.StringSlice("api-fallback"); len(fallbacks) > 0 {
+		tokens := cc.StringSlice("api-fallback-token")
+		if len(tokens) != 1 && len(tokens) != len(fallbacks) {
+			return fmt.Errorf("api-fallback-token must be given once or once for each api-fallback")
+		}
+		for i, maddr := range fallbacks {
+			token := tokens[0]
+			if len(tokens) > 1 {
+				token = tokens[i]
+			}
+			fallback, err := newAPIClient(maddr, token, cc.Int("api-errors"), cc.Int("api-concurrency"), cc.Duration("disconnect-timeout"), logfmtr.NewNamed("client"))
+			if err != nil {
+				return fmt.Errorf("failed to create fallback api client: %w", err)
+			}
+			client.AddFallback(fallback)
+		}
+		logger.Info("Failing over to fallback lotus nodes when the preferred node is unavailable", "fallbacks", len(fallbacks))
+	}
+	client.SetSlowStart(cc.Duration("api-slow-start"), cc.Int("api-concurrency"))
+	if err := CheckUpstreamTokens(ctx, client, cc.Bool("read-only"), logger); err != nil {
+		return err
 	}
 
-	if cc.String("blockstore-baseurl") != "" {
-		hCache := NewHttpBlockCache(cc.String("blockstore-baseurl"), "http")
+	cidCounter := NewCIDCounter(cidCounterSize)
+	statusReporter := NewStatusReporter(client, client)
+	statusReporter.SetCIDCounter(cidCounter)
+	egressCounter := NewEgressCounter(egressCounterSize)
+	statusReporter.SetEgressCounter(egressCounter)
 
-		upstream := caches[len(caches)-1]
-		hCache.SetUpstream(upstream)
+	nodeCache := NewNodeBlockCache(client, logfmtr.NewNamed("node"))
+	nodeCache.SetFillLimits(cc.Float64("node-fill-rate"), cc.Int64("node-fill-bandwidth"))
+	nodeCache.SetVerify(cc.Bool("node-verify"))
+	if path := cc.String("node-missing-file"); path != "" {
+		if cc.Duration("node-missing-ttl") <= 0 {
+			return fmt.Errorf("node-missing-ttl must be positive")
+		}
+		missing, err := OpenMissingBlocks(path, cc.Duration("node-missing-ttl"), logfmtr.NewNamed("node"))
+		if err != nil {
+			return fmt.Errorf("node-missing-file: %w", err)
+		}
+		defer missing.Close()
+		nodeCache.SetMissingBlocks(missing)
+	}
+	// Subscribes once to the node's head changes and passes them to everything that follows the head
+	heads := NewHeadFanout(client, logfmtr.NewNamed("proxy"))
 
-		caches = append(caches, hCache)
-		logger.Info("Added http blockstore", "base_url", cc.String("blockstore-baseurl"))
+	if n := cc.Int("node-negative-cache-size"); n > 0 {
+		negative, err := NewNegativeCache(n, cc.Duration("node-negative-cache-ttl"), logfmtr.NewNamed("node"))
+		if err != nil {
+			return fmt.Errorf("node-negative-cache: %w", err)
+		}
+		nodeCache.SetNegativeCache(negative)
+		heads.Add(negative)
 	}
 
-	if cc.String("store") != "" {
-		logger.Info("Opening store", "path", cc.String("store"))
-		s, err := openStore(ctx, cc.String("store"))
+	layers := CacheLayersFromFlags(cc)
+	if cc.String("config") != "" {
+		layers, err = ReadCacheChainConfig(cc, cc.String("config"))
 		if err != nil {
-			return fmt.Errorf("failed to open gonudb store: %w", err)
+			return fmt.Errorf("config: %w", err)
 		}
-		defer func() {
-			err := s.Close()
-			if err != nil {
-				logger.Error(err, "failed to close store cleanly")
+	}
+	// Closed once the chain has been closed on shutdown, see hardStop
+	chainClosed := make(chan struct{})
+	defer close(chainClosed)
+
+	// Background workers are run by the chain, which stops them before closing the caches they read through
+	chain := newCacheChain(ctx, nodeCache, statusReporter, reportMetrics, logger)
+	defer chain.Close()
+	if err := chain.Build(layers); err != nil {
+		return err
+	}
+
+	recovery := NewPanicRecovery(logfmtr.NewNamed("proxy"))
+	drainer := NewDrainer()
+	middleware := []MethodMiddleware{recovery.Middleware, TraceMethod, drainer.Middleware, statusReporter.Middleware, CancellationMetrics, MethodMetrics, egressCounter.Middleware}
+
+	slos, err := ParseLatencySLOs(cc.StringSlice("latency-slo"))
+	if err != nil {
+		return fmt.Errorf("latency-slo: %w", err)
+	}
+	if slos != nil {
+		middleware = append(middleware, slos.Middleware)
+	}
+
+	var auditLog *AuditLog
+	if cc.String("audit-log") != "" {
+		auditLog, err = OpenAuditLog(cc.String("audit-log"))
+		if err != nil {
+			return err
+		}
+		defer auditLog.Close()
+		middleware = append(middleware, auditLog.Middleware)
+		logger.Info("Writing audit log", "path", cc.String("audit-log"))
+	}
+
+	if cc.String("access-log") != "" {
+		accessLog, err := OpenAccessLog(cc.String("access-log"), cc.String("access-log-format"), cc.Float64("access-log-sample"))
+		if err != nil {
+			return fmt.Errorf("access-log: %w", err)
+		}
+		defer accessLog.Close()
+		middleware = append(middleware, accessLog.Middleware)
+		logger.Info("Writing access log", "path", cc.String("access-log"), "format", cc.String("access-log-format"), "sample", cc.Float64("access-log-sample"))
+	}
+
+	if cc.String("journal-file") != "" {
+		journal, err := OpenRequestJournal(cc.String("journal-file"), cc.Int("journal-size"), logfmtr.NewNamed("proxy"))
+		if err != nil {
+			return fmt.Errorf("journal-file: %w", err)
+		}
+		defer journal.Close()
+		middleware = append(middleware, journal.Middleware)
+		logger.Info("Journaling rpc calls", "path", cc.String("journal-file"), "size", cc.Int("journal-size"))
+	}
+
+	if cc.Bool("read-only") {
+		middleware = append(middleware, ReadOnlyPolicy)
+		logger.Info("Rejecting calls to methods requiring more than read permission")
+	}
+
+	var tokenIssuer *TokenIssuer
+	if cc.String("token-secret-file") != "" {
+		secret, err := ReadTokenSecret(cc.String("token-secret-file"))
+		if err != nil {
+			return fmt.Errorf("token-secret-file: %w", err)
+		}
+		tokenIssuer = NewTokenIssuer(secret)
+		middleware = append(middleware, ScopePolicy)
+		logger.Info("Requiring proxy tokens for RPC requests")
+	}
+
+	var clientAuth *ClientAuth
+	if cc.String("client-tokens-file") != "" || cc.Bool("client-auth-node") {
+		if tokenIssuer != nil {
+			return fmt.Errorf("token-secret-file cannot be used with client-tokens-file or client-auth-node")
+		}
+		clientAuth = NewClientAuth()
+		if path := cc.String("client-tokens-file"); path != "" {
+			if err := clientAuth.LoadTokens(path); err != nil {
+				return fmt.Errorf("client-tokens-file: %w", err)
 			}
-		}()
+		}
+		if cc.Bool("client-auth-node") {
+			clientAuth.SetVerifier(client)
+		}
+		middleware = append(middleware, PermPolicy)
+		logger.Info("Requiring client tokens for RPC requests", "verify_with_node", cc.Bool("client-auth-node"))
+	}
 
-		dbCache := NewDBBlockCache(s, logfmtr.NewNamed("gonudb"))
-
-		if reportMetrics {
-			go func() {
-				timer := time.NewTicker(2 * time.Second)
-				for {
-					select {
-					case <-timer.C:
-						dbCache.ReportMetrics(ctx)
-					case <-ctx.Done():
-						timer.Stop()
-						return
-					}
-				}
-			}()
+	middleware = append(middleware, ValidateParams)
+
+	rateLimits, err := ParseRateLimits(cc.StringSlice("rate-limit"))
+	if err != nil {
+		return fmt.Errorf("rate-limit: %w", err)
+	}
+	if rateLimits != nil {
+		rateLimiter, err := NewRateLimiter(rateLimits, cc.String("rate-limit-by"))
+		if err != nil {
+			return fmt.Errorf("rate-limit-by: %w", err)
 		}
+		middleware = append(middleware, rateLimiter.Middleware)
+	}
+
+	if cc.String("authz-url") != "" {
+		authz := NewAuthzWebhook(cc.String("authz-url"), cc.StringSlice("authz-method"), cc.Duration("authz-timeout"), logfmtr.NewNamed("proxy"))
+		middleware = append(middleware, authz.Middleware)
+		logger.Info("Consulting authorization service on sensitive calls", "url", cc.String("authz-url"), "methods", cc.StringSlice("authz-method"))
+	}
+
+	heavyGuard, err := NewHeavyMethodGuard(HeavyMethodOptions{
+		Enabled:     cc.StringSlice("enable-heavy-method"),
+		Timeout:     cc.Duration("heavy-method-timeout"),
+		Concurrency: cc.Int("heavy-method-concurrency"),
+	})
+	if err != nil {
+		return fmt.Errorf("enable-heavy-method: %w", err)
+	}
+	middleware = append(middleware, heavyGuard.Middleware)
+
+	if cc.String("shadow-url") != "" {
+		shadow, err := NewRequestShadow(cc.String("shadow-url"), cc.String("shadow-token"), cc.Float64("shadow-sample"), cc.Duration("shadow-timeout"), logfmtr.NewNamed("proxy"))
+		if err != nil {
+			return fmt.Errorf("shadow-sample: %w", err)
+		}
+		middleware = append(middleware, shadow.Middleware)
+		logger.Info("Copying calls to shadow endpoint", "url", cc.String("shadow-url"), "sample", cc.Float64("shadow-sample"))
+	}
+
+	sizeLimits, err := ParseResponseSizeLimits(cc.StringSlice("max-response-size"))
+	if err != nil {
+		return fmt.Errorf("max-response-size: %w", err)
+	}
+	if sizeLimits != nil {
+		middleware = append(middleware, sizeLimits.Middleware)
+	}
 
-		upstream := caches[len(caches)-1]
-		dbCache.SetUpstream(upstream)
+	subOpts := SubscriptionOptions{
+		BufferSize: cc.Int("subscription-buffer"),
+		DropPolicy: cc.String("subscription-drop-policy"),
+	}
+	if err := subOpts.Validate(); err != nil {
+		return fmt.Errorf("subscription options: %w", err)
+	}
 
-		caches = append(caches, dbCache)
-		logger.Info("Added gonudb cache", "path", cc.String("store"))
+	codecs, err := ParseCodecAllowlist(cc.StringSlice("allowed-codec"))
+	if err != nil {
+		return fmt.Errorf("allowed-codec: %w", err)
 	}
 
+	proxy := NewAPIProxy(client, chain.Head(), logfmtr.NewNamed("proxy"))
+	proxy.SetCodecAllowlist(codecs)
+	proxy.SetCoverage(chain.Coverage())
+	if cc.Int("read-many-concurrency") <= 0 {
+		return fmt.Errorf("read-many-concurrency must be positive")
+	}
+	proxy.SetReadManyConcurrency(cc.Int("read-many-concurrency"))
+	if !ValidTipSetValidation(cc.String("tipset-validation")) {
+		return fmt.Errorf("tipset-validation: unknown level %q", cc.String("tipset-validation"))
+	}
+	proxy.SetTipSetValidation(cc.String("tipset-validation"))
+	var missQueue *MissQueue
+	if n := cc.Int("miss-queue-threshold"); n > 0 {
+		if cc.Int("miss-queue-size") <= 0 {
+			return fmt.Errorf("miss-queue-size must be positive")
+		}
+		missQueue = NewMissQueue(n, cc.Int("miss-queue-size"))
+		proxy.SetMissQueue(missQueue)
+	}
+	if interval := cc.Duration("node-prune-check-interval"); interval > 0 {
+		pruned := NewPruneDetector(client, interval, logfmtr.NewNamed("proxy"))
+		chain.Go(pruned.Run)
+		proxy.SetPruneDetector(pruned)
+	}
+	if n := cc.Int("chain-notify-backlog"); n > 0 {
+		backlog := NewHeadBacklog(n, logfmtr.NewNamed("proxy"))
+		backlog.SetBackfillCache(chain.Head())
+		heads.Add(backlog)
+		proxy.SetHeadBacklog(backlog)
+	}
+	if path := cc.String("height-index"); path != "" {
+		heights, err := OpenHeightIndex(path, chain.Head(), logfmtr.NewNamed("proxy"))
+		if err != nil {
+			return fmt.Errorf("height-index: %w", err)
+		}
+		chain.OnClose(func() {
+			if err := heights.Close(); err != nil {
+				logger.Error(err, "failed to close height index")
+			}
+		})
+		heads.Add(heights)
+		proxy.SetHeightIndex(heights)
+		if snap := chain.Snapshot(); snap != nil && snap.Result != nil {
+			// The store has just been bootstrapped so index the tipsets it holds
+			chain.Go(func(ctx context.Context) {
+				n, err := heights.Seed(ctx, snap.Key(), snap.Low)
+				if err != nil {
+					logger.Error(err, "failed to index snapshot tipsets", "indexed", n)
+					return
+				}
+				logger.Info("Indexed snapshot tipsets", "indexed", n)
+			})
+		}
+	}
+	if depth := cc.Int("prefetch-depth"); depth > 0 {
+		prefetcher := NewPrefetcher(chain.Head(), depth, logfmtr.NewNamed("proxy"))
+		prefetcher.SetCoverage(chain.Coverage())
+		heads.Add(prefetcher)
+		chain.Go(prefetcher.Run)
+	}
+	heads.Add(NewReorgMonitor(logfmtr.NewNamed("proxy")))
+	if cc.Bool("epoch-metrics") {
+		epochs := NewEpochTracker()
+		heads.Add(epochs)
+		proxy.SetEpochTracker(epochs)
+	}
+	chain.Go(heads.Run)
+	if path := cc.String("backfill"); path != "" {
+		if cc.Int64("backfill-to") < 0 {
+			return fmt.Errorf("backfill-to must not be negative")
+		}
+		backfiller := NewBackfiller(client, chain.Head(), path, abi.ChainEpoch(cc.Int64("backfill-to")), logfmtr.NewNamed("proxy"))
+		backfiller.SetState(cc.Bool("backfill-state"))
+		backfiller.SetRate(cc.Float64("backfill-rate"))
+		backfiller.SetCoverage(chain.Coverage())
+		chain.Go(backfiller.Run)
+	}
+	if perms := cc.StringSlice("authnew-allow-perm"); len(perms) > 0 {
+		policy, err := NewAuthNewPolicy(perms, auditLog)
+		if err != nil {
+			return fmt.Errorf("authnew-allow-perm: %w", err)
+		}
+		proxy.SetAuthNewPolicy(policy)
+	}
+	if perm := cc.String("passthrough-max-perm"); perm != "none" {
+		if err := proxy.SetPassthrough(auth.Permission(perm)); err != nil {
+			return fmt.Errorf("passthrough-max-perm: %w", err)
+		}
+	}
+	proxy.SetSubscriptionOptions(subOpts)
+	proxy.SetCIDCounter(cidCounter)
+	statusReporter.SetSubscriptionCounter(proxy)
+
 	rpcServer := jsonrpc.NewServer()
-	rpcServer.Register("Filecoin", NewAPIProxy(client, caches[len(caches)-1], logfmtr.NewNamed("proxy")))
+	for _, h := range NewRPCHandlers(proxy, middleware...) {
+		rpcServer.Register("Filecoin", h)
+	}
 
 	// Set up a signal handler to cancel the context
 	go func() {
@@ -226,20 +1131,73 @@ func run(cc *cli.Context) error {
 		}()
 	}
 
+	// Log status summaries?
+	if interval := cc.Duration("status-log-interval"); interval > 0 {
+		go func() {
+			timer := time.NewTicker(interval)
+			for {
+				select {
+				case <-timer.C:
+					statusReporter.Status(ctx).Log(logger)
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+		}()
+	}
+
+	tlsConfig, err := ListenerTLSOptions{
+		CertFile:     cc.String("listen-tls-cert"),
+		KeyFile:      cc.String("listen-tls-key"),
+		ClientCAFile: cc.String("listen-tls-client-ca"),
+	}.TLSConfig()
+	if err != nil {
+		return fmt.Errorf("listen-tls: %w", err)
+	}
+
 	// Serve metrics via http?
 	if cc.String("diag") != "" {
 		diagListener, err := net.Listen("tcp", cc.String("diag"))
 		if err != nil {
 			return fmt.Errorf("failed to listen on %q: %w", cc.String("diag"), err)
 		}
+		if tlsConfig != nil {
+			diagListener = tls.NewListener(diagListener, tlsConfig)
+		}
 
-		pe, err := registerPrometheusExporter("lotuscpr")
+		if ns := cc.String("metrics-namespace"); ns != "" && !metricNameRe.MatchString(ns) {
+			return fmt.Errorf("metrics-namespace: invalid namespace %q", ns)
+		}
+		labels, err := parseMetricLabels(cc.StringSlice("metrics-label"))
+		if err != nil {
+			return fmt.Errorf("metrics-label: %w", err)
+		}
+
+		pe, err := registerPrometheusExporter(cc.String("metrics-namespace"), labels)
 		if err != nil {
 			return fmt.Errorf("failed to register prometheus exporter: %w", err)
 		}
 
 		diagMux := mux.NewRouter()
 		diagMux.Handle("/metrics", pe)
+		diagMux.Handle("/status", statusReporter)
+		diagMux.Handle("/health", healthHandler(statusReporter))
+		diagMux.Handle("/healthz", livenessHandler())
+		diagMux.Handle("/readyz", readinessHandler(statusReporter))
+		diagMux.Handle("/tiers", tiersHandler(chain.Tiers()))
+		if missQueue != nil {
+			diagMux.Handle("/missing", missQueueHandler(missQueue))
+		}
+		if s := chain.Store(); s != nil {
+			diagMux.Handle("/store/keys", storeKeysHandler(s))
+			diagMux.Handle("/store/record/{key}", storeRecordHandler(s))
+		}
+		if cc.Bool("diag-debug") {
+			registerDebugHandlers(diagMux)
+			logger.Info("Serving profiling and debug endpoints on the diagnostics server")
+		}
+		diagMux.Handle("/", dashboardHandler(statusReporter))
 
 		diagSrv := &http.Server{
 			Handler: diagMux,
@@ -252,7 +1210,7 @@ func run(cc *cli.Context) error {
 			}
 		}()
 
-		logger.Info("Starting diagnostics server", "addr", cc.String("diag"))
+		logger.Info("Starting diagnostics server", "addr", cc.String("diag"), "tls", tlsConfig != nil)
 		go diagSrv.Serve(diagListener)
 	}
 
@@ -261,31 +1219,143 @@ func run(cc *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %q: %w", cc.String("listen"), err)
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 
-	mux := mux.NewRouter()
-	mux.Handle("/rpc/v0", rpcServer)
-	mux.PathPrefix("/").Handler(http.DefaultServeMux)
+	clientNames := map[string]bool{}
+	for _, name := range cc.StringSlice("client-name") {
+		if name = sanitizeClientName(name); name != "" && name != anonymousClientName {
+			clientNames[name] = true
+		}
+	}
+
+	// Requests for blocks are authenticated in the same way as rpc calls
+	authenticate := func(h http.Handler) http.Handler {
+		if cc.Bool("allow-cache-control") {
+			h = honorCacheControl(h)
+		}
+		if tokenIssuer != nil {
+			h = requireToken(tokenIssuer, auditLog, h)
+		}
+		if clientAuth != nil {
+			h = requireClientToken(clientAuth, auditLog, h)
+		}
+		return traceRequest(identifyClient(clientNames, requestDeadline(h, cc.Duration("request-timeout"))))
+	}
 
 	srv := &http.Server{
-		Handler: mux,
+		Handler: rpcRouter(rpcServer, blockHandler(proxy), authenticate),
 	}
 
+	logger.Info("Starting RPC server", "addr", cc.String("listen"), "tls", tlsConfig != nil)
+	served := make(chan error, 1)
 	go func() {
-		<-ctx.Done()
-		if err := srv.Shutdown(context.Background()); err != nil {
-			logger.Error(err, "failed to shut down RPC server")
-		}
+		served <- srv.Serve(listener)
 	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	// The caches and store are closed once the requests using them have completed
+	logger.Info("Draining RPC server", "period", cc.Duration("drain-period"), "inflight", drainer.InFlight())
+	dctx, dcancel := context.WithTimeout(context.Background(), cc.Duration("drain-period"))
+	defer dcancel()
+	err = drainer.Drain(dctx, srv)
+	go hardStop(chainClosed, cc.Duration("shutdown-timeout"), logger)
+	if err != nil {
+		logger.Error(err, "requests still being handled after drain period, stopping", "inflight", drainer.InFlight())
+		srv.Close()
+		return nil
+	}
+	logger.Info("Drained RPC server")
+	return nil
+}
+
+// rpcRouter routes the requests received by the rpc listener to the rpc server and the block handler, both
+// wrapped by authenticate.
+func rpcRouter(rpc, blocks http.Handler, authenticate func(http.Handler) http.Handler) *mux.Router {
+	m := mux.NewRouter()
+	m.Handle("/rpc/v0", authenticate(rpc))
+	m.Handle("/block/{cid}/data.raw", authenticate(blocks))
+	// http.DefaultServeMux is not served since the pprof and expvar packages register their handlers on it
+	// when imported, exposing profiles and the command line, including the api token, without authentication.
+	// They are only served by the diagnostics server, see registerDebugHandlers
+	return m
+}
+
+// hardStop exits the process if closed is not closed within timeout, such as when a background worker
+// or the store does not stop while the caches are being closed on shutdown.
+func hardStop(closed <-chan struct{}, timeout time.Duration, logger logr.Logger) {
+	select {
+	case <-closed:
+	case <-time.After(timeout):
+		logger.Info("Caches were not closed within the shutdown timeout, exiting", "timeout", timeout)
+		os.Exit(1)
+	}
+}
 
-	logger.Info("Starting RPC server", "addr", cc.String("listen"))
-	return srv.Serve(listener)
+// openShardedStore opens a gonudb store in each of paths, distributing records across them.
+func openShardedStore(ctx context.Context, paths []string, readOnly bool) (*ShardedStore, error) {
+	shards, datPaths, times, err := openStoreShards(ctx, paths, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return NewShardedStore(shards, datPaths, times), nil
 }
 
-func openStore(ctx context.Context, path string) (*gonudb.Store, error) {
+// openStoreShards opens a gonudb store in each of paths, returning the stores, the paths of their data
+// files and their record times. Record times are not written for read-only stores.
+func openStoreShards(ctx context.Context, paths []string, readOnly bool) ([]*gonudb.Store, []string, []*RecordTimes, error) {
+	g := newStoreGeneration("", make([]*gonudb.Store, 0, len(paths)), make([]string, 0, len(paths)), make([]*RecordTimes, 0, len(paths)))
+	for _, path := range paths {
+		st, err := openStore(ctx, path, readOnly)
+		if err != nil {
+			g.close()
+			return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		var times *RecordTimes
+		if !readOnly {
+			times, err = OpenRecordTimes(path)
+			if err != nil {
+				st.Close()
+				g.close()
+				return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		g.shards = append(g.shards, st)
+		g.datPaths = append(g.datPaths, filepath.Join(path, "blocks.dat"))
+		g.times = append(g.times, times)
+	}
+	return g.shards, g.datPaths, g.times, nil
+}
+
+// openStore opens the gonudb store in path, creating it if it does not exist and upgrading it if its
+// format is out of date. A read-only store must already exist and is opened with a private log file so that it does not conflict with other processes
+// using the store. gonudb only writes to the log file when records are inserted.
+func openStore(ctx context.Context, path string, readOnly bool) (*gonudb.Store, error) {
 	datPath := filepath.Join(path, "blocks.dat")
 	keyPath := filepath.Join(path, "blocks.key")
 	logPath := filepath.Join(path, "blocks.log")
 
+	if readOnly {
+		if _, err := os.Stat(datPath); err != nil {
+			return nil, fmt.Errorf("stat store: %w", err)
+		}
+		// gonudb creates the log file exclusively so reserve a unique name and remove the file
+		f, err := ioutil.TempFile("", "lotus-cpr-*.log")
+		if err != nil {
+			return nil, fmt.Errorf("create log file: %w", err)
+		}
+		logPath = f.Name()
+		f.Close()
+		if err := os.Remove(logPath); err != nil {
+			return nil, fmt.Errorf("remove log file: %w", err)
+		}
+	}
+
 	_, err := os.Stat(datPath)
 	if err != nil {
 		var pathErr *os.PathError
@@ -302,12 +1372,20 @@ func openStore(ctx context.Context, path string) (*gonudb.Store, error) {
 			if err != nil {
 				return nil, fmt.Errorf("create store: %w", err)
 			}
+			if err := writeStoreFormat(path, storeFormatVersion); err != nil {
+				return nil, err
+			}
 		} else {
 			return nil, fmt.Errorf("stat store: %w", err)
 		}
 	}
 
-	s, err := gonudb.OpenStore(datPath, keyPath, logPath, &gonudb.StoreOptions{})
+	if err := migrateStore(path, readOnly, logfmtr.NewNamed("gonudb")); err != nil {
+		return nil, err
+	}
+
+	// Flushes are driven by the proxy so they can be measured, see DBBlockCache.Flush
+	s, err := gonudb.OpenStore(datPath, keyPath, logPath, &gonudb.StoreOptions{BackgroundSyncInterval: storeSyncNever})
 	if err != nil {
 		return nil, fmt.Errorf("failed to open store: %w", err)
 	}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipfs-blockstore"
+)
+
+var (
+	_ (BlockCache)       = (*MemoryBlockCache)(nil)
+	_ (BlockRangeReader) = (*MemoryBlockCache)(nil)
+)
+
+// MemoryBlockCache keeps recently used blocks in memory, up to a maximum total size. It is intended to sit in
+// front of the other caches so that frequently requested blocks, such as those near the head of the chain,
+// are served without reading from disk or the network.
+type MemoryBlockCache struct {
+	mu       sync.Mutex // guards blocks and size
+	blocks   *simplelru.LRU
+	size     int64 // total size of the data of the cached blocks
+	maxSize  int64
+	upstream BlockCache
+}
+
+// NewMemoryBlockCache creates a cache holding up to maxSize bytes of block data.
+func NewMemoryBlockCache(maxSize int64) *MemoryBlockCache {
+	m := &MemoryBlockCache{maxSize: maxSize}
+	// Only errors if size is not positive. Entries are evicted by size rather than count.
+	m.blocks, _ = simplelru.NewLRU(math.MaxInt32, m.onEvict)
+	return m
+}
+
+func (m *MemoryBlockCache) onEvict(key interface{}, value interface{}) {
+	m.size -= int64(len(value.(blocks.Block).RawData()))
+}
+
+func (m *MemoryBlockCache) get(c cid.Cid) (blocks.Block, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.blocks.Get(c)
+	if !ok {
+		return nil, false
+	}
+	return v.(blocks.Block), true
+}
+
+// add caches a block if its data matches its cid and it is no larger than the cache.
+func (m *MemoryBlockCache) add(ctx context.Context, blk blocks.Block) {
+	size := int64(len(blk.RawData()))
+	if size > m.maxSize {
+		return
+	}
+	ctx = fillContext(ctx)
+	reportEvent(ctx, fillRequest)
+	chkc, err := blk.Cid().Prefix().Sum(blk.RawData())
+	if err != nil {
+		reportFillFailure(ctx, fillReasonHashUnsupported)
+		return
+	}
+	if !chkc.Equals(blk.Cid()) {
+		reportFillFailure(ctx, fillReasonHashMismatch)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.blocks.Contains(blk.Cid()) {
+		return
+	}
+	m.blocks.Add(blk.Cid(), blk)
+	m.size += size
+	for m.size > m.maxSize {
+		m.blocks.RemoveOldest()
+	}
+	reportEvent(ctx, fillSuccess)
+	reportSize(ctx, fillSize, int(size))
+}
+
+func (m *MemoryBlockCache) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if _, ok := m.get(c); ok {
+		return true, nil
+	}
+	if m.upstream == nil {
+		return false, nil
+	}
+	return m.upstream.Has(ctx, c)
+}
+
+func (m *MemoryBlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	ctx = cacheContext(ctx, "memory")
+	reportEvent(ctx, getRequest)
+	stop := startTimer(ctx, getDuration)
+	defer stop()
+
+	if blk, ok := m.get(c); ok {
+		reportEvent(ctx, getHit)
+		reportSize(ctx, getSize, len(blk.RawData()))
+		return blk, nil
+	}
+	reportEvent(ctx, getMiss)
+
+	if m.upstream == nil {
+		return nil, blockstore.ErrNotFound
+	}
+	blk, err := m.upstream.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	m.add(ctx, blk)
+	return blk, nil
+}
+
+// GetRange reads part of a block from memory. Blocks that are not in memory are read from upstream without
+// being added to the cache.
+func (m *MemoryBlockCache) GetRange(ctx context.Context, c cid.Cid, offset int64, length int64) ([]byte, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	ctx = cacheContext(ctx, "memory")
+	reportEvent(ctx, getRequest)
+	stop := startTimer(ctx, getDuration)
+	defer stop()
+
+	if blk, ok := m.get(c); ok {
+		data := sliceRange(blk.RawData(), offset, length)
+		reportEvent(ctx, getHit)
+		reportSize(ctx, getSize, len(data))
+		return data, nil
+	}
+	reportEvent(ctx, getMiss)
+
+	if m.upstream == nil {
+		return nil, blockstore.ErrNotFound
+	}
+	return getBlockRange(ctx, m.upstream, c, offset, length)
+}
+
+func (m *MemoryBlockCache) SetUpstream(u BlockCache) {
+	m.upstream = u
+}
+
+// ReportMetrics reports the number and total size of the blocks held in memory.
+func (m *MemoryBlockCache) ReportMetrics(ctx context.Context) {
+	m.mu.Lock()
+	count, size := m.blocks.Len(), m.size
+	m.mu.Unlock()
+	reportMeasurement(ctx, memoryBlockCount.M(int64(count)))
+	reportMeasurement(ctx, memorySize.M(size))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	blockadt "github.com/filecoin-project/specs-actors/actors/util/adt"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+var errReadOnlyStore = errors.New("store is read only")
+
+// cacheBlockstore adapts a BlockCache for use as a read only ipld blockstore.
+type cacheBlockstore struct {
+	ctx   context.Context
+	cache BlockCache
+}
+
+func (b *cacheBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	return b.cache.Get(b.ctx, c)
+}
+
+func (b *cacheBlockstore) Put(blocks.Block) error {
+	return errReadOnlyStore
+}
+
+// blockMessages holds the messages included in a single block.
+type blockMessages struct {
+	bls   []*types.Message
+	secpk []*types.SignedMessage
+}
+
+// cachedBlockMessages reconstructs the messages included in a block from the message meta and
+// message objects held by the cache.
+func cachedBlockMessages(ctx context.Context, cache BlockCache, bh *types.BlockHeader) (*blockMessages, error) {
+	cst := cbor.NewCborStore(&cacheBlockstore{ctx: ctx, cache: cache})
+
+	var meta types.MsgMeta
+	if err := cst.Get(ctx, bh.Messages, &meta); err != nil {
+		return nil, fmt.Errorf("load msgmeta %s: %w", bh.Messages, err)
+	}
+
+	blsCids, err := readAMTCids(ctx, cst, meta.BlsMessages)
+	if err != nil {
+		return nil, fmt.Errorf("load bls message cids: %w", err)
+	}
+	secpkCids, err := readAMTCids(ctx, cst, meta.SecpkMessages)
+	if err != nil {
+		return nil, fmt.Errorf("load secpk message cids: %w", err)
+	}
+
+	bm := &blockMessages{
+		bls:   make([]*types.Message, len(blsCids)),
+		secpk: make([]*types.SignedMessage, len(secpkCids)),
+	}
+	for i, c := range blsCids {
+		var m types.Message
+		if err := cst.Get(ctx, c, &m); err != nil {
+			return nil, fmt.Errorf("load bls message %s: %w", c, err)
+		}
+		bm.bls[i] = &m
+	}
+	for i, c := range secpkCids {
+		var m types.SignedMessage
+		if err := cst.Get(ctx, c, &m); err != nil {
+			return nil, fmt.Errorf("load secpk message %s: %w", c, err)
+		}
+		bm.secpk[i] = &m
+	}
+
+	return bm, nil
+}
+
+// readAMTCids reads the cids held in the AMT with the given root. Block headers use v0 AMTs.
+func readAMTCids(ctx context.Context, cst cbor.IpldStore, root cid.Cid) ([]cid.Cid, error) {
+	a, err := blockadt.AsArray(blockadt.WrapStore(ctx, cst), root)
+	if err != nil {
+		return nil, fmt.Errorf("amt load: %w", err)
+	}
+
+	var (
+		cids    []cid.Cid
+		cborCid cbg.CborCid
+	)
+	if err := a.ForEach(&cborCid, func(i int64) error {
+		cids = append(cids, cid.Cid(cborCid))
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("amt traverse: %w", err)
+	}
+
+	if uint64(len(cids)) != a.Length() {
+		return nil, fmt.Errorf("found %d cids, expected %d", len(cids), a.Length())
+	}
+
+	return cids, nil
+}
+
+// tipsetMessages returns the messages that will be applied for the tipset, in execution order. Messages
+// included in more than one block and messages with out of sequence nonces are skipped, following the
+// same rules as Lotus.
+func tipsetMessages(bms []*blockMessages) []api.Message {
+	applied := make(map[address.Address]uint64)
+	selectMsg := func(m *types.Message) bool {
+		// The first match for a sender is guaranteed to have correct nonce -- the block isn't valid otherwise
+		if _, ok := applied[m.From]; !ok {
+			applied[m.From] = m.Nonce
+		}
+		if applied[m.From] != m.Nonce {
+			return false
+		}
+		applied[m.From]++
+		return true
+	}
+
+	var out []api.Message
+	for _, bm := range bms {
+		for _, m := range bm.bls {
+			if selectMsg(m) {
+				out = append(out, api.Message{Cid: m.Cid(), Message: m})
+			}
+		}
+		for _, sm := range bm.secpk {
+			if selectMsg(&sm.Message) {
+				out = append(out, api.Message{Cid: sm.Cid(), Message: &sm.Message})
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opencensus.io/tag"
+)
+
+// MethodMetrics is method middleware that tags the metrics recorded while handling a call with the name of
+// the method, so that cache requests, hits and latency and the calls made to the lotus node can be broken
+// down by the rpc method that caused them. It also counts the calls to each method and the calls answered
+// by the lotus node without reading any blocks through the caches.
+func MethodMetrics(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		ctx, _ = tag.New(ctx, tag.Upsert(methodTag, call.Method))
+		ctx, outcome := withCallOutcome(ctx)
+		reportEvent(ctx, rpcRequest)
+
+		res, err := next(ctx, call)
+		if atomic.LoadInt32(&outcome.upstream) > 0 && atomic.LoadInt32(&outcome.reads) == 0 {
+			reportEvent(ctx, rpcUpstreamFulfilled)
+		}
+		return res, err
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opencensus.io/tag"
+)
+
+// mirrorDecay is the weight given to each new sample when updating a mirror's rolling latency and error
+// rate. Larger values respond more quickly to changes in a mirror's performance.
+const mirrorDecay = 0.2
+
+// mirrorErrorPenalty scales a mirror's latency by its error rate when ranking mirrors, so a mirror failing
+// half its requests is ranked as if it were this many times slower than its latency.
+const mirrorErrorPenalty = 20
+
+// mirrorMinLatency is the lowest latency used when weighting mirrors, preventing a mirror with a few very
+// fast responses from receiving all requests.
+const mirrorMinLatency = time.Millisecond
+
+// mirrorStats holds the rolling latency and error rate of requests to a blockstore mirror.
+type mirrorStats struct {
+	mu      sync.Mutex // guards fields below
+	samples int
+	latency float64 // exponentially weighted moving average of request duration in seconds
+	errors  float64 // exponentially weighted moving average of the fraction of failed requests
+}
+
+// record adds the outcome of a request to the mirror's rolling statistics.
+func (s *mirrorStats) record(d time.Duration, failed bool) (latency float64, errors float64) {
+	var e float64
+	if failed {
+		e = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.samples == 0 {
+		s.latency, s.errors = d.Seconds(), e
+	} else {
+		s.latency += mirrorDecay * (d.Seconds() - s.latency)
+		s.errors += mirrorDecay * (e - s.errors)
+	}
+	s.samples++
+	return s.latency, s.errors
+}
+
+// weight returns the relative share of requests the mirror should be sent first, zero if the mirror has
+// not yet been sampled.
+func (s *mirrorStats) weight() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.samples == 0 {
+		return 0
+	}
+	latency := s.latency
+	if latency < mirrorMinLatency.Seconds() {
+		latency = mirrorMinLatency.Seconds()
+	}
+	return 1 / (latency * (1 + mirrorErrorPenalty*s.errors))
+}
+
+// mirrorRanking orders blockstore mirrors by their recent performance.
+type mirrorRanking struct {
+	mirrors []string
+	stats   []*mirrorStats
+}
+
+// newMirrorRanking creates a ranking of mirrors, keeping the statistics of any that were ranked by prev,
+// which may be nil.
+func newMirrorRanking(mirrors []string, prev *mirrorRanking) *mirrorRanking {
+	r := &mirrorRanking{
+		mirrors: mirrors,
+		stats:   make([]*mirrorStats, len(mirrors)),
+	}
+	for i, base := range mirrors {
+		r.stats[i] = &mirrorStats{}
+		if prev == nil {
+			continue
+		}
+		for j := range prev.mirrors {
+			if prev.mirrors[j] == base {
+				r.stats[i] = prev.stats[j]
+				break
+			}
+		}
+	}
+	return r
+}
+
+// order returns the mirrors in the order they should be tried for a request. Mirrors that have not been
+// sampled come first so every mirror is measured. Otherwise the first mirror is chosen at random, weighted
+// toward those with the lowest latency and error rate so slower mirrors are still sampled occasionally and
+// can recover their ranking, and the rest follow in descending order of weight.
+func (r *mirrorRanking) order() []string {
+	type ranked struct {
+		base   string
+		weight float64
+	}
+	rs := make([]ranked, len(r.mirrors))
+	var total float64
+	unsampled := -1
+	for i, base := range r.mirrors {
+		rs[i] = ranked{base: base, weight: r.stats[i].weight()}
+		if rs[i].weight == 0 && unsampled < 0 {
+			unsampled = i
+		}
+		total += rs[i].weight
+	}
+
+	if unsampled >= 0 {
+		rs[0], rs[unsampled] = rs[unsampled], rs[0]
+	} else {
+		pick := rand.Float64() * total
+		for i := range rs {
+			pick -= rs[i].weight
+			if pick < 0 || i == len(rs)-1 {
+				rs[0], rs[i] = rs[i], rs[0]
+				break
+			}
+		}
+	}
+	rest := rs[1:]
+	sort.SliceStable(rest, func(i, j int) bool { return rest[i].weight > rest[j].weight })
+
+	order := make([]string, len(rs))
+	for i := range rs {
+		order[i] = rs[i].base
+	}
+	return order
+}
+
+// record adds the outcome of a request to the named mirror to its statistics and reports them.
+func (r *mirrorRanking) record(ctx context.Context, base string, d time.Duration, failed bool) {
+	for i := range r.mirrors {
+		if r.mirrors[i] != base {
+			continue
+		}
+		latency, errors := r.stats[i].record(d, failed)
+		ctx, _ = tag.New(ctx, tag.Upsert(mirrorTag, base))
+		reportMeasurement(ctx, httpMirrorLatency.M(latency*1000))
+		reportMeasurement(ctx, httpMirrorErrors.M(errors))
+		return
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lotus/build"
+	"github.com/go-logr/logr"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+)
+
+// missingConfirmDelay is how long a block must have been reported missing by the node before it is
+// treated as permanently missing. A block that is still missing after the chain's finality period cannot
+// be one that the node has yet to receive.
+const missingConfirmDelay = time.Duration(build.Finality) * time.Duration(build.BlockDelaySecs) * time.Second
+
+// missingSuspectsSize is the number of blocks reported missing by the node that are remembered while
+// waiting to be confirmed.
+const missingSuspectsSize = 100000
+
+// missingRecord is a line of the missing blocks file.
+type missingRecord struct {
+	Cid     cid.Cid   `json:"cid"`
+	Expires time.Time `json:"expires"`
+}
+
+// MissingBlocks remembers blocks that the lotus node reports it does not have, such as blocks pruned from
+// a splitstore, so that repeated scans over historical data are not passed to the node again. A block is
+// only recorded once it has been missing for longer than the chain's finality period and is then
+// remembered, across restarts, until its ttl expires. Records are appended to a file that is compacted
+// when it is opened.
+type MissingBlocks struct {
+	path   string
+	ttl    time.Duration
+	logger logr.Logger
+
+	suspects *lru.Cache // time a block was first reported missing keyed by cid
+
+	mu      sync.Mutex // guards fields below
+	file    *os.File
+	missing map[cid.Cid]time.Time // expiry time keyed by cid
+}
+
+// OpenMissingBlocks opens the missing blocks persisted at path, creating the file if it does not exist.
+func OpenMissingBlocks(path string, ttl time.Duration, logger logr.Logger) (*MissingBlocks, error) {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	suspects, err := lru.New(missingSuspectsSize)
+	if err != nil {
+		return nil, fmt.Errorf("new lru: %w", err)
+	}
+	m := &MissingBlocks{
+		path:     path,
+		ttl:      ttl,
+		logger:   logger.V(LogLevelInfo),
+		suspects: suspects,
+		missing:  map[cid.Cid]time.Time{},
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	if err := m.compact(); err != nil {
+		return nil, err
+	}
+	m.logger.Info("Opened missing blocks", "path", path, "blocks", len(m.missing))
+	return m, nil
+}
+
+// load reads the records in the file. A later record for a block replaces an earlier one.
+func (m *MissingBlocks) load() error {
+	f, err := os.Open(m.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("open missing blocks: %w", err)
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec missingRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || !rec.Cid.Defined() {
+			// A partial record may be left by a crash while appending
+			continue
+		}
+		if rec.Expires.After(now) {
+			m.missing[rec.Cid] = rec.Expires
+		} else {
+			delete(m.missing, rec.Cid)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read missing blocks: %w", err)
+	}
+	return nil
+}
+
+// compact rewrites the file to hold only the unexpired records and opens it for appending.
+func (m *MissingBlocks) compact() error {
+	tmp, err := os.Create(m.path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("create missing blocks: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for c, expires := range m.missing {
+		if err := enc.Encode(missingRecord{Cid: c, Expires: expires}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write missing blocks: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write missing blocks: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write missing blocks: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return fmt.Errorf("replace missing blocks: %w", err)
+	}
+
+	m.file, err = os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open missing blocks: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (m *MissingBlocks) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Close()
+	m.file = nil
+	return err
+}
+
+// Missing reports whether the block is known to be missing from the node.
+func (m *MissingBlocks) Missing(c cid.Cid) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expires, ok := m.missing[c]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(m.missing, c)
+		return false
+	}
+	return true
+}
+
+// Len returns the number of blocks known to be missing from the node.
+func (m *MissingBlocks) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.missing)
+}
+
+// RecordMiss notes that the node reported the block as not found. It reports whether the block has now
+// been recorded as missing, which happens once it was first reported missing longer ago than the chain's
+// finality period.
+func (m *MissingBlocks) RecordMiss(c cid.Cid) bool {
+	now := time.Now()
+	v, ok := m.suspects.Get(c)
+	if !ok {
+		m.suspects.Add(c, now)
+		return false
+	}
+	if now.Sub(v.(time.Time)) < missingConfirmDelay {
+		return false
+	}
+	m.suspects.Remove(c)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.missing[c] = now.Add(m.ttl)
+	m.append(missingRecord{Cid: c, Expires: m.missing[c]})
+	return true
+}
+
+// Forget removes any record that the block is missing, used when the node is found to have it.
+func (m *MissingBlocks) Forget(c cid.Cid) {
+	m.suspects.Remove(c)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.missing[c]; !ok {
+		return
+	}
+	delete(m.missing, c)
+	// An expired record removes the block when the file is next loaded
+	m.append(missingRecord{Cid: c, Expires: time.Now()})
+}
+
+// append writes a record to the file. Callers must hold the lock.
+func (m *MissingBlocks) append(rec missingRecord) {
+	if m.file == nil {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err == nil {
+		_, err = m.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		m.logger.Error(err, "failed to write missing block record", "block", rec.Cid)
+	}
+}
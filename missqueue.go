@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+)
+
+// missTrackSize is the number of cids whose misses are counted while they are below the promotion threshold.
+const missTrackSize = 100000
+
+// MissedCID is a cid that could not be found by any cache tier or the lotus node.
+type MissedCID struct {
+	CID         string    `json:"cid"`
+	Misses      int       `json:"misses"`
+	FirstMissed time.Time `json:"first_missed"`
+	LastMissed  time.Time `json:"last_missed"`
+}
+
+// MissQueue counts requests for cids that miss every cache tier and the lotus node, such as blocks pruned
+// by the node, and promotes cids that miss repeatedly to a queue. An archival fetcher run by the operator
+// can read the queue and write the blocks to the blockstore tier, acknowledging each cid once fetched.
+type MissQueue struct {
+	threshold int // number of misses before a cid is queued
+	size      int // maximum number of cids queued
+
+	mu     sync.Mutex // guards fields below
+	counts *lru.Cache // *MissedCID keyed by cid, for cids not yet queued
+	queue  map[cid.Cid]*MissedCID
+}
+
+func NewMissQueue(threshold int, size int) *MissQueue {
+	counts, _ := lru.New(missTrackSize)
+	return &MissQueue{
+		threshold: threshold,
+		size:      size,
+		counts:    counts,
+		queue:     map[cid.Cid]*MissedCID{},
+	}
+}
+
+// Record counts a miss for the cid, queueing it once it has missed threshold times and the queue has
+// room. It is safe to call on a nil queue.
+func (q *MissQueue) Record(ctx context.Context, c cid.Cid) {
+	if q == nil {
+		return
+	}
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if m, ok := q.queue[c]; ok {
+		m.Misses++
+		m.LastMissed = now
+		return
+	}
+
+	var m *MissedCID
+	if v, ok := q.counts.Get(c); ok {
+		m = v.(*MissedCID)
+	} else {
+		m = &MissedCID{CID: c.String(), FirstMissed: now}
+		q.counts.Add(c, m)
+	}
+	m.Misses++
+	m.LastMissed = now
+	if m.Misses < q.threshold || len(q.queue) >= q.size {
+		return
+	}
+	q.counts.Remove(c)
+	q.queue[c] = m
+	reportEvent(ctx, missQueuePromoted)
+	reportMeasurement(ctx, missQueueLength.M(int64(len(q.queue))))
+}
+
+// Queued returns up to n of the queued cids, most missed first. All queued cids are returned if n is
+// not positive.
+func (q *MissQueue) Queued(n int) []MissedCID {
+	q.mu.Lock()
+	out := make([]MissedCID, 0, len(q.queue))
+	for _, m := range q.queue {
+		out = append(out, *m)
+	}
+	q.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Misses != out[j].Misses {
+			return out[i].Misses > out[j].Misses
+		}
+		return out[i].CID < out[j].CID
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Ack removes cids from the queue, normally once they have been fetched, and returns the number removed.
+func (q *MissQueue) Ack(ctx context.Context, cids []cid.Cid) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	removed := 0
+	for _, c := range cids {
+		if _, ok := q.queue[c]; ok {
+			delete(q.queue, c)
+			removed++
+		}
+	}
+	reportMeasurement(ctx, missQueueLength.M(int64(len(q.queue))))
+	return removed
+}
+
+// missQueueHandler lists the queued cids as JSON, most missed first, limited by an optional limit form
+// value. A POST with one or more cid form values removes them from the queue.
+func missQueueHandler(q *MissQueue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			limit := 0
+			if v := r.FormValue("limit"); v != "" {
+				var err error
+				if limit, err = strconv.Atoi(v); err != nil {
+					http.Error(w, fmt.Sprintf("invalid limit value: %q", v), http.StatusBadRequest)
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(q.Queued(limit))
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cids := make([]cid.Cid, 0, len(r.Form["cid"]))
+			for _, v := range r.Form["cid"] {
+				c, err := cid.Decode(v)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid cid: %q", v), http.StatusBadRequest)
+					return
+				}
+				cids = append(cids, c)
+			}
+			removed := q.Ack(r.Context(), cids)
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(struct {
+				Removed int `json:"removed"`
+			}{Removed: removed})
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
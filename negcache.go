@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/go-logr/logr"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+)
+
+// NegativeCache briefly remembers blocks that the lotus node reported as not found, so that clients
+// repeatedly asking for a block that does not exist, such as one from a tipset removed by a reorg, are not
+// each passed to the node. Blocks are forgotten after a ttl. When the node reverts a tipset the blocks reported
+// missing since the tipset's timestamp are also forgotten, since the fork replacing it may bring them. Blocks
+// reported missing earlier can't belong to that fork.
+type NegativeCache struct {
+	ttl    time.Duration
+	logger logr.Logger
+	blocks *lru.Cache // time a block was reported missing keyed by cid
+}
+
+// NewNegativeCache creates a negative cache holding up to size blocks for ttl. The cache is invalidated by
+// the head changes passed to it.
+func NewNegativeCache(size int, ttl time.Duration, logger logr.Logger) (*NegativeCache, error) {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl must be positive")
+	}
+	blocks, err := lru.New(size)
+	if err != nil {
+		return nil, fmt.Errorf("new lru: %w", err)
+	}
+	return &NegativeCache{
+		ttl:    ttl,
+		logger: logger.V(LogLevelInfo),
+		blocks: blocks,
+	}, nil
+}
+
+// HeadsLost forgets every block, since reverts may be missed while not subscribed to the node.
+func (n *NegativeCache) HeadsLost(ctx context.Context) {
+	n.blocks.Purge()
+}
+
+// HeadChanges forgets the blocks reported missing since the timestamp of any tipset reverted by the changes.
+func (n *NegativeCache) HeadChanges(ctx context.Context, changes []*api.HeadChange) {
+	for _, hc := range changes {
+		if hc.Type != "revert" {
+			continue
+		}
+		since := time.Unix(int64(hc.Val.MinTimestamp()), 0)
+		for _, k := range n.blocks.Keys() {
+			if v, ok := n.blocks.Peek(k); ok && !v.(time.Time).Before(since) {
+				n.blocks.Remove(k)
+			}
+		}
+	}
+}
+
+// Missing reports whether the node reported the block as not found within the ttl and no revert since
+// may have brought it.
+func (n *NegativeCache) Missing(c cid.Cid) bool {
+	v, ok := n.blocks.Get(c)
+	if !ok {
+		return false
+	}
+	if time.Since(v.(time.Time)) > n.ttl {
+		n.blocks.Remove(c)
+		return false
+	}
+	return true
+}
+
+// Add notes that the node reported the block as not found.
+func (n *NegativeCache) Add(c cid.Cid) {
+	n.blocks.Add(c, time.Now())
+}
+
+// Remove forgets that the block was reported as not found, used when the node is found to have it.
+func (n *NegativeCache) Remove(c cid.Cid) {
+	n.blocks.Remove(c)
+}
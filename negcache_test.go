@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/go-logr/logr"
+	blocks "github.com/ipfs/go-block-format"
+)
+
+func TestNegativeCacheRevert(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestChain(t, 0, 1, 2)
+	n, err := NewNegativeCache(10, time.Hour, logr.Discard())
+	if err != nil {
+		t.Fatalf("new negative cache: %v", err)
+	}
+
+	reverted := tc.tipsets[2]
+	since := time.Unix(int64(reverted.MinTimestamp()), 0)
+	before := blocks.NewBlock([]byte("reported missing before the reverted tipset"))
+	after := blocks.NewBlock([]byte("reported missing after the reverted tipset"))
+	// The test chain's timestamps are long past so the blocks are inspected without expiring them
+	n.blocks.Add(before.Cid(), since.Add(-time.Second))
+	n.blocks.Add(after.Cid(), since.Add(time.Second))
+
+	n.HeadChanges(ctx, []*api.HeadChange{{Type: "apply", Val: tc.tipsets[1]}})
+	if !n.blocks.Contains(before.Cid()) || !n.blocks.Contains(after.Cid()) {
+		t.Fatalf("applying a tipset forgot blocks reported missing")
+	}
+
+	n.HeadChanges(ctx, []*api.HeadChange{{Type: "revert", Val: reverted}})
+	if !n.blocks.Contains(before.Cid()) {
+		t.Errorf("block reported missing before the reverted tipset was forgotten")
+	}
+	if n.blocks.Contains(after.Cid()) {
+		t.Errorf("block reported missing after the reverted tipset was not forgotten")
+	}
+}
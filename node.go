@@ -3,15 +3,22 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-ipfs-blockstore"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"golang.org/x/time/rate"
 )
 
 var _ (BlockCache) = (*NodeBlockCache)(nil)
 
+var ErrNodeDataMismatch = errors.New("data read from node does not match cid")
+
 type NodeBlockCacheAPI interface {
 	ChainHasObj(ctx context.Context, obj cid.Cid) (bool, error)
 	ChainReadObj(ctx context.Context, obj cid.Cid) ([]byte, error)
@@ -19,7 +26,14 @@ type NodeBlockCacheAPI interface {
 
 type NodeBlockCache struct {
 	node    NodeBlockCacheAPI
+	fills   *rate.Limiter // limits the number of blocks read from the node per second, nil for no limit
+	bytes   *rate.Limiter // limits the number of bytes read from the node per second, nil for no limit
+	verify  bool          // whether to check that data read from the node matches its cid
+	logger  logr.Logger
 	tlogger logr.Logger // request tracing
+
+	missing  *MissingBlocks // blocks known to be missing from the node, nil if not tracked
+	negative *NegativeCache // blocks recently reported missing by the node, nil if not cached
 }
 
 func NewNodeBlockCache(node NodeBlockCacheAPI, logger logr.Logger) *NodeBlockCache {
@@ -28,12 +42,143 @@ func NewNodeBlockCache(node NodeBlockCacheAPI, logger logr.Logger) *NodeBlockCac
 	}
 	return &NodeBlockCache{
 		node:    node,
+		logger:  logger.V(LogLevelInfo),
 		tlogger: logger.V(LogLevelTrace),
 	}
 }
 
+// SetFillLimits limits the rate at which blocks are read from the node to fill the caches above it, so
+// that a cold cache does not overload the node. A limit of zero is not enforced.
+func (n *NodeBlockCache) SetFillLimits(blocksPerSec float64, bytesPerSec int64) {
+	n.fills, n.bytes = nil, nil
+	if blocksPerSec > 0 {
+		burst := int(blocksPerSec)
+		if burst < 1 {
+			burst = 1
+		}
+		n.fills = rate.NewLimiter(rate.Limit(blocksPerSec), burst)
+	}
+	if bytesPerSec > 0 {
+		n.bytes = rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))
+	}
+}
+
+// SetVerify sets whether data read from the node is checked against the cid it was requested by before
+// being served or used to fill the caches above the node. Data that does not match, or whose hash function
+// is not supported, is refused with ErrNodeDataMismatch.
+func (n *NodeBlockCache) SetVerify(verify bool) {
+	n.verify = verify
+}
+
+// SetMissingBlocks records blocks that the node persistently reports as not found in m and answers
+// requests for blocks recorded in m without asking the node.
+func (n *NodeBlockCache) SetMissingBlocks(m *MissingBlocks) {
+	n.missing = m
+}
+
+// SetNegativeCache remembers blocks that the node reports as not found in nc and answers requests for
+// them without asking the node until they are forgotten.
+func (n *NodeBlockCache) SetNegativeCache(nc *NegativeCache) {
+	n.negative = nc
+}
+
+// knownMissing reports whether the block is known to be missing from the node, either persistently or
+// because the node recently reported it as not found. Clients bypassing the caches always ask the node
+// for blocks it recently reported as not found.
+func (n *NodeBlockCache) knownMissing(ctx context.Context, c cid.Cid) bool {
+	if n.missing != nil && n.missing.Missing(c) {
+		reportEvent(ctx, nodeMissingHit)
+		return true
+	}
+	if n.negative != nil && !cacheBypassed(ctx) && n.negative.Missing(c) {
+		reportEvent(ctx, nodeNegativeHit)
+		return true
+	}
+	return false
+}
+
+// recordMissing notes that the node reported the block as not found.
+func (n *NodeBlockCache) recordMissing(ctx context.Context, c cid.Cid) {
+	if n.negative != nil {
+		n.negative.Add(c)
+	}
+	if n.missing == nil {
+		return
+	}
+	if n.missing.RecordMiss(c) {
+		reportEvent(ctx, nodeMissingRecorded)
+		if n.tlogger.Enabled() {
+			n.tlogger.Info("Recorded block as missing from node", "block", c)
+		}
+	}
+}
+
+// forgetMissing removes any record that the block is missing, used when the node is found to have it.
+func (n *NodeBlockCache) forgetMissing(c cid.Cid) {
+	if n.negative != nil {
+		n.negative.Remove(c)
+	}
+	if n.missing != nil {
+		n.missing.Forget(c)
+	}
+}
+
+// check verifies that data read from the node matches the cid it was requested by.
+func (n *NodeBlockCache) check(ctx context.Context, c cid.Cid, data []byte) error {
+	chkc, err := c.Prefix().Sum(data)
+	if err != nil {
+		ctx, _ = tag.New(ctx, tag.Upsert(reasonTag, fillReasonHashUnsupported))
+		reportEvent(ctx, nodeVerifyFailure)
+		return fmt.Errorf("%w: %s: %v", ErrNodeDataMismatch, c, err)
+	}
+	if !chkc.Equals(c) {
+		ctx, _ = tag.New(ctx, tag.Upsert(reasonTag, fillReasonHashMismatch))
+		reportEvent(ctx, nodeVerifyFailure)
+		return fmt.Errorf("%w: %s: data hashes to %s", ErrNodeDataMismatch, c, chkc)
+	}
+	return nil
+}
+
+// throttle waits until a block may be read from the node according to the fill limits.
+func (n *NodeBlockCache) throttle(ctx context.Context) error {
+	if n.fills == nil && n.bytes == nil {
+		return nil
+	}
+	start := time.Now()
+	if n.fills != nil {
+		if err := n.fills.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if n.bytes != nil {
+		// Bytes read by earlier fills are reserved after they complete, so wait for that debt to be repaid
+		if err := n.bytes.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		reportEvent(ctx, fillThrottled)
+		stats.Record(ctx, fillThrottleDuration.M(float64(waited)/1e6))
+	}
+	return nil
+}
+
+// consume records that size bytes were read from the node.
+func (n *NodeBlockCache) consume(size int) {
+	if n.bytes == nil {
+		return
+	}
+	if size > n.bytes.Burst() {
+		size = n.bytes.Burst()
+	}
+	n.bytes.ReserveN(time.Now(), size)
+}
+
 func (n *NodeBlockCache) Has(ctx context.Context, c cid.Cid) (bool, error) {
 	ctx = cacheContext(ctx, "node")
+	if n.knownMissing(ctx, c) {
+		return false, nil
+	}
 	has, err := n.node.ChainHasObj(ctx, c)
 	if err != nil {
 		if errors.Is(err, blockstore.ErrNotFound) {
@@ -45,6 +190,11 @@ func (n *NodeBlockCache) Has(ctx context.Context, c cid.Cid) (bool, error) {
 		return false, err
 	}
 
+	if has {
+		n.forgetMissing(c)
+	} else {
+		n.recordMissing(ctx, c)
+	}
 	return has, nil
 }
 
@@ -54,8 +204,22 @@ func (n *NodeBlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, erro
 	stop := startTimer(ctx, getDuration)
 	defer stop()
 
+	if n.knownMissing(ctx, c) {
+		reportEvent(ctx, getMiss)
+		return nil, blockstore.ErrNotFound
+	}
+
+	if err := n.throttle(ctx); err != nil {
+		reportEvent(ctx, getFailure)
+		return nil, err
+	}
+
 	data, err := n.node.ChainReadObj(ctx, c)
+	n.consume(len(data))
 	if err != nil {
+		if isBlockNotFound(err) {
+			n.recordMissing(ctx, c)
+		}
 		if errors.Is(err, blockstore.ErrNotFound) {
 			reportEvent(ctx, getMiss)
 			return nil, err
@@ -67,6 +231,15 @@ func (n *NodeBlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, erro
 		return nil, err
 	}
 
+	if n.verify {
+		if err := n.check(ctx, c, data); err != nil {
+			reportEvent(ctx, getFailure)
+			n.logger.Error(err, "Refused data read from node")
+			return nil, err
+		}
+	}
+
+	n.forgetMissing(c)
 	reportEvent(ctx, getHit)
 	reportSize(ctx, getSize, len(data))
 	return blocks.NewBlockWithCid(data, c)
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/filecoin-project/lotus/api/apistruct"
+	"github.com/filecoin-project/lotus/build"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// openRPCDocument returns an OpenRPC document describing the named methods. Each method is described from
+// the signature of its function field in the Lotus API or the proxy's extensions, with params given by
+// position since their names are not known at run time.
+func openRPCDocument(names []string) map[string]interface{} {
+	fields := rpcMethodFields()
+	methods := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		field, ok := fields[name]
+		if !ok {
+			continue
+		}
+		methods = append(methods, openRPCMethod(field))
+	}
+
+	return map[string]interface{}{
+		"openrpc": "1.2.6",
+		"info": map[string]interface{}{
+			"title":   "Lotus RPC API (lotus-cpr)",
+			"version": build.BuildVersion,
+		},
+		"methods": methods,
+	}
+}
+
+// rpcMethodFields returns the function fields of the Lotus API and the proxy's extensions keyed by method
+// name.
+func rpcMethodFields() map[string]reflect.StructField {
+	var (
+		full apistruct.FullNodeStruct
+		ext  ExtensionStruct
+	)
+	fields := map[string]reflect.StructField{}
+	for _, t := range []reflect.Type{
+		reflect.TypeOf(full.CommonStruct.Internal),
+		reflect.TypeOf(full.Internal),
+		reflect.TypeOf(ext.Internal),
+	} {
+		for i := 0; i < t.NumField(); i++ {
+			if field := t.Field(i); field.Type.Kind() == reflect.Func {
+				fields[field.Name] = field
+			}
+		}
+	}
+	return fields
+}
+
+func openRPCMethod(field reflect.StructField) map[string]interface{} {
+	ft := field.Type
+	perm := field.Tag.Get("perm")
+	if perm == "" {
+		perm = string(apistruct.PermRead)
+	}
+
+	params := []interface{}{}
+	for i := 0; i < ft.NumIn(); i++ {
+		if ft.In(i).Implements(contextType) {
+			continue
+		}
+		params = append(params, map[string]interface{}{
+			"name":     fmt.Sprintf("p%d", len(params)+1),
+			"required": true,
+			"schema":   jsonSchema(ft.In(i), map[reflect.Type]bool{}),
+		})
+	}
+
+	result := map[string]interface{}{
+		"name":   "Null",
+		"schema": map[string]interface{}{"type": "null"},
+	}
+	if ft.NumOut() == 2 {
+		out := ft.Out(0)
+		if out.Kind() == reflect.Chan {
+			// Subscriptions return each value sent on the channel in a notification
+			out = out.Elem()
+		}
+		result = map[string]interface{}{
+			"name":   typeName(out),
+			"schema": jsonSchema(out, map[reflect.Type]bool{}),
+		}
+	}
+
+	return map[string]interface{}{
+		"name":           "Filecoin." + field.Name,
+		"paramStructure": "by-position",
+		"params":         params,
+		"result":         result,
+		"x-permission":   perm,
+	}
+}
+
+// jsonSchema returns a JSON schema describing the JSON encoding of values of type t. Types with their own
+// encoding, such as cids and big integers, can't be described by reflection and are given only a title.
+// seen holds the struct types being described so that recursive types are not expanded forever.
+func jsonSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return map[string]interface{}{"title": typeName(t)}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem(), seen)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{"title": typeName(t)}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		props := map[string]interface{}{}
+		structProperties(t, seen, props)
+		return map[string]interface{}{"title": typeName(t), "type": "object", "properties": props}
+	default:
+		// Interfaces and other kinds may hold any value
+		return map[string]interface{}{}
+	}
+}
+
+// structProperties adds the schemas of the fields of struct type t that are encoded in JSON to props,
+// promoting the fields of embedded structs as encoding/json does.
+func structProperties(t reflect.Type, seen map[reflect.Type]bool, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		if f.Anonymous && f.Tag.Get("json") == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				structProperties(ft, seen, props)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		props[name] = jsonSchema(f.Type, seen)
+	}
+}
+
+// typeName returns the name of t, or of the type it points to.
+func typeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Name() == "" {
+		return t.String()
+	}
+	return t.Name()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/filecoin-project/lotus/build"
+)
+
+func TestDiscoverDescribesMethods(t *testing.T) {
+	p := NewAPIProxy(nil, nil, nil)
+	doc, err := p.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("marshal document: %v", err)
+	}
+
+	var decoded struct {
+		Info struct {
+			Version string `json:"version"`
+		} `json:"info"`
+		Methods []struct {
+			Name   string `json:"name"`
+			Params []struct {
+				Name   string                 `json:"name"`
+				Schema map[string]interface{} `json:"schema"`
+			} `json:"params"`
+			Result struct {
+				Name   string                 `json:"name"`
+				Schema map[string]interface{} `json:"schema"`
+			} `json:"result"`
+			Permission string `json:"x-permission"`
+		} `json:"methods"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal document: %v", err)
+	}
+	if decoded.Info.Version != build.BuildVersion {
+		t.Errorf("got version %q, wanted %q", decoded.Info.Version, build.BuildVersion)
+	}
+	if len(decoded.Methods) != len(rpcMethodNames(p)) {
+		t.Errorf("document describes %d methods, wanted the %d served by the proxy", len(decoded.Methods), len(rpcMethodNames(p)))
+	}
+
+	found := false
+	for _, m := range decoded.Methods {
+		if m.Name != "Filecoin.ChainReadObjMany" {
+			continue
+		}
+		found = true
+		if len(m.Params) != 1 || m.Params[0].Schema["type"] != "array" {
+			t.Errorf("ChainReadObjMany params are %+v, wanted an array of cids", m.Params)
+		}
+		items, _ := m.Result.Schema["items"].(map[string]interface{})
+		if m.Result.Schema["type"] != "array" || items["contentEncoding"] != "base64" {
+			t.Errorf("ChainReadObjMany result is %+v, wanted an array of base64 strings", m.Result.Schema)
+		}
+		if m.Permission != "read" {
+			t.Errorf("ChainReadObjMany permission is %q, wanted read", m.Permission)
+		}
+	}
+	if !found {
+		t.Errorf("ChainReadObjMany is not described")
+	}
+}
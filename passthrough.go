@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/apistruct"
+)
+
+var ErrPassthroughNotAllowed = errors.New("method requires a permission that is not passed through to the node")
+
+// MethodCaller is implemented by clients that can call any method of the Lotus FullNode API by name.
+type MethodCaller interface {
+	CallMethod(ctx context.Context, method string, params []interface{}) (interface{}, error)
+}
+
+var fullNodeType = reflect.TypeOf((*lotusapi.FullNode)(nil)).Elem()
+
+// CallMethod calls the named method of the Lotus FullNode API on the node.
+func (a *apiClient) CallMethod(ctx context.Context, method string, params []interface{}) (interface{}, error) {
+	if _, ok := fullNodeType.MethodByName(method); !ok {
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+
+	var (
+		r interface{}
+		e error
+	)
+
+	if err := a.withApi(ctx, func(api lotusapi.FullNode) error {
+		r, e = methodHandler(reflect.ValueOf(api).MethodByName(method))(ctx, &MethodCall{Method: method, Params: params})
+		return e
+	}); err != nil {
+		return nil, err
+	}
+
+	return r, e
+}
+
+// permAllowed reports whether perm is no greater than max in the order read, write, sign, admin.
+func permAllowed(perm auth.Permission, max auth.Permission) bool {
+	for _, p := range apistruct.AllPermissions {
+		if p == perm {
+			return true
+		}
+		if p == max {
+			return false
+		}
+	}
+	return false
+}
+
+// SetPassthrough allows calls to methods of the Lotus API that the proxy does not implement to be passed
+// to the node, provided they require no more than the permission maxPerm. An empty permission disables
+// passthrough. The permissions of the node's api token also limit the calls that succeed.
+func (p *Proxy) SetPassthrough(maxPerm auth.Permission) error {
+	if maxPerm != "" && !permAllowed(maxPerm, apistruct.PermAdmin) {
+		return fmt.Errorf("unknown permission %q", maxPerm)
+	}
+	p.passthroughPerm = maxPerm
+	return nil
+}
+
+// passthrough forwards a call to a method that the proxy does not implement to the node.
+func (p *Proxy) passthrough(ctx context.Context, call *MethodCall) (interface{}, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info(call.Method, "params", call.Params, "passthrough", true)
+	}
+	caller, ok := p.node.(MethodCaller)
+	if !ok || p.passthroughPerm == "" {
+		return unsupportedHandler(ctx, call)
+	}
+	if !permAllowed(call.Perm, p.passthroughPerm) {
+		return nil, fmt.Errorf("%w: %s requires %s", ErrPassthroughNotAllowed, call.Method, call.Perm)
+	}
+	return caller.CallMethod(ctx, call.Method, call.Params)
+}
+
+// passthroughMethodNames returns the sorted names of the methods of the Lotus API that are passed through
+// to the node.
+func (p *Proxy) passthroughMethodNames() []string {
+	if _, ok := p.node.(MethodCaller); !ok || p.passthroughPerm == "" {
+		return nil
+	}
+
+	var (
+		full  apistruct.FullNodeStruct
+		names []string
+	)
+	implemented := map[string]bool{}
+	for _, name := range rpcMethodNames(p) {
+		implemented[name] = true
+	}
+	for _, t := range []reflect.Type{
+		reflect.TypeOf(full.CommonStruct.Internal),
+		reflect.TypeOf(full.Internal),
+	} {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			perm := auth.Permission(field.Tag.Get("perm"))
+			if perm == "" {
+				perm = apistruct.PermRead
+			}
+			if !implemented[field.Name] && permAllowed(perm, p.passthroughPerm) {
+				names = append(names, field.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
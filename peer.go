@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipfs-blockstore"
+	"go.opencensus.io/tag"
+)
+
+var _ (BlockCache) = (*PeerBlockCache)(nil)
+
+// peerHopHeader counts the proxies a block request has passed through. A proxy asked for a block by a peer
+// does not ask its own peers, so requests cannot loop between proxies that list each other as peers.
+const peerHopHeader = "X-CPR-Hop"
+
+// peerMaxHops is the number of hops after which a request is no longer passed to peers.
+const peerMaxHops = 1
+
+type peerHopsKey struct{}
+
+// withPeerHops returns a context recording the number of proxies the request has passed through.
+func withPeerHops(ctx context.Context, hops int) context.Context {
+	return context.WithValue(ctx, peerHopsKey{}, hops)
+}
+
+// peerHops returns the number of proxies the request carried by the context has passed through.
+func peerHops(ctx context.Context) int {
+	hops, _ := ctx.Value(peerHopsKey{}).(int)
+	return hops
+}
+
+// requestPeerHops reads the hop count of a block request sent by a peer, zero if it was not sent by a peer.
+func requestPeerHops(r *http.Request) int {
+	hops, err := strconv.Atoi(r.Header.Get(peerHopHeader))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+// PeerBlockCache is a cache tier formed by sibling lotus-cpr instances. Blocks missing from the local tiers
+// are requested from the http block endpoint of each peer in turn before the lotus node is asked, so a
+// block fetched from the node by one proxy is available to all of them. Blocks received from peers are
+// verified against their cids.
+type PeerBlockCache struct {
+	peers    []string // base urls of the block endpoints of the peers, ending in /block/
+	hc       *http.Client
+	upstream BlockCache
+	name     string
+}
+
+// NewPeerBlockCache creates a cache that reads blocks from the lotus-cpr instances at the given urls, such
+// as http://cpr-2:33111, presenting token as a bearer token if it is not empty.
+func NewPeerBlockCache(peers []string, name string, token string, timeout time.Duration) *PeerBlockCache {
+	opts := DefaultHttpClientOptions
+	opts.Timeout = timeout
+	opts.BearerToken = token
+
+	bases := make([]string, 0, len(peers))
+	for _, p := range peers {
+		bases = append(bases, strings.TrimSuffix(p, "/")+"/block/")
+	}
+	return &PeerBlockCache{
+		peers: bases,
+		hc:    newHttpClient(opts),
+		name:  name,
+	}
+}
+
+// Peers returns the base urls of the block endpoints of the peers.
+func (pc *PeerBlockCache) Peers() []string {
+	return pc.peers
+}
+
+func (pc *PeerBlockCache) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	ctx = cacheContext(ctx, pc.name)
+	if _, err := pc.fetch(ctx, http.MethodHead, c); err == nil {
+		return true, nil
+	}
+	if pc.upstream == nil {
+		return false, nil
+	}
+	return pc.upstream.Has(ctx, c)
+}
+
+func (pc *PeerBlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	ctx = cacheContext(ctx, pc.name)
+	reportEvent(ctx, getRequest)
+	stop := startTimer(ctx, getDuration)
+	defer stop()
+
+	data, err := pc.fetch(ctx, http.MethodGet, c)
+	if err == nil {
+		reportEvent(ctx, getHit)
+		reportSize(ctx, getSize, len(data))
+		return blocks.NewBlockWithCid(data, c)
+	}
+	reportEvent(ctx, getMiss)
+
+	if pc.upstream == nil {
+		return nil, blockstore.ErrNotFound
+	}
+	return pc.upstream.Get(ctx, c)
+}
+
+// fetch asks each peer in turn for the block, returning the data of the first that holds it. Requests that
+// have already passed through a peer are not sent on to other peers.
+func (pc *PeerBlockCache) fetch(ctx context.Context, method string, c cid.Cid) ([]byte, error) {
+	hops := peerHops(ctx)
+	if hops >= peerMaxHops {
+		reportEvent(ctx, peerLoopSkipped)
+		return nil, blockstore.ErrNotFound
+	}
+
+	for _, base := range pc.peers {
+		pctx, _ := tag.New(ctx, tag.Upsert(peerTag, base))
+		data, err := pc.fetchPeer(pctx, base, method, c, hops+1)
+		switch {
+		case err == nil:
+			reportEvent(pctx, peerHit)
+			return data, nil
+		case errors.Is(err, blockstore.ErrNotFound):
+			reportEvent(pctx, peerMiss)
+		default:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			reportEvent(pctx, peerFailure)
+		}
+	}
+	return nil, blockstore.ErrNotFound
+}
+
+// fetchPeer requests the block from a single peer.
+func (pc *PeerBlockCache) fetchPeer(ctx context.Context, base string, method string, c cid.Cid, hops int) ([]byte, error) {
+	stop := startTimer(ctx, peerDuration)
+	defer stop()
+
+	req, err := http.NewRequestWithContext(ctx, method, base+c.String()+"/data.raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerHopHeader, strconv.Itoa(hops))
+
+	resp, err := pc.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, blockstore.ErrNotFound
+	default:
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if method == http.MethodHead {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	chkc, err := c.Prefix().Sum(data)
+	if err != nil || !chkc.Equals(c) {
+		return nil, fmt.Errorf("peer returned data that does not match cid %s", c)
+	}
+	return data, nil
+}
+
+func (pc *PeerBlockCache) SetUpstream(u BlockCache) {
+	pc.upstream = u
+}
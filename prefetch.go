@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	blockadt "github.com/filecoin-project/specs-actors/actors/util/adt"
+	"github.com/go-logr/logr"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// prefetchClientName is the client name attributed to requests made by the prefetcher.
+const prefetchClientName = "prefetch"
+
+// Prefetcher fetches the block headers, messages and receipts of new tipsets through the cache as the
+// node's head changes, so that clients asking about recent heights are answered from the cache. Each time
+// the head changes the most recent tipsets, up to the prefetch depth, are fetched if they have not been
+// already. Prefetching runs separately from the subscription so that a slow fetch never delays the node's
+// head changes; heads that arrive while a prefetch is in progress are coalesced.
+type Prefetcher struct {
+	cache  BlockCache
+	depth  int
+	logger logr.Logger
+
+	heads    chan *types.TipSet // latest head waiting to be prefetched
+	coverage *StoreCoverage     // records the heights prefetched, may be nil
+
+	// Heights of tipsets that have been prefetched, only used by the prefetch loop
+	done map[types.TipSetKey]abi.ChainEpoch
+}
+
+func NewPrefetcher(cache BlockCache, depth int, logger logr.Logger) *Prefetcher {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	return &Prefetcher{
+		cache:  cache,
+		depth:  depth,
+		logger: logger.V(LogLevelInfo),
+		heads:  make(chan *types.TipSet, 1),
+		done:   map[types.TipSetKey]abi.ChainEpoch{},
+	}
+}
+
+// SetCoverage sets the record of heights held by the store, which is updated as tipsets are prefetched.
+func (p *Prefetcher) SetCoverage(c *StoreCoverage) {
+	p.coverage = c
+}
+
+// HeadChanges offers the most recent head in the changes to be prefetched.
+func (p *Prefetcher) HeadChanges(ctx context.Context, changes []*api.HeadChange) {
+	for _, hc := range changes {
+		if hc.Type == "current" || hc.Type == "apply" {
+			p.offer(hc.Val)
+		}
+	}
+}
+
+// offer replaces any head waiting to be prefetched with ts.
+func (p *Prefetcher) offer(ts *types.TipSet) {
+	for {
+		select {
+		case p.heads <- ts:
+			return
+		default:
+		}
+		select {
+		case <-p.heads:
+		default:
+		}
+	}
+}
+
+// Run prefetches the heads offered by HeadChanges until the context is cancelled.
+func (p *Prefetcher) Run(ctx context.Context) {
+	ctx = withClientName(ctx, prefetchClientName)
+	ctx = withFillOrigin(ctx, fillOriginPrefetch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ts := <-p.heads:
+			p.prefetchHead(ctx, ts)
+		}
+	}
+}
+
+// prefetchHead prefetches ts and its ancestors, up to the prefetch depth, that have not been prefetched.
+func (p *Prefetcher) prefetchHead(ctx context.Context, ts *types.TipSet) {
+	low := ts.Height() - abi.ChainEpoch(p.depth)
+	for tsk, h := range p.done {
+		if h <= low {
+			delete(p.done, tsk)
+		}
+	}
+
+	// Height of the child of ts less one, so that null rounds between them are included in its coverage
+	high := ts.Height()
+	for i := 0; i < p.depth; i++ {
+		if _, ok := p.done[ts.Key()]; !ok {
+			if err := p.prefetch(ctx, ts); err != nil {
+				if ctx.Err() == nil {
+					reportEvent(ctx, prefetchFailure)
+					p.logger.Error(err, "failed to prefetch tipset", "height", ts.Height(), "tsk", ts.Key())
+				}
+				return
+			}
+			reportEvent(ctx, prefetchTipset)
+			p.done[ts.Key()] = ts.Height()
+		}
+		p.coverage.AddCovered(ts.Height(), high)
+		high = ts.Height() - 1
+
+		if i == p.depth-1 || ts.Height() == 0 {
+			return
+		}
+		parent, err := cachedTipSet(ctx, p.cache, ts.Parents())
+		if err != nil {
+			if ctx.Err() == nil {
+				reportEvent(ctx, prefetchFailure)
+				p.logger.Error(err, "failed to fetch parent tipset", "tsk", ts.Parents())
+			}
+			return
+		}
+		ts = parent
+	}
+}
+
+// prefetch fetches the headers, messages and parent message receipts of a tipset through the cache.
+func (p *Prefetcher) prefetch(ctx context.Context, ts *types.TipSet) error {
+	for _, c := range ts.Cids() {
+		if _, err := p.cache.Get(ctx, c); err != nil {
+			return fmt.Errorf("fetch block header %s: %w", c, err)
+		}
+	}
+
+	cst := cbor.NewCborStore(&cacheBlockstore{ctx: ctx, cache: p.cache})
+	receipts := map[string]bool{}
+	for _, bh := range ts.Blocks() {
+		if _, err := cachedBlockMessages(ctx, p.cache, bh); err != nil {
+			return fmt.Errorf("fetch messages of block %s: %w", bh.Cid(), err)
+		}
+
+		// Blocks of a tipset share their parent receipts
+		if receipts[bh.ParentMessageReceipts.KeyString()] {
+			continue
+		}
+		receipts[bh.ParentMessageReceipts.KeyString()] = true
+		if err := touchAMT(ctx, cst, bh.ParentMessageReceipts); err != nil {
+			return fmt.Errorf("fetch parent receipts of block %s: %w", bh.Cid(), err)
+		}
+	}
+	return nil
+}
+
+// touchAMT reads every node of the AMT with the given root so that they are fetched through the store.
+// Block headers use v0 AMTs.
+func touchAMT(ctx context.Context, cst cbor.IpldStore, root cid.Cid) error {
+	a, err := blockadt.AsArray(blockadt.WrapStore(ctx, cst), root)
+	if err != nil {
+		return fmt.Errorf("amt load: %w", err)
+	}
+	var d cbg.Deferred
+	if err := a.ForEach(&d, func(int64) error { return nil }); err != nil {
+		return fmt.Errorf("amt traverse: %w", err)
+	}
+	return nil
+}
@@ -2,17 +2,30 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-bitfield"
 	"github.com/filecoin-project/go-jsonrpc/auth"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/iand/circuit"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipfs-blockstore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opencensus.io/tag"
 )
 
 type BlockCache interface {
@@ -21,6 +34,36 @@ type BlockCache interface {
 	SetUpstream(BlockCache)
 }
 
+// BlockRangeReader is implemented by caches that can read part of a block without retrieving all of its data.
+type BlockRangeReader interface {
+	// GetRange returns up to length bytes of the block's data starting at offset. A negative length
+	// reads to the end of the block.
+	GetRange(ctx context.Context, c cid.Cid, offset int64, length int64) ([]byte, error)
+}
+
+// getBlockRange reads part of a block from the cache, using a ranged read if the cache supports it.
+func getBlockRange(ctx context.Context, cache BlockCache, c cid.Cid, offset int64, length int64) ([]byte, error) {
+	if rr, ok := cache.(BlockRangeReader); ok {
+		return rr.GetRange(ctx, c, offset, length)
+	}
+	blk, err := cache.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return sliceRange(blk.RawData(), offset, length), nil
+}
+
+func sliceRange(data []byte, offset int64, length int64) []byte {
+	if offset >= int64(len(data)) {
+		return []byte{}
+	}
+	end := int64(len(data))
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	return data[offset:end]
+}
+
 type ProxyAPI interface {
 	AuthVerify(ctx context.Context, token string) ([]auth.Permission, error)
 	AuthNew(ctx context.Context, perms []auth.Permission) ([]byte, error)
@@ -50,25 +93,144 @@ type ProxyAPI interface {
 	StateMinerSectors(ctx context.Context, addr address.Address, sectorNos *bitfield.BitField, tsk types.TipSetKey) ([]*miner.SectorOnChainInfo, error)
 	StateMinerPower(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*api.MinerPower, error)
 	StateVMCirculatingSupplyInternal(ctx context.Context, tsk types.TipSetKey) (api.CirculatingSupply, error)
+	StateCompute(ctx context.Context, height abi.ChainEpoch, msgs []*types.Message, tsk types.TipSetKey) (*api.ComputeStateOutput, error)
+	StateCall(ctx context.Context, msg *types.Message, tsk types.TipSetKey) (*api.InvocResult, error)
+	BeaconGetEntry(ctx context.Context, epoch abi.ChainEpoch) (*types.BeaconEntry, error)
+	StateDecodeParams(ctx context.Context, toAddr address.Address, method abi.MethodNum, params []byte, tsk types.TipSetKey) (interface{}, error)
+	ChainGetRandomnessFromBeacon(ctx context.Context, tsk types.TipSetKey, personalization crypto.DomainSeparationTag, randEpoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error)
+	ChainGetRandomnessFromTickets(ctx context.Context, tsk types.TipSetKey, personalization crypto.DomainSeparationTag, randEpoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error)
+	ID(ctx context.Context) (peer.ID, error)
+	SyncIncomingBlocks(ctx context.Context) (<-chan *types.BlockHeader, error)
+	SyncState(ctx context.Context) (*api.SyncState, error)
+	NetAddrsListen(ctx context.Context) (peer.AddrInfo, error)
+	NetPeers(ctx context.Context) ([]peer.AddrInfo, error)
 }
 
+// defaultReadManyConcurrency is the default number of objects read at once by ChainReadObjMany.
+const defaultReadManyConcurrency = 16
+
+// readManyMaxObjects is the maximum number of objects that may be requested by a call to ChainReadObjMany.
+const readManyMaxObjects = 1000
+
+// readManyMaxBytes is the maximum total size of the objects returned by a call to ChainReadObjMany.
+const readManyMaxBytes = 32 << 20
+
+var ErrTooManyObjects = errors.New("too many objects requested")
+
+// beaconCacheSize is the number of beacon entries held in memory by the proxy, one day of epochs.
+const beaconCacheSize = 2880
+
 type Proxy struct {
-	node    ProxyAPI
-	cache   BlockCache
-	tlogger logr.Logger // request tracing
+	node            ProxyAPI
+	cache           BlockCache
+	session         uuid.UUID  // identifies this instance of the proxy to clients
+	beacon          *lru.Cache // beacon entries keyed by epoch, which are immutable once produced
+	subs            SubscriptionOptions
+	submu           sync.Mutex      // guards subCounts
+	subCounts       map[string]int  // number of active subscriptions keyed by method
+	cids            *CIDCounter     // counts requests for cids, may be nil
+	codecs          CodecAllowlist  // codecs of objects that may be served, nil for all
+	authNew         *AuthNewPolicy  // limits tokens minted by AuthNew, nil to pass all calls to the node
+	backlog         *HeadBacklog    // recent head changes replayed by ChainNotifyFrom, may be nil
+	heights         *HeightIndex    // keys of tipsets by height used by ChainGetTipSetByHeight, may be nil
+	pruned          *PruneDetector  // detects whether the node has discarded history, may be nil
+	misses          *MissQueue      // queues cids that repeatedly cannot be found, may be nil
+	coverage        *StoreCoverage  // heights known to be held by or absent from the store, may be nil
+	readMany        int             // number of objects read at once by ChainReadObjMany
+	readManyBytes   int64           // maximum total size of the objects returned by ChainReadObjMany
+	tsValidation    string          // validation applied to tipsets assembled from cached headers, empty for off
+	epochs          *EpochTracker   // tags metrics with the range of epochs a call is for, may be nil
+	passthroughPerm auth.Permission // highest permission of methods passed through to the node, empty for none
+	logger          logr.Logger
+	tlogger         logr.Logger // request tracing
 }
 
 func NewAPIProxy(node ProxyAPI, cache BlockCache, logger logr.Logger) *Proxy {
 	if logger == nil {
 		logger = logr.Discard()
 	}
+	beacon, _ := lru.New(beaconCacheSize)
 	return &Proxy{
-		node:    node,
-		cache:   cache,
-		tlogger: logger.V(LogLevelTrace),
+		node:          node,
+		cache:         cache,
+		session:       uuid.New(),
+		beacon:        beacon,
+		subs:          DefaultSubscriptionOptions,
+		subCounts:     map[string]int{},
+		readMany:      defaultReadManyConcurrency,
+		readManyBytes: readManyMaxBytes,
+		logger:        logger.V(LogLevelInfo),
+		tlogger:       logger.V(LogLevelTrace),
 	}
 }
 
+// SetHeadBacklog sets the backlog of head changes used to serve ChainNotifyFrom.
+func (p *Proxy) SetHeadBacklog(b *HeadBacklog) {
+	p.backlog = b
+}
+
+// SetTipSetValidation sets the level of validation applied to tipsets assembled from cached headers.
+// Tipsets that fail validation are read from the lotus node instead.
+func (p *Proxy) SetTipSetValidation(level string) {
+	p.tsValidation = level
+}
+
+// SetEpochTracker sets the tracker used to tag the metrics recorded by calls for a known epoch with the range
+// of epochs relative to the head that the epoch falls in.
+func (p *Proxy) SetEpochTracker(t *EpochTracker) {
+	p.epochs = t
+}
+
+// SetHeightIndex sets the index used to answer ChainGetTipSetByHeight from the cache.
+func (p *Proxy) SetHeightIndex(x *HeightIndex) {
+	p.heights = x
+}
+
+// SetPruneDetector sets the detector used to find whether the node has discarded history. While it has,
+// requests for historical data the proxy can assemble from blocks are served from the cache tiers first
+// and ErrHistoryUnavailable is returned when no tier holds the data.
+func (p *Proxy) SetPruneDetector(d *PruneDetector) {
+	p.pruned = d
+}
+
+// SetMissQueue sets the queue used to record cids that cannot be found by the cache or the node.
+func (p *Proxy) SetMissQueue(q *MissQueue) {
+	p.misses = q
+}
+
+// SetCoverage sets the record of heights held by the store. While the node has discarded history, requests
+// for the messages or receipts of a block at a height known to be absent are answered with
+// ErrHistoryUnavailable without searching the cache tiers.
+func (p *Proxy) SetCoverage(c *StoreCoverage) {
+	p.coverage = c
+}
+
+// SetReadManyConcurrency sets the number of objects read from the cache at once by each call to
+// ChainReadObjMany.
+func (p *Proxy) SetReadManyConcurrency(n int) {
+	p.readMany = n
+}
+
+// SetAuthNewPolicy limits the permissions of tokens that may be minted using AuthNew.
+func (p *Proxy) SetAuthNewPolicy(a *AuthNewPolicy) {
+	p.authNew = a
+}
+
+// SetCodecAllowlist restricts the objects served by the proxy to those with the allowed codecs.
+func (p *Proxy) SetCodecAllowlist(a CodecAllowlist) {
+	p.codecs = a
+}
+
+// SetCIDCounter sets the counter used to record requests for cids.
+func (p *Proxy) SetCIDCounter(c *CIDCounter) {
+	p.cids = c
+}
+
+// SetSubscriptionOptions sets how messages are buffered for subscribers to channel methods.
+func (p *Proxy) SetSubscriptionOptions(opts SubscriptionOptions) {
+	p.subs = opts
+}
+
 // Common subset
 
 func (p *Proxy) AuthVerify(ctx context.Context, token string) ([]auth.Permission, error) {
@@ -82,7 +244,18 @@ func (p *Proxy) AuthNew(ctx context.Context, perms []auth.Permission) ([]byte, e
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("AuthNew")
 	}
-	return p.node.AuthNew(ctx, perms)
+	if p.authNew == nil {
+		return p.node.AuthNew(ctx, perms)
+	}
+	if err := p.authNew.Check(perms); err != nil {
+		return nil, err
+	}
+	token, err := p.node.AuthNew(ctx, perms)
+	if err != nil {
+		return nil, err
+	}
+	p.authNew.Issued(ctx, perms, token)
+	return token, nil
 }
 
 func (p *Proxy) Version(ctx context.Context) (api.Version, error) {
@@ -92,13 +265,71 @@ func (p *Proxy) Version(ctx context.Context) (api.Version, error) {
 	return p.node.Version(ctx)
 }
 
+func (p *Proxy) ID(ctx context.Context) (peer.ID, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("ID")
+	}
+	return p.node.ID(ctx)
+}
+
+// Session returns the proxy's own session id, which changes each time the proxy is started.
+func (p *Proxy) Session(ctx context.Context) (uuid.UUID, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("Session")
+	}
+	return p.session, nil
+}
+
+// LogList returns the logging subsystems of the proxy.
+func (p *Proxy) LogList(ctx context.Context) ([]string, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("LogList")
+	}
+	return logSubsystems, nil
+}
+
+// Discover returns an OpenRPC document describing the methods served by the proxy, including those passed
+// through to the node, generated from the signatures of the methods bound to the rpc server.
+func (p *Proxy) Discover(ctx context.Context) (map[string]interface{}, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("Discover")
+	}
+	names := append(rpcMethodNames(p), p.passthroughMethodNames()...)
+	sort.Strings(names)
+	return openRPCDocument(names), nil
+}
+
 // Chain subset
 
+// ChainNotifyFrom is like ChainNotify but first replays the head changes at or above the epoch from
+// that are held in the proxy's backlog, allowing a client that briefly disconnected to catch up.
+func (p *Proxy) ChainNotifyFrom(ctx context.Context, from abi.ChainEpoch) (<-chan []*api.HeadChange, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("ChainNotifyFrom", "from", from)
+	}
+	if p.backlog == nil {
+		return nil, ErrBacklogDisabled
+	}
+	ch, err := p.subscribe(ctx, "ChainNotifyFrom", func(ctx context.Context) (interface{}, error) {
+		return p.backlog.Subscribe(ctx, from)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch.(<-chan []*api.HeadChange), nil
+}
+
 func (p *Proxy) ChainNotify(ctx context.Context) (<-chan []*api.HeadChange, error) {
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainNotify")
 	}
-	return p.node.ChainNotify(ctx)
+	ch, err := p.subscribe(ctx, "ChainNotify", func(ctx context.Context) (interface{}, error) {
+		return p.node.ChainNotify(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch.(<-chan []*api.HeadChange), nil
 }
 
 func (p *Proxy) ChainHead(ctx context.Context) (*types.TipSet, error) {
@@ -112,8 +343,15 @@ func (p *Proxy) ChainGetBlock(ctx context.Context, obj cid.Cid) (*types.BlockHea
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainGetBlock", "block", obj)
 	}
+	if err := p.checkCodec(ctx, "ChainGetBlock", obj); err != nil {
+		return nil, err
+	}
+	p.cids.Add(obj)
 	sb, err := p.cache.Get(ctx, obj)
 	if err != nil {
+		if isBlockNotFound(err) {
+			p.misses.Record(ctx, obj)
+		}
 		if p.tlogger.Enabled() {
 			p.tlogger.Error(err, "Failed to get block from cache", "obj", obj)
 		}
@@ -147,6 +385,10 @@ func (p *Proxy) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types
 	if err != nil {
 		return nil, err
 	}
+	if err := validateTipSet(ctx, p.cache, tsk, ts, p.tsValidation); err != nil {
+		p.reportInvalidTipSet(ctx, "ChainGetTipSet", tsk, err)
+		return p.node.ChainGetTipSet(ctx, tsk)
+	}
 
 	return ts, nil
 }
@@ -155,6 +397,22 @@ func (p *Proxy) ChainGetBlockMessages(ctx context.Context, blockCid cid.Cid) (*a
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainGetBlockMessages", "block", blockCid)
 	}
+	if p.nodePruned() {
+		bh, err := cachedBlockHeader(ctx, p.cache, blockCid)
+		if err == nil {
+			ctx = p.epochContext(ctx, bh.Height)
+			if p.heightAbsent(ctx, "ChainGetBlockMessages", bh.Height) {
+				return nil, fmt.Errorf("%w: messages of block %s", ErrHistoryUnavailable, blockCid)
+			}
+			var bm *blockMessages
+			if bm, err = cachedBlockMessages(ctx, p.cache, bh); err == nil {
+				return bm.apiBlockMessages(), nil
+			}
+		}
+		if p.historyUnavailable(ctx, "ChainGetBlockMessages", err) {
+			return nil, fmt.Errorf("%w: messages of block %s", ErrHistoryUnavailable, blockCid)
+		}
+	}
 	return p.node.ChainGetBlockMessages(ctx, blockCid)
 }
 
@@ -162,6 +420,22 @@ func (p *Proxy) ChainGetParentReceipts(ctx context.Context, blockCid cid.Cid) ([
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainGetParentReceipts", "block", blockCid)
 	}
+	if p.nodePruned() {
+		bh, err := cachedBlockHeader(ctx, p.cache, blockCid)
+		if err == nil {
+			ctx = p.epochContext(ctx, bh.Height)
+			if p.heightAbsent(ctx, "ChainGetParentReceipts", bh.Height) {
+				return nil, fmt.Errorf("%w: parent receipts of block %s", ErrHistoryUnavailable, blockCid)
+			}
+			var receipts []*types.MessageReceipt
+			if receipts, err = cachedParentReceipts(ctx, p.cache, bh); err == nil {
+				return receipts, nil
+			}
+		}
+		if p.historyUnavailable(ctx, "ChainGetParentReceipts", err) {
+			return nil, fmt.Errorf("%w: parent receipts of block %s", ErrHistoryUnavailable, blockCid)
+		}
+	}
 	return p.node.ChainGetParentReceipts(ctx, blockCid)
 }
 
@@ -169,6 +443,29 @@ func (p *Proxy) ChainGetParentMessages(ctx context.Context, blockCid cid.Cid) ([
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainGetParentMessages", "block", blockCid)
 	}
+	if p.nodePruned() {
+		bh, err := cachedBlockHeader(ctx, p.cache, blockCid)
+		if err == nil {
+			ctx = p.epochContext(ctx, bh.Height)
+			// The messages are held at the height of the parent, which is earlier than the block's when
+			// there were null rounds
+			if len(bh.Parents) > 0 {
+				var parent *types.BlockHeader
+				if parent, err = cachedBlockHeader(ctx, p.cache, bh.Parents[0]); err == nil && p.heightAbsent(ctx, "ChainGetParentMessages", parent.Height) {
+					return nil, fmt.Errorf("%w: parent messages of block %s", ErrHistoryUnavailable, blockCid)
+				}
+			}
+		}
+		if err == nil {
+			var msgs []api.Message
+			if msgs, err = cachedParentMessages(ctx, p.cache, bh); err == nil {
+				return msgs, nil
+			}
+		}
+		if p.historyUnavailable(ctx, "ChainGetParentMessages", err) {
+			return nil, fmt.Errorf("%w: parent messages of block %s", ErrHistoryUnavailable, blockCid)
+		}
+	}
 	return p.node.ChainGetParentMessages(ctx, blockCid)
 }
 
@@ -176,6 +473,17 @@ func (p *Proxy) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, ts
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainGetTipSetByHeight", "height", h, "tsk", tsk)
 	}
+	ctx = p.epochContext(ctx, h)
+	if p.heights != nil && !cacheBypassed(ctx) {
+		if key, ok := p.heights.Lookup(h, tsk); ok {
+			ts, err := cachedTipSet(ctx, p.cache, key)
+			if err == nil {
+				reportEvent(ctx, heightIndexHit)
+				return ts, nil
+			}
+		}
+		reportEvent(ctx, heightIndexMiss)
+	}
 	return p.node.ChainGetTipSetByHeight(ctx, h, tsk)
 }
 
@@ -183,18 +491,102 @@ func (p *Proxy) ChainReadObj(ctx context.Context, obj cid.Cid) ([]byte, error) {
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainReadObj", "obj", obj)
 	}
+	if err := p.checkCodec(ctx, "ChainReadObj", obj); err != nil {
+		return nil, err
+	}
+	p.cids.Add(obj)
 	blk, err := p.cache.Get(ctx, obj)
 	if err != nil {
-		return p.node.ChainReadObj(ctx, obj)
+		// The cache chain ends with the node, which has already been asked for the block unless it is known
+		// to be missing, and whose data has been checked and throttled according to its settings
+		if p.historyUnavailable(ctx, "ChainReadObj", err) {
+			p.misses.Record(ctx, obj)
+			return nil, fmt.Errorf("%w: %s", ErrHistoryUnavailable, obj)
+		}
+		if isBlockNotFound(err) {
+			p.misses.Record(ctx, obj)
+		}
+		return nil, err
 	}
 
+	reportServedBlock(ctx, obj, blk.RawData())
 	return blk.RawData(), nil
 }
 
+// ChainReadObjMany is a lotus-cpr extension that reads a batch of objects, returning their data in the
+// order requested. Objects are read in parallel as though each were requested by ChainReadObj. The call
+// fails with the error of the first object that cannot be read, or once the objects read exceed the
+// maximum total size.
+func (p *Proxy) ChainReadObjMany(ctx context.Context, objs []cid.Cid) ([][]byte, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("ChainReadObjMany", "objs", len(objs))
+	}
+	if len(objs) > readManyMaxObjects {
+		return nil, fmt.Errorf("%w: %d objects requested, limit is %d", ErrTooManyObjects, len(objs), readManyMaxObjects)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		total    int64
+		sem      = make(chan struct{}, p.readMany)
+		out      = make([][]byte, len(objs))
+	)
+	for i, obj := range objs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, obj cid.Cid) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			data, err := p.ChainReadObj(ctx, obj)
+			if err != nil {
+				once.Do(func() {
+					firstErr = fmt.Errorf("read %s: %w", obj, err)
+					cancel()
+				})
+				return
+			}
+			if atomic.AddInt64(&total, int64(len(data))) > p.readManyBytes {
+				once.Do(func() {
+					mctx, _ := tag.New(ctx, tag.Upsert(methodTag, "ChainReadObjMany"))
+					reportEvent(mctx, responseTooLarge)
+					firstErr = fmt.Errorf("%w: objects requested exceed %d bytes", ErrResponseTooLarge, p.readManyBytes)
+					cancel()
+				})
+				return
+			}
+			out[i] = data
+		}(i, obj)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (p *Proxy) ChainHasObj(ctx context.Context, obj cid.Cid) (bool, error) {
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainHasObj", "obj", obj)
 	}
+	if err := p.checkCodec(ctx, "ChainHasObj", obj); err != nil {
+		return false, err
+	}
+	p.cids.Add(obj)
 	has, err := p.cache.Has(ctx, obj)
 	if err != nil {
 		return p.node.ChainHasObj(ctx, obj)
@@ -206,6 +598,9 @@ func (p *Proxy) ChainStatObj(ctx context.Context, obj cid.Cid, base cid.Cid) (ap
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainStatObj", "obj", obj, "base", base)
 	}
+	if err := p.checkCodec(ctx, "ChainStatObj", obj); err != nil {
+		return api.ObjStat{}, err
+	}
 	return p.node.ChainStatObj(ctx, obj, base)
 }
 
@@ -234,6 +629,18 @@ func (p *Proxy) ChainGetMessage(ctx context.Context, mc cid.Cid) (*types.Message
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("ChainGetMessage", "msg", mc)
 	}
+	if err := p.checkCodec(ctx, "ChainGetMessage", mc); err != nil {
+		return nil, err
+	}
+	if p.nodePruned() {
+		m, err := cachedMessage(ctx, p.cache, mc)
+		if err == nil {
+			return m, nil
+		}
+		if p.historyUnavailable(ctx, "ChainGetMessage", err) {
+			return nil, fmt.Errorf("%w: message %s", ErrHistoryUnavailable, mc)
+		}
+	}
 	return p.node.ChainGetMessage(ctx, mc)
 }
 
@@ -244,6 +651,54 @@ func (p *Proxy) ChainGetPath(ctx context.Context, from types.TipSetKey, to types
 	return p.node.ChainGetPath(ctx, from, to)
 }
 
+func (p *Proxy) ChainGetRandomnessFromTickets(ctx context.Context, tsk types.TipSetKey, personalization crypto.DomainSeparationTag, randEpoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("ChainGetRandomnessFromTickets", "tsk", tsk, "personalization", personalization, "epoch", randEpoch)
+	}
+	return p.node.ChainGetRandomnessFromTickets(ctx, tsk, personalization, randEpoch, entropy)
+}
+
+func (p *Proxy) ChainGetRandomnessFromBeacon(ctx context.Context, tsk types.TipSetKey, personalization crypto.DomainSeparationTag, randEpoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("ChainGetRandomnessFromBeacon", "tsk", tsk, "personalization", personalization, "epoch", randEpoch)
+	}
+	return p.node.ChainGetRandomnessFromBeacon(ctx, tsk, personalization, randEpoch, entropy)
+}
+
+func (p *Proxy) ChainGetMessagesInTipset(ctx context.Context, tsk types.TipSetKey) ([]api.Message, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("ChainGetMessagesInTipset", "tsk", tsk)
+	}
+	ts, err := p.ChainGetTipSet(ctx, tsk)
+	if err != nil {
+		return nil, err
+	}
+
+	// The genesis tipset has no messages
+	if ts.Height() == 0 {
+		return nil, nil
+	}
+	ctx = p.epochContext(ctx, ts.Height())
+
+	bms := make([]*blockMessages, len(ts.Blocks()))
+	for i, bh := range ts.Blocks() {
+		bm, err := cachedBlockMessages(ctx, p.cache, bh)
+		if err != nil {
+			if p.tlogger.Enabled() {
+				p.tlogger.Error(err, "Failed to reconstruct block messages from cache", "block", bh.Cid())
+			}
+			msgs, err := p.node.ChainGetBlockMessages(ctx, bh.Cid())
+			if err != nil {
+				return nil, err
+			}
+			bm = &blockMessages{bls: msgs.BlsMessages, secpk: msgs.SecpkMessages}
+		}
+		bms[i] = bm
+	}
+
+	return tipsetMessages(bms), nil
+}
+
 // State subset
 
 func (p *Proxy) StateChangedActors(ctx context.Context, old cid.Cid, new cid.Cid) (map[string]types.Actor, error) {
@@ -309,6 +764,87 @@ func (p *Proxy) StateVMCirculatingSupplyInternal(ctx context.Context, tsk types.
 	return p.node.StateVMCirculatingSupplyInternal(ctx, tsk)
 }
 
+func (p *Proxy) StateDecodeParams(ctx context.Context, toAddr address.Address, method abi.MethodNum, params []byte, tsk types.TipSetKey) (interface{}, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("StateDecodeParams", "to", toAddr, "method", method, "tsk", tsk)
+	}
+	return p.node.StateDecodeParams(ctx, toAddr, method, params, tsk)
+}
+
+func (p *Proxy) StateCall(ctx context.Context, msg *types.Message, tsk types.TipSetKey) (*api.InvocResult, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("StateCall", "tsk", tsk)
+	}
+	return p.node.StateCall(ctx, msg, tsk)
+}
+
+func (p *Proxy) StateCompute(ctx context.Context, height abi.ChainEpoch, msgs []*types.Message, tsk types.TipSetKey) (*api.ComputeStateOutput, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("StateCompute", "height", height, "tsk", tsk)
+	}
+	return p.node.StateCompute(ctx, height, msgs, tsk)
+}
+
+// Beacon subset
+
+func (p *Proxy) BeaconGetEntry(ctx context.Context, epoch abi.ChainEpoch) (*types.BeaconEntry, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("BeaconGetEntry", "epoch", epoch)
+	}
+	ctx = p.epochContext(ctx, epoch)
+	if v, ok := p.beacon.Get(epoch); ok && !cacheBypassed(ctx) {
+		return v.(*types.BeaconEntry), nil
+	}
+	e, err := p.node.BeaconGetEntry(ctx, epoch)
+	if err != nil {
+		return nil, err
+	}
+	p.beacon.Add(epoch, e)
+	return e, nil
+}
+
+// Net subset
+
+func (p *Proxy) NetPeers(ctx context.Context) ([]peer.AddrInfo, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("NetPeers")
+	}
+	return p.node.NetPeers(ctx)
+}
+
+func (p *Proxy) NetAddrsListen(ctx context.Context) (peer.AddrInfo, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("NetAddrsListen")
+	}
+	return p.node.NetAddrsListen(ctx)
+}
+
+// Sync subset
+
+func (p *Proxy) SyncState(ctx context.Context) (*api.SyncState, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("SyncState")
+	}
+	return p.node.SyncState(ctx)
+}
+
+func (p *Proxy) SyncIncomingBlocks(ctx context.Context) (<-chan *types.BlockHeader, error) {
+	if p.tlogger.Enabled() {
+		p.tlogger.Info("SyncIncomingBlocks")
+	}
+	ch, err := p.subscribe(ctx, "SyncIncomingBlocks", func(ctx context.Context) (interface{}, error) {
+		return p.node.SyncIncomingBlocks(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch.(<-chan *types.BlockHeader), nil
+}
+
+// GetTipSetFromKey returns the tipset with the given key, or the head tipset if the key is empty. Tipsets
+// with a non-empty key are read through the cache so they continue to be served while the upstream node
+// is unavailable if all their blocks are cached. ErrTipSetNotFound is returned if a block of the tipset
+// could not be found anywhere.
 func (p *Proxy) GetTipSetFromKey(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
 	if p.tlogger.Enabled() {
 		p.tlogger.Info("GetTipSetFromKey", "tsk", tsk)
@@ -316,5 +852,26 @@ func (p *Proxy) GetTipSetFromKey(ctx context.Context, tsk types.TipSetKey) (*typ
 	if tsk.IsEmpty() {
 		return p.node.ChainHead(ctx) // equivalent to Chain.GetHeaviestTipSet
 	}
-	return p.ChainGetTipSet(ctx, tsk)
+	ts, err := p.ChainGetTipSet(ctx, tsk)
+	if err != nil {
+		switch {
+		case isBlockNotFound(err):
+			return nil, fmt.Errorf("%w: %s", ErrTipSetNotFound, tsk)
+		case isUpstreamUnavailable(err):
+			return nil, fmt.Errorf("tipset %s is not cached: %w", tsk, ErrLotusUnavailable)
+		}
+		return nil, err
+	}
+	return ts, nil
+}
+
+// isBlockNotFound reports whether err indicates that a block does not exist, including errors returned
+// by the upstream node which lose their type when passed over rpc.
+func isBlockNotFound(err error) bool {
+	return errors.Is(err, blockstore.ErrNotFound) || strings.Contains(err.Error(), blockstore.ErrNotFound.Error())
+}
+
+// isUpstreamUnavailable reports whether err was returned because the upstream node could not be called.
+func isUpstreamUnavailable(err error) bool {
+	return errors.Is(err, ErrLotusUnavailable) || errors.Is(err, circuit.ErrCircuitOpen) || errors.Is(err, circuit.ErrTooManyConcurrent)
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// stubNode is a lotus node serving objects held in memory, counting the objects read from it. Calls to
+// other methods of the api panic.
+type stubNode struct {
+	ProxyAPI
+
+	mu    sync.Mutex
+	data  map[cid.Cid][]byte
+	reads int
+}
+
+func newStubNode() *stubNode {
+	return &stubNode{data: map[cid.Cid][]byte{}}
+}
+
+func (s *stubNode) ChainHasObj(ctx context.Context, obj cid.Cid) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.data[obj]
+	return ok, nil
+}
+
+func (s *stubNode) ChainReadObj(ctx context.Context, obj cid.Cid) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	data, ok := s.data[obj]
+	if !ok {
+		return nil, blockstore.ErrNotFound
+	}
+	return data, nil
+}
+
+func (s *stubNode) objectReads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+// newStubProxy returns a proxy reading objects from node through a node cache and no other tiers.
+func newStubProxy(node *stubNode) (*Proxy, *NodeBlockCache) {
+	nc := NewNodeBlockCache(node, logr.Discard())
+	return NewAPIProxy(node, nc, logr.Discard()), nc
+}
+
+func TestProxyReadObjRefusesMismatchedData(t *testing.T) {
+	ctx := context.Background()
+	node := newStubNode()
+	p, nc := newStubProxy(node)
+	nc.SetVerify(true)
+
+	blk := blocks.NewBlock([]byte("the data that was requested"))
+	node.data[blk.Cid()] = []byte("some other data")
+
+	if data, err := p.ChainReadObj(ctx, blk.Cid()); !errors.Is(err, ErrNodeDataMismatch) {
+		t.Fatalf("ChainReadObj of mismatched data returned %q, %v, wanted error %v", data, err, ErrNodeDataMismatch)
+	}
+	if n := node.objectReads(); n != 1 {
+		t.Errorf("object was read from the node %d times, wanted 1", n)
+	}
+}
+
+func TestProxyReadObjRecordedMissing(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "missing")
+	missing, err := OpenMissingBlocks(path, time.Hour, logr.Discard())
+	if err != nil {
+		t.Fatalf("open missing blocks: %v", err)
+	}
+	node := newStubNode()
+	p, nc := newStubProxy(node)
+	nc.SetMissingBlocks(missing)
+
+	// A block first reported missing longer ago than the finality period is recorded by its next miss
+	blk := blocks.NewBlock([]byte("missing from the node"))
+	missing.suspects.Add(blk.Cid(), time.Now().Add(-missingConfirmDelay))
+	if _, err := p.ChainReadObj(ctx, blk.Cid()); !isBlockNotFound(err) {
+		t.Fatalf("ChainReadObj of a missing block: got error %v, wanted not found", err)
+	}
+	if !missing.Missing(blk.Cid()) {
+		t.Fatalf("block was not recorded as missing")
+	}
+	missing.Close()
+
+	// The record survives a restart and answers requests without the node
+	missing, err = OpenMissingBlocks(path, time.Hour, logr.Discard())
+	if err != nil {
+		t.Fatalf("reopen missing blocks: %v", err)
+	}
+	defer missing.Close()
+	p, nc = newStubProxy(node)
+	nc.SetMissingBlocks(missing)
+	for i := 0; i < 3; i++ {
+		if _, err := p.ChainReadObj(ctx, blk.Cid()); !errors.Is(err, blockstore.ErrNotFound) {
+			t.Fatalf("ChainReadObj of a recorded missing block: got error %v, wanted %v", err, blockstore.ErrNotFound)
+		}
+	}
+	if n := node.objectReads(); n != 1 {
+		t.Errorf("block was read from the node %d times, wanted only the read that recorded it", n)
+	}
+}
+
+func TestProxyReadObjThrottlesMisses(t *testing.T) {
+	ctx := context.Background()
+	node := newStubNode()
+	p, nc := newStubProxy(node)
+	nc.SetFillLimits(1, 0)
+
+	blk := blocks.NewBlock([]byte("missing from the node"))
+	if _, err := p.ChainReadObj(ctx, blk.Cid()); !isBlockNotFound(err) {
+		t.Fatalf("ChainReadObj of a missing block: got error %v, wanted not found", err)
+	}
+
+	// The fill limit has been used up so a request that can't wait for it is not passed to the node
+	tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := p.ChainReadObj(tctx, blk.Cid()); err == nil || isBlockNotFound(err) {
+		t.Fatalf("ChainReadObj over the fill limit: got error %v, wanted the limit to be enforced", err)
+	}
+	if n := node.objectReads(); n != 1 {
+		t.Errorf("block was read from the node %d times, wanted 1", n)
+	}
+}
+
+func TestProxyReadObjNegativeCache(t *testing.T) {
+	ctx := context.Background()
+	negative, err := NewNegativeCache(10, time.Minute, logr.Discard())
+	if err != nil {
+		t.Fatalf("new negative cache: %v", err)
+	}
+	node := newStubNode()
+	p, nc := newStubProxy(node)
+	nc.SetNegativeCache(negative)
+
+	blk := blocks.NewBlock([]byte("missing from the node"))
+	for i := 0; i < 3; i++ {
+		if _, err := p.ChainReadObj(ctx, blk.Cid()); !isBlockNotFound(err) {
+			t.Fatalf("ChainReadObj of a missing block: got error %v, wanted not found", err)
+		}
+	}
+	if n := node.objectReads(); n != 1 {
+		t.Errorf("block was read from the node %d times, wanted 1", n)
+	}
+}
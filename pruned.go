@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/types"
+	blockadt "github.com/filecoin-project/specs-actors/actors/util/adt"
+	"github.com/go-logr/logr"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"go.opencensus.io/tag"
+)
+
+var ErrHistoryUnavailable = errors.New("historical data unavailable: pruned by the lotus node and not held by any cache tier")
+
+// pruneProbeDepth is how far below the head the node is probed for historical state. Nodes running a
+// splitstore keep a few finality periods of state before discarding it.
+const pruneProbeDepth = 10 * build.Finality
+
+// PruneProbeAPI is the part of the lotus api used to detect whether the node has discarded history.
+type PruneProbeAPI interface {
+	ChainHead(ctx context.Context) (*types.TipSet, error)
+	ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error)
+	ChainHasObj(ctx context.Context, obj cid.Cid) (bool, error)
+}
+
+// PruneDetector periodically checks whether the lotus node has discarded historical objects, such as a node
+// running a splitstore in discard mode, by asking whether it still has the state and messages of a tipset
+// well below its head.
+type PruneDetector struct {
+	node     PruneProbeAPI
+	interval time.Duration
+	logger   logr.Logger
+	pruned   int32 // non-zero when the node has been found to be missing history, accessed atomically
+}
+
+func NewPruneDetector(node PruneProbeAPI, interval time.Duration, logger logr.Logger) *PruneDetector {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	return &PruneDetector{
+		node:     node,
+		interval: interval,
+		logger:   logger.V(LogLevelInfo),
+	}
+}
+
+// Pruned reports whether the node was missing historical objects when last probed.
+func (d *PruneDetector) Pruned() bool {
+	return atomic.LoadInt32(&d.pruned) != 0
+}
+
+// Run probes the node until the context is cancelled.
+func (d *PruneDetector) Run(ctx context.Context) {
+	timer := time.NewTicker(d.interval)
+	defer timer.Stop()
+	for {
+		d.Probe(ctx)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Probe checks whether the node has discarded history. Failed probes leave the previous result unchanged.
+func (d *PruneDetector) Probe(ctx context.Context) {
+	pruned, err := d.probe(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			d.logger.Error(err, "failed to probe node for historical data")
+		}
+		return
+	}
+
+	var v int32
+	if pruned {
+		v = 1
+	}
+	if atomic.SwapInt32(&d.pruned, v) != v {
+		if pruned {
+			d.logger.Info("Lotus node is missing historical data, serving history from the cache tiers first")
+		} else {
+			d.logger.Info("Lotus node has historical data")
+		}
+	}
+	reportMeasurement(ctx, nodePruned.M(int64(v)))
+}
+
+func (d *PruneDetector) probe(ctx context.Context) (bool, error) {
+	head, err := d.node.ChainHead(ctx)
+	if err != nil {
+		return false, fmt.Errorf("chain head: %w", err)
+	}
+	if head.Height() <= pruneProbeDepth {
+		return false, nil
+	}
+	ts, err := d.node.ChainGetTipSetByHeight(ctx, head.Height()-pruneProbeDepth, head.Key())
+	if err != nil {
+		return false, fmt.Errorf("get tipset by height: %w", err)
+	}
+	for _, c := range []cid.Cid{ts.ParentState(), ts.Blocks()[0].Messages} {
+		has, err := d.node.ChainHasObj(ctx, c)
+		if err != nil {
+			return false, fmt.Errorf("has obj: %w", err)
+		}
+		if !has {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// historyUnavailable reports whether err shows that an object is held neither by the caches nor by a node
+// known to have discarded history.
+func (p *Proxy) historyUnavailable(ctx context.Context, method string, err error) bool {
+	if !p.nodePruned() || !isBlockNotFound(err) {
+		return false
+	}
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, method))
+	reportEvent(mctx, historyUnavailable)
+	return true
+}
+
+// heightAbsent reports whether the messages and receipts of blocks at the height are known to be absent
+// from both the store and the node, so that searching the cache tiers for them is futile.
+func (p *Proxy) heightAbsent(ctx context.Context, method string, h abi.ChainEpoch) bool {
+	if !p.coverage.Absent(h) {
+		return false
+	}
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, method))
+	reportEvent(mctx, storeAbsentSkipped)
+	return true
+}
+
+// nodePruned reports whether the node is known to have discarded history.
+func (p *Proxy) nodePruned() bool {
+	return p.pruned != nil && p.pruned.Pruned()
+}
+
+// cachedBlockHeader reads a block header through the cache.
+func cachedBlockHeader(ctx context.Context, cache BlockCache, c cid.Cid) (*types.BlockHeader, error) {
+	blk, err := cache.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return types.DecodeBlock(blk.RawData())
+}
+
+// cachedMessage reads a message through the cache. The message of a signed message is returned when c is
+// the cid of a signed message.
+func cachedMessage(ctx context.Context, cache BlockCache, c cid.Cid) (*types.Message, error) {
+	blk, err := cache.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if m, err := types.DecodeMessage(blk.RawData()); err == nil {
+		return m, nil
+	}
+	sm, err := types.DecodeSignedMessage(blk.RawData())
+	if err != nil {
+		return nil, fmt.Errorf("decode message: %w", err)
+	}
+	return &sm.Message, nil
+}
+
+// cachedParentReceipts reads the receipts of the messages executed by a block's parent tipset through the
+// cache. Block headers use v0 AMTs.
+func cachedParentReceipts(ctx context.Context, cache BlockCache, bh *types.BlockHeader) ([]*types.MessageReceipt, error) {
+	cst := cbor.NewCborStore(&cacheBlockstore{ctx: ctx, cache: cache})
+	a, err := blockadt.AsArray(blockadt.WrapStore(ctx, cst), bh.ParentMessageReceipts)
+	if err != nil {
+		return nil, fmt.Errorf("amt load: %w", err)
+	}
+
+	var (
+		out []*types.MessageReceipt
+		r   types.MessageReceipt
+	)
+	if err := a.ForEach(&r, func(i int64) error {
+		rc := r
+		out = append(out, &rc)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("amt traverse: %w", err)
+	}
+	return out, nil
+}
+
+// cachedParentMessages reads the messages executed by a block's parent tipset through the cache.
+func cachedParentMessages(ctx context.Context, cache BlockCache, bh *types.BlockHeader) ([]api.Message, error) {
+	// The genesis block has no parent
+	if bh.Height == 0 {
+		return nil, nil
+	}
+	parent, err := cachedTipSet(ctx, cache, types.NewTipSetKey(bh.Parents...))
+	if err != nil {
+		return nil, fmt.Errorf("load parent tipset: %w", err)
+	}
+	bms := make([]*blockMessages, len(parent.Blocks()))
+	for i, pbh := range parent.Blocks() {
+		if bms[i], err = cachedBlockMessages(ctx, cache, pbh); err != nil {
+			return nil, err
+		}
+	}
+	return tipsetMessages(bms), nil
+}
+
+// apiBlockMessages returns the messages in the form returned by ChainGetBlockMessages.
+func (bm *blockMessages) apiBlockMessages() *api.BlockMessages {
+	out := &api.BlockMessages{
+		BlsMessages:   bm.bls,
+		SecpkMessages: bm.secpk,
+		Cids:          make([]cid.Cid, 0, len(bm.bls)+len(bm.secpk)),
+	}
+	for _, m := range bm.bls {
+		out.Cids = append(out.Cids, m.Cid())
+	}
+	for _, m := range bm.secpk {
+		out.Cids = append(out.Cids, m.Cid())
+	}
+	return out
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	"go.opencensus.io/tag"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitBuckets is the number of token buckets held for recently seen clients and methods.
+const rateLimitBuckets = 100000
+
+// Rate limit keys, the part of a request used to identify the client whose calls are limited.
+const (
+	RateLimitByIP    = "ip"    // the client's IP address
+	RateLimitByToken = "token" // the bearer token presented by the client, or its IP address if it presented none
+	RateLimitByBoth  = "both"  // the client's IP address and bearer token together
+)
+
+// ErrRateLimited is returned for calls rejected because the client exceeded its rate limit. The JSON-RPC
+// server reports method errors with its generic error code, so the error message gives the limit that was
+// exceeded and how long the client should wait before retrying.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// ValidRateLimitBy reports whether by is a supported rate limit key.
+func ValidRateLimitBy(by string) bool {
+	switch by {
+	case RateLimitByIP, RateLimitByToken, RateLimitByBoth:
+		return true
+	default:
+		return false
+	}
+}
+
+// RateLimit is the sustained rate of calls per second and the burst of calls allowed above it.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimiter is method middleware that limits the rate of calls made by each client using a token bucket.
+// Limits are keyed by method name, with the limit keyed by * applying to methods without their own limit.
+// Methods with their own limit have their own bucket for each client, so that expensive calls can be
+// throttled independently of cheap reads that share the bucket of the * limit. Calls that read a batch,
+// such as ChainReadObjMany, are charged as one call of the batched method for each item.
+type RateLimiter struct {
+	limits  map[string]RateLimit
+	by      string
+	buckets *lru.Cache // *rate.Limiter keyed by client key and bucket name
+}
+
+// ParseRateLimits parses a list of limits of the form method=rate or method=rate:burst, such as
+// StateChangedActors=0.5:2. A method of * sets the limit for every method without its own limit. The burst
+// defaults to the rate rounded up.
+func ParseRateLimits(specs []string) (map[string]RateLimit, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	limits := map[string]RateLimit{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid limit %q, expected method=rate or method=rate:burst", spec)
+		}
+		rateBurst := strings.SplitN(parts[1], ":", 2)
+		r, err := strconv.ParseFloat(rateBurst[0], 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("invalid rate in limit %q", spec)
+		}
+		l := RateLimit{Rate: r, Burst: int(r)}
+		if float64(l.Burst) < r {
+			l.Burst++
+		}
+		if len(rateBurst) == 2 {
+			if l.Burst, err = strconv.Atoi(rateBurst[1]); err != nil || l.Burst <= 0 {
+				return nil, fmt.Errorf("invalid burst in limit %q", spec)
+			}
+		}
+		limits[parts[0]] = l
+	}
+	return limits, nil
+}
+
+func NewRateLimiter(limits map[string]RateLimit, by string) (*RateLimiter, error) {
+	if !ValidRateLimitBy(by) {
+		return nil, fmt.Errorf("unknown rate limit key %q", by)
+	}
+	buckets, err := lru.New(rateLimitBuckets)
+	if err != nil {
+		return nil, fmt.Errorf("new lru: %w", err)
+	}
+	return &RateLimiter{
+		limits:  limits,
+		by:      by,
+		buckets: buckets,
+	}, nil
+}
+
+func (l *RateLimiter) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		method, n := batchCost(call)
+		bucket := method
+		limit, ok := l.limits[bucket]
+		if !ok {
+			bucket = "*"
+			if limit, ok = l.limits[bucket]; !ok {
+				return next(ctx, call)
+			}
+		}
+
+		key := l.clientKey(ctx) + "/" + bucket
+		var lim *rate.Limiter
+		if v, ok := l.buckets.Get(key); ok {
+			lim = v.(*rate.Limiter)
+		} else {
+			lim = rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)
+			// Another call from the client may have added a bucket first
+			if v, ok, _ := l.buckets.PeekOrAdd(key, lim); ok {
+				lim = v.(*rate.Limiter)
+			}
+		}
+
+		res := lim.ReserveN(time.Now(), n)
+		if !res.OK() {
+			mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+			reportEvent(mctx, rateLimited)
+			return nil, fmt.Errorf("%w: %s of %d items exceeds the burst of %d %s calls", ErrRateLimited, call.Method, n, limit.Burst, method)
+		}
+		if delay := res.Delay(); delay > 0 {
+			res.Cancel()
+			mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+			reportEvent(mctx, rateLimited)
+			return nil, fmt.Errorf("%w: %s is limited to %g calls per second, retry after %s", ErrRateLimited, method, limit.Rate, delay.Round(time.Millisecond))
+		}
+		return next(ctx, call)
+	}
+}
+
+// batchCost returns the method a call is charged as and the number of calls it is charged for. Batch
+// calls are charged as a call of the batched method for each item requested, or one call if empty.
+func batchCost(call *MethodCall) (string, int) {
+	if call.Method == "ChainReadObjMany" && len(call.Params) == 1 {
+		if objs, ok := call.Params[0].([]cid.Cid); ok && len(objs) > 0 {
+			return "ChainReadObj", len(objs)
+		}
+		return "ChainReadObj", 1
+	}
+	return call.Method, 1
+}
+
+// clientKey identifies the client making the call carried by the context.
+func (l *RateLimiter) clientKey(ctx context.Context) string {
+	ip := clientAddr(ctx)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	switch l.by {
+	case RateLimitByToken:
+		if token := clientTokenID(ctx); token != "" {
+			return token
+		}
+		return ip
+	case RateLimitByBoth:
+		return ip + "/" + clientTokenID(ctx)
+	default:
+		return ip
+	}
+}
+
+// tokenID returns an identifier for a bearer token that does not reveal the token, empty if there is no
+// token.
+func tokenID(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
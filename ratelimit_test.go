@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+func TestRateLimiterChargesBatchPerObject(t *testing.T) {
+	rl, err := NewRateLimiter(map[string]RateLimit{"ChainReadObj": {Rate: 0.001, Burst: 5}}, RateLimitByIP)
+	if err != nil {
+		t.Fatalf("NewRateLimiter: %v", err)
+	}
+	h := rl.Middleware(func(ctx context.Context, call *MethodCall) (interface{}, error) { return nil, nil })
+
+	objs := func(n int) []cid.Cid {
+		cids := make([]cid.Cid, n)
+		for i := range cids {
+			cids[i] = blocks.NewBlock([]byte{byte(i)}).Cid()
+		}
+		return cids
+	}
+	call := func(method string, params ...interface{}) error {
+		_, err := h(context.Background(), &MethodCall{Method: method, Params: params})
+		return err
+	}
+
+	if err := call("ChainReadObjMany", objs(6)); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("batch larger than the burst returned %v, wanted %v", err, ErrRateLimited)
+	}
+	if err := call("ChainReadObjMany", objs(3)); err != nil {
+		t.Fatalf("batch within the burst returned %v", err)
+	}
+	if err := call("ChainReadObj", objs(1)[0]); err != nil {
+		t.Fatalf("ChainReadObj within the burst returned %v", err)
+	}
+	if err := call("ChainReadObjMany", objs(2)); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("batch beyond the remaining allowance returned %v, wanted %v", err, ErrRateLimited)
+	}
+	if err := call("ChainReadObj", objs(1)[0]); err != nil {
+		t.Errorf("ChainReadObj was charged for the rejected batch: %v", err)
+	}
+}
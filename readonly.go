@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/lotus/api/apistruct"
+)
+
+var ErrReadOnly = errors.New("proxy is read only")
+
+// ReadOnlyPolicy is method middleware that rejects calls to methods requiring more than read permission,
+// such as MpoolPush or WalletNew. It is based on the permission the Lotus API declares for each method so
+// that mutating methods remain rejected when the proxy later implements or passes them through.
+func ReadOnlyPolicy(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		if call.Perm != apistruct.PermRead {
+			return nil, fmt.Errorf("%w: %s requires %s permission", ErrReadOnly, call.Method, call.Perm)
+		}
+		return next(ctx, call)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// recordTimesFile is the name of the sidecar file in a store directory that records when records were
+// inserted and last accessed.
+const recordTimesFile = "times.log"
+
+// recordAccessResolution is the minimum interval between recorded accesses of a record.
+const recordAccessResolution = time.Hour
+
+// recordTimesCacheSize is the number of recently accessed records whose last recorded access is remembered
+// to avoid recording repeated accesses.
+const recordTimesCacheSize = 65536
+
+// Record time events.
+const (
+	recordInserted byte = 'i'
+	recordAccessed byte = 'a'
+)
+
+// RecordTime is the insert and last access times of a record. Either may be zero if unknown, such as for
+// records inserted before timestamps were recorded.
+type RecordTime struct {
+	Inserted time.Time
+	Accessed time.Time
+}
+
+// RecordTimes appends insert and access events for the records of a store to a sidecar file. Each event is
+// a type byte, the time in seconds since the Unix epoch as a big endian uint64, the key length as a byte
+// and the key. The latest events for a key give its times. Accesses are recorded at most once per
+// recordAccessResolution for recently accessed records. All methods are safe to call on a nil RecordTimes.
+type RecordTimes struct {
+	mu     sync.Mutex // guards f, w and recent
+	f      *os.File
+	w      *bufio.Writer
+	recent *lru.Cache // unix time of last recorded access keyed by record key
+}
+
+// OpenRecordTimes opens the record times sidecar file of the store in path, creating it if necessary.
+func OpenRecordTimes(path string) (*RecordTimes, error) {
+	f, err := os.OpenFile(filepath.Join(path, recordTimesFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open record times: %w", err)
+	}
+	recent, _ := lru.New(recordTimesCacheSize)
+	return &RecordTimes{
+		f:      f,
+		w:      bufio.NewWriter(f),
+		recent: recent,
+	}, nil
+}
+
+// Inserted records that the record with the given key was inserted at t.
+func (r *RecordTimes) Inserted(key string, t time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.append(recordInserted, key, t)
+	r.recent.Add(key, t.Unix())
+}
+
+// Accessed records that the record with the given key was read at t.
+func (r *RecordTimes) Accessed(key string, t time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.recent.Get(key); ok && t.Unix()-v.(int64) < int64(recordAccessResolution/time.Second) {
+		return
+	}
+	r.append(recordAccessed, key, t)
+	r.recent.Add(key, t.Unix())
+}
+
+func (r *RecordTimes) append(event byte, key string, t time.Time) {
+	if len(key) > 255 {
+		return
+	}
+	var buf [10]byte
+	buf[0] = event
+	binary.BigEndian.PutUint64(buf[1:9], uint64(t.Unix()))
+	buf[9] = byte(len(key))
+	// Write errors are sticky and reported by Flush
+	_, _ = r.w.Write(buf[:])
+	_, _ = r.w.WriteString(key)
+}
+
+// Flush writes buffered events to the sidecar file.
+func (r *RecordTimes) Flush() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Flush()
+}
+
+// Close flushes buffered events and closes the sidecar file.
+func (r *RecordTimes) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// readRecordTimes reads the record times sidecar file of the store in path, returning the times of each
+// record that has events.
+func readRecordTimes(path string) (map[string]*RecordTime, error) {
+	f, err := os.Open(filepath.Join(path, recordTimesFile))
+	if err != nil {
+		return nil, fmt.Errorf("open record times: %w", err)
+	}
+	defer f.Close()
+
+	times := map[string]*RecordTime{}
+	br := bufio.NewReader(f)
+	var hdr [10]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// A truncated final event is left by a crash while writing
+				return times, nil
+			}
+			return nil, fmt.Errorf("read record times: %w", err)
+		}
+		key := make([]byte, hdr[9])
+		if _, err := io.ReadFull(br, key); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return times, nil
+			}
+			return nil, fmt.Errorf("read record times: %w", err)
+		}
+
+		rt, ok := times[string(key)]
+		if !ok {
+			rt = &RecordTime{}
+			times[string(key)] = rt
+		}
+		t := time.Unix(int64(binary.BigEndian.Uint64(hdr[1:9])), 0)
+		switch hdr[0] {
+		case recordInserted:
+			rt.Inserted = t
+		case recordAccessed:
+			rt.Accessed = t
+		default:
+			return nil, fmt.Errorf("read record times: unknown event type %q", hdr[0])
+		}
+	}
+}
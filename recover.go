@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/go-logr/logr"
+	"go.opencensus.io/tag"
+)
+
+var ErrInternal = errors.New("internal error")
+
+// PanicRecovery is method middleware that recovers from panics raised while handling a call so that a
+// single bad request cannot take down the server. The panic is logged with its stack trace and the
+// method, client and params of the call, and the call fails with ErrInternal.
+type PanicRecovery struct {
+	logger logr.Logger
+}
+
+func NewPanicRecovery(logger logr.Logger) *PanicRecovery {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	return &PanicRecovery{
+		logger: logger.V(LogLevelInfo),
+	}
+}
+
+func (p *PanicRecovery) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (res interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+				reportEvent(mctx, methodPanic)
+				p.logger.Error(fmt.Errorf("panic: %v", r), "Recovered from panic in method handler", "method", call.Method,
+					"client", clientName(ctx), "addr", clientAddr(ctx), "params", auditParams(call.Params), "stack", string(debug.Stack()))
+				res, err = nil, fmt.Errorf("%w: %s", ErrInternal, call.Method)
+			}
+		}()
+		return next(ctx, call)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/go-logr/logr"
+)
+
+// ReorgMonitor follows the node's head changes and reports chain reorganisations, in which tipsets that were
+// part of the chain are reverted and replaced. Reorgs invalidate data derived from the reverted tipsets, so
+// each one is logged with its depth and the epochs affected and counted by metrics.
+type ReorgMonitor struct {
+	logger logr.Logger
+
+	// Tipsets reverted since the last applied tipset, only used by HeadChanges and HeadsLost
+	reverted []*types.TipSet
+}
+
+func NewReorgMonitor(logger logr.Logger) *ReorgMonitor {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	return &ReorgMonitor{
+		logger: logger.V(LogLevelInfo),
+	}
+}
+
+// HeadsLost forgets the tracked reverts, since without the changes that replaced them they cannot be
+// reported accurately.
+func (m *ReorgMonitor) HeadsLost(ctx context.Context) {
+	m.reverted = nil
+}
+
+// HeadChanges reports a reorg when a tipset is applied after one or more tipsets were reverted. The node
+// normally sends the reverts and the applies that replace them together, but they are tracked across
+// notifications in case they are split.
+func (m *ReorgMonitor) HeadChanges(ctx context.Context, changes []*api.HeadChange) {
+	for _, hc := range changes {
+		switch hc.Type {
+		case "revert":
+			m.reverted = append(m.reverted, hc.Val)
+		case "apply":
+			if len(m.reverted) == 0 {
+				continue
+			}
+			m.report(ctx, hc.Val)
+			m.reverted = nil
+		case "current":
+			m.reverted = nil
+		}
+	}
+}
+
+// report logs and counts a reorg that reverted the tracked tipsets, the first of which was the head, and
+// applied a new head.
+func (m *ReorgMonitor) report(ctx context.Context, head *types.TipSet) {
+	oldHead := m.reverted[0]
+	lowest := oldHead.Height()
+	keys := make([]string, len(m.reverted))
+	for i, ts := range m.reverted {
+		if ts.Height() < lowest {
+			lowest = ts.Height()
+		}
+		keys[i] = ts.Key().String()
+	}
+
+	depth := len(m.reverted)
+	reportEvent(ctx, chainReorg)
+	reportMeasurement(ctx, chainReorgDepth.M(int64(depth)))
+	m.logger.Info("Chain reorganisation", "depth", depth, "reverted_from", lowest, "reverted_to", oldHead.Height(), "old_head", oldHead.Key().String(), "new_head", head.Key().String(), "new_height", head.Height(), "reverted", keys)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Store rotation schedules.
+const (
+	StoreRotateDaily  = "daily"  // start a new generation at midnight UTC
+	StoreRotateWeekly = "weekly" // start a new generation at midnight UTC on Mondays
+)
+
+// storeGenerationPrefix is prefixed to the names of the directories holding each store generation.
+const storeGenerationPrefix = "gen-"
+
+// storeRotateCheckInterval is how often the rotator checks whether a new generation is due.
+const storeRotateCheckInterval = time.Minute
+
+// ValidStoreRotate reports whether period is a known store rotation schedule.
+func ValidStoreRotate(period string) bool {
+	switch period {
+	case StoreRotateDaily, StoreRotateWeekly:
+		return true
+	}
+	return false
+}
+
+// generationName returns the name of the generation covering time t, which is the date the generation's
+// period started.
+func generationName(period string, t time.Time) string {
+	t = t.UTC()
+	if period == StoreRotateWeekly {
+		t = t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+	}
+	return t.Format("20060102")
+}
+
+// StoreRotator rolls a store over to a new generation on a schedule, keeping a bounded number of older
+// generations readable. Each generation is held in a subdirectory of every store path. Expired generations
+// are closed and deleted, so blocks that were only in them are filled from upstream again when next requested.
+type StoreRotator struct {
+	paths    []string
+	period   string
+	keep     int  // number of generations to keep, including the current one
+	readOnly bool // open generations created by another process instead of creating them
+	readers  int  // number of handles opened for reading each shard, see storeGeneration.openReaders
+	evict    StoreCeiling
+	store    *ShardedStore
+	logger   logr.Logger
+
+	onDiscard func() // called after a generation is removed, may be nil
+}
+
+func NewStoreRotator(paths []string, period string, keep int, readOnly bool, logger logr.Logger) *StoreRotator {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	return &StoreRotator{
+		paths:    paths,
+		period:   period,
+		keep:     keep,
+		readOnly: readOnly,
+		logger:   logger.V(LogLevelInfo),
+	}
+}
+
+// SetReadConcurrency sets the number of handles opened for reading each shard of a generation.
+func (r *StoreRotator) SetReadConcurrency(n int) {
+	r.readers = n
+}
+
+// SetEviction evicts the oldest generations whenever the store exceeds the record or size limits of the
+// ceiling. When only the current generation remains a new generation is started early so that the current
+// one can be evicted. Zero limits are not enforced.
+func (r *StoreRotator) SetEviction(c StoreCeiling) {
+	r.evict = c
+}
+
+// SetDiscardHook sets a function called whenever a generation is removed by rotation or eviction.
+func (r *StoreRotator) SetDiscardHook(fn func()) {
+	r.onDiscard = fn
+}
+
+// Open opens the newest existing generations and, unless the rotator is read only, creates the generation
+// for the current period if it does not exist. Generations beyond the number to keep are deleted.
+func (r *StoreRotator) Open(ctx context.Context) (*ShardedStore, error) {
+	if _, err := os.Stat(filepath.Join(r.paths[0], "blocks.dat")); err == nil {
+		r.logger.Info("Ignoring store that is not part of a generation", "path", r.paths[0])
+	}
+
+	names, err := r.existingGenerations()
+	if err != nil {
+		return nil, err
+	}
+
+	current := generationName(r.period, time.Now())
+	if !r.readOnly && (len(names) == 0 || names[len(names)-1] < current) {
+		names = append(names, current)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no store generations found")
+	}
+
+	if len(names) > r.keep {
+		if !r.readOnly {
+			for _, name := range names[:len(names)-r.keep] {
+				r.removeGeneration(name)
+			}
+		}
+		names = names[len(names)-r.keep:]
+	}
+
+	r.store = &ShardedStore{}
+	for _, name := range names {
+		g, err := r.openGeneration(ctx, name)
+		if err != nil {
+			r.store.Close()
+			return nil, err
+		}
+		r.store.rotate(g, r.keep)
+	}
+	r.logger.Info("Opened store generations", "generations", r.store.generationNames())
+
+	return r.store, nil
+}
+
+// Run starts a new generation whenever the current period ends, and evicts generations while the store
+// exceeds its eviction limits, until the context is cancelled.
+func (r *StoreRotator) Run(ctx context.Context) {
+	ticker := time.NewTicker(storeRotateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.rotate(ctx); err != nil {
+				r.logger.Error(err, "failed to rotate store")
+			}
+			if err := r.evictOverLimit(ctx); err != nil {
+				r.logger.Error(err, "failed to evict store generation")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *StoreRotator) rotate(ctx context.Context) error {
+	current := generationName(r.period, time.Now())
+	if r.readOnly {
+		// Follow the newest generation created by the writer, which may have been started early by eviction
+		names, err := r.existingGenerations()
+		if err != nil || len(names) == 0 {
+			return err
+		}
+		current = names[len(names)-1]
+		if _, err := os.Stat(filepath.Join(r.paths[0], storeGenerationPrefix+current, "blocks.dat")); err != nil {
+			return nil
+		}
+	}
+	if current <= r.store.generationNames()[0] {
+		return nil
+	}
+	return r.startGeneration(ctx, current)
+}
+
+// startGeneration opens the named generation as the newest, closing and removing generations beyond the
+// number to keep.
+func (r *StoreRotator) startGeneration(ctx context.Context, name string) error {
+	g, err := r.openGeneration(ctx, name)
+	if err != nil {
+		return fmt.Errorf("open generation %s: %w", name, err)
+	}
+	removed := r.store.rotate(g, r.keep)
+	r.logger.Info("Rotated store", "generation", name)
+
+	for _, old := range removed {
+		r.closeGeneration(old)
+	}
+	return nil
+}
+
+func (r *StoreRotator) closeGeneration(g *storeGeneration) {
+	if err := g.close(); err != nil {
+		r.logger.Error(err, "failed to close store generation", "generation", g.name)
+	}
+	if !r.readOnly {
+		r.removeGeneration(g.name)
+		if r.onDiscard != nil {
+			r.onDiscard()
+		}
+	}
+}
+
+// overLimit reports whether the store exceeds its eviction limits.
+func (r *StoreRotator) overLimit() (bool, error) {
+	if r.evict.MaxRecords > 0 && int64(r.store.RecordCount()) > r.evict.MaxRecords {
+		return true, nil
+	}
+	if r.evict.MaxBytes > 0 {
+		size, err := r.store.DataSize()
+		if err != nil {
+			return false, fmt.Errorf("read store size: %w", err)
+		}
+		return size > r.evict.MaxBytes, nil
+	}
+	return false, nil
+}
+
+// evictOverLimit evicts the oldest generations until the store is within its eviction limits. If the
+// current generation alone exceeds the limits a new generation is started early, named after the time it
+// was started, and the current generation is evicted. A read only rotator leaves eviction to the writer.
+func (r *StoreRotator) evictOverLimit(ctx context.Context) error {
+	if r.readOnly || (r.evict.MaxRecords <= 0 && r.evict.MaxBytes <= 0) {
+		return nil
+	}
+	ctx = cacheContext(ctx, "gonudb")
+	for {
+		over, err := r.overLimit()
+		if err != nil || !over {
+			return err
+		}
+
+		if len(r.store.generationNames()) == 1 {
+			// Sorts after the current period's generation and before the next period's
+			name := time.Now().UTC().Format("20060102-150405")
+			if name <= r.store.generationNames()[0] {
+				// Already started a generation this second
+				return nil
+			}
+			if err := r.startGeneration(ctx, name); err != nil {
+				return err
+			}
+		}
+
+		g := r.store.evictOldest()
+		if g == nil {
+			return nil
+		}
+		records := int64(g.recordCount())
+		size, err := g.dataSize()
+		if err != nil {
+			r.logger.Error(err, "failed to read size of evicted store generation", "generation", g.name)
+		}
+		reportMeasurement(ctx, gonudbEvictedRecords.M(records))
+		reportMeasurement(ctx, gonudbEvictedSize.M(size))
+		r.logger.Info("Evicted store generation", "generation", g.name, "records", records, "size", size)
+		r.closeGeneration(g)
+	}
+}
+
+// existingGenerations returns the names of the generations found in the first store path, oldest first.
+func (r *StoreRotator) existingGenerations() ([]string, error) {
+	infos, err := ioutil.ReadDir(r.paths[0])
+	if err != nil {
+		return nil, fmt.Errorf("read store directory: %w", err)
+	}
+	var names []string
+	for _, fi := range infos {
+		if fi.IsDir() && strings.HasPrefix(fi.Name(), storeGenerationPrefix) {
+			names = append(names, strings.TrimPrefix(fi.Name(), storeGenerationPrefix))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *StoreRotator) openGeneration(ctx context.Context, name string) (*storeGeneration, error) {
+	paths := make([]string, len(r.paths))
+	for i, path := range r.paths {
+		paths[i] = filepath.Join(path, storeGenerationPrefix+name)
+		if !r.readOnly {
+			if err := os.MkdirAll(paths[i], 0o755); err != nil {
+				return nil, fmt.Errorf("create generation directory: %w", err)
+			}
+		}
+	}
+	shards, datPaths, times, err := openStoreShards(ctx, paths, r.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	g := newStoreGeneration(name, shards, datPaths, times)
+	if err := g.openReaders(ctx, r.readers); err != nil {
+		g.close()
+		return nil, err
+	}
+	return g, nil
+}
+
+func (r *StoreRotator) removeGeneration(name string) {
+	for _, path := range r.paths {
+		dir := filepath.Join(path, storeGenerationPrefix+name)
+		if err := os.RemoveAll(dir); err != nil {
+			r.logger.Error(err, "failed to remove store generation", "path", dir)
+			continue
+		}
+		r.logger.Info("Removed store generation", "path", dir)
+	}
+}
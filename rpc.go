@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/apistruct"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+)
+
+// MethodCall describes a call to an RPC method served by the proxy.
+type MethodCall struct {
+	Method string          // name of the method without its namespace, e.g. ChainHead
+	Perm   auth.Permission // permission required to call the method, as declared by the Lotus API
+	Params []interface{}   // parameters passed to the method, excluding the context
+}
+
+// MethodHandler handles a call to an RPC method, returning the method's result (nil for methods
+// that only return an error) and any error.
+type MethodHandler func(ctx context.Context, call *MethodCall) (interface{}, error)
+
+// MethodMiddleware wraps a MethodHandler to add behaviour common to all methods.
+type MethodMiddleware func(next MethodHandler) MethodHandler
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ExtensionStruct exposes methods served by lotus-cpr that are not part of the Lotus FullNode API.
+type ExtensionStruct struct {
+	Internal struct {
+		GetTipSetFromKey         func(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error)            `perm:"read"`
+		Discover                 func(ctx context.Context) (map[string]interface{}, error)                        `perm:"read"`
+		ChainGetMessagesInTipset func(ctx context.Context, tsk types.TipSetKey) ([]api.Message, error)            `perm:"read"`
+		ChainNotifyFrom          func(ctx context.Context, from abi.ChainEpoch) (<-chan []*api.HeadChange, error) `perm:"read"`
+		ChainReadObjMany         func(ctx context.Context, objs []cid.Cid) ([][]byte, error)                      `perm:"read"`
+	}
+}
+
+func (e *ExtensionStruct) Discover(ctx context.Context) (map[string]interface{}, error) {
+	return e.Internal.Discover(ctx)
+}
+
+func (e *ExtensionStruct) ChainGetMessagesInTipset(ctx context.Context, tsk types.TipSetKey) ([]api.Message, error) {
+	return e.Internal.ChainGetMessagesInTipset(ctx, tsk)
+}
+
+func (e *ExtensionStruct) ChainNotifyFrom(ctx context.Context, from abi.ChainEpoch) (<-chan []*api.HeadChange, error) {
+	return e.Internal.ChainNotifyFrom(ctx, from)
+}
+
+func (e *ExtensionStruct) ChainReadObjMany(ctx context.Context, objs []cid.Cid) ([][]byte, error) {
+	return e.Internal.ChainReadObjMany(ctx, objs)
+}
+
+func (e *ExtensionStruct) GetTipSetFromKey(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	return e.Internal.GetTipSetFromKey(ctx, tsk)
+}
+
+// NewRPCHandlers returns the handlers to be registered with the jsonrpc server. Every method call is
+// passed through the middleware, with the first middleware being outermost, before being dispatched
+// to the proxy. Methods of the Lotus API that are not implemented by the proxy are passed through to the
+// node if the proxy allows it, otherwise they return an error.
+func NewRPCHandlers(p *Proxy, mw ...MethodMiddleware) []interface{} {
+	var (
+		full apistruct.FullNodeStruct
+		ext  ExtensionStruct
+	)
+
+	bindMethods(&full.CommonStruct.Internal, p, p.passthrough, mw)
+	bindMethods(&full.Internal, p, p.passthrough, mw)
+	bindMethods(&ext.Internal, p, unsupportedHandler, mw)
+
+	return []interface{}{&full, &ext}
+}
+
+// rpcMethodNames returns the sorted names of the RPC methods implemented by impl.
+func rpcMethodNames(impl interface{}) []string {
+	var (
+		full apistruct.FullNodeStruct
+		ext  ExtensionStruct
+	)
+
+	iv := reflect.ValueOf(impl)
+	var names []string
+	for _, t := range []reflect.Type{
+		reflect.TypeOf(full.CommonStruct.Internal),
+		reflect.TypeOf(full.Internal),
+		reflect.TypeOf(ext.Internal),
+	} {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if m := iv.MethodByName(field.Name); m.IsValid() && m.Type() == field.Type {
+				names = append(names, field.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bindMethods sets each function field of the struct pointed to by out to a function that dispatches
+// the call through the middleware to the method of impl with the same name, or to fallback when impl has
+// no such method.
+func bindMethods(out interface{}, impl interface{}, fallback MethodHandler, mw []MethodMiddleware) {
+	rv := reflect.ValueOf(out).Elem()
+	rt := rv.Type()
+	iv := reflect.ValueOf(impl)
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.Type.Kind() != reflect.Func {
+			continue
+		}
+
+		perm := auth.Permission(field.Tag.Get("perm"))
+		if perm == "" {
+			perm = apistruct.PermRead
+		}
+
+		var h MethodHandler
+		if m := iv.MethodByName(field.Name); m.IsValid() && m.Type() == field.Type {
+			h = methodHandler(m)
+		} else {
+			h = fallback
+		}
+
+		for j := len(mw) - 1; j >= 0; j-- {
+			h = mw[j](h)
+		}
+
+		rv.Field(i).Set(methodFunc(field.Name, perm, field.Type, h))
+	}
+}
+
+// methodHandler returns a MethodHandler that calls the method value m.
+func methodHandler(m reflect.Value) MethodHandler {
+	mt := m.Type()
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		in := make([]reflect.Value, mt.NumIn())
+		in[0] = reflect.ValueOf(ctx)
+		for i, p := range call.Params {
+			if p == nil {
+				in[i+1] = reflect.Zero(mt.In(i + 1))
+			} else {
+				in[i+1] = reflect.ValueOf(p)
+			}
+		}
+
+		out := m.Call(in)
+
+		var err error
+		if e := out[len(out)-1]; !e.IsNil() {
+			err = e.Interface().(error)
+		}
+		if len(out) == 1 {
+			return nil, err
+		}
+		return out[0].Interface(), err
+	}
+}
+
+func unsupportedHandler(ctx context.Context, call *MethodCall) (interface{}, error) {
+	return nil, fmt.Errorf("method %s is not supported by lotus-cpr", call.Method)
+}
+
+// methodFunc creates a function of type ft that invokes the handler for the named method.
+func methodFunc(name string, perm auth.Permission, ft reflect.Type, h MethodHandler) reflect.Value {
+	return reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+		var ctx context.Context
+		params := in
+		if len(in) > 0 && in[0].Type().Implements(contextType) {
+			ctx, _ = in[0].Interface().(context.Context)
+			params = in[1:]
+		}
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		call := &MethodCall{
+			Method: name,
+			Perm:   perm,
+			Params: make([]interface{}, len(params)),
+		}
+		for i, p := range params {
+			call.Params[i] = p.Interface()
+		}
+
+		res, err := h(ctx, call)
+
+		out := make([]reflect.Value, ft.NumOut())
+		if ft.NumOut() == 2 {
+			if res == nil {
+				out[0] = reflect.Zero(ft.Out(0))
+			} else {
+				out[0] = reflect.ValueOf(res)
+			}
+		}
+		if err == nil {
+			out[len(out)-1] = reflect.Zero(errorType)
+		} else {
+			out[len(out)-1] = reflect.ValueOf(&err).Elem()
+		}
+		return out
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"go.opencensus.io/tag"
+)
+
+// defaultS3Region is the region assumed for a bucket when none is given. It is also the region expected by
+// most S3 compatible servers, such as MinIO.
+const defaultS3Region = "us-east-1"
+
+// s3WriteConcurrency is the maximum number of blocks written to the bucket at once when writing through.
+// Blocks filled while this many writes are in progress are not written.
+const s3WriteConcurrency = 8
+
+// S3Location identifies a blockstore held in an S3 bucket, or a bucket on an S3 compatible server.
+type S3Location struct {
+	Bucket   string
+	Region   string // region of the bucket, defaults to us-east-1
+	Endpoint string // optional url of an S3 compatible server, the bucket is addressed using its path
+	Prefix   string // optional key prefix under which the blockstore's objects are held
+}
+
+func (l S3Location) region() string {
+	if l.Region == "" {
+		return defaultS3Region
+	}
+	return l.Region
+}
+
+// key returns the key of the object holding the block's data. Blocks are held at the same paths as in an
+// http blockstore so a bucket may be read either way.
+func (l S3Location) key(c cid.Cid) string {
+	key := c.String() + "/data.raw"
+	if prefix := strings.Trim(l.Prefix, "/"); prefix != "" {
+		key = prefix + "/" + key
+	}
+	return key
+}
+
+// S3Options configures the client used by an S3BlockCache.
+type S3Options struct {
+	Timeout       time.Duration   // maximum time allowed for each attempt of a request
+	Retries       int             // retries of failed requests, made with the SDK's backoff
+	PartSize      int64           // size of the ranges objects are downloaded in and the parts they are uploaded in
+	Concurrency   int             // number of parts of an object downloaded or uploaded at once
+	WriteThrough  bool            // write blocks filled from upstream to the bucket
+	RequesterPays bool            // acknowledge that the requester is charged for access to the bucket
+	Credentials   *AWSCredentials // static credentials, nil to use the SDK's default credential chain
+}
+
+// S3BlockCache reads blocks from a blockstore held in an S3 bucket using the AWS SDK. Credentials are found
+// by the SDK's default chain of environment variables, shared config files and instance or task roles
+// unless given explicitly. Blocks larger than the part size are downloaded with concurrent ranged GETs and
+// uploaded in multiple parts.
+type S3BlockCache struct {
+	name          string
+	loc           S3Location
+	client        *s3.S3
+	downloader    *s3manager.Downloader
+	uploader      *s3manager.Uploader
+	requesterPays bool
+	writes        chan struct{} // limits concurrent writes to the bucket, nil when not writing through
+	upstream      BlockCache
+}
+
+// NewS3BlockCache creates a cache that reads blocks from the bucket at loc.
+func NewS3BlockCache(loc S3Location, name string, opts S3Options) (*S3BlockCache, error) {
+	if loc.Bucket == "" {
+		return nil, fmt.Errorf("bucket must be specified")
+	}
+
+	cfg := aws.NewConfig().
+		WithRegion(loc.region()).
+		WithMaxRetries(opts.Retries).
+		WithHTTPClient(&http.Client{Timeout: opts.Timeout})
+	if loc.Endpoint != "" {
+		u, err := url.Parse(loc.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q, expected an http or https url", loc.Endpoint)
+		}
+		// Path style addressing is widely supported by S3 compatible servers
+		cfg = cfg.WithEndpoint(loc.Endpoint).WithS3ForcePathStyle(true)
+	}
+	if opts.Credentials != nil {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(opts.Credentials.AccessKeyID, opts.Credentials.SecretAccessKey, opts.Credentials.SessionToken))
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create aws session: %w", err)
+	}
+
+	client := s3.New(sess)
+	bc := &S3BlockCache{
+		name:          name,
+		loc:           loc,
+		client:        client,
+		requesterPays: opts.RequesterPays,
+		downloader: s3manager.NewDownloaderWithClient(client, func(d *s3manager.Downloader) {
+			if opts.PartSize > 0 {
+				d.PartSize = opts.PartSize
+			}
+			if opts.Concurrency > 0 {
+				d.Concurrency = opts.Concurrency
+			}
+		}),
+		uploader: s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+			if opts.PartSize > u.PartSize {
+				u.PartSize = opts.PartSize
+			}
+			if opts.Concurrency > 0 {
+				u.Concurrency = opts.Concurrency
+			}
+		}),
+	}
+	if opts.WriteThrough {
+		bc.writes = make(chan struct{}, s3WriteConcurrency)
+	}
+	return bc, nil
+}
+
+// requestPayer returns the value of the request payer parameter sent with each request.
+func (bc *S3BlockCache) requestPayer() *string {
+	if bc.requesterPays {
+		return aws.String(s3.RequestPayerRequester)
+	}
+	return nil
+}
+
+func (bc *S3BlockCache) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	_, err := bc.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bc.loc.Bucket),
+		Key:          aws.String(bc.loc.key(c)),
+		RequestPayer: bc.requestPayer(),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if bc.upstream == nil {
+		if isS3NotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bc.upstream.Has(ctx, c)
+}
+
+func (bc *S3BlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	ctx = cacheContext(ctx, bc.name)
+	reportEvent(ctx, getRequest)
+	stop := startTimer(ctx, getDuration)
+	defer stop()
+
+	buf := aws.NewWriteAtBuffer(nil)
+	_, err := bc.downloader.DownloadWithContext(ctx, buf, &s3.GetObjectInput{
+		Bucket:       aws.String(bc.loc.Bucket),
+		Key:          aws.String(bc.loc.key(c)),
+		RequestPayer: bc.requestPayer(),
+	})
+	if err == nil {
+		reportEvent(ctx, getHit)
+		reportSize(ctx, getSize, len(buf.Bytes()))
+		return blocks.NewBlockWithCid(buf.Bytes(), c)
+	}
+
+	if !isS3NotFound(err) {
+		reportEvent(ctx, getFailure)
+		if bc.upstream == nil {
+			return nil, err
+		}
+		return bc.upstream.Get(ctx, c)
+	}
+	reportEvent(ctx, getMiss)
+
+	if bc.upstream == nil {
+		return nil, blockstore.ErrNotFound
+	}
+	blk, err := bc.upstream.Get(ctx, c)
+	if err == nil && bc.writes != nil {
+		bc.fill(ctx, blk)
+	}
+	return blk, err
+}
+
+// GetRange reads part of a block using a ranged GET. Partial data can't be verified against the cid so it
+// is never used to fill a cache.
+func (bc *S3BlockCache) GetRange(ctx context.Context, c cid.Cid, offset int64, length int64) ([]byte, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	ctx = cacheContext(ctx, bc.name)
+	reportEvent(ctx, getRequest)
+	stop := startTimer(ctx, getDuration)
+	defer stop()
+
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		if length == 0 {
+			return []byte{}, nil
+		}
+		rng = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	out, err := bc.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(bc.loc.Bucket),
+		Key:          aws.String(bc.loc.key(c)),
+		Range:        aws.String(rng),
+		RequestPayer: bc.requestPayer(),
+	})
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		if err == nil {
+			reportEvent(ctx, getHit)
+			reportSize(ctx, getSize, len(data))
+			return data, nil
+		}
+	}
+
+	var rf awserr.RequestFailure
+	if errors.As(err, &rf) && rf.StatusCode() == http.StatusRequestedRangeNotSatisfiable {
+		reportEvent(ctx, getHit)
+		return []byte{}, nil
+	}
+	if !isS3NotFound(err) {
+		reportEvent(ctx, getFailure)
+		if bc.upstream == nil {
+			return nil, err
+		}
+		return getBlockRange(ctx, bc.upstream, c, offset, length)
+	}
+
+	reportEvent(ctx, getMiss)
+	if bc.upstream == nil {
+		return nil, blockstore.ErrNotFound
+	}
+	return getBlockRange(ctx, bc.upstream, c, offset, length)
+}
+
+// fill writes a block that was missing from the bucket in the background. Blocks are only written if their
+// data matches their cid.
+func (bc *S3BlockCache) fill(ctx context.Context, blk blocks.Block) {
+	ctx = fillContext(ctx)
+	reportEvent(ctx, fillRequest)
+
+	chkc, err := blk.Cid().Prefix().Sum(blk.RawData())
+	if err != nil {
+		reportFillFailure(ctx, fillReasonHashUnsupported)
+		return
+	}
+	if !chkc.Equals(blk.Cid()) {
+		reportFillFailure(ctx, fillReasonHashMismatch)
+		return
+	}
+
+	select {
+	case bc.writes <- struct{}{}:
+	default:
+		reportFillFailure(ctx, fillReasonBusy)
+		return
+	}
+
+	// The write outlives the request so only the request's tags are kept
+	wctx := tag.NewContext(context.Background(), tag.FromContext(ctx))
+	go func() {
+		defer func() { <-bc.writes }()
+		stop := startTimer(wctx, fillDuration)
+		defer stop()
+		_, err := bc.uploader.UploadWithContext(wctx, &s3manager.UploadInput{
+			Bucket:       aws.String(bc.loc.Bucket),
+			Key:          aws.String(bc.loc.key(blk.Cid())),
+			Body:         bytes.NewReader(blk.RawData()),
+			ContentType:  aws.String("application/octet-stream"),
+			RequestPayer: bc.requestPayer(),
+		})
+		if err != nil {
+			reportFillFailure(wctx, fillReasonInsertError)
+			return
+		}
+		reportEvent(wctx, fillSuccess)
+		reportSize(wctx, fillSize, len(blk.RawData()))
+	}()
+}
+
+func (bc *S3BlockCache) SetUpstream(u BlockCache) {
+	bc.upstream = u
+}
+
+// isS3NotFound reports whether err shows that an object does not exist in the bucket.
+func isS3NotFound(err error) bool {
+	var rf awserr.RequestFailure
+	if errors.As(err, &rf) && rf.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	var ae awserr.Error
+	if errors.As(err, &ae) {
+		switch ae.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
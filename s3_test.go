@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// testS3Server is an S3 compatible server holding objects in memory, addressed by path. It supports ranged
+// GETs and single part uploads and records the ranges requested.
+type testS3Server struct {
+	mu      sync.Mutex
+	objects map[string][]byte // keyed by bucket/key
+	ranges  []string
+	faults  int // number of requests to fail with a server error before serving normally
+}
+
+func (s *testS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.faults > 0 {
+		s.faults--
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>InternalError</Code><Message>try again</Message></Error>`)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		s.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+		return
+	case http.MethodHead, http.MethodGet:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, ok := s.objects[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+		}
+		return
+	}
+
+	rng := r.Header.Get("Range")
+	if rng == "" || r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+		return
+	}
+	s.ranges = append(s.ranges, rng)
+
+	var start, end int
+	if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+		end = len(data) - 1
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &start); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if start >= len(data) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>InvalidRange</Code><Message>invalid range</Message></Error>`)
+		return
+	}
+	if end >= len(data) {
+		end = len(data) - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+	w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(data[start : end+1])
+}
+
+func (s *testS3Server) put(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+}
+
+func (s *testS3Server) object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	return data, ok
+}
+
+func (s *testS3Server) requestedRanges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.ranges...)
+}
+
+// testUpstream is a BlockCache holding blocks in memory.
+type testUpstream struct {
+	memBlockstore
+}
+
+func (u *testUpstream) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	_, ok := u.memBlockstore[c]
+	return ok, nil
+}
+
+func (u *testUpstream) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return u.memBlockstore.Get(c)
+}
+
+func (u *testUpstream) SetUpstream(BlockCache) {}
+
+func newTestS3Cache(t *testing.T, opts S3Options) (*S3BlockCache, *testS3Server) {
+	t.Helper()
+	srv := &testS3Server{objects: map[string][]byte{}}
+	hs := httptest.NewServer(srv)
+	t.Cleanup(hs.Close)
+
+	opts.Timeout = 5 * time.Second
+	opts.Credentials = &AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+	bc, err := NewS3BlockCache(S3Location{Bucket: "blocks", Endpoint: hs.URL, Prefix: "/chain/"}, CacheLayerS3, opts)
+	if err != nil {
+		t.Fatalf("NewS3BlockCache: %v", err)
+	}
+	return bc, srv
+}
+
+func TestS3BlockCacheGet(t *testing.T) {
+	ctx := context.Background()
+	bc, srv := newTestS3Cache(t, S3Options{PartSize: 1024, Concurrency: 3, Retries: 2})
+
+	data := bytes.Repeat([]byte("0123456789"), 500)
+	blk := blocks.NewBlock(data)
+	srv.put("blocks/chain/"+blk.Cid().String()+"/data.raw", data)
+	srv.faults = 1 // retried by the sdk
+
+	got, err := bc.Get(ctx, blk.Cid())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got.RawData(), data) {
+		t.Fatalf("Get returned %d bytes, wanted %d", len(got.RawData()), len(data))
+	}
+	if n := len(srv.requestedRanges()); n != 5 {
+		t.Errorf("block of %d bytes was downloaded in %d ranges %v, wanted 5", len(data), n, srv.requestedRanges())
+	}
+
+	part, err := bc.GetRange(ctx, blk.Cid(), 5, 10)
+	if err != nil {
+		t.Fatalf("GetRange: %v", err)
+	}
+	if string(part) != "5678901234" {
+		t.Errorf("GetRange returned %q, wanted %q", part, "5678901234")
+	}
+	part, err = bc.GetRange(ctx, blk.Cid(), int64(len(data)), 10)
+	if err != nil || len(part) != 0 {
+		t.Errorf("GetRange beyond the end returned %q, %v, wanted no data", part, err)
+	}
+
+	has, err := bc.Has(ctx, blk.Cid())
+	if err != nil || !has {
+		t.Errorf("Has returned %v, %v, wanted true", has, err)
+	}
+
+	missing := blocks.NewBlock([]byte("missing"))
+	if _, err := bc.Get(ctx, missing.Cid()); err != blockstore.ErrNotFound {
+		t.Errorf("Get of a missing block returned error %v, wanted %v", err, blockstore.ErrNotFound)
+	}
+	has, err = bc.Has(ctx, missing.Cid())
+	if err != nil || has {
+		t.Errorf("Has of a missing block returned %v, %v, wanted false", has, err)
+	}
+}
+
+func TestS3BlockCacheWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	bc, srv := newTestS3Cache(t, S3Options{WriteThrough: true})
+	upstream := &testUpstream{memBlockstore{}}
+	bc.SetUpstream(upstream)
+
+	blk := blocks.NewBlock([]byte("held upstream"))
+	upstream.Put(blk)
+
+	got, err := bc.Get(ctx, blk.Cid())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got.RawData(), blk.RawData()) {
+		t.Fatalf("Get returned %q, wanted %q", got.RawData(), blk.RawData())
+	}
+
+	key := "blocks/chain/" + blk.Cid().String() + "/data.raw"
+	waitFor(t, "write through to the bucket", func() bool {
+		_, ok := srv.object(key)
+		return ok
+	})
+	if data, _ := srv.object(key); !bytes.Equal(data, blk.RawData()) {
+		t.Errorf("bucket holds %q, wanted %q", data, blk.RawData())
+	}
+}
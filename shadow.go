@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/lotus/api/apistruct"
+	"github.com/go-logr/logr"
+	"go.opencensus.io/tag"
+)
+
+// shadowConcurrency is the maximum number of shadowed calls in flight. Calls sampled while this many are in
+// flight are dropped so that a slow secondary cannot hold resources of the proxy.
+const shadowConcurrency = 64
+
+// shadowSkipMethods are methods that return channels, which cannot be called over plain http.
+var shadowSkipMethods = map[string]bool{
+	"ChainNotify":        true,
+	"ChainNotifyFrom":    true,
+	"MpoolSub":           true,
+	"SyncIncomingBlocks": true,
+}
+
+// RequestShadow is method middleware that copies a sample of calls to a secondary lotus-cpr, such as a
+// standby whose cache should be kept warm or a new build being tried against production traffic. Shadowed
+// calls are sent in the background after the call is accepted and their results are discarded, so they
+// never delay or alter the response to the client. Only methods requiring read permission are shadowed
+// since calls that mutate state, such as MpoolPush, must not be repeated.
+type RequestShadow struct {
+	url    string
+	token  string
+	sample float64
+	hc     *http.Client
+	sem    chan struct{}
+	nextID int64 // atomic
+	logger logr.Logger
+}
+
+// NewRequestShadow creates middleware that sends the given fraction of calls to the rpc endpoint at url,
+// presenting token as a bearer token if it is not empty.
+func NewRequestShadow(url string, token string, sample float64, timeout time.Duration, logger logr.Logger) (*RequestShadow, error) {
+	if sample <= 0 || sample > 1 {
+		return nil, fmt.Errorf("sample must be greater than 0 and no more than 1")
+	}
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	return &RequestShadow{
+		url:    url,
+		token:  token,
+		sample: sample,
+		hc:     &http.Client{Timeout: timeout},
+		sem:    make(chan struct{}, shadowConcurrency),
+		logger: logger.V(LogLevelInfo),
+	}, nil
+}
+
+func (s *RequestShadow) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		if call.Perm != apistruct.PermRead || shadowSkipMethods[call.Method] || rand.Float64() >= s.sample {
+			return next(ctx, call)
+		}
+
+		mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+		// Encode the params before the call in case the handler modifies them
+		body, err := json.Marshal(struct {
+			JSONRPC string        `json:"jsonrpc"`
+			ID      int64         `json:"id"`
+			Method  string        `json:"method"`
+			Params  []interface{} `json:"params"`
+		}{
+			JSONRPC: "2.0",
+			ID:      atomic.AddInt64(&s.nextID, 1),
+			Method:  "Filecoin." + call.Method,
+			Params:  call.Params,
+		})
+		if err != nil {
+			reportEvent(mctx, shadowFailed)
+			return next(ctx, call)
+		}
+
+		select {
+		case s.sem <- struct{}{}:
+			// The shadowed call must not be cancelled when the client's call completes
+			sctx := tag.NewContext(context.Background(), tag.FromContext(mctx))
+			go func() {
+				defer func() { <-s.sem }()
+				s.send(sctx, call.Method, body)
+			}()
+		default:
+			reportEvent(mctx, shadowDropped)
+		}
+
+		return next(ctx, call)
+	}
+}
+
+// send posts an encoded call to the secondary, discarding the response.
+func (s *RequestShadow) send(ctx context.Context, method string, body []byte) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		reportEvent(ctx, shadowFailed)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.hc.Do(req)
+	if err != nil {
+		s.logger.Info("Shadowed call failed", "method", method, "error", err.Error())
+		reportEvent(ctx, shadowFailed)
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.logger.Info("Shadowed call failed", "method", method, "status", resp.Status)
+		reportEvent(ctx, shadowFailed)
+		return
+	}
+	reportEvent(ctx, shadowSent)
+}
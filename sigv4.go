@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigv4Algorithm       = "AWS4-HMAC-SHA256"
+	sigv4UnsignedPayload = "UNSIGNED-PAYLOAD"
+	sigv4TimeFormat      = "20060102T150405Z"
+	sigv4DateFormat      = "20060102"
+)
+
+// AWSCredentials holds the credentials used to sign requests with AWS signature version 4.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // optional, only needed for temporary credentials
+}
+
+// sigv4Signer signs http requests using AWS signature version 4. Payloads are not included in
+// the signature which is permitted by S3 and avoids buffering request bodies.
+type sigv4Signer struct {
+	creds   AWSCredentials
+	region  string
+	service string
+	now     func() time.Time
+}
+
+func newSigV4Signer(creds AWSCredentials, region string, service string) *sigv4Signer {
+	return &sigv4Signer{
+		creds:   creds,
+		region:  region,
+		service: service,
+		now:     time.Now,
+	}
+}
+
+// Sign adds the authorization headers to the request. Any headers that must be covered by the
+// signature, such as x-amz-request-payer, must be set before calling Sign.
+func (s *sigv4Signer) Sign(req *http.Request) {
+	t := s.now().UTC()
+	amzDate := t.Format(sigv4TimeFormat)
+	date := t.Format(sigv4DateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", sigv4UnsignedPayload)
+	if s.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	signed := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "authorization" {
+			continue
+		}
+		if lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			signed[lk] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k)
+		canonicalHeaders.WriteString(":")
+		canonicalHeaders.WriteString(signed[k])
+		canonicalHeaders.WriteString("\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		sigv4CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sigv4UnsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/" + s.service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		sigv4Algorithm,
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.creds.SecretAccessKey), []byte(date))
+	key = hmacSHA256(key, []byte(s.region))
+	key = hmacSHA256(key, []byte(s.service))
+	key = hmacSHA256(key, []byte("aws4_request"))
+	signature := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+
+	req.Header.Set("Authorization", sigv4Algorithm+" Credential="+s.creds.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sigv4CanonicalQuery(v url.Values) string {
+	if len(v) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := append([]string(nil), v[k]...)
+		sort.Strings(vs)
+		for _, val := range vs {
+			parts = append(parts, sigv4Escape(k)+"="+sigv4Escape(val))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// sigv4Escape encodes a string using the rules required by AWS which differ from url.QueryEscape
+// in the handling of spaces and tildes.
+func sigv4Escape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(url.QueryEscape(s), "+", "%20"), "%7E", "~")
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/tag"
+)
+
+var ErrResponseTooLarge = errors.New("response exceeds maximum size")
+
+// ResponseSizeLimits is method middleware that refuses to return responses larger than a maximum size,
+// protecting the proxy and its clients from unexpectedly large transfers. Limits are keyed by method name,
+// with the limit keyed by * applying to methods without their own limit.
+type ResponseSizeLimits map[string]int
+
+// ParseResponseSizeLimits parses a list of limits of the form method=bytes, such as ChainReadObj=1048576.
+// A method of * sets the limit for every method without its own limit.
+func ParseResponseSizeLimits(specs []string) (ResponseSizeLimits, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	l := ResponseSizeLimits{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid limit %q, expected method=bytes", spec)
+		}
+		size, err := strconv.Atoi(parts[1])
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size in limit %q", spec)
+		}
+		l[parts[0]] = size
+	}
+	return l, nil
+}
+
+// limit returns the maximum response size for the method, zero if there is none.
+func (l ResponseSizeLimits) limit(method string) int {
+	if size, ok := l[method]; ok {
+		return size
+	}
+	return l["*"]
+}
+
+func (l ResponseSizeLimits) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		res, err := next(ctx, call)
+		max := l.limit(call.Method)
+		if err != nil || res == nil || max == 0 {
+			return res, err
+		}
+
+		size, ok := responseSize(res)
+		if !ok || size <= max {
+			return res, nil
+		}
+		mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+		reportEvent(mctx, responseTooLarge)
+		return nil, fmt.Errorf("%w: %s response is %d bytes, limit is %d bytes", ErrResponseTooLarge, call.Method, size, max)
+	}
+}
+
+// responseSize returns the size of a response. Byte slices, such as those returned by ChainReadObj, are
+// measured by their length and other responses by their JSON encoding. Channels are not measured.
+func responseSize(res interface{}) (int, bool) {
+	if b, ok := res.([]byte); ok {
+		return len(b), true
+	}
+	if reflect.TypeOf(res).Kind() == reflect.Chan {
+		return 0, false
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		return 0, false
+	}
+	return len(data), true
+}
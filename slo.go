@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opencensus.io/tag"
+)
+
+var sloTag, _ = tag.NewKey("slo")
+
+// LatencySLOs is method middleware that counts the calls to each method taking longer than a latency
+// objective, so that operators can alert on breaches seen by clients rather than on latency distributions.
+// Objectives are keyed by a method name, a class of methods given by a name prefix ending in * such as
+// State*, or * for every method without a more specific objective.
+type LatencySLOs struct {
+	methods  map[string]time.Duration
+	prefixes []string // prefixes of method classes, longest first
+	classes  map[string]time.Duration
+}
+
+// ParseLatencySLOs parses a list of objectives of the form method=duration, such as ChainReadObj=50ms or
+// State*=2s.
+func ParseLatencySLOs(specs []string) (*LatencySLOs, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	s := &LatencySLOs{
+		methods: map[string]time.Duration{},
+		classes: map[string]time.Duration{},
+	}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid objective %q, expected method=duration", spec)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration in objective %q", spec)
+		}
+		if strings.HasSuffix(parts[0], "*") {
+			prefix := strings.TrimSuffix(parts[0], "*")
+			if _, exists := s.classes[prefix]; !exists {
+				s.prefixes = append(s.prefixes, prefix)
+			}
+			s.classes[prefix] = d
+			continue
+		}
+		s.methods[parts[0]] = d
+	}
+	sort.Slice(s.prefixes, func(i, j int) bool { return len(s.prefixes[i]) > len(s.prefixes[j]) })
+	return s, nil
+}
+
+// objective returns the latency objective for the method and the name of the objective, false if the method
+// has none.
+func (s *LatencySLOs) objective(method string) (time.Duration, string, bool) {
+	if d, ok := s.methods[method]; ok {
+		return d, method, true
+	}
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(method, prefix) {
+			return s.classes[prefix], prefix + "*", true
+		}
+	}
+	return 0, "", false
+}
+
+func (s *LatencySLOs) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		max, name, ok := s.objective(call.Method)
+		if !ok {
+			return next(ctx, call)
+		}
+
+		start := time.Now()
+		res, err := next(ctx, call)
+		mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method), tag.Upsert(sloTag, name))
+		reportEvent(mctx, sloRequest)
+		if time.Since(start) > max {
+			reportEvent(mctx, sloBreach)
+		}
+		return res, err
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// slowStartPollInterval is the time between checks of whether a call waiting for admission may proceed.
+const slowStartPollInterval = 20 * time.Millisecond
+
+// SlowStart limits the number of concurrent calls to a lotus node for a period after its circuit closes,
+// raising the limit linearly from one call to the full concurrency of the circuit. This stops the backlog of
+// calls that built up while the circuit was open from overwhelming a node that has just recovered and
+// tripping the circuit again. Calls over the limit wait until a call completes or their context is done.
+type SlowStart struct {
+	period time.Duration
+	max    int
+
+	mu       sync.Mutex // guards fields below
+	start    time.Time  // time the ramp started, zero when no ramp is in progress
+	inflight int
+}
+
+func NewSlowStart(period time.Duration, maxConcurrency int) *SlowStart {
+	return &SlowStart{
+		period: period,
+		max:    maxConcurrency,
+	}
+}
+
+// Begin starts raising the limit from one call.
+func (s *SlowStart) Begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = time.Now()
+}
+
+// Cancel ends the ramp, admitting every waiting call.
+func (s *SlowStart) Cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = time.Time{}
+}
+
+// limit returns the number of concurrent calls allowed, false if calls are not being limited. The caller
+// must hold s.mu.
+func (s *SlowStart) limit() (int, bool) {
+	if s.start.IsZero() {
+		return 0, false
+	}
+	elapsed := time.Since(s.start)
+	if elapsed >= s.period {
+		s.start = time.Time{}
+		return 0, false
+	}
+	return 1 + int(int64(s.max-1)*int64(elapsed)/int64(s.period)), true
+}
+
+// Acquire waits until the call may be made, returning the context's error if it is done first. The
+// returned function must be called when the call completes.
+func (s *SlowStart) Acquire(ctx context.Context) (func(), error) {
+	waited := false
+	for {
+		s.mu.Lock()
+		limit, limited := s.limit()
+		if !limited || s.inflight < limit {
+			s.inflight++
+			s.mu.Unlock()
+			if waited {
+				reportEvent(ctx, upstreamAdmissionDelayed)
+			}
+			return s.release, nil
+		}
+		s.mu.Unlock()
+
+		waited = true
+		select {
+		case <-ctx.Done():
+			reportEvent(ctx, upstreamAdmissionRejected)
+			return nil, ctx.Err()
+		case <-time.After(slowStartPollInterval):
+		}
+	}
+}
+
+func (s *SlowStart) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/prometheus"
 	"github.com/go-logr/logr"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
 	prom "github.com/prometheus/client_golang/prometheus"
 	"go.opencensus.io/metric/metricdata"
 	"go.opencensus.io/metric/metricexport"
@@ -22,7 +25,14 @@ var (
 	blockSizeDistributionBytes = view.Distribution(1<<7, 1<<8, 1<<9, 1<<10, 1<<11, 1<<12, 1<<13, 1<<14, 1<<15, 1<<16, 1<<18, 1<<19, 1<<20, 1<<21, 1<<22, 1<<23, 1<<24, 1<<25)
 )
 
-var cacheTag, _ = tag.NewKey("cache")
+var (
+	cacheTag, _  = tag.NewKey("cache")
+	methodTag, _ = tag.NewKey("method")
+	reasonTag, _ = tag.NewKey("reason")
+	mirrorTag, _ = tag.NewKey("mirror")
+	peerTag, _   = tag.NewKey("peer")
+	originTag, _ = tag.NewKey("origin")
+)
 
 var (
 	fillDuration = stats.Float64("fill_duration_ms", "Time taken to fill the cache with a block", stats.UnitMilliseconds)
@@ -32,6 +42,24 @@ var (
 	fillSuccess  = stats.Int64("fill_success", "Number of successful fills", stats.UnitDimensionless)
 	fillZero     = stats.Int64("fill_zero", "Number of zero sized blocks ignored", stats.UnitDimensionless)
 
+	servedZero     = stats.Int64("served_zero_block", "Number of zero sized blocks served by ChainReadObj", stats.UnitDimensionless)
+	servedIdentity = stats.Int64("served_identity_block", "Number of blocks with identity hashed cids served by ChainReadObj", stats.UnitDimensionless)
+
+	fillThrottled        = stats.Int64("fill_throttled", "Number of reads from the lotus node delayed by fill limits", stats.UnitDimensionless)
+	fillThrottleDuration = stats.Float64("fill_throttle_duration_ms", "Time reads from the lotus node were delayed by fill limits", stats.UnitMilliseconds)
+	nodeVerifyFailure    = stats.Int64("node_verify_failure", "Number of reads from the lotus node refused because the data did not match the cid", stats.UnitDimensionless)
+
+	nodePruned         = stats.Int64("node_pruned", "Whether the lotus node has discarded historical data (0: no, 1: yes)", stats.UnitDimensionless)
+	historyUnavailable = stats.Int64("history_unavailable", "Number of requests for historical data discarded by the lotus node that no cache tier held", stats.UnitDimensionless)
+
+	missQueuePromoted = stats.Int64("miss_queue_promoted", "Number of cids queued for fetching after repeatedly missing every cache tier and the lotus node", stats.UnitDimensionless)
+	missQueueLength   = stats.Int64("miss_queue_length", "Number of cids waiting in the miss queue to be fetched", stats.UnitDimensionless)
+
+	nodeMissingHit      = stats.Int64("node_missing_hit", "Number of requests for blocks known to be missing from the lotus node that were not passed to it", stats.UnitDimensionless)
+	nodeMissingRecorded = stats.Int64("node_missing_recorded", "Number of blocks recorded as permanently missing from the lotus node", stats.UnitDimensionless)
+
+	nodeNegativeHit = stats.Int64("node_negative_hit", "Number of requests for blocks recently reported missing by the lotus node that were not passed to it", stats.UnitDimensionless)
+
 	getDuration = stats.Float64("get_duration_ms", "Time taken to get a block via the cache", stats.UnitMilliseconds)
 	getSize     = stats.Int64("get_size_bytes", "Size of block retrieved for get", stats.UnitBytes)
 	getRequest  = stats.Int64("get_request", "Number of get requests", stats.UnitDimensionless)
@@ -39,12 +67,108 @@ var (
 	getHit      = stats.Int64("get_hit", "Number of get requests that were satisfied from the cache", stats.UnitDimensionless)
 	getFailure  = stats.Int64("get_failure", "Number of get requests that failed", stats.UnitDimensionless)
 
+	lifetimeGetRequest  = stats.Int64("lifetime_get_request", "Number of get requests over the lifetime of the store", stats.UnitDimensionless)
+	lifetimeGetHit      = stats.Int64("lifetime_get_hit", "Number of get requests satisfied from the cache over the lifetime of the store", stats.UnitDimensionless)
+	lifetimeGetMiss     = stats.Int64("lifetime_get_miss", "Number of get requests that were not in the cache over the lifetime of the store", stats.UnitDimensionless)
+	lifetimeGetSize     = stats.Int64("lifetime_get_size_bytes", "Size of blocks retrieved for get over the lifetime of the store", stats.UnitBytes)
+	lifetimeFillSuccess = stats.Int64("lifetime_fill_success", "Number of successful fills over the lifetime of the store", stats.UnitDimensionless)
+	lifetimeFillSize    = stats.Int64("lifetime_fill_size_bytes", "Size of blocks retrieved for fill over the lifetime of the store", stats.UnitBytes)
+
+	cacheTierEnabled = stats.Int64("cache_tier_enabled", "Whether a cache tier is serving requests (1) or has been disabled (0)", stats.UnitDimensionless)
+
+	memoryBlockCount = stats.Int64("memory_block_count", "Number of blocks held by the memory cache", stats.UnitDimensionless)
+	memorySize       = stats.Int64("memory_size_bytes", "Size of the blocks held by the memory cache", stats.UnitBytes)
+
+	httpRaceLaunched  = stats.Int64("http_race_launched", "Number of requests raced against a second blockstore mirror", stats.UnitDimensionless)
+	httpMirrorLatency = stats.Float64("http_mirror_latency_ms", "Rolling average time taken by requests to a blockstore mirror", stats.UnitMilliseconds)
+	httpMirrorErrors  = stats.Float64("http_mirror_error_ratio", "Rolling average fraction of requests to a blockstore mirror that failed", stats.UnitDimensionless)
+
+	peerHit         = stats.Int64("peer_hit", "Number of blocks found by a peer lotus-cpr", stats.UnitDimensionless)
+	peerMiss        = stats.Int64("peer_miss", "Number of blocks not held by a peer lotus-cpr", stats.UnitDimensionless)
+	peerFailure     = stats.Int64("peer_failure", "Number of failed requests to a peer lotus-cpr", stats.UnitDimensionless)
+	peerDuration    = stats.Float64("peer_duration_ms", "Time taken by requests to a peer lotus-cpr", stats.UnitMilliseconds)
+	peerLoopSkipped = stats.Int64("peer_loop_skipped", "Number of block requests not passed to peers because they were made by a peer", stats.UnitDimensionless)
+
+	bitswapPeersConnected = stats.Int64("bitswap_peers_connected", "Number of bitswap peers connected", stats.UnitDimensionless)
+
 	gonudbRecordCount = stats.Int64("gonudb_record_count", "Number of records reported by the gonudb store", stats.UnitDimensionless)
 	gonudbRate        = stats.Float64("gonudb_rate_bytes_per_second", "Data write rate reported by the gonudb store", stats.UnitDimensionless)
 
+	gonudbFlushDuration = stats.Float64("gonudb_flush_duration_ms", "Time taken to flush the gonudb store", stats.UnitMilliseconds)
+	gonudbFlushRecords  = stats.Int64("gonudb_flush_records", "Number of records committed by a flush of the gonudb store", stats.UnitDimensionless)
+	gonudbFlushSize     = stats.Int64("gonudb_flush_size_bytes", "Size of records committed by a flush of the gonudb store", stats.UnitBytes)
+	gonudbFlushFailure  = stats.Int64("gonudb_flush_failure", "Number of failed flushes of the gonudb store", stats.UnitDimensionless)
+	gonudbFlushBacklog  = stats.Int64("gonudb_flush_backlog", "Number of records waiting to be flushed to the gonudb store", stats.UnitDimensionless)
+	gonudbInsertBacklog = stats.Int64("gonudb_insert_backlog", "Number of blocks waiting to be inserted into the gonudb store", stats.UnitDimensionless)
+
+	gonudbSize            = stats.Int64("gonudb_size_bytes", "Size of the gonudb store's data files", stats.UnitBytes)
+	gonudbCeilingUsage    = stats.Float64("gonudb_ceiling_usage_ratio", "Fraction of the gonudb store's record or size ceiling in use, whichever is greater", stats.UnitDimensionless)
+	gonudbCeilingExceeded = stats.Int64("gonudb_ceiling_exceeded", "Whether the gonudb store has exceeded its record or size ceiling (1) or not (0)", stats.UnitDimensionless)
+	gonudbEvictedRecords  = stats.Int64("gonudb_evicted_records", "Number of records in gonudb store generations evicted to keep the store within its limits", stats.UnitDimensionless)
+	gonudbEvictedSize     = stats.Int64("gonudb_evicted_size_bytes", "Size of gonudb store generations evicted to keep the store within its limits", stats.UnitBytes)
+
+	codecRejected       = stats.Int64("codec_rejected", "Number of requests rejected because the object's codec is not allowed", stats.UnitDimensionless)
+	subscriptionDropped = stats.Int64("subscription_dropped", "Number of subscription messages that could not be buffered for a slow subscriber", stats.UnitDimensionless)
+	subscriptionClosed  = stats.Int64("subscription_closed", "Number of subscriptions closed because the subscriber was too slow", stats.UnitDimensionless)
+
 	circuitStatus  = stats.Int64("circuit_status", "Status of the lotus node circuit breaker, 0 when closed, 1 when open", stats.UnitDimensionless)
 	circuitRequest = stats.Int64("circuit_request", "Number of requests through the lotus node circuit breaker", stats.UnitDimensionless)
 	circuitFailure = stats.Int64("circuit_failure", "Number of failed requests through the lotus node circuit breaker", stats.UnitDimensionless)
+	upstreamActive = stats.Int64("upstream_active", "Priority of the lotus node answering calls, 0 for the preferred node and 1 or more for fallbacks", stats.UnitDimensionless)
+
+	upstreamTokenPerm = stats.Int64("upstream_token_perm", "Whether the api token used by the proxy is granted a permission (1) or not (0) by a lotus node", stats.UnitDimensionless)
+
+	headGapDetected   = stats.Int64("head_gap_detected", "Number of gaps detected in the head changes followed by the proxy", stats.UnitDimensionless)
+	headGapBackfilled = stats.Int64("head_gap_backfilled", "Number of tipsets fetched to fill gaps in the head changes followed by the proxy", stats.UnitDimensionless)
+
+	prefetchTipset  = stats.Int64("prefetch_tipset", "Number of tipsets whose headers, messages and receipts were prefetched into the cache", stats.UnitDimensionless)
+	prefetchFailure = stats.Int64("prefetch_failure", "Number of tipsets that could not be prefetched into the cache", stats.UnitDimensionless)
+
+	backfillTipset  = stats.Int64("backfill_tipset", "Number of tipsets backfilled into the cache", stats.UnitDimensionless)
+	backfillBlock   = stats.Int64("backfill_block", "Number of blocks read through the cache by the backfill", stats.UnitDimensionless)
+	backfillMissing = stats.Int64("backfill_missing", "Number of blocks linked from backfilled tipsets that could not be found", stats.UnitDimensionless)
+	backfillFailure = stats.Int64("backfill_failure", "Number of attempts to backfill a tipset that failed", stats.UnitDimensionless)
+	backfillHeight  = stats.Int64("backfill_height", "Height of the last tipset backfilled into the cache", stats.UnitDimensionless)
+
+	storeCoveredEpochs = stats.Int64("store_covered_epochs", "Number of heights whose headers, messages and receipts are all held by the store", stats.UnitDimensionless)
+	storeAbsentSkipped = stats.Int64("store_absent_skipped", "Number of requests answered without searching the cache tiers because the height is known to be absent", stats.UnitDimensionless)
+
+	heightIndexHit  = stats.Int64("height_index_hit", "Number of ChainGetTipSetByHeight calls answered from the height index", stats.UnitDimensionless)
+	heightIndexMiss = stats.Int64("height_index_miss", "Number of ChainGetTipSetByHeight calls passed to the lotus node because the height index could not answer", stats.UnitDimensionless)
+
+	upstreamSent      = stats.Int64("upstream_sent_bytes", "Number of bytes sent to the lotus node over its connection", stats.UnitBytes)
+	upstreamReceived  = stats.Int64("upstream_received_bytes", "Number of bytes received from the lotus node over its connection", stats.UnitBytes)
+	upstreamCancelled = stats.Int64("upstream_cancelled", "Number of requests to the lotus node cancelled because the client disconnected or its deadline passed", stats.UnitDimensionless)
+	invalidParams     = stats.Int64("invalid_params", "Number of rpc calls rejected because their parameters were invalid", stats.UnitDimensionless)
+	responseTooLarge  = stats.Int64("response_too_large", "Number of rpc calls refused because the response exceeded the maximum size for the method", stats.UnitDimensionless)
+	rateLimited       = stats.Int64("rate_limited", "Number of rpc calls rejected because the client exceeded its rate limit for the method", stats.UnitDimensionless)
+	clientEgress      = stats.Int64("client_egress_bytes", "Size of the results served to rpc clients", stats.UnitBytes)
+	methodPanic       = stats.Int64("method_panic", "Number of rpc calls that failed because handling them panicked", stats.UnitDimensionless)
+	requestCancelled  = stats.Int64("request_cancelled", "Number of rpc calls abandoned because the client disconnected or its deadline passed", stats.UnitDimensionless)
+
+	shadowSent    = stats.Int64("shadow_sent", "Number of rpc calls copied to the shadow endpoint", stats.UnitDimensionless)
+	shadowDropped = stats.Int64("shadow_dropped", "Number of sampled rpc calls not copied to the shadow endpoint because too many copies were in flight", stats.UnitDimensionless)
+	shadowFailed  = stats.Int64("shadow_failed", "Number of rpc calls that could not be copied to the shadow endpoint", stats.UnitDimensionless)
+
+	cacheDirectiveRequest = stats.Int64("cache_directive_request", "Number of rpc requests whose Cache-Control header changed how the caches are used", stats.UnitDimensionless)
+
+	tipsetValidationFailed = stats.Int64("tipset_validation_failed", "Number of tipsets assembled from cached headers that failed validation and were read from the lotus node", stats.UnitDimensionless)
+
+	sloRequest = stats.Int64("slo_request", "Number of rpc calls to methods with a latency objective", stats.UnitDimensionless)
+	sloBreach  = stats.Int64("slo_breach", "Number of rpc calls that took longer than the latency objective for the method", stats.UnitDimensionless)
+
+	chainReorg      = stats.Int64("chain_reorg", "Number of chain reorganisations seen in the head changes followed by the proxy", stats.UnitDimensionless)
+	chainReorgDepth = stats.Int64("chain_reorg_depth", "Number of tipsets reverted by a chain reorganisation", stats.UnitDimensionless)
+
+	upstreamAdmissionDelayed  = stats.Int64("upstream_admission_delayed", "Number of requests to the lotus node delayed by the slow start after its circuit closed", stats.UnitDimensionless)
+	upstreamAdmissionRejected = stats.Int64("upstream_admission_rejected", "Number of requests to the lotus node abandoned while waiting for admission during the slow start", stats.UnitDimensionless)
+
+	rpcRequest           = stats.Int64("rpc_request", "Number of rpc calls handled by the proxy", stats.UnitDimensionless)
+	rpcUpstreamFulfilled = stats.Int64("rpc_upstream_fulfilled", "Number of rpc calls answered by calling the lotus node without reading blocks through the caches", stats.UnitDimensionless)
+
+	authzRequest = stats.Int64("authz_request", "Number of rpc calls the authorization service was consulted on", stats.UnitDimensionless)
+	authzDenied  = stats.Int64("authz_denied", "Number of rpc calls denied by the authorization service", stats.UnitDimensionless)
+	authzFailed  = stats.Int64("authz_failed", "Number of rpc calls denied because the authorization service could not be consulted", stats.UnitDimensionless)
 )
 
 func startTimer(ctx context.Context, m *stats.Float64Measure) func() {
@@ -63,6 +187,57 @@ func reportEvent(ctx context.Context, m *stats.Int64Measure) {
 	stats.Record(ctx, m.M(1))
 }
 
+// Reasons for fill failures, used as the value of the reason tag.
+const (
+	fillReasonUpstreamMiss    = "upstream_miss"    // the block was not found upstream
+	fillReasonUpstreamError   = "upstream_error"   // the upstream request failed
+	fillReasonHashMismatch    = "hash_mismatch"    // the upstream data does not match the cid
+	fillReasonHashUnsupported = "hash_unsupported" // the cid's hash function is not supported
+	fillReasonInsertError     = "insert_error"     // the block could not be inserted into the store
+	fillReasonBusy            = "busy"             // too many blocks were already being written to the cache
+)
+
+// Origins of fills, used as the value of the origin tag to attribute store growth and upstream load to the
+// subsystem that requested the blocks.
+const (
+	fillOriginClient   = "client"   // a block requested by an rpc client was missing from the cache
+	fillOriginPrefetch = "prefetch" // the prefetcher read a new tipset
+	fillOriginBackfill = "backfill" // the backfiller walked back through the chain
+	fillOriginGap      = "gap"      // tipsets missed by the head change subscription were fetched
+	fillOriginIndex    = "index"    // the height index read tipsets it had not indexed
+)
+
+// withFillOrigin returns a context that tags the fills made with it with the given origin.
+func withFillOrigin(ctx context.Context, origin string) context.Context {
+	ctx, _ = tag.New(ctx, tag.Upsert(originTag, origin))
+	return ctx
+}
+
+// fillContext returns a context for reporting a fill, tagged as made for a client unless the context already
+// carries an origin. The fill is counted towards the outcome of the call carried by the context.
+func fillContext(ctx context.Context) context.Context {
+	noteFill(ctx)
+	ctx, _ = tag.New(ctx, tag.Insert(originTag, fillOriginClient))
+	return ctx
+}
+
+// reportFillFailure records a failed fill, tagged with the reason it failed.
+func reportFillFailure(ctx context.Context, reason string) {
+	ctx, _ = tag.New(ctx, tag.Upsert(reasonTag, reason))
+	stats.Record(ctx, fillFailure.M(1))
+}
+
+// reportServedBlock counts blocks served that the gonudb store cannot hold: zero sized blocks and blocks
+// whose data is embedded in their identity hashed cid. Both are always read from further upstream.
+func reportServedBlock(ctx context.Context, c cid.Cid, data []byte) {
+	if len(data) == 0 {
+		reportEvent(ctx, servedZero)
+	}
+	if c.Prefix().MhType == multihash.IDENTITY {
+		reportEvent(ctx, servedIdentity)
+	}
+}
+
 func reportSize(ctx context.Context, m *stats.Int64Measure, v int) {
 	stats.Record(ctx, m.M(int64(v)))
 }
@@ -86,7 +261,43 @@ func initMetricReporting(reportingInterval time.Duration) error {
 			Name:        fillFailure.Name() + "_total",
 			Measure:     fillFailure,
 			Aggregation: view.Sum(),
-			TagKeys:     []tag.Key{cacheTag},
+			TagKeys:     []tag.Key{cacheTag, reasonTag},
+		},
+		{
+			Name:        nodePruned.Name(),
+			Measure:     nodePruned,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        historyUnavailable.Name() + "_total",
+			Measure:     historyUnavailable,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        missQueuePromoted.Name() + "_total",
+			Measure:     missQueuePromoted,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        missQueueLength.Name(),
+			Measure:     missQueueLength,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        nodeMissingHit.Name() + "_total",
+			Measure:     nodeMissingHit,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        nodeMissingRecorded.Name() + "_total",
+			Measure:     nodeMissingRecorded,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        nodeNegativeHit.Name() + "_total",
+			Measure:     nodeNegativeHit,
+			Aggregation: view.Sum(),
 		},
 		{
 			Name:        fillSuccess.Name() + "_total",
@@ -100,6 +311,36 @@ func initMetricReporting(reportingInterval time.Duration) error {
 			Aggregation: view.Sum(),
 			TagKeys:     []tag.Key{cacheTag},
 		},
+		{
+			Name:        servedZero.Name() + "_total",
+			Measure:     servedZero,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{clientTag},
+		},
+		{
+			Name:        servedIdentity.Name() + "_total",
+			Measure:     servedIdentity,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{clientTag},
+		},
+		{
+			Name:        fillThrottled.Name() + "_total",
+			Measure:     fillThrottled,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        fillThrottleDuration.Name() + "_total",
+			Measure:     fillThrottleDuration,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        nodeVerifyFailure.Name() + "_total",
+			Measure:     nodeVerifyFailure,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, reasonTag},
+		},
 		{
 			Name:        fillSize.Name() + "_total",
 			Measure:     fillSize,
@@ -174,6 +415,427 @@ func initMetricReporting(reportingInterval time.Duration) error {
 			TagKeys:     []tag.Key{cacheTag},
 		},
 
+		{
+			Name:        lifetimeGetRequest.Name(),
+			Measure:     lifetimeGetRequest,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        lifetimeGetHit.Name(),
+			Measure:     lifetimeGetHit,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        lifetimeGetMiss.Name(),
+			Measure:     lifetimeGetMiss,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        lifetimeGetSize.Name(),
+			Measure:     lifetimeGetSize,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        lifetimeFillSuccess.Name(),
+			Measure:     lifetimeFillSuccess,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        lifetimeFillSize.Name(),
+			Measure:     lifetimeFillSize,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+
+		{
+			Name:        httpRaceLaunched.Name() + "_total",
+			Measure:     httpRaceLaunched,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        httpMirrorLatency.Name(),
+			Measure:     httpMirrorLatency,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag, mirrorTag},
+		},
+		{
+			Name:        httpMirrorErrors.Name(),
+			Measure:     httpMirrorErrors,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag, mirrorTag},
+		},
+		{
+			Name:        peerHit.Name() + "_total",
+			Measure:     peerHit,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, peerTag},
+		},
+		{
+			Name:        peerMiss.Name() + "_total",
+			Measure:     peerMiss,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, peerTag},
+		},
+		{
+			Name:        peerFailure.Name() + "_total",
+			Measure:     peerFailure,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, peerTag},
+		},
+		{
+			Name:        peerDuration.Name(),
+			Measure:     peerDuration,
+			Aggregation: networkIODistributionMs,
+			TagKeys:     []tag.Key{cacheTag, peerTag},
+		},
+		{
+			Name:        bitswapPeersConnected.Name(),
+			Measure:     bitswapPeersConnected,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        peerLoopSkipped.Name() + "_total",
+			Measure:     peerLoopSkipped,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+
+		{
+			Name:        "client_" + getRequest.Name() + "_total",
+			Measure:     getRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, clientTag},
+		},
+		{
+			Name:        "client_" + getMiss.Name() + "_total",
+			Measure:     getMiss,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, clientTag},
+		},
+		{
+			Name:        "client_" + circuitRequest.Name() + "_total",
+			Measure:     circuitRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{clientTag},
+		},
+
+		{
+			Name:        "epoch_" + getRequest.Name() + "_total",
+			Measure:     getRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, epochTag},
+		},
+		{
+			Name:        "epoch_" + getHit.Name() + "_total",
+			Measure:     getHit,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, epochTag},
+		},
+		{
+			Name:        "epoch_" + getDuration.Name(),
+			Measure:     getDuration,
+			Aggregation: networkIODistributionMs,
+			TagKeys:     []tag.Key{cacheTag, epochTag},
+		},
+
+		{
+			Name:        "method_" + getRequest.Name() + "_total",
+			Measure:     getRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, methodTag},
+		},
+		{
+			Name:        "method_" + getHit.Name() + "_total",
+			Measure:     getHit,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, methodTag},
+		},
+		{
+			Name:        "method_" + getDuration.Name(),
+			Measure:     getDuration,
+			Aggregation: networkIODistributionMs,
+			TagKeys:     []tag.Key{cacheTag, methodTag},
+		},
+		{
+			Name:        "method_" + circuitRequest.Name() + "_total",
+			Measure:     circuitRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+
+		{
+			Name:        "origin_" + fillRequest.Name() + "_total",
+			Measure:     fillRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, originTag},
+		},
+		{
+			Name:        "origin_" + fillSuccess.Name() + "_total",
+			Measure:     fillSuccess,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, originTag},
+		},
+		{
+			Name:        "origin_" + fillSize.Name() + "_total",
+			Measure:     fillSize,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag, originTag},
+		},
+
+		{
+			Name:        prefetchTipset.Name() + "_total",
+			Measure:     prefetchTipset,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        prefetchFailure.Name() + "_total",
+			Measure:     prefetchFailure,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        backfillTipset.Name() + "_total",
+			Measure:     backfillTipset,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        backfillBlock.Name() + "_total",
+			Measure:     backfillBlock,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        backfillMissing.Name() + "_total",
+			Measure:     backfillMissing,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        backfillFailure.Name() + "_total",
+			Measure:     backfillFailure,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        backfillHeight.Name(),
+			Measure:     backfillHeight,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        storeCoveredEpochs.Name(),
+			Measure:     storeCoveredEpochs,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        storeAbsentSkipped.Name() + "_total",
+			Measure:     storeAbsentSkipped,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        headGapDetected.Name() + "_total",
+			Measure:     headGapDetected,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        headGapBackfilled.Name() + "_total",
+			Measure:     headGapBackfilled,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        heightIndexHit.Name() + "_total",
+			Measure:     heightIndexHit,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        heightIndexMiss.Name() + "_total",
+			Measure:     heightIndexMiss,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        upstreamSent.Name() + "_total",
+			Measure:     upstreamSent,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{upstreamTag},
+		},
+		{
+			Name:        upstreamReceived.Name() + "_total",
+			Measure:     upstreamReceived,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{upstreamTag},
+		},
+		{
+			Name:        upstreamCancelled.Name() + "_total",
+			Measure:     upstreamCancelled,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{reasonTag},
+		},
+		{
+			Name:        requestCancelled.Name() + "_total",
+			Measure:     requestCancelled,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag, reasonTag},
+		},
+		{
+			Name:        invalidParams.Name() + "_total",
+			Measure:     invalidParams,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        responseTooLarge.Name() + "_total",
+			Measure:     responseTooLarge,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        rateLimited.Name() + "_total",
+			Measure:     rateLimited,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag, clientTag},
+		},
+		{
+			Name:        shadowSent.Name() + "_total",
+			Measure:     shadowSent,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        shadowDropped.Name() + "_total",
+			Measure:     shadowDropped,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        shadowFailed.Name() + "_total",
+			Measure:     shadowFailed,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        tipsetValidationFailed.Name() + "_total",
+			Measure:     tipsetValidationFailed,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        sloRequest.Name() + "_total",
+			Measure:     sloRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag, sloTag},
+		},
+		{
+			Name:        sloBreach.Name() + "_total",
+			Measure:     sloBreach,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag, sloTag},
+		},
+		{
+			Name:        chainReorg.Name() + "_total",
+			Measure:     chainReorg,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        chainReorgDepth.Name(),
+			Measure:     chainReorgDepth,
+			Aggregation: view.Distribution(1, 2, 3, 4, 5, 10, 20, 50, 100, 500),
+		},
+		{
+			Name:        rpcRequest.Name() + "_total",
+			Measure:     rpcRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        rpcUpstreamFulfilled.Name() + "_total",
+			Measure:     rpcUpstreamFulfilled,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        authzRequest.Name() + "_total",
+			Measure:     authzRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        authzDenied.Name() + "_total",
+			Measure:     authzDenied,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        authzFailed.Name() + "_total",
+			Measure:     authzFailed,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        upstreamAdmissionDelayed.Name() + "_total",
+			Measure:     upstreamAdmissionDelayed,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        upstreamAdmissionRejected.Name() + "_total",
+			Measure:     upstreamAdmissionRejected,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        cacheDirectiveRequest.Name() + "_total",
+			Measure:     cacheDirectiveRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{reasonTag, clientTag},
+		},
+		{
+			Name:        clientEgress.Name() + "_total",
+			Measure:     clientEgress,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{clientTag},
+		},
+		{
+			Name:        methodPanic.Name() + "_total",
+			Measure:     methodPanic,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        codecRejected.Name() + "_total",
+			Measure:     codecRejected,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        subscriptionDropped.Name() + "_total",
+			Measure:     subscriptionDropped,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        subscriptionClosed.Name() + "_total",
+			Measure:     subscriptionClosed,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+
+		{
+			Name:        cacheTierEnabled.Name(),
+			Measure:     cacheTierEnabled,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+		{
+			Name:        memoryBlockCount.Name(),
+			Measure:     memoryBlockCount,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        memorySize.Name(),
+			Measure:     memorySize,
+			Aggregation: view.LastValue(),
+		},
 		{
 			Name:        gonudbRecordCount.Name(),
 			Measure:     gonudbRecordCount,
@@ -184,12 +846,83 @@ func initMetricReporting(reportingInterval time.Duration) error {
 			Measure:     gonudbRate,
 			Aggregation: view.LastValue(),
 		},
+		{
+			Name:        gonudbFlushDuration.Name(),
+			Measure:     gonudbFlushDuration,
+			Aggregation: networkIODistributionMs,
+		},
+		{
+			Name:        gonudbFlushDuration.Name() + "_total",
+			Measure:     gonudbFlushDuration,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        gonudbFlushRecords.Name() + "_total",
+			Measure:     gonudbFlushRecords,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        gonudbFlushSize.Name() + "_total",
+			Measure:     gonudbFlushSize,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        gonudbFlushFailure.Name() + "_total",
+			Measure:     gonudbFlushFailure,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        gonudbFlushBacklog.Name(),
+			Measure:     gonudbFlushBacklog,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        gonudbInsertBacklog.Name(),
+			Measure:     gonudbInsertBacklog,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        gonudbSize.Name(),
+			Measure:     gonudbSize,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        gonudbCeilingUsage.Name(),
+			Measure:     gonudbCeilingUsage,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        gonudbCeilingExceeded.Name(),
+			Measure:     gonudbCeilingExceeded,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        gonudbEvictedRecords.Name() + "_total",
+			Measure:     gonudbEvictedRecords,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        gonudbEvictedSize.Name() + "_total",
+			Measure:     gonudbEvictedSize,
+			Aggregation: view.Sum(),
+		},
 
 		{
 			Name:        circuitStatus.Name(),
 			Measure:     circuitStatus,
 			Aggregation: view.LastValue(),
 		},
+		{
+			Name:        upstreamActive.Name(),
+			Measure:     upstreamActive,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        upstreamTokenPerm.Name(),
+			Measure:     upstreamTokenPerm,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{upstreamTag, permTag},
+		},
 		{
 			Name:        circuitRequest.Name() + "_total",
 			Measure:     circuitRequest,
@@ -205,13 +938,16 @@ func initMetricReporting(reportingInterval time.Duration) error {
 	return view.Register(metricViews...)
 }
 
-func registerPrometheusExporter(namespace string) (*prometheus.Exporter, error) {
+// registerPrometheusExporter registers an exporter for the metric views. Metric names are prefixed
+// by namespace and every metric, including go runtime and process metrics, carries the constant labels.
+func registerPrometheusExporter(namespace string, labels prom.Labels) (*prometheus.Exporter, error) {
 	registry := prom.NewRegistry()
-	registry.MustRegister(prom.NewGoCollector(), prom.NewProcessCollector(prom.ProcessCollectorOpts{}))
+	prom.WrapRegistererWith(labels, registry).MustRegister(prom.NewGoCollector(), prom.NewProcessCollector(prom.ProcessCollectorOpts{}))
 
 	pe, err := prometheus.NewExporter(prometheus.Options{
-		Namespace: namespace,
-		Registry:  registry,
+		Namespace:   namespace,
+		Registry:    registry,
+		ConstLabels: labels,
 	})
 	if err != nil {
 		return nil, err
@@ -222,6 +958,21 @@ func registerPrometheusExporter(namespace string) (*prometheus.Exporter, error)
 	return pe, nil
 }
 
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseMetricLabels parses constant metric labels given in the form "name=value".
+func parseMetricLabels(ls []string) (prom.Labels, error) {
+	labels := prom.Labels{}
+	for _, l := range ls {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || !metricNameRe.MatchString(parts[0]) || strings.HasPrefix(parts[0], "__") {
+			return nil, fmt.Errorf("invalid metric label %q, expected form \"name=value\"", l)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
 func NewMetricLogger(logger logr.Logger) *MetricLogger {
 	return &MetricLogger{
 		logger: logger,
@@ -246,6 +997,10 @@ func (l *MetricLogger) ExportMetrics(ctx context.Context, metrics []*metricdata.
 	counts := map[string]map[string]int64{}
 
 	for _, m := range metrics {
+		// Per-client, per-origin, per-epoch and per-method breakdowns are too detailed for the log summary
+		if strings.HasPrefix(m.Descriptor.Name, "client_") || strings.HasPrefix(m.Descriptor.Name, "origin_") || strings.HasPrefix(m.Descriptor.Name, "epoch_") || strings.HasPrefix(m.Descriptor.Name, "method_") {
+			continue
+		}
 		for _, ts := range m.TimeSeries {
 			labels := make([]string, 0, len(ts.LabelValues))
 			for _, lv := range ts.LabelValues {
@@ -288,6 +1043,11 @@ func (l *MetricLogger) ExportMetrics(ctx context.Context, metrics []*metricdata.
 			if _, exists := c["fill_request_total"]; exists {
 				l.logger.Info(lbl, "fills", c["fill_request_total"], "fill_bytes", c["fill_size_bytes_total"])
 			}
+
+			if _, exists := c["lifetime_get_request"]; exists {
+				lifetimeHitRate := float64(c["lifetime_get_hit"]) / float64(c["lifetime_get_request"])
+				l.logger.Info(lbl, "lifetime_requests", c["lifetime_get_request"], "lifetime_hits", c["lifetime_get_hit"], "lifetime_hit_rate", fmt.Sprintf("%0.2f", lifetimeHitRate), "lifetime_fills", c["lifetime_fill_success"], "lifetime_fill_bytes", c["lifetime_fill_size_bytes"])
+			}
 		} else if _, exists := c["gonudb_record_count"]; exists {
 			l.logger.Info("gonudb", "records", c["gonudb_record_count"])
 		}
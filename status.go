@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/go-logr/logr"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricexport"
+)
+
+// statusTopCIDs is the number of most requested cids included in the status.
+const statusTopCIDs = 10
+
+// statusTopClients is the number of clients served the most bytes included in the status.
+const statusTopClients = 20
+
+// statusHeadTimeout is the maximum time to wait for the upstream node when fetching the chain head for a status report.
+const statusHeadTimeout = 5 * time.Second
+
+// Circuit states reported in the status.
+const (
+	CircuitClosed       = "closed"
+	CircuitOpen         = "open"
+	CircuitHalfOpen     = "half-open"
+	CircuitDisconnected = "disconnected"
+)
+
+// Status is a snapshot of the health of the proxy.
+type Status struct {
+	Time         time.Time               `json:"time"`
+	HeadHeight   int64                   `json:"head_height"`          // height of the upstream node's chain head, -1 if unknown
+	HeadLag      float64                 `json:"head_lag_seconds"`     // seconds since the timestamp of the chain head
+	HeadError    string                  `json:"head_error,omitempty"` // error fetching the chain head, if any
+	Circuit      string                  `json:"circuit"`              // state of the upstream circuit breaker
+	Upstream     string                  `json:"upstream,omitempty"`   // address of the lotus node answering calls
+	InFlight     int64                   `json:"in_flight"`            // number of rpc calls being handled
+	Caches       map[string]*CacheStatus `json:"caches"`
+	StoreRecords int64                   `json:"store_records"`
+	StoreBytes   int64                   `json:"store_bytes"`
+	Covered      []EpochRange            `json:"covered,omitempty"`  // heights whose data is held by the store
+	Absent       []EpochRange            `json:"absent,omitempty"`   // heights whose data is missing from the store and node
+	TopCIDs      []CIDCount              `json:"top_cids,omitempty"` // most requested recent cids
+	Egress       []ClientEgress          `json:"egress,omitempty"`   // clients served the most bytes
+}
+
+// CacheStatus summarises the activity of a cache tier since the proxy started.
+type CacheStatus struct {
+	Requests    int64   `json:"requests"`
+	Hits        int64   `json:"hits"`
+	Failures    int64   `json:"failures"`
+	HitRate     float64 `json:"hit_rate"`
+	Fills       int64   `json:"fills"`
+	FillsPerSec float64 `json:"fills_per_second"` // rate of successful fills since the previous report
+}
+
+// HeadFetcher is the subset of the node api needed to report the chain head.
+type HeadFetcher interface {
+	ChainHead(ctx context.Context) (*types.TipSet, error)
+}
+
+// CircuitReporter is implemented by upstream clients that can report the state of their circuit breaker.
+type CircuitReporter interface {
+	CircuitState() string
+}
+
+// ActiveUpstreamReporter is implemented by upstream clients that fail over between lotus nodes.
+type ActiveUpstreamReporter interface {
+	ActiveUpstream() string
+	FallbackHealth() []*UpstreamHealth
+}
+
+// StatusReporter gathers status snapshots from the upstream client, metrics and store.
+type StatusReporter struct {
+	inflight int64 // number of rpc calls being handled, accessed atomically and first for alignment
+
+	node    HeadFetcher
+	circuit CircuitReporter
+	store   *ShardedStore
+	cover   *StoreCoverage
+	cids    *CIDCounter
+	egress  *EgressCounter
+	subs    SubscriptionCounter
+	reader  *metricexport.Reader
+
+	mu        sync.Mutex // guards lastFills and lastTime
+	lastFills map[string]int64
+	lastTime  time.Time
+}
+
+func NewStatusReporter(node HeadFetcher, circuit CircuitReporter) *StatusReporter {
+	return &StatusReporter{
+		node:      node,
+		circuit:   circuit,
+		reader:    metricexport.NewReader(),
+		lastFills: map[string]int64{},
+		lastTime:  time.Now(),
+	}
+}
+
+// SetStore sets the store whose size is included in the status.
+func (s *StatusReporter) SetStore(st *ShardedStore) {
+	s.store = st
+}
+
+// SetCoverage sets the record of heights held by the store that is included in the status.
+func (s *StatusReporter) SetCoverage(c *StoreCoverage) {
+	s.cover = c
+}
+
+// SetSubscriptionCounter sets the source of the active subscription counts included in health reports.
+func (s *StatusReporter) SetSubscriptionCounter(c SubscriptionCounter) {
+	s.subs = c
+}
+
+// SetCIDCounter sets the counter used to report the most requested cids.
+func (s *StatusReporter) SetCIDCounter(c *CIDCounter) {
+	s.cids = c
+}
+
+// SetEgressCounter sets the counter used to report the bytes served to each client.
+func (s *StatusReporter) SetEgressCounter(e *EgressCounter) {
+	s.egress = e
+}
+
+// Status returns a snapshot of the proxy's current status.
+func (s *StatusReporter) Status(ctx context.Context) *Status {
+	st := &Status{
+		Time:       time.Now(),
+		HeadHeight: -1,
+		Circuit:    CircuitDisconnected,
+		Caches:     map[string]*CacheStatus{},
+	}
+
+	if s.circuit != nil {
+		st.Circuit = s.circuit.CircuitState()
+	}
+	if au, ok := s.circuit.(ActiveUpstreamReporter); ok {
+		st.Upstream = au.ActiveUpstream()
+	}
+	st.InFlight = atomic.LoadInt64(&s.inflight)
+	st.TopCIDs = s.cids.Top(statusTopCIDs)
+	st.Egress = s.egress.Top(statusTopClients)
+
+	hctx, cancel := context.WithTimeout(ctx, statusHeadTimeout)
+	head, err := s.node.ChainHead(hctx)
+	cancel()
+	if err != nil {
+		st.HeadError = err.Error()
+	} else {
+		st.HeadHeight = int64(head.Height())
+		st.HeadLag = st.Time.Sub(time.Unix(int64(head.MinTimestamp()), 0)).Seconds()
+	}
+
+	if s.store != nil {
+		st.StoreRecords = int64(s.store.RecordCount())
+		if size, err := s.store.DataSize(); err == nil {
+			st.StoreBytes = size
+		}
+	}
+	if s.cover != nil {
+		st.Covered, st.Absent = s.cover.Ranges()
+	}
+
+	exp := &statusExporter{counts: map[string]map[string]int64{}}
+	s.reader.ReadAndExport(exp)
+
+	s.mu.Lock()
+	elapsed := st.Time.Sub(s.lastTime).Seconds()
+	for cache, c := range exp.counts {
+		cs := &CacheStatus{
+			Requests: c[getRequest.Name()+"_total"],
+			Hits:     c[getHit.Name()+"_total"],
+			Failures: c[getFailure.Name()+"_total"],
+			Fills:    c[fillSuccess.Name()+"_total"],
+		}
+		if cs.Requests > 0 {
+			cs.HitRate = float64(cs.Hits) / float64(cs.Requests)
+		}
+		if elapsed > 0 {
+			cs.FillsPerSec = float64(cs.Fills-s.lastFills[cache]) / elapsed
+		}
+		s.lastFills[cache] = cs.Fills
+		st.Caches[cache] = cs
+	}
+	s.lastTime = st.Time
+	s.mu.Unlock()
+
+	return st
+}
+
+// Middleware is method middleware that counts the rpc calls being handled.
+func (s *StatusReporter) Middleware(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		atomic.AddInt64(&s.inflight, 1)
+		defer atomic.AddInt64(&s.inflight, -1)
+		return next(ctx, call)
+	}
+}
+
+// ServeHTTP serves the current status as JSON.
+func (s *StatusReporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Status(r.Context())); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Log writes a one line summary of the status to the logger.
+func (st *Status) Log(logger logr.Logger) {
+	kv := []interface{}{"head", st.HeadHeight, "head_lag", time.Duration(st.HeadLag * float64(time.Second)).Round(time.Second).String(), "circuit", st.Circuit}
+
+	caches := make([]string, 0, len(st.Caches))
+	for name := range st.Caches {
+		caches = append(caches, name)
+	}
+	sort.Strings(caches)
+	for _, name := range caches {
+		cs := st.Caches[name]
+		kv = append(kv, name+"_hit_rate", fmt.Sprintf("%0.2f", cs.HitRate))
+		if cs.Fills > 0 {
+			kv = append(kv, name+"_fills_per_sec", fmt.Sprintf("%0.2f", cs.FillsPerSec))
+		}
+	}
+
+	kv = append(kv, "store_records", st.StoreRecords, "store_bytes", st.StoreBytes)
+	if st.HeadError != "" {
+		kv = append(kv, "head_error", st.HeadError)
+	}
+	logger.Info("Status", kv...)
+}
+
+// statusExporter collects the cumulative cache counters, keyed by cache then view name.
+type statusExporter struct {
+	counts map[string]map[string]int64
+}
+
+func (e *statusExporter) ExportMetrics(ctx context.Context, metrics []*metricdata.Metric) error {
+	for _, m := range metrics {
+		if !strings.HasSuffix(m.Descriptor.Name, "_total") || strings.HasPrefix(m.Descriptor.Name, "client_") {
+			continue
+		}
+		if len(m.Descriptor.LabelKeys) != 1 || m.Descriptor.LabelKeys[0].Key != cacheTag.Name() {
+			continue
+		}
+		for _, ts := range m.TimeSeries {
+			if len(ts.LabelValues) != 1 || !ts.LabelValues[0].Present {
+				continue
+			}
+			for _, p := range ts.Points {
+				if v, ok := p.Value.(int64); ok {
+					c, ok := e.counts[ts.LabelValues[0].Value]
+					if !ok {
+						c = map[string]int64{}
+						e.counts[ts.LabelValues[0].Value] = c
+					}
+					c[m.Descriptor.Name] = v
+				}
+			}
+		}
+	}
+	return nil
+}
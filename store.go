@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iand/gonudb"
+)
+
+// ShardedStore distributes records across several gonudb stores, typically on separate disks, so that
+// reads and writes are spread across them. Each key is always assigned to the same shard, so the number
+// and order of the shards must not change once records have been inserted.
+//
+// Records may also be divided into generations when the store is rotated. New records are inserted into
+// the newest generation and older generations remain readable until they are removed.
+type ShardedStore struct {
+	mu   sync.RWMutex       // guards gens
+	gens []*storeGeneration // newest first
+}
+
+// storeReaderRefreshInterval is the minimum time between reopening a generation's read-only handles so that
+// they see records flushed since they were opened. Opening a handle loads the shard's index so they are not
+// reopened on every flush.
+const storeReaderRefreshInterval = time.Minute
+
+// storeGeneration is a set of shards that were created together.
+type storeGeneration struct {
+	next          uint32 // counter used to spread reads across handles, accessed atomically and first for alignment
+	refreshing    int32  // set while the read-only handles are being reopened, accessed atomically
+	name          string
+	shards        []*gonudb.Store
+	datPaths      []string          // paths of the shards' data files
+	times         []*RecordTimes    // record times of each shard, nil when not recorded
+	readers       [][]*gonudb.Store // additional read-only handles of each shard, see openReaders
+	readerCount   int               // number of handles requested for each shard, including the primary
+	readersOpened time.Time         // when the read-only handles were opened
+	readerRecords int               // number of records in the generation when the read-only handles were opened
+}
+
+// NewShardedStore returns a store that distributes records across shards. datPaths are the paths of the
+// data files of each shard, in the same order, and are used to report the size of the store. times
+// records the insert and access times of each shard's records and may be nil.
+func NewShardedStore(shards []*gonudb.Store, datPaths []string, times []*RecordTimes) *ShardedStore {
+	return &ShardedStore{
+		gens: []*storeGeneration{newStoreGeneration("", shards, datPaths, times)},
+	}
+}
+
+func newStoreGeneration(name string, shards []*gonudb.Store, datPaths []string, times []*RecordTimes) *storeGeneration {
+	if times == nil {
+		times = make([]*RecordTimes, len(shards))
+	}
+	return &storeGeneration{name: name, shards: shards, datPaths: datPaths, times: times, readers: make([][]*gonudb.Store, len(shards))}
+}
+
+// OpenReaders opens additional read-only handles so that up to n reads of each shard may be made
+// concurrently. See storeGeneration.openReaders.
+func (s *ShardedStore) OpenReaders(ctx context.Context, n int) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, g := range s.gens {
+		if err := g.openReaders(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shards returns the underlying gonudb stores of every generation.
+func (s *ShardedStore) Shards() []*gonudb.Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var shards []*gonudb.Store
+	for _, g := range s.gens {
+		shards = append(shards, g.shards...)
+	}
+	return shards
+}
+
+// shard returns the index of the shard that holds key.
+func (g *storeGeneration) shard(key string) int {
+	if len(g.shards) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(g.shards)))
+}
+
+// openReaders opens n-1 additional read-only handles of each shard. gonudb serializes lookups made
+// through a single handle so spreading reads across several handles lets them proceed concurrently.
+// Each handle holds its own copy of the shard's index in memory and only sees the records that had been
+// flushed when it was opened. Reads that miss are retried using the shard's primary handle, and the
+// handles are reopened by ShardedStore.Flush once they fall behind.
+func (g *storeGeneration) openReaders(ctx context.Context, n int) error {
+	if n <= 1 {
+		return nil
+	}
+	records := g.recordCount()
+	readers, err := g.openReaderHandles(ctx, n)
+	if err != nil {
+		return err
+	}
+	g.readers = readers
+	g.readerCount = n
+	g.readersOpened = time.Now()
+	g.readerRecords = records
+	return nil
+}
+
+func (g *storeGeneration) openReaderHandles(ctx context.Context, n int) ([][]*gonudb.Store, error) {
+	readers := make([][]*gonudb.Store, len(g.shards))
+	for i := range g.shards {
+		for j := 0; j < n-1; j++ {
+			st, err := openStore(ctx, filepath.Dir(g.datPaths[i]), true)
+			if err != nil {
+				closeStores(readers)
+				return nil, fmt.Errorf("open store reader: %w", err)
+			}
+			readers[i] = append(readers[i], st)
+		}
+	}
+	return readers, nil
+}
+
+// readersStale reports whether records have been added to the generation since its read-only handles were
+// opened and the handles are due to be reopened.
+func (g *storeGeneration) readersStale(now time.Time) bool {
+	return g.readerCount > 1 && now.Sub(g.readersOpened) >= storeReaderRefreshInterval && g.recordCount() != g.readerRecords
+}
+
+// fetchReader returns a reader for the record with the given key in shard i, spreading lookups across the
+// shard's handles. Records read through a read-only handle are copied into memory so that the handle may
+// be closed when the handles are reopened.
+func (g *storeGeneration) fetchReader(i int, key string) (io.Reader, error) {
+	if readers := g.readers[i]; len(readers) > 0 {
+		if j := atomic.AddUint32(&g.next, 1) % uint32(len(readers)+1); j > 0 {
+			if r, err := readers[j-1].FetchReader(key); err == nil {
+				data, err := ioutil.ReadAll(r)
+				if err == nil {
+					return bytes.NewReader(data), nil
+				}
+			}
+		}
+	}
+	return g.shards[i].FetchReader(key)
+}
+
+func closeStores(stores [][]*gonudb.Store) error {
+	var firstErr error
+	for _, sts := range stores {
+		for _, st := range sts {
+			if err := st.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// close closes the generation's shards and record times, returning the first error encountered.
+func (g *storeGeneration) close() error {
+	firstErr := closeStores(g.readers)
+	for i := range g.shards {
+		if err := g.times[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := g.shards[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// FetchReader returns a reader for the record with the given key, searching generations from newest to
+// oldest.
+func (s *ShardedStore) FetchReader(key string) (io.Reader, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var err error
+	for _, g := range s.gens {
+		var r io.Reader
+		i := g.shard(key)
+		r, err = g.fetchReader(i, key)
+		if err == nil {
+			g.times[i].Accessed(key, time.Now())
+			return r, nil
+		}
+	}
+	return nil, err
+}
+
+// Insert adds a record to the newest generation.
+func (s *ShardedStore) Insert(key string, data []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g := s.gens[0]
+	i := g.shard(key)
+	if err := g.shards[i].Insert(key, data); err != nil {
+		return err
+	}
+	g.times[i].Inserted(key, time.Now())
+	return nil
+}
+
+// Flush flushes every shard and its record times, then reopens the newest generation's read-only handles
+// if they are stale. It returns the first error encountered.
+func (s *ShardedStore) Flush() error {
+	firstErr := s.flush()
+	if err := s.refreshReaders(context.Background()); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (s *ShardedStore) flush() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var firstErr error
+	for _, g := range s.gens {
+		for i := range g.shards {
+			if err := g.shards[i].Flush(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if err := g.times[i].Flush(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// refreshReaders reopens the read-only handles of the newest generation if they have fallen behind the
+// records flushed to it. The new handles are opened while reads continue using the old ones, which are
+// closed once no reads can be using them.
+func (s *ShardedStore) refreshReaders(ctx context.Context) error {
+	s.mu.RLock()
+	g := s.gens[0]
+	stale := g.readersStale(time.Now())
+	s.mu.RUnlock()
+	if !stale || !atomic.CompareAndSwapInt32(&g.refreshing, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&g.refreshing, 0)
+
+	records := g.recordCount()
+	readers, err := g.openReaderHandles(ctx, g.readerCount)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	current := false
+	for _, cg := range s.gens {
+		if cg == g {
+			current = true
+			break
+		}
+	}
+	old := readers
+	if current {
+		old = g.readers
+		g.readers = readers
+		g.readersOpened = time.Now()
+		g.readerRecords = records
+	}
+	s.mu.Unlock()
+	return closeStores(old)
+}
+
+// Close closes every shard, returning the first error encountered.
+func (s *ShardedStore) Close() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var firstErr error
+	for _, g := range s.gens {
+		if err := g.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Err returns the first error reported by a shard's background operations.
+func (s *ShardedStore) Err() error {
+	return s.each(func(st *gonudb.Store) error { return st.Err() })
+}
+
+func (s *ShardedStore) each(fn func(*gonudb.Store) error) error {
+	var firstErr error
+	for _, st := range s.Shards() {
+		if err := fn(st); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// RecordCount returns the total number of records in all shards.
+func (s *ShardedStore) RecordCount() int {
+	n := 0
+	for _, st := range s.Shards() {
+		n += st.RecordCount()
+	}
+	return n
+}
+
+// Rate returns the combined rate at which data is being written to the shards.
+func (s *ShardedStore) Rate() float64 {
+	var r float64
+	for _, st := range s.Shards() {
+		r += st.Rate()
+	}
+	return r
+}
+
+// DataSize returns the total size of the shards' data files.
+func (s *ShardedStore) DataSize() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var size int64
+	for _, g := range s.gens {
+		gsize, err := g.dataSize()
+		if err != nil {
+			return 0, err
+		}
+		size += gsize
+	}
+	return size, nil
+}
+
+// recordCount returns the number of records in the generation's shards.
+func (g *storeGeneration) recordCount() int {
+	n := 0
+	for _, st := range g.shards {
+		n += st.RecordCount()
+	}
+	return n
+}
+
+// dataSize returns the total size of the generation's data files.
+func (g *storeGeneration) dataSize() (int64, error) {
+	var size int64
+	for _, p := range g.datPaths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// generationNames returns the names of the store's generations, newest first.
+func (s *ShardedStore) generationNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, len(s.gens))
+	for i, g := range s.gens {
+		names[i] = g.name
+	}
+	return names
+}
+
+// rotate makes g the newest generation and removes all but the newest keep generations, returning
+// the removed generations so they can be closed.
+func (s *ShardedStore) rotate(g *storeGeneration, keep int) []*storeGeneration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gens = append([]*storeGeneration{g}, s.gens...)
+	if len(s.gens) <= keep {
+		return nil
+	}
+	removed := s.gens[keep:]
+	s.gens = s.gens[:keep:keep]
+	return removed
+}
+
+// evictOldest removes the oldest generation so that it can be closed, returning nil if the store has a
+// single generation.
+func (s *ShardedStore) evictOldest() *storeGeneration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.gens) <= 1 {
+		return nil
+	}
+	g := s.gens[len(s.gens)-1]
+	s.gens = s.gens[: len(s.gens)-1 : len(s.gens)-1]
+	return g
+}
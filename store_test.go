@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func newTestShardedStore(tb testing.TB, records int) (*ShardedStore, []string) {
+	tb.Helper()
+	s, err := openShardedStore(context.Background(), []string{tb.TempDir()}, false)
+	if err != nil {
+		tb.Fatalf("open store: %v", err)
+	}
+	tb.Cleanup(func() { s.Close() })
+
+	keys := make([]string, records)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%08d", i)
+		if err := s.Insert(keys[i], []byte(fmt.Sprintf("value of record %d", i))); err != nil {
+			tb.Fatalf("insert: %v", err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		tb.Fatalf("flush: %v", err)
+	}
+	return s, keys
+}
+
+// BenchmarkShardedStoreFetch measures how read throughput scales with the number of handles opened for
+// reading the store, as set by --store-read-concurrency.
+func BenchmarkShardedStoreFetch(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("handles-%d", n), func(b *testing.B) {
+			s, keys := newTestShardedStore(b, 10000)
+			if err := s.OpenReaders(context.Background(), n); err != nil {
+				b.Fatalf("open readers: %v", err)
+			}
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					r, err := s.FetchReader(keys[i%len(keys)])
+					if err != nil {
+						b.Errorf("fetch: %v", err)
+						return
+					}
+					if _, err := ioutil.ReadAll(r); err != nil {
+						b.Errorf("read: %v", err)
+						return
+					}
+					i += 7
+				}
+			})
+		})
+	}
+}
+
+func TestShardedStoreRefreshReaders(t *testing.T) {
+	s, _ := newTestShardedStore(t, 100)
+	if err := s.OpenReaders(context.Background(), 3); err != nil {
+		t.Fatalf("open readers: %v", err)
+	}
+	g := s.gens[0]
+	opened := g.readers[0]
+
+	if err := s.Insert("late", []byte("flushed after the readers were opened")); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if g.readers[0][0] != opened[0] {
+		t.Fatalf("readers were reopened within %s of being opened", storeReaderRefreshInterval)
+	}
+	for _, st := range g.readers[0] {
+		if _, err := st.FetchReader("late"); err == nil {
+			t.Fatalf("reader opened before the flush found the record")
+		}
+	}
+
+	g.readersOpened = time.Now().Add(-storeReaderRefreshInterval)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if g.readers[0][0] == opened[0] {
+		t.Fatalf("stale readers were not reopened")
+	}
+	if len(g.readers[0]) != 2 {
+		t.Errorf("got %d readers after reopening, wanted 2", len(g.readers[0]))
+	}
+	for _, st := range g.readers[0] {
+		if _, err := st.FetchReader("late"); err != nil {
+			t.Errorf("reopened reader did not find the record: %v", err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		r, err := s.FetchReader("late")
+		if err != nil {
+			t.Fatalf("fetch: %v", err)
+		}
+		if data, _ := ioutil.ReadAll(r); string(data) != "flushed after the readers were opened" {
+			t.Errorf("fetch returned %q", data)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/iand/gonudb"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// StoreCheckResult reports the outcome of a store consistency check.
+type StoreCheckResult struct {
+	Sampled     int  // number of data records checked
+	BadHash     int  // number of sampled records whose data does not match their key
+	Unindexed   int  // number of sampled records that could not be fetched using their key
+	RecordCount int  // number of records in the key index
+	Complete    bool // whether every record in the data file was sampled
+}
+
+// Inconsistencies returns the total number of problems found by the check.
+func (r *StoreCheckResult) Inconsistencies() int {
+	n := r.BadHash + r.Unindexed
+	if r.Complete {
+		if r.RecordCount > r.Sampled {
+			n += r.RecordCount - r.Sampled
+		} else {
+			n += r.Sampled - r.RecordCount
+		}
+	}
+	return n
+}
+
+// CheckStore performs a quick consistency check of a store. Up to samples data records are read from the
+// start of the data files, divided evenly between the shards, verifying that each record's data hashes to
+// its key and that it can be fetched using the key index. When every data record has been sampled their
+// number is also compared with the number of records in the key indexes.
+func CheckStore(s *ShardedStore, samples int) (*StoreCheckResult, error) {
+	res := &StoreCheckResult{
+		RecordCount: s.RecordCount(),
+		Complete:    true,
+	}
+
+	shards := s.Shards()
+	perShard := (samples + len(shards) - 1) / len(shards)
+	for _, st := range shards {
+		complete, err := checkShard(st, perShard, res)
+		if err != nil {
+			return nil, err
+		}
+		res.Complete = res.Complete && complete
+	}
+
+	return res, nil
+}
+
+// checkShard samples up to samples data records of a single shard, adding the problems found to res. It
+// reports whether every record in the shard was sampled.
+func checkShard(s *gonudb.Store, samples int, res *StoreCheckResult) (bool, error) {
+	sampled := 0
+	rs := s.RecordScanner()
+	defer rs.Close()
+	for rs.Next() {
+		if !rs.IsData() {
+			continue
+		}
+		if sampled == samples {
+			return false, nil
+		}
+		sampled++
+		res.Sampled++
+
+		key := rs.Key()
+		data, err := ioutil.ReadAll(rs.Reader())
+		if err != nil {
+			return false, fmt.Errorf("read record: %w", err)
+		}
+		if !verifyRecordHash(key, data) {
+			res.BadHash++
+		}
+
+		if _, err := s.FetchReader(key); err != nil {
+			res.Unindexed++
+		}
+	}
+	if err := rs.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("scan records: %w", err)
+	}
+	return true, nil
+}
+
+// verifyRecordHash reports whether data hashes to the multihash used as its key.
+func verifyRecordHash(key string, data []byte) bool {
+	dmh, err := mh.Decode([]byte(key))
+	if err != nil {
+		return false
+	}
+	sum, err := mh.Sum(data, dmh.Code, dmh.Length)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(sum, []byte(key))
+}
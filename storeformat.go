@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+)
+
+// storeFormatFile is the name of the file in a store directory that records the format of the store.
+const storeFormatFile = "format.json"
+
+// storeFormatVersion is the current version of the store format. Stores created before the format was
+// recorded are treated as version 0.
+const storeFormatVersion = 2
+
+type storeFormat struct {
+	Version int `json:"version"`
+}
+
+// storeMigration upgrades a closed store from the previous format version to version.
+type storeMigration struct {
+	version     int
+	description string
+	migrate     func(path string) error
+}
+
+// storeMigrations are applied in order to upgrade a store to the current format version. New migrations
+// must be appended and storeFormatVersion increased to match.
+var storeMigrations = []storeMigration{
+	{
+		version:     1,
+		description: "record the store format",
+		migrate:     func(path string) error { return nil },
+	},
+	{
+		// Records inserted before this version have no insert time
+		version:     2,
+		description: "add record times",
+		migrate: func(path string) error {
+			rt, err := OpenRecordTimes(path)
+			if err != nil {
+				return err
+			}
+			return rt.Close()
+		},
+	},
+}
+
+// readStoreFormat returns the format version of the store in path.
+func readStoreFormat(path string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, storeFormatFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("read store format: %w", err)
+	}
+	var f storeFormat
+	if err := json.Unmarshal(data, &f); err != nil {
+		return 0, fmt.Errorf("decode store format: %w", err)
+	}
+	return f.Version, nil
+}
+
+// writeStoreFormat records the format version of the store in path, replacing the previous record atomically.
+func writeStoreFormat(path string, version int) error {
+	data, err := json.Marshal(storeFormat{Version: version})
+	if err != nil {
+		return fmt.Errorf("encode store format: %w", err)
+	}
+	tmp := filepath.Join(path, storeFormatFile+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write store format: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(path, storeFormatFile)); err != nil {
+		return fmt.Errorf("write store format: %w", err)
+	}
+	return nil
+}
+
+// migrateStore upgrades the closed store in path to the current format version, recording the new version
+// after each migration so that an interrupted upgrade resumes where it stopped. A read-only store cannot be
+// upgraded and must already be at the current version.
+func migrateStore(path string, readOnly bool, logger logr.Logger) error {
+	version, err := readStoreFormat(path)
+	if err != nil {
+		return err
+	}
+	if version > storeFormatVersion {
+		return fmt.Errorf("store format version %d is newer than the supported version %d", version, storeFormatVersion)
+	}
+	if version == storeFormatVersion {
+		return nil
+	}
+	if readOnly {
+		return fmt.Errorf("store format version %d must be upgraded to version %d by opening the store without --store-readonly", version, storeFormatVersion)
+	}
+
+	for _, m := range storeMigrations {
+		if m.version <= version {
+			continue
+		}
+		logger.V(LogLevelInfo).Info("Migrating store", "path", path, "version", m.version, "migration", m.description)
+		if err := m.migrate(path); err != nil {
+			return fmt.Errorf("migrate store to version %d: %w", m.version, err)
+		}
+		if err := writeStoreFormat(path, m.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"go.opencensus.io/tag"
+)
+
+// Policies for handling subscribers that fall behind.
+const (
+	DropPolicyClose  = "close"  // close the subscription, the subscriber must resubscribe
+	DropPolicyOldest = "oldest" // discard the oldest buffered message
+	DropPolicyNewest = "newest" // discard the message that does not fit in the buffer
+)
+
+// SubscriptionOptions configure how messages are buffered for subscribers to channel methods
+// such as ChainNotify.
+type SubscriptionOptions struct {
+	BufferSize int    // maximum number of messages buffered for a subscriber
+	DropPolicy string // action taken when a subscriber's buffer is full
+}
+
+var DefaultSubscriptionOptions = SubscriptionOptions{
+	BufferSize: 256,
+	DropPolicy: DropPolicyClose,
+}
+
+// Validate checks the options are usable.
+func (o SubscriptionOptions) Validate() error {
+	if o.BufferSize < 1 {
+		return fmt.Errorf("buffer size must be at least 1")
+	}
+	switch o.DropPolicy {
+	case DropPolicyClose, DropPolicyOldest, DropPolicyNewest:
+		return nil
+	default:
+		return fmt.Errorf("unknown drop policy %q", o.DropPolicy)
+	}
+}
+
+// subscribe calls a channel method of the upstream node and relays the messages it produces to the
+// subscriber through a bounded buffer. Messages continue to be read from the upstream node while the
+// subscriber is slow so that the upstream connection does not accumulate them without limit. The
+// upstream subscription is cancelled when the subscriber goes away or is closed by the drop policy.
+// The returned channel has the same type as the channel returned by call.
+func (p *Proxy) subscribe(ctx context.Context, method string, call func(context.Context) (interface{}, error)) (interface{}, error) {
+	subCtx, cancel := context.WithCancel(ctx)
+	in, err := call(subCtx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	inV := reflect.ValueOf(in)
+	outV := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, inV.Type().Elem()), 0)
+
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, method))
+	opts := p.subs
+
+	p.submu.Lock()
+	p.subCounts[method]++
+	p.submu.Unlock()
+
+	go func() {
+		defer func() {
+			p.submu.Lock()
+			p.subCounts[method]--
+			p.submu.Unlock()
+		}()
+		defer cancel()
+		defer outV.Close()
+
+		const (
+			caseDone = iota
+			caseRecv
+			caseSend
+		)
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(subCtx.Done())},
+			{Dir: reflect.SelectRecv, Chan: inV},
+			{Dir: reflect.SelectSend, Chan: outV},
+		}
+
+		var queue []reflect.Value
+		for {
+			// Only offer a message to the subscriber when one is buffered and stop reading once
+			// the upstream channel has closed.
+			active := cases
+			if len(queue) == 0 {
+				active = cases[:caseSend]
+				if !cases[caseRecv].Chan.IsValid() {
+					return
+				}
+			} else {
+				cases[caseSend].Send = queue[0]
+			}
+
+			chosen, v, ok := reflect.Select(active)
+			switch chosen {
+			case caseDone:
+				return
+			case caseRecv:
+				if !ok {
+					cases[caseRecv].Chan = reflect.Value{}
+					continue
+				}
+				if len(queue) < opts.BufferSize {
+					queue = append(queue, v)
+					continue
+				}
+
+				reportEvent(mctx, subscriptionDropped)
+				switch opts.DropPolicy {
+				case DropPolicyOldest:
+					queue = append(queue[1:], v)
+				case DropPolicyNewest:
+				default:
+					reportEvent(mctx, subscriptionClosed)
+					p.logger.Info("Closing subscription for slow subscriber", "method", method, "client", clientName(ctx), "buffered", len(queue))
+					return
+				}
+			case caseSend:
+				queue[0] = reflect.Value{}
+				queue = queue[1:]
+			}
+		}
+	}()
+
+	return outV.Convert(inV.Type()).Interface(), nil
+}
+
+// SubscriptionCounts returns the number of active subscriptions, keyed by method.
+func (p *Proxy) SubscriptionCounts() map[string]int {
+	p.submu.Lock()
+	defer p.submu.Unlock()
+	counts := make(map[string]int, len(p.subCounts))
+	for method, n := range p.subCounts {
+		counts[method] = n
+	}
+	return counts
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/go-logr/logr"
+	"github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+var (
+	_ (BlockCache)       = (*CacheTier)(nil)
+	_ (BlockRangeReader) = (*CacheTier)(nil)
+)
+
+// CacheTier wraps a layer of the cache chain so that it can be disabled while the proxy is running, for
+// example while an http blockstore is suffering an outage. Requests to a disabled tier skip it and are
+// passed directly to the layer it fills from.
+type CacheTier struct {
+	disabled int32 // non-zero when the tier is disabled, accessed atomically
+	name     string
+	cache    BlockCache
+	upstream BlockCache
+	logger   logr.Logger
+}
+
+func NewCacheTier(name string, cache BlockCache, logger logr.Logger) *CacheTier {
+	if logger == nil {
+		logger = logr.Discard()
+	}
+	t := &CacheTier{
+		name:   name,
+		cache:  cache,
+		logger: logger.V(LogLevelInfo),
+	}
+	t.reportEnabled()
+	return t
+}
+
+// Name returns the name used to refer to the tier.
+func (t *CacheTier) Name() string {
+	return t.name
+}
+
+// Enabled reports whether requests are being served by the tier.
+func (t *CacheTier) Enabled() bool {
+	return atomic.LoadInt32(&t.disabled) == 0
+}
+
+// SetEnabled enables or disables the tier.
+func (t *CacheTier) SetEnabled(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	if atomic.SwapInt32(&t.disabled, disabled) == disabled {
+		return
+	}
+	if enabled {
+		t.logger.Info("Enabled cache tier", "tier", t.name)
+	} else {
+		t.logger.Info("Disabled cache tier", "tier", t.name)
+	}
+	t.reportEnabled()
+}
+
+func (t *CacheTier) reportEnabled() {
+	var v int64
+	if t.Enabled() {
+		v = 1
+	}
+	reportMeasurement(cacheContext(context.Background(), t.name), cacheTierEnabled.M(v))
+}
+
+// active returns the cache that should serve the request carried by the context. The tier is skipped when
+// it is disabled or the client asked to bypass the caches.
+func (t *CacheTier) active(ctx context.Context) BlockCache {
+	if (t.Enabled() && !cacheBypassed(ctx)) || t.upstream == nil {
+		return t.cache
+	}
+	return t.upstream
+}
+
+func (t *CacheTier) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	ctx, span := startCacheSpan(ctx, "Has", t.name, c)
+	defer span.End()
+	has, err := t.active(ctx).Has(ctx, c)
+	recordSpanError(span, err)
+	return has, err
+}
+
+func (t *CacheTier) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	noteCacheRead(ctx)
+	ctx, span := startCacheSpan(ctx, "Get", t.name, c)
+	defer span.End()
+	blk, err := t.active(ctx).Get(ctx, c)
+	recordSpanError(span, err)
+	return blk, err
+}
+
+func (t *CacheTier) GetRange(ctx context.Context, c cid.Cid, offset int64, length int64) ([]byte, error) {
+	return getBlockRange(ctx, t.active(ctx), c, offset, length)
+}
+
+func (t *CacheTier) SetUpstream(u BlockCache) {
+	t.upstream = u
+	t.cache.SetUpstream(u)
+}
+
+// TierStatus reports whether a cache tier is enabled.
+type TierStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// tiersHandler lists the cache tiers and their status as JSON. A POST with name and enabled form values
+// enables or disables the named tier.
+func tiersHandler(tiers []*CacheTier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid enabled value: %q", r.FormValue("enabled")), http.StatusBadRequest)
+				return
+			}
+			var tier *CacheTier
+			for _, t := range tiers {
+				if t.Name() == r.FormValue("name") {
+					tier = t
+					break
+				}
+			}
+			if tier == nil {
+				http.Error(w, fmt.Sprintf("unknown tier: %q", r.FormValue("name")), http.StatusNotFound)
+				return
+			}
+			tier.SetEnabled(enabled)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := make([]TierStatus, len(tiers))
+		for i, t := range tiers {
+			status[i] = TierStatus{Name: t.Name(), Enabled: t.Enabled()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
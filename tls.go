@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// ListenerTLSOptions configure TLS for the proxy's listeners.
+type ListenerTLSOptions struct {
+	CertFile     string // path to PEM encoded certificate chain
+	KeyFile      string // path to PEM encoded private key
+	ClientCAFile string // path to PEM encoded certificates of the CAs that client certificates must be signed by, empty to not request client certificates
+}
+
+// TLSConfig returns the TLS configuration for the listeners, nil if TLS is not configured.
+func (o ListenerTLSOptions) TLSConfig() (*tls.Config, error) {
+	if o.CertFile == "" && o.KeyFile == "" {
+		if o.ClientCAFile != "" {
+			return nil, fmt.Errorf("client certificate verification requires a certificate and key")
+		}
+		return nil, nil
+	}
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, fmt.Errorf("both a certificate and key are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if o.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in client ca file")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/apistruct"
+	"github.com/go-logr/logr"
+	"go.opencensus.io/tag"
+)
+
+// upstreamTokenCheckTimeout is the maximum time allowed for a lotus node to verify the proxy's token.
+const upstreamTokenCheckTimeout = 10 * time.Second
+
+var (
+	upstreamTag, _ = tag.NewKey("upstream")
+	permTag, _     = tag.NewKey("perm")
+)
+
+// token returns the api token the proxy presents to the node.
+func (a *apiClient) token() string {
+	return strings.TrimPrefix(a.headers.Get("Authorization"), "Bearer ")
+}
+
+// tokenPerms asks this node, without failing over, for the permissions it grants the proxy's token.
+func (a *apiClient) tokenPerms(ctx context.Context) ([]auth.Permission, error) {
+	var perms []auth.Permission
+	err := a.call(ctx, func(_ *apiClient, api lotusapi.FullNode) error {
+		var err error
+		perms, err = api.AuthVerify(ctx, a.token())
+		return err
+	})
+	return perms, err
+}
+
+// CheckUpstreamTokens asks the preferred node and each fallback for the permissions granted to the token
+// the proxy uses to call it, logging them and reporting them with the upstream_token_perm metric. It fails
+// if a node does not grant read permission, since the proxy cannot serve any call through it. A token
+// granting more than read permission to a read only proxy is reported as an error but is not refused.
+// Nodes that cannot be reached are logged and skipped so the proxy can start before its nodes.
+func CheckUpstreamTokens(ctx context.Context, client *apiClient, readOnly bool, logger logr.Logger) error {
+	for _, u := range client.upstreams() {
+		cctx, cancel := context.WithTimeout(ctx, upstreamTokenCheckTimeout)
+		perms, err := u.tokenPerms(cctx)
+		cancel()
+		if err != nil {
+			// AuthVerify itself needs read permission
+			if strings.Contains(err.Error(), "missing permission") {
+				return fmt.Errorf("api token for %s does not grant read permission: %w", u.maddr, err)
+			}
+			logger.Error(err, "failed to verify api token permissions", "maddr", u.maddr)
+			continue
+		}
+		logger.Info("Verified api token permissions", "maddr", u.maddr, "perms", perms)
+
+		for _, perm := range apistruct.AllPermissions {
+			granted := int64(0)
+			if hasPerm(perms, perm) {
+				granted = 1
+			}
+			mctx, _ := tag.New(ctx, tag.Upsert(upstreamTag, u.maddr), tag.Upsert(permTag, string(perm)))
+			reportMeasurement(mctx, upstreamTokenPerm.M(granted))
+		}
+
+		if !hasPerm(perms, apistruct.PermRead) {
+			return fmt.Errorf("api token for %s does not grant read permission", u.maddr)
+		}
+		if readOnly {
+			for _, perm := range perms {
+				if perm != apistruct.PermRead {
+					logger.Error(fmt.Errorf("api token grants %s permission", perm), "Api token grants more than read permission to a read only proxy, consider using a read token", "maddr", u.maddr)
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
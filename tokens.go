@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/lotus/api/apistruct"
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// Method groups used to scope access granted by proxy tokens. Only methods that Lotus permits with read
+// permission are placed in the common, chain and state groups.
+const (
+	MethodGroupCommon = "common" // methods describing the api itself such as Version
+	MethodGroupChain  = "chain"  // methods reading chain data
+	MethodGroupState  = "state"  // methods reading actor state
+	MethodGroupAdmin  = "admin"  // all other methods, including every method requiring more than read permission
+)
+
+// Token scopes, each granting access to a set of method groups.
+const (
+	ScopeChain      = "chain"
+	ScopeChainState = "chain+state"
+	ScopeAdmin      = "admin"
+)
+
+var scopeGroups = map[string][]string{
+	ScopeChain:      {MethodGroupCommon, MethodGroupChain},
+	ScopeChainState: {MethodGroupCommon, MethodGroupChain, MethodGroupState},
+	ScopeAdmin:      {MethodGroupCommon, MethodGroupChain, MethodGroupState, MethodGroupAdmin},
+}
+
+var commonMethods = map[string]bool{
+	"AuthVerify": true,
+	"Version":    true,
+	"Session":    true,
+	"Closing":    true,
+	"ID":         true,
+	"Discover":   true,
+}
+
+var (
+	ErrTokenRequired = errors.New("a valid api token is required")
+	ErrMethodScope   = errors.New("method not permitted by token scope")
+)
+
+// methodGroup returns the group a method belongs to. perm is the permission Lotus requires to call the
+// method; methods that need more than read permission, such as ChainSetHead, belong to the admin group
+// whatever their name.
+func methodGroup(method string, perm auth.Permission) string {
+	switch {
+	case perm != apistruct.PermRead:
+		return MethodGroupAdmin
+	case commonMethods[method]:
+		return MethodGroupCommon
+	case strings.HasPrefix(method, "Chain"), strings.HasPrefix(method, "Beacon"), method == "GetTipSetFromKey":
+		return MethodGroupChain
+	case strings.HasPrefix(method, "State"):
+		return MethodGroupState
+	default:
+		return MethodGroupAdmin
+	}
+}
+
+// ValidScope reports whether scope is a known token scope.
+func ValidScope(scope string) bool {
+	_, ok := scopeGroups[scope]
+	return ok
+}
+
+// scopeAllows reports whether a token with the given scope may call the method, which requires perm.
+func scopeAllows(scope string, method string, perm auth.Permission) bool {
+	group := methodGroup(method, perm)
+	for _, g := range scopeGroups[scope] {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenClaims are the claims carried by tokens minted by the proxy.
+type TokenClaims struct {
+	Name  string `json:"name,omitempty"`
+	Scope string `json:"scope"`
+}
+
+// TokenIssuer mints and verifies tokens signed with the proxy's secret.
+type TokenIssuer struct {
+	alg *jwt.HMACSHA
+}
+
+func NewTokenIssuer(secret []byte) *TokenIssuer {
+	return &TokenIssuer{alg: jwt.NewHS256(secret)}
+}
+
+// Mint creates a signed token with the given claims.
+func (ti *TokenIssuer) Mint(claims TokenClaims) ([]byte, error) {
+	if !ValidScope(claims.Scope) {
+		return nil, fmt.Errorf("unknown scope %q", claims.Scope)
+	}
+	return jwt.Sign(&claims, ti.alg)
+}
+
+// Verify checks the token's signature and returns its claims.
+func (ti *TokenIssuer) Verify(token string) (*TokenClaims, error) {
+	var claims TokenClaims
+	if _, err := jwt.Verify([]byte(token), ti.alg, &claims); err != nil {
+		return nil, err
+	}
+	if !ValidScope(claims.Scope) {
+		return nil, fmt.Errorf("unknown scope %q", claims.Scope)
+	}
+	return &claims, nil
+}
+
+// ReadTokenSecret reads a hex encoded token secret from a file.
+func ReadTokenSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read secret: %w", err)
+	}
+	secret, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decode secret: %w", err)
+	}
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("secret must be at least 32 bytes")
+	}
+	return secret, nil
+}
+
+// WriteTokenSecret generates a new random token secret and writes it to a file, which must not exist.
+func WriteTokenSecret(path string) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("generate secret: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("create secret: %w", err)
+	}
+	if _, err := f.WriteString(hex.EncodeToString(secret) + "\n"); err != nil {
+		f.Close()
+		return fmt.Errorf("write secret: %w", err)
+	}
+	return f.Close()
+}
+
+type tokenClaimsKey struct{}
+
+// tokenClaims returns the claims of the verified token carried by the context, if any.
+func tokenClaims(ctx context.Context) (*TokenClaims, bool) {
+	claims, ok := ctx.Value(tokenClaimsKey{}).(*TokenClaims)
+	return claims, ok
+}
+
+// bearerToken returns the bearer token sent with the request, if any.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+}
+
+// requireToken is middleware that rejects requests without a valid proxy token and adds the
+// token's claims and name to the request's context. Rejected requests are recorded in the audit log, if any.
+func requireToken(ti *TokenIssuer, al *AuditLog, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := ti.Verify(bearerToken(r))
+		if err != nil {
+			if al != nil {
+				al.Record(r.Context(), AuditEntry{Event: AuditAuthFailure, Error: err.Error()})
+			}
+			http.Error(w, ErrTokenRequired.Error(), http.StatusUnauthorized)
+			return
+		}
+		ctx := r.Context()
+		if name := sanitizeClientName(claims.Name); name != "" {
+			ctx = withClientIdentity(ctx, name)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, tokenClaimsKey{}, claims)))
+	})
+}
+
+// ScopePolicy is method middleware that only permits calls to methods covered by the scope of the
+// caller's token. Calls without token claims are rejected.
+func ScopePolicy(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		claims, ok := tokenClaims(ctx)
+		if !ok {
+			return nil, ErrTokenRequired
+		}
+		if !scopeAllows(claims.Scope, call.Method, call.Perm) {
+			return nil, fmt.Errorf("%w: %s is in the %s method group", ErrMethodScope, call.Method, methodGroup(call.Method, call.Perm))
+		}
+		return next(ctx, call)
+	}
+}
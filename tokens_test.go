@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/filecoin-project/lotus/api/apistruct"
+)
+
+func TestScopesOnlyGrantReadMethods(t *testing.T) {
+	for name, field := range rpcMethodFields() {
+		perm := auth.Permission(field.Tag.Get("perm"))
+		if perm == "" {
+			perm = apistruct.PermRead
+		}
+		for _, scope := range []string{ScopeChain, ScopeChainState} {
+			if scopeAllows(scope, name, perm) && perm != apistruct.PermRead {
+				t.Errorf("%s scope allows %s, which requires %s permission", scope, name, perm)
+			}
+		}
+		if !scopeAllows(ScopeAdmin, name, perm) {
+			t.Errorf("admin scope does not allow %s", name)
+		}
+	}
+
+	for _, tc := range []struct {
+		method string
+		perm   auth.Permission
+		scope  string
+		want   bool
+	}{
+		{"ChainHead", apistruct.PermRead, ScopeChain, true},
+		{"ChainSetHead", apistruct.PermAdmin, ScopeChain, false},
+		{"ChainSetHead", apistruct.PermAdmin, ScopeChainState, false},
+		{"StateGetActor", apistruct.PermRead, ScopeChain, false},
+		{"StateGetActor", apistruct.PermRead, ScopeChainState, true},
+		{"Version", apistruct.PermRead, ScopeChain, true},
+	} {
+		if got := scopeAllows(tc.scope, tc.method, tc.perm); got != tc.want {
+			t.Errorf("scopeAllows(%q, %q, %q) = %v, wanted %v", tc.scope, tc.method, tc.perm, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName             = "github.com/iand/lotus-cpr"
+	tracingShutdownTimeout = 5 * time.Second // maximum time allowed to export remaining spans at shutdown
+)
+
+// tracer creates the spans recorded by the proxy. It uses the global tracer provider, which discards spans
+// until InitTracing is called.
+var tracer = otel.Tracer(tracerName)
+
+// InitTracing exports the spans recorded by the proxy to an OTLP collector over http and propagates W3C
+// trace context from incoming requests. The endpoint is a url such as http://localhost:4318, a scheme of
+// http disables TLS. The returned function flushes any spans not yet exported and stops the exporter.
+func InitTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid otlp endpoint %q, expected a url such as http://localhost:4318", endpoint)
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme in otlp endpoint %q", endpoint)
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create otlp exporter: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("lotus-cpr"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// traceRequest is middleware that continues any trace given by the traceparent header of a request.
+func traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// TraceMethod is method middleware that records a span for each rpc call.
+func TraceMethod(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		ctx, span := tracer.Start(ctx, call.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.RPCSystemKey.String("jsonrpc"),
+			semconv.RPCMethodKey.String(call.Method),
+			attribute.String("client", clientName(ctx)),
+		))
+		defer span.End()
+
+		res, err := next(ctx, call)
+		recordSpanError(span, err)
+		return res, err
+	}
+}
+
+// startCacheSpan starts a span for an operation on a cache tier.
+func startCacheSpan(ctx context.Context, op string, tier string, c cid.Cid) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "cache."+op, trace.WithAttributes(
+		attribute.String("cache", tier),
+		attribute.String("cid", c.String()),
+	))
+}
+
+// startUpstreamSpan starts a span for a call to a lotus node.
+func startUpstreamSpan(ctx context.Context, u *apiClient) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "lotus", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("upstream", u.maddr),
+		attribute.Int("priority", u.priority),
+	))
+}
+
+// recordSpanError records the error, if any, on the span.
+func recordSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"go.opencensus.io/tag"
+)
+
+// Levels of validation applied to tipsets assembled from cached block headers by ChainGetTipSet.
+const (
+	TipSetValidationOff     = "off"     // only the checks made when building any tipset
+	TipSetValidationHeaders = "headers" // each header hashes to its cid and all share the same parent weight
+	TipSetValidationParent  = "parent"  // as headers, and the parent tipset is lower and no heavier than the tipset
+)
+
+// ValidTipSetValidation reports whether level is a supported tipset validation level.
+func ValidTipSetValidation(level string) bool {
+	switch level {
+	case TipSetValidationOff, TipSetValidationHeaders, TipSetValidationParent:
+		return true
+	default:
+		return false
+	}
+}
+
+// validateTipSet checks a tipset assembled from cached headers at the given level, catching headers that
+// were corrupted while held by a cache before they are served. The parent tipset is read through the cache.
+func validateTipSet(ctx context.Context, cache BlockCache, tsk types.TipSetKey, ts *types.TipSet, level string) error {
+	if level != TipSetValidationHeaders && level != TipSetValidationParent {
+		return nil
+	}
+
+	want := map[string]bool{}
+	for _, c := range tsk.Cids() {
+		want[c.KeyString()] = true
+	}
+	weight := ts.Blocks()[0].ParentWeight
+	for _, bh := range ts.Blocks() {
+		if !want[bh.Cid().KeyString()] {
+			return fmt.Errorf("header of block %s does not match any requested cid", bh.Cid())
+		}
+		if !bh.ParentWeight.Equals(weight) {
+			return fmt.Errorf("block %s has parent weight %s, expected %s", bh.Cid(), bh.ParentWeight, weight)
+		}
+	}
+
+	if level != TipSetValidationParent || ts.Height() == 0 {
+		return nil
+	}
+	parent, err := cachedTipSet(ctx, cache, ts.Parents())
+	if err != nil {
+		return fmt.Errorf("load parent tipset: %w", err)
+	}
+	if parent.Height() >= ts.Height() {
+		return fmt.Errorf("parent height %d is not below height %d", parent.Height(), ts.Height())
+	}
+	// Weight never decreases along a chain
+	if !weight.GreaterThanEqual(parent.ParentWeight()) {
+		return fmt.Errorf("parent weight %s is less than the weight %s of its parent", weight, parent.ParentWeight())
+	}
+	return nil
+}
+
+// reportInvalidTipSet logs and counts a tipset that failed validation.
+func (p *Proxy) reportInvalidTipSet(ctx context.Context, method string, tsk types.TipSetKey, err error) {
+	p.logger.Error(err, "Cached tipset failed validation, reading it from the lotus node", "method", method, "tsk", tsk.String())
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, method))
+	reportEvent(mctx, tipsetValidationFailed)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"go.opencensus.io/tag"
+)
+
+// The lotus api client connects to the node using gorilla's default websocket dialer and offers no way to
+// supply another, so the default is replaced with one whose connections count the bytes they carry. Calls
+// share a single connection so the bytes are attributed to the node being called rather than to methods.
+func init() {
+	d := *websocket.DefaultDialer
+	d.NetDialContext = dialCounted
+	websocket.DefaultDialer = &d
+}
+
+var (
+	upstreamDialer net.Dialer
+	upstreamAddrs  sync.Map // multiaddrs of the lotus nodes keyed by the address dialed to reach them
+)
+
+// dialCounted dials a connection to a lotus node that reports the bytes sent and received over it,
+// including the websocket framing and JSON-RPC envelopes. The bytes are tagged with the node's multiaddr.
+func dialCounted(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := upstreamDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	name := addr
+	if maddr, ok := upstreamAddrs.Load(addr); ok {
+		name = maddr.(string)
+	}
+	tctx, err := tag.New(context.Background(), tag.Upsert(upstreamTag, name))
+	if err != nil {
+		tctx = context.Background()
+	}
+	return &countingConn{Conn: conn, ctx: tctx}, nil
+}
+
+// countingConn is a connection to a lotus node that reports the bytes sent and received over it.
+type countingConn struct {
+	net.Conn
+	ctx context.Context // holds the tags the bytes are reported with
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		reportMeasurement(c.ctx, upstreamReceived.M(int64(n)))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		reportMeasurement(c.ctx, upstreamSent.M(int64(n)))
+	}
+	return n, err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"go.opencensus.io/tag"
+)
+
+var ErrInvalidParams = errors.New("invalid params")
+
+// optionalCidParams are the indexes of cid parameters that may be undefined, keyed by method.
+var optionalCidParams = map[string]int{
+	"ChainStatObj": 1, // base
+}
+
+// ValidateParams is method middleware that rejects calls with parameters that can never succeed before
+// they reach the proxy, so that they do not consume the node's capacity or count as failures of the node.
+// Malformed values are already refused when the request is decoded; this catches values that decode but
+// are not valid: undefined cids or cids with unknown hash functions, tipset keys holding such cids or the
+// same cid twice, undefined addresses, negative epochs and missing messages.
+func ValidateParams(next MethodHandler) MethodHandler {
+	return func(ctx context.Context, call *MethodCall) (interface{}, error) {
+		for i, p := range call.Params {
+			if c, ok := p.(cid.Cid); ok && !c.Defined() {
+				if idx, ok := optionalCidParams[call.Method]; ok && idx == i {
+					continue
+				}
+			}
+			if err := validateParam(call.Method, p); err != nil {
+				mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+				reportEvent(mctx, invalidParams)
+				return nil, fmt.Errorf("%w: %s param %d: %v", ErrInvalidParams, call.Method, i, err)
+			}
+		}
+		return next(ctx, call)
+	}
+}
+
+// validateParam checks a single parameter of a call to the method.
+func validateParam(method string, p interface{}) error {
+	switch v := p.(type) {
+	case cid.Cid:
+		return validateCid(v)
+	case []cid.Cid:
+		for _, c := range v {
+			if err := validateCid(c); err != nil {
+				return err
+			}
+		}
+	case types.TipSetKey:
+		seen := map[cid.Cid]bool{}
+		for _, c := range v.Cids() {
+			if err := validateCid(c); err != nil {
+				return fmt.Errorf("tipset key: %w", err)
+			}
+			if seen[c] {
+				return fmt.Errorf("tipset key: duplicate cid %s", c)
+			}
+			seen[c] = true
+		}
+	case address.Address:
+		if v == address.Undef {
+			return fmt.Errorf("undefined address")
+		}
+	case abi.ChainEpoch:
+		// Randomness may be drawn for epochs before genesis
+		if v < 0 && !strings.Contains(method, "Randomness") {
+			return fmt.Errorf("negative epoch %d", v)
+		}
+	case *types.Message:
+		if v == nil {
+			return fmt.Errorf("missing message")
+		}
+	}
+	return nil
+}
+
+func validateCid(c cid.Cid) error {
+	if !c.Defined() {
+		return fmt.Errorf("undefined cid")
+	}
+	if !mh.ValidCode(c.Prefix().MhType) {
+		return fmt.Errorf("cid %s has unknown hash function 0x%x", c, c.Prefix().MhType)
+	}
+	return nil
+}